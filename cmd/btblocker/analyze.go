@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/example/BitTorrentBlocker/internal/blocker"
+)
+
+// runAnalyze implements "btblocker analyze", offline DPI of pcap/pcapng captures
+// Detection settings come from the usual configuration sources, so a capture is
+// judged exactly as the running daemon would judge it.
+func runAnalyze(args []string) int {
+	fs := flag.NewFlagSet("btblocker analyze", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: btblocker analyze [--format text|json|csv] [--detected-only] [--config FILE] [flags] FILE|DIR...")
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", "text", "Output format: text, json or csv")
+	detectedOnly := fs.Bool("detected-only", false, "Only list flows detected as BitTorrent")
+	configFlags := blocker.NewConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	switch *format {
+	case "text", "json", "csv":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q (want text, json or csv)\n", *format)
+		return 2
+	}
+
+	config, err := configFlags.Load(os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	analyzer, err := blocker.NewCaptureAnalyzer(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	status := 0
+	for _, path := range fs.Args() {
+		if err := analyzer.AnalyzePath(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+
+	flows := analyzer.Flows()
+	if *detectedOnly {
+		detected := flows[:0]
+		for _, f := range flows {
+			if f.Verdict == blocker.CaptureBitTorrent {
+				detected = append(detected, f)
+			}
+		}
+		flows = detected
+	}
+
+	switch *format {
+	case "json":
+		err = writeAnalyzeJSON(os.Stdout, flows, analyzer.Summary())
+	case "csv":
+		err = writeAnalyzeCSV(os.Stdout, flows)
+	default:
+		writeAnalyzeText(os.Stdout, flows, analyzer.Summary())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return status
+}
+
+// writeAnalyzeText prints a flow table followed by the summary
+func writeAnalyzeText(w io.Writer, flows []blocker.CaptureFlow, summary blocker.CaptureSummary) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tPROTO\tSRC\tDST\tPACKETS\tBYTES\tVERDICT\tREASON")
+	for _, f := range flows {
+		reason := f.Reason
+		if f.DetectedAt > 0 {
+			reason = fmt.Sprintf("%s (packet %d)", reason, f.DetectedAt)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			f.File, f.Proto, f.Src, f.Dst, f.Packets, f.Bytes, f.Verdict, orDash(reason))
+	}
+	_ = tw.Flush()
+
+	fmt.Fprintf(w, "\n%d file(s), %d packets (%d TCP/UDP), %d flows, %d detected as BitTorrent\n",
+		summary.Files, summary.Packets, summary.IPPackets, summary.Flows, summary.BitTorrentFlows)
+	reasons := make([]string, 0, len(summary.Reasons))
+	for reason := range summary.Reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if summary.Reasons[reasons[i]] != summary.Reasons[reasons[j]] {
+			return summary.Reasons[reasons[i]] > summary.Reasons[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "  %6d  %s\n", summary.Reasons[reason], reason)
+	}
+}
+
+// writeAnalyzeJSON prints flows and summary as one JSON document
+func writeAnalyzeJSON(w io.Writer, flows []blocker.CaptureFlow, summary blocker.CaptureSummary) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Flows   []blocker.CaptureFlow  `json:"flows"`
+		Summary blocker.CaptureSummary `json:"summary"`
+	}{flows, summary})
+}
+
+// writeAnalyzeCSV prints one row per flow
+func writeAnalyzeCSV(w io.Writer, flows []blocker.CaptureFlow) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"file", "proto", "src", "dst", "first_seen", "last_seen", "packets", "bytes", "verdict", "reason", "detected_at"})
+	for _, f := range flows {
+		_ = cw.Write([]string{
+			f.File, f.Proto, f.Src, f.Dst,
+			f.FirstSeen.Format(time.RFC3339Nano), f.LastSeen.Format(time.RFC3339Nano),
+			strconv.Itoa(f.Packets), strconv.Itoa(f.Bytes), f.Verdict, f.Reason, strconv.Itoa(f.DetectedAt),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/example/BitTorrentBlocker/internal/blocker"
+)
+
+const ctlUsage = `usage: btblocker ctl [--socket PATH] [--json] COMMAND
+
+Commands:
+  list                                      List all bans
+  show IP                                   Show the ban of one IP
+  ban IP [--duration 2h] [--reason TEXT]    Ban an IP (default duration: configured ban duration)
+  unban IP                                  Lift the ban of an IP
+  flush                                     Lift all bans
+  reload                                    Re-read and apply the configuration (like SIGHUP)
+`
+
+// runCtl implements "btblocker ctl", a client for the control socket
+func runCtl(args []string) int {
+	socket := os.Getenv("CONTROL_SOCKET")
+	if socket == "" {
+		socket = blocker.DefaultControlSocket
+	}
+
+	fs := flag.NewFlagSet("btblocker ctl", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), ctlUsage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&socket, "socket", socket, "Control socket path (env CONTROL_SOCKET)")
+	jsonOut := fs.Bool("json", false, "Print the raw JSON response")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	req, err := parseCtlCommand(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprint(os.Stderr, ctlUsage)
+		return 2
+	}
+
+	resp, err := blocker.ControlCall(socket, req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "btblocker ctl %s: %v\n", req.Op, err)
+		return 1
+	}
+	if *jsonOut {
+		out, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(string(out))
+		return 0
+	}
+	printCtlResponse(os.Stdout, req, resp, time.Now())
+	return 0
+}
+
+// parseCtlCommand builds the control request for a command line
+// Options of "ban" may come before or after the IP.
+func parseCtlCommand(args []string) (blocker.ControlRequest, error) {
+	if len(args) == 0 {
+		return blocker.ControlRequest{}, fmt.Errorf("missing command")
+	}
+	req := blocker.ControlRequest{Op: args[0]}
+
+	fs := flag.NewFlagSet("btblocker ctl "+req.Op, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if req.Op == blocker.ControlBan {
+		fs.StringVar(&req.Duration, "duration", "", "Ban duration, e.g. 30m or 2h")
+		fs.StringVar(&req.Reason, "reason", "", "Reason recorded with the ban")
+	}
+	var positional []string
+	rest := args[1:]
+	for {
+		if err := fs.Parse(rest); err != nil {
+			return req, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		rest = fs.Args()[1:]
+	}
+
+	switch req.Op {
+	case blocker.ControlList, blocker.ControlFlush, blocker.ControlReload:
+		if len(positional) != 0 {
+			return req, fmt.Errorf("%s takes no arguments", req.Op)
+		}
+	case blocker.ControlShow, blocker.ControlBan, blocker.ControlUnban:
+		if len(positional) != 1 {
+			return req, fmt.Errorf("%s takes exactly one IP address", req.Op)
+		}
+		req.IP = positional[0]
+	default:
+		return req, fmt.Errorf("unknown command %q", req.Op)
+	}
+	if req.Duration != "" {
+		if d, err := time.ParseDuration(req.Duration); err != nil || d <= 0 {
+			return req, fmt.Errorf("invalid duration %q", req.Duration)
+		}
+	}
+	return req, nil
+}
+
+// printCtlResponse prints a successful response in human-readable form
+func printCtlResponse(w io.Writer, req blocker.ControlRequest, resp blocker.ControlResponse, now time.Time) {
+	switch req.Op {
+	case blocker.ControlList:
+		if len(resp.Bans) == 0 {
+			fmt.Fprintln(w, "No active bans")
+			return
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "IP\tEXPIRES IN\tREASON\tHITS\tSTRIKES\tNEXT BAN\tDROPPED")
+		for _, ban := range resp.Bans {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%d\n", ban.IP, ban.ExpiresAt.Sub(now).Round(time.Second),
+				orDash(ban.Reason), ban.Hits, ban.Strikes, nextBan(ban), ban.DroppedPackets)
+		}
+		_ = tw.Flush()
+	case blocker.ControlShow, blocker.ControlBan:
+		for _, ban := range resp.Bans {
+			fmt.Fprintf(w, "IP:              %s\n", ban.IP)
+			fmt.Fprintf(w, "Expires:         %s (in %s)\n", ban.ExpiresAt.Format(time.RFC3339), ban.ExpiresAt.Sub(now).Round(time.Second))
+			fmt.Fprintf(w, "Reason:          %s\n", orDash(ban.Reason))
+			if !ban.FirstDetected.IsZero() {
+				fmt.Fprintf(w, "First detected:  %s\n", ban.FirstDetected.Format(time.RFC3339))
+				fmt.Fprintf(w, "Hits:            %d\n", ban.Hits)
+			}
+			if ban.NextTier > 0 {
+				fmt.Fprintf(w, "Strikes:         %d (next ban %s, tier %d)\n", ban.Strikes, nextBan(ban), ban.NextTier)
+			}
+			if ban.DroppedPackets > 0 {
+				fmt.Fprintf(w, "Dropped:         %d packets / %d bytes, last %s\n",
+					ban.DroppedPackets, ban.DroppedBytes, ban.LastSeen.Format(time.RFC3339))
+			}
+		}
+	case blocker.ControlUnban:
+		fmt.Fprintf(w, "Unbanned %s\n", req.IP)
+	case blocker.ControlFlush:
+		fmt.Fprintf(w, "Unbanned %d IPs\n", resp.Removed)
+	case blocker.ControlReload:
+		fmt.Fprintln(w, "Configuration reloaded")
+		if len(resp.Restart) > 0 {
+			fmt.Fprintf(w, "Not applied until restart: %s\n", strings.Join(resp.Restart, ", "))
+		}
+	}
+}
+
+// nextBan formats the duration of the next ban of an escalating ban, or "-"
+func nextBan(ban blocker.BanInfo) string {
+	if ban.NextBan == 0 {
+		return "-"
+	}
+	return (time.Duration(ban.NextBan) * time.Second).String()
+}
+
+// orDash returns s, or "-" if s is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
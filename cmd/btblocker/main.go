@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 
 	"github.com/example/BitTorrentBlocker/internal/blocker"
 )
@@ -22,24 +24,82 @@ var (
 	Date    = "unknown"
 )
 
-// splitAndTrim splits a string by separator and trims whitespace from each part
-func splitAndTrim(s, sep string) []string {
-	parts := strings.Split(s, sep)
-	result := make([]string, 0, len(parts))
-	for _, part := range parts {
-		trimmed := strings.TrimSpace(part)
-		if trimmed != "" {
-			result = append(result, trimmed)
+// loadConfig builds the effective configuration from parsed flags
+// Precedence: flags > environment variables > --config file > defaults.
+func loadConfig(fs *flag.FlagSet, configFlags *blocker.ConfigFlags) (blocker.Config, error) {
+	if fs.NArg() > 0 {
+		return blocker.Config{}, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	return configFlags.Load(os.LookupEnv)
+}
+
+// runConfig implements "btblocker config dump" and "btblocker config detectors"
+func runConfig(args []string) int {
+	if len(args) == 0 || (args[0] != "dump" && args[0] != "detectors") {
+		fmt.Fprintln(os.Stderr, "usage: btblocker config dump|detectors [--config FILE] [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("btblocker config "+args[0], flag.ContinueOnError)
+	configFlags := blocker.NewConfigFlags(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		// The flag package has already printed the error and usage
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
 		}
+		return 2
 	}
-	return result
+	config, err := loadConfig(fs, configFlags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if args[0] == "detectors" {
+		return printDetectors(config)
+	}
+
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(out))
+	return 0
+}
+
+// printDetectors lists the DPI pipeline of config, in the order the detectors run
+func printDetectors(config blocker.Config) int {
+	statuses, err := blocker.DetectorStatuses(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTRANSPORT\tCOST\tMODE\tREASON")
+	for _, s := range statuses {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.ID(), s.Transport(), s.Cost(), s.Mode, s.Reason())
+	}
+	_ = tw.Flush()
+	return 0
 }
 
-//nolint:gocyclo // Main function complexity is acceptable for CLI entry point
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "config":
+			os.Exit(runConfig(os.Args[2:]))
+		case "ctl":
+			os.Exit(runCtl(os.Args[2:]))
+		case "analyze":
+			os.Exit(runAnalyze(os.Args[2:]))
+		}
+	}
+
 	// Define flags
-	showVersion := flag.Bool("version", false, "Show version information")
-	flag.Parse()
+	fs := flag.NewFlagSet("btblocker", flag.ExitOnError)
+	showVersion := fs.Bool("version", false, "Show version information")
+	configFlags := blocker.NewConfigFlags(fs)
+	_ = fs.Parse(os.Args[1:]) // ExitOnError
 
 	// Handle version flag
 	if *showVersion {
@@ -48,56 +108,28 @@ func main() {
 		fmt.Printf("  built:  %s\n", Date)
 		os.Exit(0)
 	}
-	// Create blocker with default configuration
-	config := blocker.DefaultConfig()
 
-	// Override with environment variables if set
-	if queueNum := os.Getenv("QUEUE_NUM"); queueNum != "" {
-		if num, err := strconv.Atoi(queueNum); err == nil && num >= 0 && num <= 65535 {
-			config.QueueNum = num
-		}
-	}
-	if logLevel := os.Getenv("LOG_LEVEL"); logLevel != "" {
-		config.LogLevel = logLevel
-	}
-	if iface := os.Getenv("INTERFACE"); iface != "" {
-		// Support comma-separated list of interfaces (used for XDP fast-path)
-		config.Interfaces = []string{}
-		for _, i := range splitAndTrim(iface, ",") {
-			if i != "" {
-				config.Interfaces = append(config.Interfaces, i)
-			}
-		}
-	}
-	if banDuration := os.Getenv("BAN_DURATION"); banDuration != "" {
-		if duration, err := strconv.Atoi(banDuration); err == nil && duration > 0 {
-			config.BanDuration = duration
-		}
-	}
-	if detectionLog := os.Getenv("DETECTION_LOG"); detectionLog != "" {
-		config.DetectionLogPath = detectionLog
-	}
-	if monitorOnly := os.Getenv("MONITOR_ONLY"); monitorOnly == "true" || monitorOnly == "1" {
-		config.MonitorOnly = true
-	}
-	if xdpMode := os.Getenv("XDP_MODE"); xdpMode != "" {
-		config.XDPMode = xdpMode
-	}
-	if cleanupInterval := os.Getenv("XDP_CLEANUP_INTERVAL"); cleanupInterval != "" {
-		if interval, err := strconv.Atoi(cleanupInterval); err == nil && interval > 0 {
-			config.CleanupInterval = interval
-		}
+	config, err := loadConfig(fs, configFlags)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
 	}
 
 	btBlocker, err := blocker.New(config)
 	if err != nil {
 		log.Fatalf("Failed to create blocker: %v", err)
 	}
-	defer btBlocker.Close()
 
-	log.Println("BitTorrent Blocker (Inline Blocking via NFQUEUE) Starting...")
-	log.Printf("Configuration: NFQUEUE=%d, XDP Interface=%v, BanDuration=%ds",
-		config.QueueNum, config.Interfaces, config.BanDuration)
+	// SIGHUP and "btblocker ctl reload" read the file and environment again;
+	// command-line flags still take precedence
+	btBlocker.SetConfigSource(func() (blocker.Config, error) {
+		return configFlags.Load(os.LookupEnv)
+	})
+
+	// Everything logged from here on, including by the log package, goes to the configured output
+	slog.SetDefault(btBlocker.Logger())
+	slog.Info("BitTorrent Blocker (inline blocking via NFQUEUE) starting", "version", Version,
+		"queue_num", config.QueueNum, "queue_count", config.QueueCount,
+		"interfaces", strings.Join(config.Interfaces, ","), "ban_duration", config.BanDuration)
 
 	// Setup context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
@@ -107,14 +139,40 @@ func main() {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
-	// Start blocker (blocking)
+	// Start blocker (blocking); Start closes the blocker when it returns
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		if err := btBlocker.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
-			log.Fatalf("Failed to start blocker: %v", err)
+			slog.Error("Failed to start blocker", "error", err)
+			os.Exit(1)
 		}
 	}()
 
-	<-sig
-	log.Println("Shutting down...")
-	cancel()
+	// SIGHUP reloads the configuration without reopening the queues
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	// SIGUSR1 reopens the detection log after an external logrotate
+	reopen := make(chan os.Signal, 1)
+	if len(reopenSignals) > 0 {
+		signal.Notify(reopen, reopenSignals...)
+	}
+	for {
+		select {
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading configuration")
+			_, _ = btBlocker.ReloadConfig() // Failures are logged, the current configuration stays
+		case <-reopen:
+			if err := btBlocker.ReopenLogs(); err != nil {
+				slog.Error("Failed to reopen logs", "error", err)
+			}
+		case <-sig:
+			slog.Info("Received signal, shutting down")
+			cancel()
+			<-done // Let Start close the queues, the backend, the journal and the webhooks
+			return
+		case <-done:
+			return
+		}
+	}
 }
@@ -0,0 +1,11 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignals make the blocker reopen its detection log (logrotate postrotate)
+var reopenSignals = []os.Signal{syscall.SIGUSR1}
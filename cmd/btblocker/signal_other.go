@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// reopenSignals is empty where the blocker cannot run; see signal_linux.go
+var reopenSignals []os.Signal
@@ -4,16 +4,18 @@ go 1.25
 
 // Dependencies for BitTorrent detection and blocking
 
-require github.com/google/gopacket v1.1.19
+require (
+	github.com/cilium/ebpf v0.20.0
+	github.com/florianl/go-nfqueue/v2 v2.0.2
+	github.com/google/gopacket v1.1.19
+	github.com/mdlayher/netlink v1.7.2
+	golang.org/x/sys v0.37.0
+)
 
 require (
-	github.com/cilium/ebpf v0.20.0 // indirect
-	github.com/florianl/go-nfqueue/v2 v2.0.2 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/josharian/native v1.1.0 // indirect
-	github.com/mdlayher/netlink v1.7.2 // indirect
 	github.com/mdlayher/socket v0.4.1 // indirect
 	golang.org/x/net v0.46.0 // indirect
 	golang.org/x/sync v0.17.0 // indirect
-	golang.org/x/sys v0.37.0 // indirect
 )
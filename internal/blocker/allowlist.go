@@ -0,0 +1,73 @@
+package blocker
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Allowlist exempts addresses and ports from detection and bans
+// Built from Config.Allowlist and Config.AllowPorts; safe for concurrent reads.
+type Allowlist struct {
+	prefixes []net.IPNet
+	ports    map[uint16]bool
+}
+
+// NewAllowlist parses CIDRs (or bare addresses) and ports into an Allowlist
+func NewAllowlist(cidrs []string, ports []int) (*Allowlist, error) {
+	a := &Allowlist{ports: make(map[uint16]bool, len(ports))}
+	for _, s := range cidrs {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		a.prefixes = append(a.prefixes, prefix)
+	}
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid allowlist port %d (must be 1-65535)", port)
+		}
+		a.ports[uint16(port)] = true // #nosec G115 - range checked above
+	}
+	return a, nil
+}
+
+// parsePrefix parses a CIDR, treating a bare address as a single-host prefix
+func parsePrefix(s string) (net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return net.IPNet{}, fmt.Errorf("invalid allowlist entry %q (want an address or CIDR)", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return net.IPNet{}, fmt.Errorf("invalid allowlist entry %q (want an address or CIDR)", s)
+	}
+	return *prefix, nil
+}
+
+// ContainsIP reports whether ip is inside an allowlisted prefix
+func (a *Allowlist) ContainsIP(ip net.IP) bool {
+	for i := range a.prefixes {
+		if a.prefixes[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsPort reports whether port is allowlisted
+func (a *Allowlist) ContainsPort(port uint16) bool {
+	return a.ports[port]
+}
+
+// Prefixes returns the allowlisted prefixes
+func (a *Allowlist) Prefixes() []net.IPNet {
+	return a.prefixes
+}
@@ -0,0 +1,72 @@
+package blocker
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllowlist(t *testing.T) {
+	a, err := NewAllowlist([]string{"192.0.2.0/24", "198.51.100.7", " 2001:db8:1::/48 ", "2001:db8::5"}, []int{22, 6881})
+	if err != nil {
+		t.Fatalf("NewAllowlist() failed: %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.255", true},
+		{"192.0.3.1", false},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"::ffff:192.0.2.10", true}, // IPv4-mapped
+		{"2001:db8:1:ffff::1", true},
+		{"2001:db8:2::1", false},
+		{"2001:db8::5", true},
+		{"2001:db8::6", false},
+	}
+	for _, tt := range tests {
+		if got := a.ContainsIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("ContainsIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	if !a.ContainsPort(6881) || a.ContainsPort(6882) {
+		t.Error("ContainsPort() mismatch")
+	}
+	if len(a.Prefixes()) != 4 {
+		t.Errorf("Prefixes() = %v, want 4 entries", a.Prefixes())
+	}
+}
+
+func TestAllowlist_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidrs []string
+		ports []int
+	}{
+		{"Bad address", []string{"192.0.2.256"}, nil},
+		{"Bad prefix length", []string{"192.0.2.0/33"}, nil},
+		{"Hostname", []string{"example.com"}, nil},
+		{"Port zero", nil, []int{0}},
+		{"Port too large", nil, []int{70000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewAllowlist(tt.cidrs, tt.ports); err == nil {
+				t.Error("NewAllowlist() should fail")
+			}
+		})
+	}
+}
+
+func TestAllowlist_Empty(t *testing.T) {
+	a, err := NewAllowlist(nil, nil)
+	if err != nil {
+		t.Fatalf("NewAllowlist() failed: %v", err)
+	}
+	if a.ContainsIP(net.ParseIP("192.0.2.1")) || a.ContainsPort(80) {
+		t.Error("Empty allowlist should not contain anything")
+	}
+}
@@ -1,156 +1,181 @@
 package blocker
 
+import (
+	"sort"
+	"time"
+)
+
 // AnalysisResult contains the result of packet analysis
 type AnalysisResult struct {
 	ShouldBlock bool
 	Reason      string
+	FromFlow    bool // Verdict reused from an earlier packet of the same flow (already reported)
+	FromPeer    bool // FromFlow packet sent by the other endpoint than the one detected
+	LogOnly     bool // Reason was matched by a log-only detector; the packet is not blocked
+}
+
+// stage is a detector in the pipeline of an analyzer
+type stage struct {
+	detector Detector
+	logOnly  bool // Matches are reported without blocking
 }
 
+// DetectorObserver receives the time spent in each detector call
+// detector is a short stable name such as "utp" or "mse"
+type DetectorObserver func(detector string, elapsed time.Duration)
+
 // Analyzer performs deep packet inspection for BitTorrent traffic
 type Analyzer struct {
-	config Config
+	config  Config
+	observe DetectorObserver // nil = detectors are not timed
+
+	// Pipelines built from the registry, in registry order
+	tcp    []stage
+	udp    []stage
+	stream []stage // Re-run against the accumulated payload prefix of a TCP flow direction
 }
 
 // NewAnalyzer creates a new packet analyzer with the given configuration
+// The pipelines hold the built-in detectors that config does not turn off
+// (see DetectorStatuses).
 func NewAnalyzer(config Config) *Analyzer {
-	return &Analyzer{
+	a := &Analyzer{
 		config: config,
 	}
+	statuses, _ := DetectorStatuses(config) // Checked by Validate
+	for _, s := range statuses {
+		if s.Mode == DetectorOff {
+			continue
+		}
+		st := stage{detector: s.Detector, logOnly: s.Mode == DetectorLogOnly}
+		if s.Transport()&TransportTCP != 0 {
+			a.tcp = append(a.tcp, st)
+		}
+		if s.Transport()&TransportUDP != 0 {
+			a.udp = append(a.udp, st)
+		}
+		// UDP detectors work on whole datagrams and never need reassembly
+		if d, ok := s.Detector.(*builtinDetector); ok && d.stream > 0 {
+			a.stream = append(a.stream, st)
+		}
+	}
+	sort.SliceStable(a.stream, func(i, j int) bool {
+		return a.stream[i].detector.(*builtinDetector).stream < a.stream[j].detector.(*builtinDetector).stream
+	})
+	return a
 }
 
-// AnalyzePacket performs comprehensive DPI analysis on a packet
-// Returns whether the packet should be blocked and the reason
-func (a *Analyzer) AnalyzePacket(payload []byte, isUDP bool) AnalysisResult {
-	return a.AnalyzePacketEx(payload, isUDP, "", 0)
+// SetDetectorObserver installs a callback timing every detector call
+// Must be called before the analyzer is shared between goroutines;
+// the observer itself must be safe for concurrent use.
+func (a *Analyzer) SetDetectorObserver(observe DetectorObserver) {
+	a.observe = observe
 }
 
-// AnalyzePacketEx performs comprehensive DPI analysis with destination info
-// destIP and destPort are used for LSD detection
-func (a *Analyzer) AnalyzePacketEx(payload []byte, isUDP bool, destIP string, destPort uint16) AnalysisResult {
-	if len(payload) == 0 {
-		return AnalysisResult{ShouldBlock: false}
+// run invokes a detector, timing it if an observer is installed
+func (a *Analyzer) run(d Detector, payload []byte, destIP string, destPort uint16) bool {
+	if a.observe == nil {
+		return d.Check(payload, destIP, destPort)
 	}
+	start := time.Now()
+	matched := d.Check(payload, destIP, destPort)
+	a.observe(d.ID(), time.Since(start))
+	return matched
+}
 
-	// Preprocessing: unwrap SOCKS5 if present
-	processingPayload := payload
-	if isUDP {
-		if unwrapped, ok := UnwrapSOCKS5(payload); ok {
-			processingPayload = unwrapped
+// runPipeline runs the stages in order until one that blocks matches
+// A log-only match does not stop the pipeline; it is returned only if no
+// blocking detector matches after it.
+func (a *Analyzer) runPipeline(stages []stage, payload []byte, destIP string, destPort uint16) AnalysisResult {
+	var logged Detector
+	for _, s := range stages {
+		if !a.run(s.detector, payload, destIP, destPort) {
+			continue
 		}
-	}
-
-	// --- DPI ANALYZERS (Ordered by performance: fastest first) ---
-	// Performance metrics from benchmarks (ns/op, lower is faster):
-	// CheckExtendedMessage: 0.19, CheckSOCKSConnection: 0.19, CheckFASTExtension: 0.38
-	// CheckLSD: 1.13, CheckBitTorrentMessage: 1.25, CheckUTPRobust: 1.89
-	// CheckBencodeDHT: 2.81, CheckUDPTrackerDeep: 3.73, CheckHTTPBitTorrent: 7.17
-	// CheckDHTNodes: 15.04, CheckSignatures: 31.87
-	// CheckMSEEncryption: 899, ShannonEntropy: 928
-	//
-	// OPTIMIZATION Phase 2: Split UDP/TCP into separate fast paths
-	// Benefits: Better branch prediction, fewer conditionals, more cache-friendly
-
-	if isUDP {
-		// === UDP FAST PATH ===
-		// 1. LSD Detection (1.13 ns/op) - very fast and specific
-		if destIP != "" && CheckLSD(processingPayload, destIP, destPort) {
-			return AnalysisResult{
-				ShouldBlock: true,
-				Reason:      "Local Service Discovery (BEP 14)",
-			}
+		if !s.logOnly {
+			return AnalysisResult{ShouldBlock: true, Reason: s.detector.Reason()}
 		}
-
-		// 2. uTP Protocol (1.89 ns/op) - fast, common for UDP
-		if CheckUTPRobust(processingPayload) {
-			return AnalysisResult{
-				ShouldBlock: true,
-				Reason:      "uTP Protocol (BEP 29)",
-			}
+		if logged == nil {
+			logged = s.detector
 		}
+	}
+	if logged != nil {
+		return AnalysisResult{ShouldBlock: false, Reason: logged.Reason(), LogOnly: true}
+	}
+	return AnalysisResult{ShouldBlock: false}
+}
 
-		// 3. DHT Bencode (2.81 ns/op) - fast, very common for DHT
-		if CheckBencodeDHT(processingPayload) {
-			return AnalysisResult{
-				ShouldBlock: true,
-				Reason:      "DHT Bencode Structure (BEP 5)",
-			}
-		}
+// AnalyzePacket performs comprehensive DPI analysis on a packet
+// Returns whether the packet should be blocked and the reason
+func (a *Analyzer) AnalyzePacket(payload []byte, isUDP bool) AnalysisResult {
+	return a.AnalyzePacketEx(payload, isUDP, "", 0)
+}
 
-		// 4. UDP Tracker (3.73 ns/op) - fast tracker detection
-		if CheckUDPTrackerDeep(processingPayload) {
-			return AnalysisResult{
-				ShouldBlock: true,
-				Reason:      "UDP Tracker Protocol",
-			}
-		}
+// AnalyzeFlow analyzes a packet in the context of its flow
+// Once a flow has been classified, its verdict is reused and DPI is skipped.
+// A nil flow falls back to single-packet analysis.
+func (a *Analyzer) AnalyzeFlow(flow *Flow, dir FlowDirection, payload []byte, isUDP bool, destIP string, destPort uint16) AnalysisResult {
+	if flow == nil {
+		return a.AnalyzePacketEx(payload, isUDP, destIP, destPort)
+	}
 
-		// 5. Signature check (catches remaining UDP patterns)
-		if CheckSignatures(processingPayload) {
-			return AnalysisResult{
-				ShouldBlock: true,
-				Reason:      "BitTorrent Signature",
-			}
-		}
+	flow.mu.Lock()
+	defer flow.mu.Unlock()
 
-		return AnalysisResult{ShouldBlock: false}
-	}
+	flow.Packets[dir]++
+	flow.Bytes[dir] += uint64(len(payload))
 
-	// === TCP FAST PATH ===
-	// 1. FAST Extension (0.38 ns/op) - extremely fast
-	if CheckFASTExtension(processingPayload) {
-		return AnalysisResult{
-			ShouldBlock: true,
-			Reason:      "FAST Extension Message (BEP 6)",
-		}
+	switch flow.Verdict {
+	case FlowBitTorrent:
+		return AnalysisResult{ShouldBlock: true, Reason: flow.Reason, FromFlow: true, FromPeer: dir != flow.Detected}
+	case FlowClean:
+		return AnalysisResult{ShouldBlock: false, FromFlow: true}
 	}
 
-	// 2. BitTorrent TCP message structure (1.25 ns/op) - HIGH HIT RATE (34%)
-	if CheckBitTorrentMessage(processingPayload) {
-		return AnalysisResult{
-			ShouldBlock: true,
-			Reason:      "BitTorrent Message Structure",
-		}
-	}
+	result := a.AnalyzePacketEx(payload, isUDP, destIP, destPort)
 
-	// 3. DHT Bencode (2.81 ns/op) - DHT can be over TCP too
-	if CheckBencodeDHT(processingPayload) {
-		return AnalysisResult{
-			ShouldBlock: true,
-			Reason:      "DHT Bencode Structure (BEP 5)",
+	// Multi-packet inspection: run stream detectors on the accumulated prefix
+	if !isUDP {
+		prefix := flow.appendPrefix(dir, payload, a.config.FlowInspectBytes)
+		if !result.ShouldBlock && len(prefix) > len(payload) {
+			if stream := a.analyzeStream(prefix); stream.ShouldBlock || !result.LogOnly {
+				result = stream
+			}
 		}
 	}
 
-	// 4. HTTP-based BitTorrent (7.17 ns/op) - WebSeed, User-Agents
-	if CheckHTTPBitTorrent(processingPayload) {
-		return AnalysisResult{
-			ShouldBlock: true,
-			Reason:      "HTTP BitTorrent Protocol (BEP 19)",
-		}
+	flow.inspected++
+	if result.ShouldBlock {
+		flow.Verdict = FlowBitTorrent
+		flow.Reason = result.Reason
+		flow.Detected = dir
+		flow.prefix = [2][]byte{} // No longer needed
+	} else if a.config.FlowMaxPackets > 0 && flow.inspected >= a.config.FlowMaxPackets {
+		flow.Verdict = FlowClean
+		flow.prefix = [2][]byte{}
 	}
 
-	// 5. Signature analysis (optimized) - catches common TCP patterns
-	if CheckSignatures(processingPayload) {
-		return AnalysisResult{
-			ShouldBlock: true,
-			Reason:      "BitTorrent Signature",
-		}
-	}
+	return result
+}
 
-	// 6. MSE/PE Encryption (899 ns/op) - expensive, check last
-	if CheckMSEEncryption(processingPayload) {
-		return AnalysisResult{
-			ShouldBlock: true,
-			Reason:      "MSE/PE Encryption",
-		}
+// analyzeStream runs the multi-packet detectors against a reassembled flow prefix
+func (a *Analyzer) analyzeStream(prefix []byte) AnalysisResult {
+	return a.runPipeline(a.stream, prefix, "", 0)
+}
+
+// AnalyzePacketEx performs comprehensive DPI analysis with destination info
+// destIP and destPort are used for LSD detection
+func (a *Analyzer) AnalyzePacketEx(payload []byte, isUDP bool, destIP string, destPort uint16) AnalysisResult {
+	if len(payload) == 0 {
+		return AnalysisResult{ShouldBlock: false}
 	}
 
-	// 7. SOCKS proxy (optional, disabled by default)
-	if a.config.BlockSOCKS && CheckSOCKSConnection(processingPayload) {
-		return AnalysisResult{
-			ShouldBlock: true,
-			Reason:      "SOCKS Proxy Connection",
+	// Preprocessing: unwrap SOCKS5 if present
+	if isUDP {
+		if unwrapped, ok := UnwrapSOCKS5(payload); ok {
+			payload = unwrapped
 		}
+		return a.runPipeline(a.udp, payload, destIP, destPort)
 	}
-
-	return AnalysisResult{ShouldBlock: false}
+	return a.runPipeline(a.tcp, payload, destIP, destPort)
 }
@@ -0,0 +1,342 @@
+package blocker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BanRecord is the persisted state of one banned IP
+type BanRecord struct {
+	IP            string    `json:"ip"`
+	Reason        string    `json:"reason"`
+	FirstDetected time.Time `json:"first_detected"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	Hits          int       `json:"hits"`
+
+	// Escalating bans: the record outlives its ban until StrikesUntil
+	Strikes      int       `json:"strikes,omitempty"`      // Strike count as of LastStrike
+	LastStrike   time.Time `json:"last_strike,omitzero"`   // Time of the latest strike
+	StrikesUntil time.Time `json:"strikes_until,omitzero"` // When the strikes no longer count
+}
+
+// retained reports whether the record is still needed at now (active ban or strike history)
+func (r *BanRecord) retained(now time.Time) bool {
+	return r.ExpiresAt.After(now) || r.StrikesUntil.After(now)
+}
+
+// BanStore keeps active bans in an append-only JSON-lines journal
+// Every ban appends the full record for its IP, so on load the last line per IP
+// wins. The journal is rewritten with only the unexpired records by Compact.
+// All methods are safe for concurrent use.
+type BanStore struct {
+	path     string
+	mu       sync.Mutex
+	file     *os.File
+	bans     map[string]*BanRecord
+	appended int  // Records in the journal, including superseded ones
+	skipped  int  // Unparseable lines found on load (e.g. a write torn by a crash)
+	dirty    bool // Journal must be rewritten even if nothing expired
+}
+
+// OpenBanStore opens (or creates) the ban journal at path and loads its records
+// Records that have already expired are dropped on the next compaction.
+func OpenBanStore(path string) (*BanStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create ban database directory: %w", err)
+	}
+
+	s := &BanStore{path: path, bans: make(map[string]*BanRecord)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ban database: %w", err)
+	}
+	s.file = file
+
+	// Rewrite a damaged journal right away so new records are not appended to a torn line
+	if s.dirty {
+		if _, err := s.Compact(time.Now()); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// load reads the journal into memory
+func (s *BanStore) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read ban database: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var rec BanRecord
+		if err := json.Unmarshal(line, &rec); err != nil || net.ParseIP(rec.IP) == nil {
+			s.skipped++
+			s.dirty = true
+			continue
+		}
+		s.bans[rec.IP] = &rec
+		s.appended++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read ban database: %w", err)
+	}
+	return nil
+}
+
+// Skipped returns the number of corrupt journal lines ignored on load
+func (s *BanStore) Skipped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.skipped
+}
+
+// Record persists a ban of ip until expiresAt
+// A repeat ban of an already known IP keeps its first detection time and reason
+// and increments its hit count. The strike history is kept.
+func (s *BanStore) Record(ip net.IP, reason string, now, expiresAt time.Time) (BanRecord, error) {
+	return s.record(ip, reason, now, expiresAt, nil, time.Time{})
+}
+
+// RecordStrike is Record for an escalating ban: it also persists the strike
+// history of ip, which keeps the record after the ban expires until strikesUntil
+func (s *BanStore) RecordStrike(ip net.IP, reason string, now, expiresAt time.Time, strike Strike, strikesUntil time.Time) (BanRecord, error) {
+	return s.record(ip, reason, now, expiresAt, &strike, strikesUntil)
+}
+
+// record implements Record and RecordStrike
+func (s *BanStore) record(ip net.IP, reason string, now, expiresAt time.Time, strike *Strike, strikesUntil time.Time) (BanRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	rec, ok := s.bans[key]
+	if !ok || !rec.ExpiresAt.After(now) {
+		fresh := &BanRecord{IP: key, Reason: reason, FirstDetected: now}
+		if ok {
+			fresh.Strikes, fresh.LastStrike, fresh.StrikesUntil = rec.Strikes, rec.LastStrike, rec.StrikesUntil
+		}
+		rec = fresh
+		s.bans[key] = rec
+	}
+	rec.Hits++
+	if expiresAt.After(rec.ExpiresAt) {
+		rec.ExpiresAt = expiresAt
+	}
+	if strike != nil {
+		rec.Strikes, rec.LastStrike, rec.StrikesUntil = strike.Count, strike.Last, strikesUntil
+	}
+
+	if s.file == nil {
+		return *rec, fmt.Errorf("ban database is closed")
+	}
+	if err := writeBanRecord(s.file, rec); err != nil {
+		return *rec, fmt.Errorf("failed to write ban database: %w", err)
+	}
+	s.appended++
+	return *rec, nil
+}
+
+// IsBanned reports whether ip has an unexpired ban
+func (s *BanStore) IsBanned(ip net.IP, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.bans[ip.String()]
+	return ok && rec.ExpiresAt.After(now)
+}
+
+// Active returns all unexpired bans, ordered by expiry
+func (s *BanStore) Active(now time.Time) []BanRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	active := make([]BanRecord, 0, len(s.bans))
+	for _, rec := range s.bans {
+		if rec.ExpiresAt.After(now) {
+			active = append(active, *rec)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].ExpiresAt.Before(active[j].ExpiresAt) })
+	return active
+}
+
+// Records returns every record, including expired bans kept for their strike history, ordered by IP
+func (s *BanStore) Records() []BanRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]BanRecord, 0, len(s.bans))
+	for _, key := range sortedKeys(s.bans) {
+		records = append(records, *s.bans[key])
+	}
+	return records
+}
+
+// Get returns the record of ip, expired or not
+func (s *BanStore) Get(ip net.IP) (BanRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.bans[ip.String()]
+	if !ok {
+		return BanRecord{}, false
+	}
+	return *rec, true
+}
+
+// Remove forgets the ban of ip and rewrites the journal right away,
+// so a lifted ban is not restored by the next start
+// Reports whether ip had a record.
+func (s *BanStore) Remove(ip net.IP) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	if _, ok := s.bans[key]; !ok {
+		return false, nil
+	}
+	delete(s.bans, key)
+	s.dirty = true
+	_, err := s.compact(time.Now())
+	return true, err
+}
+
+// RemoveAll forgets every ban and truncates the journal
+// Returns the number of records removed.
+func (s *BanStore) RemoveAll() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := len(s.bans)
+	s.bans = make(map[string]*BanRecord)
+	s.dirty = true
+	_, err := s.compact(time.Now())
+	return removed, err
+}
+
+// Compact drops expired bans and rewrites the journal with one line per active ban
+// Expired bans whose strikes still count are kept (see BanRecord.StrikesUntil).
+// The new journal is written to a temporary file and renamed over the old one,
+// so a crash mid-compaction leaves the previous journal intact.
+// Returns the number of bans removed.
+func (s *BanStore) Compact(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact(now)
+}
+
+// compact implements Compact; the caller holds s.mu
+func (s *BanStore) compact(now time.Time) (int, error) {
+	if s.file == nil {
+		return 0, nil // Closed
+	}
+
+	removed := 0
+	for key, rec := range s.bans {
+		if !rec.retained(now) {
+			delete(s.bans, key)
+			removed++
+		}
+	}
+	// Nothing superseded or expired: the journal already has one line per ban
+	if s.appended == len(s.bans) && !s.dirty {
+		return removed, nil
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return removed, fmt.Errorf("failed to compact ban database: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	for _, key := range sortedKeys(s.bans) {
+		if err := writeBanRecord(w, s.bans[key]); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return removed, fmt.Errorf("failed to compact ban database: %w", err)
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return removed, fmt.Errorf("failed to compact ban database: %w", err)
+	}
+
+	// Keep appending to the new journal
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return removed, fmt.Errorf("failed to reopen ban database: %w", err)
+	}
+	s.file.Close()
+	s.file = file
+	s.appended = len(s.bans)
+	s.dirty = false
+	return removed, nil
+}
+
+// Close compacts and closes the journal
+func (s *BanStore) Close() error {
+	_, compactErr := s.Compact(time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return compactErr
+	}
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return err
+	}
+	return compactErr
+}
+
+// writeBanRecord writes one record as a single JSON line
+func writeBanRecord(w io.Writer, rec *BanRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// sortedKeys returns map keys in a stable order
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,170 @@
+package blocker
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanStore_RecordAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.jsonl")
+	now := time.Now()
+
+	s, err := OpenBanStore(path)
+	if err != nil {
+		t.Fatalf("OpenBanStore() failed: %v", err)
+	}
+	ip := net.ParseIP("10.0.0.5")
+	if _, err := s.Record(ip, "BitTorrent handshake", now, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Record() failed: %v", err)
+	}
+	rec, err := s.Record(ip, "uTP", now.Add(time.Minute), now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("Record() failed: %v", err)
+	}
+	if rec.Hits != 2 || rec.Reason != "BitTorrent handshake" || !rec.FirstDetected.Equal(now) {
+		t.Errorf("Repeat ban = %+v, want 2 hits keeping the first reason and detection time", rec)
+	}
+	if _, err := s.Record(net.ParseIP("2001:db8::1"), "DHT", now, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Record() failed: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	s, err = OpenBanStore(path)
+	if err != nil {
+		t.Fatalf("OpenBanStore() reload failed: %v", err)
+	}
+	defer s.Close()
+
+	active := s.Active(now)
+	if len(active) != 2 {
+		t.Fatalf("Active() after reload = %d bans, want 2", len(active))
+	}
+	if active[1].IP != "10.0.0.5" || active[1].Hits != 2 || !active[1].ExpiresAt.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("Reloaded ban = %+v", active[1])
+	}
+	if !s.IsBanned(ip, now) || s.IsBanned(ip, now.Add(3*time.Hour)) {
+		t.Error("IsBanned() should follow the stored expiry")
+	}
+}
+
+func TestBanStore_Compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.jsonl")
+	now := time.Now()
+
+	s, err := OpenBanStore(path)
+	if err != nil {
+		t.Fatalf("OpenBanStore() failed: %v", err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		_, _ = s.Record(net.ParseIP("10.0.0.1"), "test", now, now.Add(time.Hour))
+	}
+	_, _ = s.Record(net.ParseIP("10.0.0.2"), "test", now, now.Add(time.Second))
+
+	removed, err := s.Compact(now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Compact() failed: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Compact() removed %d, want 1", removed)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"hits":3`) {
+		t.Errorf("Compacted journal = %q, want a single record with 3 hits", data)
+	}
+
+	// Appends after compaction go to the new journal
+	_, _ = s.Record(net.ParseIP("10.0.0.3"), "test", now, now.Add(time.Hour))
+	data, _ = os.ReadFile(path)
+	if strings.Count(string(data), "\n") != 2 {
+		t.Errorf("Journal after append = %q, want 2 lines", data)
+	}
+}
+
+func TestBanStore_Remove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.jsonl")
+	now := time.Now()
+
+	s, err := OpenBanStore(path)
+	if err != nil {
+		t.Fatalf("OpenBanStore() failed: %v", err)
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if _, err := s.Record(net.ParseIP(ip), "test", now, now.Add(time.Hour)); err != nil {
+			t.Fatalf("Record() failed: %v", err)
+		}
+	}
+
+	if removed, err := s.Remove(net.ParseIP("10.0.0.1")); !removed || err != nil {
+		t.Fatalf("Remove() = %v, %v", removed, err)
+	}
+	if removed, _ := s.Remove(net.ParseIP("10.0.0.1")); removed {
+		t.Error("Remove() of an unknown IP should report false")
+	}
+
+	// The journal is rewritten right away, without waiting for Close
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "10.0.0.1") || strings.Count(string(data), "\n") != 2 {
+		t.Errorf("Journal after Remove() = %q", data)
+	}
+
+	if removed, err := s.RemoveAll(); removed != 2 || err != nil {
+		t.Errorf("RemoveAll() = %d, %v, want 2", removed, err)
+	}
+	_ = s.Close()
+
+	s, err = OpenBanStore(path)
+	if err != nil {
+		t.Fatalf("OpenBanStore() reload failed: %v", err)
+	}
+	defer s.Close()
+	if active := s.Active(now); len(active) != 0 {
+		t.Errorf("Active() after RemoveAll() = %v", active)
+	}
+}
+
+func TestBanStore_SkipsCorruptLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.jsonl")
+	expires := time.Now().Add(time.Hour).Format(time.RFC3339Nano)
+	journal := `{"ip":"10.0.0.1","reason":"test","expires_at":"` + expires + `","hits":1}` + "\n" +
+		`{"ip":"not-an-ip","expires_at":"` + expires + `"}` + "\n" +
+		`{"ip":"10.0.0.2","reas` // Torn write from a crash
+	if err := os.WriteFile(path, []byte(journal), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenBanStore(path)
+	if err != nil {
+		t.Fatalf("OpenBanStore() failed: %v", err)
+	}
+	defer s.Close()
+
+	if s.Skipped() != 2 {
+		t.Errorf("Skipped() = %d, want 2", s.Skipped())
+	}
+	if active := s.Active(time.Now()); len(active) != 1 || active[0].IP != "10.0.0.1" {
+		t.Errorf("Active() = %+v, want only 10.0.0.1", active)
+	}
+
+	// The torn line is gone, so the next record lands on its own line
+	_, _ = s.Record(net.ParseIP("10.0.0.3"), "test", time.Now(), time.Now().Add(time.Hour))
+	data, _ := os.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 {
+		t.Errorf("Journal after append = %q, want 2 records", data)
+	}
+}
@@ -2,260 +2,766 @@ package blocker
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/example/BitTorrentBlocker/internal/enforcer"
 	"github.com/example/BitTorrentBlocker/internal/xdp"
 	nfqueue "github.com/florianl/go-nfqueue/v2"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 )
 
 // Blocker is the main BitTorrent blocker service (inline blocking via NFQUEUE)
 type Blocker struct {
-	config          Config
-	analyzer        *Analyzer
-	nfq             *nfqueue.Nfqueue
-	logger          *Logger
+	config          Config                    // Startup configuration (settings that need a restart)
+	live            atomic.Pointer[liveState] // Settings replaced by Reload, loaded once per packet
+	reloadMu        sync.Mutex                // Serializes reloads
+	configSource    func() (Config, error)    // Re-reads the configuration for ReloadConfig (nil = not set)
+	queues          []*nfqueue.Nfqueue        // One NFQUEUE per queue number, each with its own reader goroutine
+	logs            *Logger                   // Process log output with per-component levels
+	logger          *slog.Logger              // Logger of the blocker component
 	detectionLogger *DetectionLogger
-	xdpFilter       *xdp.Filter // XDP filter for fast-path blocking of known IPs
+	enforcer        enforcer.Backend // Kernel enforcement of bans (nil = none)
+	xdpFilter       *xdp.Filter      // XDP filter when it is the enforcement backend (for statistics)
+	flows           *FlowTable       // Per-flow state (nil = flow tracking disabled)
+	bans            *BanStore        // Persistent ban journal (nil = bans are not persisted)
+	metrics         *blockerMetrics  // Prometheus metrics (nil = metrics endpoint disabled)
+	events          *banEvents       // Ban event webhooks (nil = disabled)
+	strikes         *strikeTable     // Strike history for escalating bans
+	evidence        *evidenceTable   // Detections of sources not banned yet
+	closeOnce       sync.Once        // Close runs once, however many callers
+}
+
+// liveState holds everything a configuration reload replaces
+// It is swapped as a whole so a packet never sees a mix of old and new settings.
+type liveState struct {
+	config     Config
+	analyzer   *Analyzer
+	allow      *Allowlist
+	escalation escalation
+	evidence   evidencePolicy
 }
 
 // New creates a new BitTorrent blocker instance with inline blocking (NFQUEUE)
 func New(config Config) (*Blocker, error) {
-	if config.QueueNum < 0 || config.QueueNum > 65535 {
-		return nil, fmt.Errorf("invalid queue number: %d (must be 0-65535)", config.QueueNum)
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
 
-	logger := NewLogger(config.LogLevel)
+	allow, err := NewAllowlist(config.Allowlist, config.AllowPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := NewLogger(config.LogFormat, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	_ = logs.SetLevels(config.LogLevel, config.LogComponentLevels) // Checked by Validate
+	logger := logs.Component(LogComponentBlocker)
 
 	// Initialize detection logger if enabled
-	detectionLogger, err := NewDetectionLogger(config.DetectionLogPath)
+	detectionLogger, err := NewDetectionLoggerWithOptions(config.DetectionLogPath, detectionLogOptions(config))
 	if err != nil {
+		_ = logs.Close()
 		return nil, fmt.Errorf("failed to create detection logger: %w", err)
 	}
 	if config.DetectionLogPath != "" {
-		logger.Info("Detection logging enabled: %s", config.DetectionLogPath)
+		logger.Info("Detection logging enabled", "path", config.DetectionLogPath, "format", config.DetectionLogFormat)
+	}
+	if config.DetectionPcapPath != "" {
+		logger.Info("Detected packets written to pcapng", "path", config.DetectionPcapPath)
 	}
 
-	// Initialize XDP filter for fast-path blocking (optional but recommended)
+	// Set up kernel enforcement of bans (XDP fast-path by default)
+	backend := newEnforcer(config, logs)
 	var xdpFilter *xdp.Filter
-	if len(config.Interfaces) > 0 && config.Interfaces[0] != "" {
-		logger.Info("Initializing XDP filter on %s (mode: %s)", config.Interfaces[0], config.XDPMode)
-		xdpFilter, err = xdp.NewXDPFilter(config.Interfaces[0])
+	if x, ok := backend.(*enforcer.XDP); ok {
+		xdpFilter = x.Filter()
+	}
+	// Load the allowlist into the XDP program before any ban is restored
+	if xdpFilter != nil {
+		if err := xdpFilter.GetMapManager().SetAllowlist(allow.Prefixes()); err != nil {
+			logger.Error("Failed to load allowlist into XDP", "error", err)
+		}
+		if err := xdpFilter.GetMapManager().SetAggregation(aggregationPolicy(config)); err != nil {
+			logger.Error("Failed to set subnet ban aggregation", "error", err)
+		} else if config.SubnetBanThreshold > 0 {
+			logger.Info("Subnet ban aggregation enabled", "threshold", config.SubnetBanThreshold,
+				"prefix4", config.SubnetBanPrefix4, "prefix6", config.SubnetBanPrefix6,
+				"window", time.Duration(config.SubnetBanWindow)*time.Second)
+		}
+	} else if config.SubnetBanThreshold > 0 {
+		logger.Warn("Subnet ban aggregation requires the XDP backend, ignoring subnetBanThreshold")
+	}
+
+	// Open the ban journal and re-apply bans that outlived the previous run
+	var bans *BanStore
+	if config.BanDBPath != "" {
+		bans, err = OpenBanStore(config.BanDBPath)
 		if err != nil {
-			logger.Warn("Failed to initialize XDP filter: %v (continuing without XDP fast-path)", err)
-			xdpFilter = nil
-		} else {
-			// Start periodic cleanup of expired IPs
-			cleanupInterval := time.Duration(config.CleanupInterval) * time.Second
-			xdpFilter.GetMapManager().StartPeriodicCleanup(cleanupInterval)
-			logger.Info("XDP filter initialized successfully (cleanup interval: %v)", cleanupInterval)
+			if backend != nil {
+				_ = backend.Close()
+			}
+			_ = detectionLogger.Close()
+			_ = logs.Close()
+			return nil, fmt.Errorf("failed to open ban database: %w", err)
+		}
+		if skipped := bans.Skipped(); skipped > 0 {
+			logger.Warn("Ignored corrupt ban database records", "path", config.BanDBPath, "skipped", skipped)
+		}
+		active := bans.Active(time.Now())
+		if backend != nil {
+			for _, rec := range active {
+				if allow.ContainsIP(net.ParseIP(rec.IP)) {
+					logger.Info("Not restoring ban of allowlisted address", "ip", rec.IP)
+					continue
+				}
+				if err := backend.Ban(net.ParseIP(rec.IP), time.Until(rec.ExpiresAt)); err != nil {
+					logger.Error("Failed to restore ban", "ip", rec.IP, "backend", backend.Name(), "error", err)
+				}
+			}
+		}
+		logger.Info("Ban database enabled", "path", config.BanDBPath, "restored", len(active))
+	}
+
+	// Strike history of repeat offenders, restored from the ban journal
+	strikes := newStrikeTable()
+	if bans != nil {
+		for _, rec := range bans.Records() {
+			if rec.Strikes > 0 {
+				strikes.restore(rec.IP, Strike{Count: rec.Strikes, Last: rec.LastStrike})
+			}
+		}
+	}
+
+	// Start the ban event webhooks; bans restored above were announced by the previous run
+	var events *banEvents
+	if len(config.WebhookURLs) > 0 {
+		events, err = newBanEvents(config, logs.Component(LogComponentWebhook))
+		if err != nil {
+			if backend != nil {
+				_ = backend.Close()
+			}
+			if bans != nil {
+				_ = bans.Close()
+			}
+			_ = detectionLogger.Close()
+			_ = logs.Close()
+			return nil, fmt.Errorf("failed to start webhooks: %w", err)
+		}
+		if backend != nil {
+			if list, err := backend.List(); err == nil {
+				for _, ban := range list {
+					events.track(ban.IP.String(), "", ban.ExpiresAt)
+				}
+			}
 		}
+		if bans != nil {
+			for _, rec := range bans.Active(time.Now()) {
+				events.track(rec.IP, rec.Reason, rec.ExpiresAt)
+			}
+		}
+		logger.Info("Ban event webhooks enabled", "endpoints", len(config.WebhookURLs),
+			"signed", config.WebhookSecret != "", "queue_dir", config.WebhookQueueDir)
+	}
+
+	// Initialize flow tracking so detections can use more than one packet
+	var flows *FlowTable
+	if config.FlowTableSize > 0 {
+		flows = NewFlowTable(config.FlowTableSize, time.Duration(config.FlowTimeout)*time.Second)
+		logger.Info("Flow tracking enabled", "max_flows", config.FlowTableSize,
+			"idle_timeout", time.Duration(config.FlowTimeout)*time.Second)
 	}
 
 	blocker := &Blocker{
 		config:          config,
-		analyzer:        NewAnalyzer(config),
+		logs:            logs,
 		logger:          logger,
 		detectionLogger: detectionLogger,
+		enforcer:        backend,
 		xdpFilter:       xdpFilter,
+		flows:           flows,
+		bans:            bans,
+		events:          events,
+		strikes:         strikes,
+		evidence:        newEvidenceTable(),
+	}
+
+	// Collect metrics only when the endpoint is enabled, so the packet path pays nothing otherwise
+	if config.MetricsAddr != "" {
+		blocker.metrics = newBlockerMetrics(blocker)
 	}
+	evidence, _ := newEvidencePolicy(config) // Checked by Validate
+	blocker.live.Store(&liveState{config: config, analyzer: blocker.newAnalyzer(config), allow: allow,
+		escalation: newEscalation(config), evidence: evidence})
+	if len(allow.Prefixes()) > 0 {
+		logger.Info("Allowlist enabled", "allowlist", strings.Join(config.Allowlist, ","))
+	}
+	blocker.unbanAllowlisted(allow)
 
 	return blocker, nil
 }
 
+// newAnalyzer creates an analyzer for config, timed by the metrics if enabled
+func (b *Blocker) newAnalyzer(config Config) *Analyzer {
+	analyzer := NewAnalyzer(config)
+	if b.metrics != nil {
+		analyzer.SetDetectorObserver(b.metrics.observeDetector)
+	}
+	return analyzer
+}
+
+// Reload applies a new configuration without reopening the queues
+// Live settings (see configFields) apply from the next packet on. Settings
+// that need a restart keep their current values; their keys are returned.
+// An invalid configuration is rejected and the current one stays in effect.
+func (b *Blocker) Reload(config Config) ([]string, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+
+	current := b.live.Load()
+	merged, restart := mergeLiveConfig(current.config, config)
+	allow := current.allow
+	if !reflect.DeepEqual(merged.Allowlist, current.config.Allowlist) || !reflect.DeepEqual(merged.AllowPorts, current.config.AllowPorts) {
+		allow, _ = NewAllowlist(merged.Allowlist, merged.AllowPorts) // Checked by Validate
+		if b.xdpFilter != nil {
+			if err := b.xdpFilter.GetMapManager().SetAllowlist(allow.Prefixes()); err != nil {
+				b.logger.Error("Failed to load allowlist into XDP", "error", err)
+			}
+		}
+	}
+	if b.xdpFilter != nil && aggregationPolicy(merged) != aggregationPolicy(current.config) {
+		if err := b.xdpFilter.GetMapManager().SetAggregation(aggregationPolicy(merged)); err != nil {
+			b.logger.Error("Failed to set subnet ban aggregation", "error", err)
+		}
+	}
+	_ = b.logs.SetLevels(merged.LogLevel, merged.LogComponentLevels) // Checked by Validate
+
+	evidence, _ := newEvidencePolicy(merged) // Checked by Validate
+	b.live.Store(&liveState{config: merged, analyzer: b.newAnalyzer(merged), allow: allow,
+		escalation: newEscalation(merged), evidence: evidence})
+	if allow != current.allow {
+		b.unbanAllowlisted(allow)
+	}
+
+	mode := "blocking enabled"
+	if merged.MonitorOnly {
+		mode = "MONITOR ONLY"
+	}
+	b.logger.Info("Configuration reloaded", "log_level", merged.LogLevel,
+		"ban_duration", formatDuration(merged.BanDuration), "mode", mode, "block_socks", merged.BlockSOCKS,
+		"detectors", strings.Join(merged.Detectors, ","))
+	if len(restart) > 0 {
+		b.logger.Warn("Configuration changes that require a restart were not applied", "keys", strings.Join(restart, ","))
+	}
+	return restart, nil
+}
+
+// SetConfigSource sets how ReloadConfig re-reads the configuration, usually the
+// same file, environment and flags it was loaded from at startup
+// Must be called before Start.
+func (b *Blocker) SetConfigSource(load func() (Config, error)) {
+	b.configSource = load
+}
+
+// ReloadConfig re-reads the configuration from the source set by SetConfigSource
+// and applies it with Reload. Returns the keys that need a restart.
+// Failures are logged; the current configuration stays in effect.
+func (b *Blocker) ReloadConfig() ([]string, error) {
+	if b.configSource == nil {
+		return nil, errors.New("no configuration source to reload from")
+	}
+	config, err := b.configSource()
+	var restart []string
+	if err == nil {
+		restart, err = b.Reload(config)
+	}
+	if err != nil {
+		b.logger.Error("Configuration reload failed, keeping current configuration", "error", err)
+	}
+	return restart, err
+}
+
+// ReopenLogs reopens the detection log and pcapng file after they were moved by an external logrotate
+func (b *Blocker) ReopenLogs() error {
+	if err := b.detectionLogger.Reopen(); err != nil {
+		return err
+	}
+	b.logger.Info("Detection log reopened")
+	return nil
+}
+
+// unbanAllowlisted lifts bans the enforcement backend holds on allowlisted addresses
+// (restored from a previous run, or banned before the allowlist entry was added)
+func (b *Blocker) unbanAllowlisted(allow *Allowlist) {
+	if b.enforcer == nil || len(allow.Prefixes()) == 0 {
+		return
+	}
+	bans, err := b.enforcer.List()
+	if err != nil {
+		b.logger.Error("Failed to list bans", "backend", b.enforcer.Name(), "error", err)
+		return
+	}
+	for _, ban := range bans {
+		if !allow.ContainsIP(ban.IP) {
+			continue
+		}
+		if err := b.enforcer.Unban(ban.IP); err != nil {
+			b.logger.Error("Failed to unban allowlisted address", "ip", ban.IP, "backend", b.enforcer.Name(), "error", err)
+		} else {
+			b.logger.Info("Unbanned allowlisted address", "ip", ban.IP, "backend", b.enforcer.Name())
+			b.strikes.forget(ban.IP.String())
+			if b.events != nil {
+				b.events.unban(ban.IP, BanSourceAllowlist)
+			}
+		}
+	}
+}
+
+// Config returns the configuration currently in effect
+func (b *Blocker) Config() Config {
+	return b.live.Load().config
+}
+
+// Logger returns the logger of the blocker component
+func (b *Blocker) Logger() *slog.Logger {
+	return b.logger
+}
+
 // Start begins the inline packet filtering loop (NFQUEUE)
 func (b *Blocker) Start(ctx context.Context) error {
+	config := b.Config()
 	mode := "blocking enabled"
-	if b.config.MonitorOnly {
+	if config.MonitorOnly {
 		mode = "MONITOR ONLY - accepting all packets"
 	}
 
-	xdpStatus := "disabled"
-	if b.xdpFilter != nil {
-		xdpStatus = "enabled (fast-path)"
+	enforcement := "none"
+	if b.enforcer != nil {
+		enforcement = b.enforcer.Name()
+	}
+
+	b.logger.Info("BitTorrent blocker started (inline DPI)", "queues", formatQueueRange(b.config.QueueNum, b.config.QueueCount),
+		"enforcement", enforcement, "log_level", config.LogLevel, "mode", mode)
+
+	defer b.Close()
+
+	if b.metrics != nil {
+		if err := b.serveMetrics(ctx, b.config.MetricsAddr); err != nil {
+			return err
+		}
+	}
+	if b.config.ControlSocket != "" {
+		if err := b.serveControl(ctx, b.config.ControlSocket, b.config.ControlSocketGroup); err != nil {
+			return err
+		}
+	}
+
+	// Open one NFQUEUE per queue number; the kernel balances flows across them
+	// (iptables --queue-balance) and each queue gets its own reader goroutine
+	for i := 0; i < b.config.QueueCount; i++ {
+		queueNum := uint16(b.config.QueueNum + i) // #nosec G115 - queue range is validated to be 0-65535 by Config.Validate()
+		if err := b.openQueue(ctx, queueNum); err != nil {
+			return err
+		}
+	}
+
+	b.logger.Info("NFQUEUE registered, processing packets inline", "queue_count", b.config.QueueCount,
+		"max_queue_len", b.config.QueueMaxLen, "bypass", b.config.QueueBypass)
+
+	// Expire idle flows in the background
+	if b.flows != nil {
+		go b.expireFlows(ctx)
 	}
 
-	b.logger.Info("BitTorrent blocker started on NFQUEUE %d (inline DPI, XDP: %s, log level: %s, mode: %s)",
-		b.config.QueueNum, xdpStatus, b.config.LogLevel, mode)
+	// Drop expired bans and strikes from the backend, the journal and memory in the background
+	if b.config.CleanupInterval > 0 {
+		go b.expireBans(ctx)
+	}
+
+	// Block until context is canceled
+	<-ctx.Done()
+	b.logger.Info("Shutting down")
+	return ctx.Err()
+}
+
+// openQueue opens a single NFQUEUE and registers the packet callback
+// The callback runs on the queue's own reader goroutine
+func (b *Blocker) openQueue(ctx context.Context, queueNum uint16) error {
+	flags := uint32(nfqueue.NfQaCfgFlagGSO) // Enable GSO (Generic Segmentation Offload)
+	if b.config.QueueBypass {
+		// Accept packets instead of dropping them when the queue overflows
+		flags |= nfqueue.NfQaCfgFlagFailOpen
+	}
 
 	// Configure NFQUEUE
 	nfqConfig := nfqueue.Config{
-		NfQueue:      uint16(b.config.QueueNum), // #nosec G115 - QueueNum is validated to be 0-65535 in New()
-		MaxPacketLen: 0xFFFF,                    // 64KB max packet size
-		MaxQueueLen:  1024,                      // Queue up to 1024 packets
+		NfQueue:      queueNum,
+		MaxPacketLen: 0xFFFF,                       // 64KB max packet size
+		MaxQueueLen:  uint32(b.config.QueueMaxLen), // #nosec G115 - QueueMaxLen is validated to be positive by Config.Validate()
 		Copymode:     nfqueue.NfQnlCopyPacket,
-		Flags:        nfqueue.NfQaCfgFlagGSO, // Enable GSO (Generic Segmentation Offload)
+		Flags:        flags,
 	}
 
 	// Create NFQUEUE instance
-	var err error
-	b.nfq, err = nfqueue.Open(&nfqConfig)
+	nfq, err := nfqueue.Open(&nfqConfig)
 	if err != nil {
-		return fmt.Errorf("failed to open NFQUEUE %d: %w (ensure iptables rules are configured)", b.config.QueueNum, err)
+		return fmt.Errorf("failed to open NFQUEUE %d: %w (ensure iptables rules are configured)", queueNum, err)
 	}
-	defer b.Close()
+	b.queues = append(b.queues, nfq)
 
 	// Register packet callback
 	hookFunc := func(attr nfqueue.Attribute) int {
-		verdict := b.processNFQPacket(attr)
-		return verdict
+		if attr.PacketID == nil {
+			return 0
+		}
+		var payload []byte
+		if attr.Payload != nil {
+			payload = *attr.Payload
+		}
+		verdict := b.processNFQPacket(payload, queueNum)
+		_ = nfq.SetVerdict(*attr.PacketID, verdict)
+		if b.metrics != nil {
+			b.metrics.packets.Inc()
+			b.metrics.countVerdict(verdict)
+		}
+		return 0
 	}
 
-	if err := b.nfq.RegisterWithErrorFunc(ctx, hookFunc, func(err error) int {
-		b.logger.Error("NFQUEUE error: %v", err)
+	if err := nfq.RegisterWithErrorFunc(ctx, hookFunc, func(err error) int {
+		b.logger.Error("NFQUEUE error", "queue", queueNum, "error", err)
+		if b.metrics != nil {
+			b.metrics.countQueueError(queueNum)
+		}
 		return 0
 	}); err != nil {
-		return fmt.Errorf("failed to register NFQUEUE callback: %w", err)
+		return fmt.Errorf("failed to register NFQUEUE %d callback: %w", queueNum, err)
 	}
 
-	b.logger.Info("NFQUEUE registered, processing packets inline...")
-
-	// Block until context is canceled
-	<-ctx.Done()
-	b.logger.Info("Shutting down...")
-	return ctx.Err()
+	return nil
 }
 
 // processNFQPacket processes a single packet from NFQUEUE and returns verdict
 // This function is called synchronously for each packet - must be FAST!
+// It runs concurrently on every queue's reader goroutine, so all state it
+// touches (analyzer, flow table, XDP map, loggers) must be safe for concurrent use.
 //
 //nolint:gocyclo // Packet processing requires sequential checks, complexity acceptable for performance
-func (b *Blocker) processNFQPacket(attr nfqueue.Attribute) int {
+func (b *Blocker) processNFQPacket(payload []byte, queueNum uint16) int {
 	// Default verdict: accept packet
 	verdict := nfqueue.NfAccept
+	live := b.live.Load()
 
-	// Get packet ID (required for verdict)
-	packetID := *attr.PacketID
-
-	// Get packet payload
-	if attr.Payload == nil || len(*attr.Payload) == 0 {
-		// No payload, accept by default
-		_ = b.nfq.SetVerdict(packetID, verdict)
-		return 0
+	// No payload, accept by default
+	if len(payload) == 0 {
+		return verdict
 	}
 
-	payload := *attr.Payload
+	// Parse IPv4/IPv6 packet down to the TCP/UDP payload
+	pkt, ok := parsePacket(payload)
+	if !ok {
+		// Not TCP/UDP over IP, accept by default
+		return verdict
+	}
 
-	// Parse packet using gopacket
-	packet := gopacket.NewPacket(payload, layers.LayerTypeIPv4, gopacket.DecodeOptions{
-		Lazy:   true,
-		NoCopy: true, // Zero-copy for performance
-	})
+	// Allowlisted addresses are never inspected, dropped or banned
+	if live.allow.ContainsIP(pkt.srcIP) || live.allow.ContainsIP(pkt.dstIP) {
+		if b.metrics != nil {
+			b.metrics.allowlisted.Inc()
+		}
+		return verdict
+	}
 
-	// Check if already blocked by XDP fast-path
-	// (This should rarely happen since XDP blocks at kernel level,
+	// Check if already banned by the enforcement backend
+	// (This should rarely happen since the backend drops in the kernel,
 	//  but checking here prevents wasted DPI analysis)
-	if b.xdpFilter != nil {
-		if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
-			ip, _ := ipLayer.(*layers.IPv4)
-			srcIP := ip.SrcIP
-			if blocked, _ := b.xdpFilter.GetMapManager().IsBlocked(srcIP); blocked {
-				// Already blocked by XDP, drop immediately
-				_ = b.nfq.SetVerdict(packetID, nfqueue.NfDrop)
-				return 0
-			}
+	if b.enforcer != nil && b.enforcer.IsBanned(pkt.srcIP) {
+		if b.metrics != nil {
+			b.metrics.countBlocklistHit(b.enforcer.Name())
 		}
+		return nfqueue.NfDrop
 	}
 
-	// Extract packet information
-	var srcIP, dstIP string
-	var srcPort, dstPort uint16
-	var appLayer []byte
-	isUDP := false
-
-	// Parse IP layer
-	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
-		ip, _ := ipLayer.(*layers.IPv4)
-		srcIP = ip.SrcIP.String()
-		dstIP = ip.DstIP.String()
-	} else {
-		// Not IPv4, accept by default
-		_ = b.nfq.SetVerdict(packetID, verdict)
-		return 0
+	// Without a backend the ban journal is the only record of banned IPs, so enforce it here
+	if b.enforcer == nil && b.bans != nil && !live.config.MonitorOnly && b.bans.IsBanned(pkt.srcIP, time.Now()) {
+		if b.metrics != nil {
+			b.metrics.countBlocklistHit(enforcer.BackendNone)
+		}
+		return nfqueue.NfDrop
 	}
 
-	// Parse TCP/UDP layers
-	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-		tcp, _ := tcpLayer.(*layers.TCP)
-		srcPort, dstPort = uint16(tcp.SrcPort), uint16(tcp.DstPort)
-		appLayer = tcp.Payload
-	} else if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
-		udp, _ := udpLayer.(*layers.UDP)
-		srcPort, dstPort = uint16(udp.SrcPort), uint16(udp.DstPort)
-		appLayer = udp.Payload
-		isUDP = true
-	} else {
-		// Not TCP/UDP, accept by default
-		_ = b.nfq.SetVerdict(packetID, verdict)
-		return 0
-	}
+	srcIP, dstIP := pkt.srcIP.String(), pkt.dstIP.String()
+	srcPort, dstPort := pkt.srcPort, pkt.dstPort
+	appLayer := pkt.payload
+	isUDP := pkt.isUDP
 
-	// Whitelist check (fast rejection)
-	if WhitelistPorts[srcPort] || WhitelistPorts[dstPort] {
-		b.logger.Debug("Whitelisted port: %s:%d -> %d", srcIP, srcPort, dstPort)
-		_ = b.nfq.SetVerdict(packetID, verdict)
-		return 0
+	// Analyze packet for BitTorrent traffic (in the context of its flow if tracking is enabled)
+	result, skipped := inspectPacket(live, b.flows, pkt, time.Now())
+	if skipped != "" {
+		if skipped == skipWhitelistedPort {
+			b.logger.Debug("Whitelisted port", "src_ip", srcIP, "src_port", srcPort, "dst_port", dstPort)
+		}
+		return verdict
 	}
 
-	// No payload to analyze, accept
-	if len(appLayer) == 0 {
-		_ = b.nfq.SetVerdict(packetID, verdict)
-		return 0
+	// Flow already classified as BitTorrent: the detection was logged on the first
+	// hit, so keep dropping the rest of the flow. Until the detected endpoint is
+	// banned, every packet it sends still counts towards the evidence threshold,
+	// so one long flow is enough to ban it; replies from its peer are only dropped.
+	if result.ShouldBlock && result.FromFlow {
+		if live.config.MonitorOnly {
+			return verdict
+		}
+		if !result.FromPeer && (b.enforcer != nil || b.bans != nil) {
+			now := time.Now()
+			flow, _ := makeFlowKey(pkt.srcIP, srcPort, pkt.dstIP, dstPort, isUDP)
+			evidence, _, promote := b.evidence.add(srcIP, evidenceHit{at: now, reason: result.Reason, flow: flow}, live.evidence)
+			if promote {
+				if action, banDuration, strike := b.banSource(live, pkt.srcIP, result.Reason, now, queueNum); action == DetectionActionBan {
+					b.logger.Info("BitTorrent flow banned", "src_ip", srcIP, "src_port", srcPort, "dst_ip", dstIP, "dst_port", dstPort,
+						"reason", result.Reason, "evidence", evidence, "ban_duration", banDuration, "strikes", strike.Count, "queue", queueNum)
+				}
+			}
+		}
+		return nfqueue.NfDrop
 	}
 
-	// Analyze packet for BitTorrent traffic
-	result := b.analyzer.AnalyzePacketEx(appLayer, isUDP, dstIP, dstPort)
+	// Handle detection (log-only detectors are reported but never drop or ban)
+	if result.ShouldBlock || result.LogOnly {
+		if b.metrics != nil {
+			b.metrics.detections.WithLabel(result.Reason).Inc()
+		}
 
-	// Handle detection
-	if result.ShouldBlock {
 		proto := "TCP"
 		if isUDP {
 			proto = "UDP"
 		}
 
-		// Log detection
-		if b.config.MonitorOnly {
-			b.logger.Info("[DETECT] %s %s:%d (%s) - Monitor only (accepting)", proto, srcIP, srcPort, result.Reason)
+		action := DetectionActionMonitor
+		banDuration := time.Duration(live.config.BanDuration) * time.Second
+		var strike Strike
+		var evidence, needed int // Detections against the source, and the number that bans it
+		if result.LogOnly {
+			action = DetectionActionLog
+		} else if live.config.MonitorOnly {
 			verdict = nfqueue.NfAccept // Accept in monitor mode
 		} else {
-			duration := formatDuration(b.config.BanDuration)
-			b.logger.Info("[DETECT] %s %s:%d (%s) - Dropping packet, banning IP for %s", proto, srcIP, srcPort, result.Reason, duration)
+			action = DetectionActionDrop
 			verdict = nfqueue.NfDrop // DROP the packet inline
 
-			// Add to XDP blocklist for fast-path blocking of future packets
-			if b.xdpFilter != nil {
-				ip := net.ParseIP(srcIP)
-				if ip != nil {
-					banDuration := time.Duration(b.config.BanDuration) * time.Second
-					if err := b.xdpFilter.GetMapManager().AddIP(ip, banDuration); err != nil {
-						b.logger.Error("Failed to add IP %s to XDP blocklist: %v", srcIP, err)
-					} else {
-						b.logger.Debug("Added IP %s to XDP fast-path (expires in %v)", srcIP, banDuration)
-					}
-				}
+			// Below the evidence threshold the packet is dropped, but the peer is not banned yet
+			now := time.Now()
+			flow, _ := makeFlowKey(pkt.srcIP, srcPort, pkt.dstIP, dstPort, isUDP)
+			var promote bool
+			evidence, needed, promote = b.evidence.add(srcIP, evidenceHit{at: now, reason: result.Reason, flow: flow}, live.evidence)
+			if promote {
+				action, banDuration, strike = b.banSource(live, pkt.srcIP, result.Reason, now, queueNum)
 			}
 		}
 
+		// Log the detection with the action actually taken
+		attrs := []any{"proto", proto, "src_ip", srcIP, "src_port", srcPort, "dst_ip", dstIP, "dst_port", dstPort,
+			"reason", result.Reason, "action", action, "queue", queueNum}
+		if action == DetectionActionBan {
+			attrs = append(attrs, "ban_duration", banDuration)
+			if strike.Count > 0 {
+				attrs = append(attrs, "strikes", strike.Count)
+			}
+		} else if action == DetectionActionDrop && evidence < needed {
+			attrs = append(attrs, "evidence", evidence, "evidence_needed", needed)
+		}
+		b.logger.Info("BitTorrent detected", attrs...)
+
 		// Log detailed packet information for false positive analysis
-		b.detectionLogger.LogDetection(
-			time.Now(),
-			fmt.Sprintf("nfq%d", b.config.QueueNum),
-			proto,
-			srcIP,
-			srcPort,
-			dstIP,
-			dstPort,
-			result.Reason,
-			appLayer,
-		)
-	}
-
-	// Set verdict and return
-	_ = b.nfq.SetVerdict(packetID, verdict)
-	return 0
+		b.detectionLogger.LogDetection(Detection{
+			Timestamp: time.Now(),
+			Interface: fmt.Sprintf("nfq%d", queueNum),
+			Queue:     queueNum,
+			Protocol:  proto,
+			SrcIP:     srcIP,
+			SrcPort:   srcPort,
+			DstIP:     dstIP,
+			DstPort:   dstPort,
+			Reason:    result.Reason,
+			Action:    action,
+			Payload:   appLayer,
+			Packet:    payload,
+		})
+	}
+
+	return verdict
+}
+
+// Reasons inspectPacket skips DPI
+const (
+	skipWhitelistedPort = "whitelisted port"
+	skipNoPayload       = "no payload"
+)
+
+// banSource bans a detected source whose evidence reached the threshold.
+// It returns DetectionActionBan once the ban is persisted or enforced
+// (DetectionActionDrop otherwise), with the ban duration and strike applied.
+func (b *Blocker) banSource(live *liveState, ip net.IP, reason string, now time.Time, queueNum uint16) (string, time.Duration, Strike) {
+	action := DetectionActionDrop
+	srcIP := ip.String()
+	banDuration := time.Duration(live.config.BanDuration) * time.Second
+
+	// Repeat offenders climb the ban ladder
+	var strike Strike
+	if live.escalation.enabled() {
+		strike = b.strikes.add(srcIP, now, live.escalation)
+		banDuration = live.escalation.duration(strike.Count)
+	}
+
+	// Persist the ban (and strikes) so it survives restarts
+	hits := 0
+	if b.bans != nil {
+		var rec BanRecord
+		var err error
+		if strike.Count > 0 {
+			rec, err = b.bans.RecordStrike(ip, reason, now, now.Add(banDuration), strike, strike.Last.Add(live.escalation.window))
+		} else {
+			rec, err = b.bans.Record(ip, reason, now, now.Add(banDuration))
+		}
+		if err != nil {
+			b.logger.Error("Failed to persist ban", "ip", srcIP, "error", err)
+		} else {
+			action = DetectionActionBan
+			hits = rec.Hits
+			if rec.Hits > 1 {
+				b.logger.Debug("IP banned again", "ip", srcIP, "hits", rec.Hits, "first_detected", rec.FirstDetected)
+			}
+		}
+	}
+
+	// Ban in the kernel so future packets never reach NFQUEUE
+	if b.enforcer != nil {
+		if err := b.enforcer.Ban(ip, banDuration); err != nil {
+			b.logger.Error("Failed to ban IP", "ip", srcIP, "backend", b.enforcer.Name(), "error", err)
+		} else {
+			action = DetectionActionBan
+			b.logger.Debug("Banned IP", "ip", srcIP, "backend", b.enforcer.Name(), "expires_in", banDuration)
+		}
+	}
+
+	// Announce the ban; the webhook sender queues it without blocking
+	if b.events != nil && action == DetectionActionBan {
+		b.events.ban(BanEvent{
+			Time:      now,
+			IP:        srcIP,
+			Reason:    reason,
+			ExpiresAt: now.Add(banDuration),
+			Source:    BanSourceDetection,
+			Hits:      hits,
+			Strikes:   strike.Count,
+			Interface: fmt.Sprintf("nfq%d", queueNum),
+		})
+	}
+	return action, banDuration, strike
+}
+
+// inspectPacket runs a parsed packet through the port whitelist and DPI, in the
+// context of its flow if flow tracking is enabled
+// This is the inspection path shared by processNFQPacket and offline capture
+// analysis; the caller handles the allowlist and bans. skipped names the reason
+// DPI was not run, or is empty.
+func inspectPacket(live *liveState, flows *FlowTable, pkt packetInfo, now time.Time) (result AnalysisResult, skipped string) {
+	// Whitelist check (fast rejection)
+	if WhitelistPorts[pkt.srcPort] || WhitelistPorts[pkt.dstPort] || live.allow.ContainsPort(pkt.srcPort) || live.allow.ContainsPort(pkt.dstPort) {
+		return result, skipWhitelistedPort
+	}
+
+	// No payload to analyze
+	if len(pkt.payload) == 0 {
+		return result, skipNoPayload
+	}
+
+	dstIP := pkt.dstIP.String()
+	if flows != nil {
+		flow, dir := flows.Track(pkt.srcIP, pkt.srcPort, pkt.dstIP, pkt.dstPort, pkt.isUDP, now)
+		return live.analyzer.AnalyzeFlow(flow, dir, pkt.payload, pkt.isUDP, dstIP, pkt.dstPort), ""
+	}
+	return live.analyzer.AnalyzePacketEx(pkt.payload, pkt.isUDP, dstIP, pkt.dstPort), ""
+}
+
+// expireFlows periodically removes idle flows from the flow table
+func (b *Blocker) expireFlows(ctx context.Context) {
+	interval := time.Duration(b.config.FlowTimeout) * time.Second / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if removed := b.flows.Expire(time.Now()); removed > 0 {
+				b.logger.Debug("Expired idle flows", "removed", removed, "active", b.flows.Len())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expireBans periodically removes expired bans from the backend and the ban journal,
+// reports them to the webhooks, and forgets strikes and evidence that no longer count
+func (b *Blocker) expireBans(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(b.config.CleanupInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if b.enforcer != nil {
+				removed, err := b.enforcer.Expire()
+				if err != nil {
+					b.logger.Error("Failed to expire bans", "backend", b.enforcer.Name(), "error", err)
+				} else if removed > 0 {
+					b.logger.Debug("Expired bans", "backend", b.enforcer.Name(), "removed", removed)
+				}
+			}
+			if b.bans != nil {
+				removed, err := b.bans.Compact(time.Now())
+				if err != nil {
+					b.logger.Error("Failed to compact ban database", "error", err)
+				} else if removed > 0 {
+					b.logger.Debug("Removed expired bans from ban database", "removed", removed)
+				}
+			}
+			if b.events != nil {
+				b.events.expire(time.Now())
+			}
+			live := b.live.Load()
+			if removed := b.strikes.expire(time.Now(), live.escalation); removed > 0 {
+				b.logger.Debug("Forgot strike history", "removed", removed)
+			}
+			b.evidence.expire(time.Now(), live.evidence.window)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// formatQueueRange formats a queue range as "N" or "N-M"
+func formatQueueRange(first, count int) string {
+	if count <= 1 {
+		return fmt.Sprintf("%d", first)
+	}
+	return fmt.Sprintf("%d-%d", first, first+count-1)
 }
 
 // formatDuration converts seconds to a human-readable duration string
@@ -271,20 +777,44 @@ func formatDuration(seconds int) string {
 }
 
 // Close cleans up resources
+// It is safe to call more than once and from several goroutines; only the
+// first call does the work, the others wait for it to finish.
 func (b *Blocker) Close() error {
-	// Close NFQUEUE
-	if b.nfq != nil {
-		b.logger.Info("Closing NFQUEUE")
-		if err := b.nfq.Close(); err != nil {
-			b.logger.Error("Failed to close NFQUEUE: %v", err)
+	b.closeOnce.Do(b.close)
+	return nil
+}
+
+// close is the body of Close
+func (b *Blocker) close() {
+	// Close NFQUEUEs
+	for i, nfq := range b.queues {
+		b.logger.Info("Closing NFQUEUE", "queue", b.config.QueueNum+i)
+		if err := nfq.Close(); err != nil {
+			b.logger.Error("Failed to close NFQUEUE", "queue", b.config.QueueNum+i, "error", err)
+		}
+	}
+	b.queues = nil
+
+	// Close the enforcement backend (if enabled)
+	// Its kernel bans stay in place for the next run unless teardown was asked for.
+	if b.enforcer != nil {
+		if persistent, ok := b.enforcer.(enforcer.Persistent); ok && b.config.EnforcementTeardown {
+			b.logger.Info("Removing enforcement backend, lifting its bans", "backend", b.enforcer.Name())
+			if err := persistent.Teardown(); err != nil {
+				b.logger.Error("Failed to remove enforcement backend", "backend", b.enforcer.Name(), "error", err)
+			}
+		} else {
+			b.logger.Info("Closing enforcement backend", "backend", b.enforcer.Name())
+			if err := b.enforcer.Close(); err != nil {
+				b.logger.Error("Failed to close enforcement backend", "backend", b.enforcer.Name(), "error", err)
+			}
 		}
 	}
 
-	// Close XDP filter (if enabled)
-	if b.xdpFilter != nil {
-		b.logger.Info("Closing XDP filter")
-		if err := b.xdpFilter.Close(); err != nil {
-			b.logger.Error("Failed to close XDP filter: %v", err)
+	// Compact and close the ban journal
+	if b.bans != nil {
+		if err := b.bans.Close(); err != nil {
+			b.logger.Error("Failed to close ban database", "error", err)
 		}
 	}
 
@@ -293,5 +823,16 @@ func (b *Blocker) Close() error {
 		b.detectionLogger.Close()
 	}
 
-	return nil
+	// Stop the webhooks; undelivered events stay in the queue directory
+	if b.events != nil {
+		if err := b.events.Close(); err != nil {
+			b.logger.Error("Failed to close webhook queues", "error", err)
+		}
+		b.events = nil
+	}
+
+	// Close the journald or syslog connection last
+	if b.logs != nil {
+		_ = b.logs.Close()
+	}
 }
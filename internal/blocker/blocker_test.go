@@ -0,0 +1,469 @@
+package blocker
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/example/BitTorrentBlocker/internal/enforcer"
+	nfqueue "github.com/florianl/go-nfqueue/v2"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// newTestBlocker creates a blocker without NFQUEUE or XDP attached
+func newTestBlocker(t *testing.T, config Config) *Blocker {
+	t.Helper()
+	config.Interfaces = nil // No XDP in unit tests
+	config.LogLevel = "error"
+	b, err := New(config)
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	t.Cleanup(func() { _ = b.Close() })
+	return b
+}
+
+// tcpPacket builds a raw IPv4/TCP packet with the given payload
+func tcpPacket(t *testing.T, src string, srcPort uint16, payload []byte) []byte {
+	t.Helper()
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(src),
+		DstIP:    net.ParseIP("10.0.0.1"),
+	}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: 6881, PSH: true, ACK: true, Window: 1024}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+	return serializeIPPacket(t, ip, tcp, gopacket.Payload(payload))
+}
+
+// tcpReply builds the reply to a tcpPacket: from 10.0.0.1:6881 back to dst
+func tcpReply(t *testing.T, dst string, dstPort uint16, payload []byte) []byte {
+	t.Helper()
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP("10.0.0.1"),
+		DstIP:    net.ParseIP(dst),
+	}
+	tcp := &layers.TCP{SrcPort: 6881, DstPort: layers.TCPPort(dstPort), PSH: true, ACK: true, Window: 1024}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+	return serializeIPPacket(t, ip, tcp, gopacket.Payload(payload))
+}
+
+func TestNew_QueueValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr bool
+	}{
+		{"Default", func(c *Config) {}, false},
+		{"Queue range", func(c *Config) { c.QueueNum, c.QueueCount = 0, 8 }, false},
+		{"Range ends at 65535", func(c *Config) { c.QueueNum, c.QueueCount = 65532, 4 }, false},
+		{"Range past 65535", func(c *Config) { c.QueueNum, c.QueueCount = 65532, 5 }, true},
+		{"Zero queues", func(c *Config) { c.QueueCount = 0 }, true},
+		{"Zero queue length", func(c *Config) { c.QueueMaxLen = 0 }, true},
+		{"Negative queue number", func(c *Config) { c.QueueNum = -1 }, true},
+		{"Unknown detection log format", func(c *Config) { c.DetectionLogFormat = "xml" }, true},
+		{"Negative detection log payload", func(c *Config) { c.DetectionLogPayloadBytes = -1 }, true},
+		{"Unknown log format", func(c *Config) { c.LogFormat = "xml" }, true},
+		{"Unknown log component", func(c *Config) { c.LogComponentLevels = []string{"kernel=debug"} }, true},
+		{"Component log level", func(c *Config) { c.LogComponentLevels = []string{"xdp=debug"} }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Interfaces = nil
+			config.LogLevel = "error"
+			tt.modify(&config)
+			b, err := New(config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if b != nil {
+				_ = b.Close()
+			}
+		})
+	}
+}
+
+func TestProcessNFQPacket_Verdicts(t *testing.T) {
+	b := newTestBlocker(t, DefaultConfig())
+
+	if v := b.processNFQPacket(nil, 0); v != nfqueue.NfAccept {
+		t.Errorf("Empty packet verdict = %d, want NfAccept", v)
+	}
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.2", 40000, []byte("GET / HTTP/1.1\r\n\r\n")), 0); v != nfqueue.NfAccept {
+		t.Errorf("HTTP packet verdict = %d, want NfAccept", v)
+	}
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, []byte("\x13BitTorrent protocol")), 0); v != nfqueue.NfDrop {
+		t.Errorf("BitTorrent handshake verdict = %d, want NfDrop", v)
+	}
+}
+
+func TestProcessNFQPacket_MonitorOnly(t *testing.T) {
+	config := DefaultConfig()
+	config.MonitorOnly = true
+	b := newTestBlocker(t, config)
+
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, []byte("\x13BitTorrent protocol")), 0); v != nfqueue.NfAccept {
+		t.Errorf("Monitor-only verdict = %d, want NfAccept", v)
+	}
+}
+
+// TestProcessNFQPacket_Concurrent simulates one reader goroutine per queue
+// sharing the analyzer, flow table and loggers (run with -race)
+func TestProcessNFQPacket_Concurrent(t *testing.T) {
+	config := DefaultConfig()
+	config.QueueCount = 8
+	config.DetectionLogPath = t.TempDir() + "/detections.log"
+	b := newTestBlocker(t, config)
+
+	handshake := []byte("\x13BitTorrent protocol")
+	clean := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	// Flows overlap across queues so workers contend on the same flow state
+	type testPacket struct {
+		data []byte
+		want int
+	}
+	packets := make([]testPacket, 0, 200)
+	for i := 0; i < 200; i++ {
+		port := uint16(40000 + i%32) // #nosec G115 - small test values
+		if i%16 == 0 {
+			packets = append(packets, testPacket{tcpPacket(t, fmt.Sprintf("10.0.2.%d", i/16+2), port, handshake), nfqueue.NfDrop})
+		} else {
+			packets = append(packets, testPacket{tcpPacket(t, fmt.Sprintf("10.0.1.%d", i%16+2), port, clean), nfqueue.NfAccept})
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, config.QueueCount)
+	for q := 0; q < config.QueueCount; q++ {
+		wg.Add(1)
+		go func(queueNum uint16) {
+			defer wg.Done()
+			for i, pkt := range packets {
+				if got := b.processNFQPacket(pkt.data, queueNum); got != pkt.want {
+					errs <- fmt.Errorf("queue %d packet %d: verdict = %d, want %d", queueNum, i, got, pkt.want)
+					return
+				}
+			}
+		}(uint16(q)) // #nosec G115 - small test values
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestProcessNFQPacket_Metrics(t *testing.T) {
+	config := DefaultConfig()
+	config.MetricsAddr = "127.0.0.1:0"
+	b := newTestBlocker(t, config)
+	if b.metrics == nil {
+		t.Fatal("Metrics should be enabled when MetricsAddr is set")
+	}
+
+	b.processNFQPacket(tcpPacket(t, "10.0.0.2", 40000, []byte("GET / HTTP/1.1\r\n\r\n")), 0)
+	b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, []byte("\x13BitTorrent protocol")), 0)
+	b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, []byte("more data")), 0) // Cached flow verdict
+
+	if got := b.metrics.detections.WithLabel("BitTorrent Signature").Value(); got != 1 {
+		t.Errorf("detections = %d, want 1 (cached flow verdicts are not new detections)", got)
+	}
+
+	var buf bytes.Buffer
+	if err := b.metrics.registry.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText() failed: %v", err)
+	}
+	for _, want := range []string{
+		`btblocker_detector_duration_seconds_count{detector="signatures"}`,
+		`btblocker_detector_duration_seconds_count{detector="fast_extension"}`,
+		"btblocker_flows 2\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestProcessNFQPacket_BlocklistMetrics(t *testing.T) {
+	config := DefaultConfig()
+	config.MetricsAddr = "127.0.0.1:0"
+	b := newTestBlocker(t, config)
+	backend := &fakeBackend{banned: map[string]time.Duration{"10.0.0.4": time.Hour}}
+	b.enforcer = backend
+	b.metrics = newBlockerMetrics(b)
+
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.4", 40000, []byte("anything")), 0); v != nfqueue.NfDrop {
+		t.Errorf("Verdict for a banned source = %d, want NfDrop", v)
+	}
+
+	var buf bytes.Buffer
+	if err := b.metrics.registry.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText() failed: %v", err)
+	}
+	for _, want := range []string{
+		`btblocker_blocklist_hits_total{backend="fake"} 1` + "\n",
+		`btblocker_blocked_ips{backend="fake"} 1` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestNew_MetricsDisabledByDefault(t *testing.T) {
+	b := newTestBlocker(t, DefaultConfig())
+	if b.metrics != nil || b.live.Load().analyzer.observe != nil {
+		t.Error("Metrics should be disabled when MetricsAddr is empty")
+	}
+}
+
+func TestProcessNFQPacket_BanDBSurvivesRestart(t *testing.T) {
+	config := DefaultConfig()
+	config.BanDBPath = filepath.Join(t.TempDir(), "bans.jsonl")
+	config.FlowTableSize = 0 // Each packet is judged on its own
+
+	b := newTestBlocker(t, config)
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, []byte("\x13BitTorrent protocol")), 0); v != nfqueue.NfDrop {
+		t.Fatalf("BitTorrent handshake verdict = %d, want NfDrop", v)
+	}
+	_ = b.Close()
+
+	// Without XDP the restarted blocker drops the banned peer's clean traffic from the journal alone
+	b = newTestBlocker(t, config)
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40001, []byte("GET / HTTP/1.1\r\n\r\n")), 0); v != nfqueue.NfDrop {
+		t.Errorf("Banned IP verdict after restart = %d, want NfDrop", v)
+	}
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.4", 40001, []byte("GET / HTTP/1.1\r\n\r\n")), 0); v != nfqueue.NfAccept {
+		t.Errorf("Unbanned IP verdict = %d, want NfAccept", v)
+	}
+}
+
+// fakeBackend is an in-memory enforcement backend
+type fakeBackend struct {
+	mu     sync.Mutex
+	banned map[string]time.Duration
+}
+
+func (f *fakeBackend) Name() string { return "fake" }
+func (f *fakeBackend) Ban(ip net.IP, d time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.banned[ip.String()] = d
+	return nil
+}
+func (f *fakeBackend) Unban(ip net.IP) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.banned, ip.String())
+	return nil
+}
+func (f *fakeBackend) IsBanned(ip net.IP) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.banned[ip.String()]
+	return ok
+}
+func (f *fakeBackend) List() ([]enforcer.Ban, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var bans []enforcer.Ban
+	for ip, d := range f.banned {
+		bans = append(bans, enforcer.Ban{IP: net.ParseIP(ip), ExpiresAt: time.Now().Add(d)})
+	}
+	return bans, nil
+}
+func (f *fakeBackend) Expire() (int, error) { return 0, nil }
+func (f *fakeBackend) Close() error         { return nil }
+
+// persistentBackend is a fakeBackend whose bans outlive Close
+type persistentBackend struct {
+	fakeBackend
+	closed, tornDown atomic.Int32
+}
+
+func (p *persistentBackend) Close() error    { p.closed.Add(1); return nil }
+func (p *persistentBackend) Teardown() error { p.tornDown.Add(1); return nil }
+
+func TestClose_EnforcementTeardown(t *testing.T) {
+	for _, teardown := range []bool{false, true} {
+		config := DefaultConfig()
+		config.EnforcementTeardown = teardown
+		b := newTestBlocker(t, config)
+		backend := &persistentBackend{fakeBackend: fakeBackend{banned: make(map[string]time.Duration)}}
+		b.enforcer = backend
+
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if (backend.tornDown.Load() == 1) != teardown || (backend.closed.Load() == 1) == teardown {
+			t.Errorf("EnforcementTeardown=%v: closed=%d tornDown=%d", teardown, backend.closed.Load(), backend.tornDown.Load())
+		}
+	}
+}
+
+func TestClose_Once(t *testing.T) {
+	b := newTestBlocker(t, DefaultConfig())
+	backend := &persistentBackend{fakeBackend: fakeBackend{banned: make(map[string]time.Duration)}}
+	b.enforcer = backend
+
+	// Start's deferred Close and the caller's Close may race on shutdown
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = b.Close()
+		}()
+	}
+	wg.Wait()
+	_ = b.Close()
+	if n := backend.closed.Load(); n != 1 {
+		t.Errorf("Enforcement backend closed %d times, want 1", n)
+	}
+}
+
+func TestProcessNFQPacket_EnforcementBackend(t *testing.T) {
+	config := DefaultConfig()
+	config.FlowTableSize = 0
+	b := newTestBlocker(t, config)
+	backend := &fakeBackend{banned: make(map[string]time.Duration)}
+	b.enforcer = backend
+
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, []byte("\x13BitTorrent protocol")), 0); v != nfqueue.NfDrop {
+		t.Fatalf("BitTorrent handshake verdict = %d, want NfDrop", v)
+	}
+	if d := backend.banned["10.0.0.3"]; d != 5*time.Hour {
+		t.Errorf("Backend ban duration = %v, want 5h", d)
+	}
+
+	// Further packets from the banned IP are dropped without DPI
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40001, []byte("GET / HTTP/1.1\r\n\r\n")), 0); v != nfqueue.NfDrop {
+		t.Errorf("Banned IP verdict = %d, want NfDrop", v)
+	}
+}
+
+func TestNew_InvalidEnforcementBackend(t *testing.T) {
+	config := DefaultConfig()
+	config.Interfaces = nil
+	config.EnforcementBackend = "iptables"
+	if _, err := New(config); err == nil {
+		t.Error("New() should reject an unknown enforcement backend")
+	}
+}
+
+func TestReload(t *testing.T) {
+	config := DefaultConfig()
+	config.FlowTableSize = 0
+	b := newTestBlocker(t, config)
+	backend := &fakeBackend{banned: make(map[string]time.Duration)}
+	b.enforcer = backend
+	handshake := []byte("\x13BitTorrent protocol")
+
+	// Live settings apply to the next packet; queue settings need a restart
+	next := b.Config()
+	next.MonitorOnly = true
+	next.LogLevel = "warn"
+	next.LogComponentLevels = []string{"xdp=debug"}
+	next.QueueNum = 3
+	restart, err := b.Reload(next)
+	if err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+	if len(restart) != 1 || restart[0] != "queueNum" {
+		t.Errorf("Reload() restart = %v, want [queueNum]", restart)
+	}
+	if got := b.Config(); got.QueueNum != 0 || !got.MonitorOnly {
+		t.Errorf("Config() after reload: QueueNum = %d, MonitorOnly = %v", got.QueueNum, got.MonitorOnly)
+	}
+	if got := b.logs.Level(LogComponentBlocker); got != slog.LevelWarn {
+		t.Errorf("Blocker log level = %v, want warn", got)
+	}
+	if got := b.logs.Level(LogComponentXDP); got != slog.LevelDebug {
+		t.Errorf("XDP log level = %v, want debug", got)
+	}
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, handshake), 0); v != nfqueue.NfAccept {
+		t.Errorf("Monitor-only verdict after reload = %d, want NfAccept", v)
+	}
+
+	next.MonitorOnly = false
+	next.BanDuration = 60
+	if _, err := b.Reload(next); err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.4", 40000, handshake), 0); v != nfqueue.NfDrop {
+		t.Errorf("Verdict after reload = %d, want NfDrop", v)
+	}
+	if d := backend.banned["10.0.0.4"]; d != time.Minute {
+		t.Errorf("Backend ban duration = %v, want the reloaded 1m", d)
+	}
+
+	// An invalid configuration is rejected as a whole
+	next.BanDuration = 120
+	next.LogLevel = "loud"
+	if _, err := b.Reload(next); err == nil {
+		t.Error("Reload() should reject an invalid configuration")
+	}
+	if got := b.Config(); got.BanDuration != 60 || got.LogLevel != "warn" {
+		t.Errorf("Rejected reload changed the configuration: %+v", got)
+	}
+}
+
+func TestProcessNFQPacket_Allowlist(t *testing.T) {
+	config := DefaultConfig()
+	config.Allowlist = []string{"10.0.0.2/31", "2001:db8::/32"} // Packets go to 10.0.0.1
+	config.AllowPorts = []int{40001}
+	b := newTestBlocker(t, config)
+	handshake := []byte("\x13BitTorrent protocol")
+
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, handshake), 0); v != nfqueue.NfAccept {
+		t.Errorf("Allowlisted source verdict = %d, want NfAccept", v)
+	}
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.9", 40001, handshake), 0); v != nfqueue.NfAccept {
+		t.Errorf("Allowlisted port verdict = %d, want NfAccept", v)
+	}
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.9", 40000, handshake), 0); v != nfqueue.NfDrop {
+		t.Errorf("Verdict outside the allowlist = %d, want NfDrop", v)
+	}
+}
+
+func TestReload_AllowlistUnbans(t *testing.T) {
+	config := DefaultConfig()
+	config.FlowTableSize = 0
+	b := newTestBlocker(t, config)
+	backend := &fakeBackend{banned: make(map[string]time.Duration)}
+	b.enforcer = backend
+
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, []byte("\x13BitTorrent protocol")), 0); v != nfqueue.NfDrop {
+		t.Fatalf("BitTorrent handshake verdict = %d, want NfDrop", v)
+	}
+
+	// Allowlisting a banned address lifts its ban and lets its traffic through
+	next := b.Config()
+	next.Allowlist = []string{"10.0.0.3"}
+	if _, err := b.Reload(next); err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+	if backend.IsBanned(net.ParseIP("10.0.0.3")) {
+		t.Error("Allowlisted address should have been unbanned")
+	}
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40002, []byte("\x13BitTorrent protocol")), 0); v != nfqueue.NfAccept {
+		t.Errorf("Allowlisted verdict after reload = %d, want NfAccept", v)
+	}
+}
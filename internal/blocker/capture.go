@@ -0,0 +1,255 @@
+package blocker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Flow verdicts reported by offline capture analysis
+const (
+	CaptureBitTorrent  = "bittorrent"  // Detected, would have been dropped and banned
+	CaptureClean       = "clean"       // Inspected without a detection
+	CaptureAllowlisted = "allowlisted" // Source or destination in the allowlist, never inspected
+	CaptureWhitelisted = "whitelisted" // Whitelisted port or no payload, never inspected
+)
+
+// CaptureFlow is the verdict for one flow of a capture file
+type CaptureFlow struct {
+	File       string    `json:"file"`
+	Proto      string    `json:"proto"` // TCP or UDP
+	Src        string    `json:"src"`   // Sender of the first packet seen, "ip:port"
+	Dst        string    `json:"dst"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	Packets    int       `json:"packets"`
+	Bytes      int       `json:"bytes"` // Payload bytes
+	Verdict    string    `json:"verdict"`
+	Reason     string    `json:"reason,omitempty"`      // Detector reason, or why DPI was skipped
+	DetectedAt int       `json:"detected_at,omitempty"` // Packet of the flow (1-based) that triggered the detection
+}
+
+// CaptureSummary totals an offline capture analysis
+type CaptureSummary struct {
+	Files           int            `json:"files"`
+	Packets         int            `json:"packets"`    // Packets read
+	IPPackets       int            `json:"ip_packets"` // TCP/UDP over IPv4 or IPv6
+	Flows           int            `json:"flows"`
+	BitTorrentFlows int            `json:"bittorrent_flows"`
+	Reasons         map[string]int `json:"reasons"` // BitTorrent flows by detector reason
+}
+
+// CaptureAnalyzer runs pcap/pcapng captures through the same parsing and inspection
+// path as the NFQUEUE handler (allowlist, port whitelist, flow tracking and DPI)
+// Flows are tracked per file; packet timestamps drive flow idle timeouts.
+type CaptureAnalyzer struct {
+	live    *liveState
+	config  Config
+	flows   *FlowTable
+	reports map[FlowKey]*CaptureFlow
+	order   []*CaptureFlow
+	summary CaptureSummary
+}
+
+// NewCaptureAnalyzer creates an offline analyzer using the detection settings of config
+func NewCaptureAnalyzer(config Config) (*CaptureAnalyzer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	allow, err := NewAllowlist(config.Allowlist, config.AllowPorts)
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureAnalyzer{
+		live:    &liveState{config: config, analyzer: NewAnalyzer(config), allow: allow},
+		config:  config,
+		summary: CaptureSummary{Reasons: make(map[string]int)},
+	}, nil
+}
+
+// AnalyzePath analyzes a capture file, or every .pcap, .pcapng and .cap file below a directory
+func (c *CaptureAnalyzer) AnalyzePath(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return c.AnalyzeFile(path)
+	}
+
+	var files []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".pcap", ".pcapng", ".cap":
+			if !d.IsDir() {
+				files = append(files, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	var errs []error
+	for _, file := range files {
+		if err := c.AnalyzeFile(file); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AnalyzeFile analyzes one pcap or pcapng file (detected from its magic number)
+func (c *CaptureAnalyzer) AnalyzeFile(path string) error {
+	f, err := os.Open(path) // #nosec G304 - path given by the operator
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err != nil {
+		return fmt.Errorf("%s: not a capture file: %w", path, err)
+	}
+
+	var source interface {
+		ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	}
+	var linkType layers.LinkType
+	if binary.BigEndian.Uint32(magic) == 0x0A0D0D0A { // pcapng section header block
+		ng, err := pcapgo.NewNgReader(r, pcapgo.NgReaderOptions{})
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		source, linkType = ng, ng.LinkType()
+	} else {
+		pr, err := pcapgo.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		source, linkType = pr, pr.LinkType()
+	}
+
+	// Flows never span capture files
+	if c.config.FlowTableSize > 0 {
+		c.flows = NewFlowTable(c.config.FlowTableSize, time.Duration(c.config.FlowTimeout)*time.Second)
+	}
+	c.reports = make(map[FlowKey]*CaptureFlow)
+	c.summary.Files++
+
+	for {
+		data, ci, err := source.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			// A capture cut off mid-packet still yields everything before the cut
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		c.AnalyzePacket(path, data, linkType, ci.Timestamp)
+	}
+}
+
+// AnalyzePacket analyzes one captured frame of the given link type
+func (c *CaptureAnalyzer) AnalyzePacket(file string, data []byte, linkType layers.LinkType, ts time.Time) {
+	c.summary.Packets++
+
+	// Strip the link layer: processNFQPacket sees raw IP packets
+	frame := gopacket.NewPacket(data, linkType, decodeOptions)
+	network := frame.NetworkLayer()
+	if network == nil {
+		return
+	}
+	raw := append(append([]byte(nil), network.LayerContents()...), network.LayerPayload()...)
+	pkt, ok := parsePacket(raw)
+	if !ok {
+		return
+	}
+	c.summary.IPPackets++
+
+	key, _ := makeFlowKey(pkt.srcIP, pkt.srcPort, pkt.dstIP, pkt.dstPort, pkt.isUDP)
+	report, exists := c.reports[key]
+	if !exists {
+		proto := "TCP"
+		if pkt.isUDP {
+			proto = "UDP"
+		}
+		report = &CaptureFlow{
+			File:      file,
+			Proto:     proto,
+			Src:       net.JoinHostPort(pkt.srcIP.String(), strconv.Itoa(int(pkt.srcPort))),
+			Dst:       net.JoinHostPort(pkt.dstIP.String(), strconv.Itoa(int(pkt.dstPort))),
+			FirstSeen: ts,
+			Verdict:   CaptureClean,
+		}
+		c.reports[key] = report
+		c.order = append(c.order, report)
+		c.summary.Flows++
+	}
+	report.LastSeen = ts
+	report.Packets++
+	report.Bytes += len(pkt.payload)
+
+	// Same order as processNFQPacket: allowlist, then whitelist and DPI
+	if c.live.allow.ContainsIP(pkt.srcIP) || c.live.allow.ContainsIP(pkt.dstIP) {
+		report.Verdict, report.Reason = CaptureAllowlisted, ""
+		return
+	}
+	result, skipped := inspectPacket(c.live, c.flows, pkt, ts)
+	switch {
+	case report.Verdict == CaptureBitTorrent:
+		// Already detected; later packets only reuse the verdict
+	case result.ShouldBlock:
+		report.Verdict, report.Reason, report.DetectedAt = CaptureBitTorrent, result.Reason, report.Packets
+		c.summary.BitTorrentFlows++
+		c.summary.Reasons[result.Reason]++
+	case skipped == skipWhitelistedPort:
+		report.Verdict, report.Reason = CaptureWhitelisted, skipped
+	case skipped == skipNoPayload && report.Bytes == 0:
+		report.Verdict, report.Reason = CaptureWhitelisted, skipped
+	case skipped == "":
+		report.Verdict, report.Reason = CaptureClean, ""
+	}
+}
+
+// Flows returns the verdicts of all flows, in the order they were first seen
+func (c *CaptureAnalyzer) Flows() []CaptureFlow {
+	flows := make([]CaptureFlow, len(c.order))
+	for i, report := range c.order {
+		flows[i] = *report
+	}
+	return flows
+}
+
+// Summary returns the totals of all captures analyzed so far
+func (c *CaptureAnalyzer) Summary() CaptureSummary {
+	summary := c.summary
+	summary.Reasons = make(map[string]int, len(c.summary.Reasons))
+	for reason, n := range c.summary.Reasons {
+		summary.Reasons[reason] = n
+	}
+	return summary
+}
@@ -0,0 +1,136 @@
+package blocker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// writeCapture writes raw IP packets as Ethernet frames to a pcap (or pcapng) file
+func writeCapture(t *testing.T, path string, ng bool, packets ...[]byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var write func(gopacket.CaptureInfo, []byte) error
+	if ng {
+		w, err := pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Flush()
+		write = w.WritePacket
+	} else {
+		w := pcapgo.NewWriter(f)
+		if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+			t.Fatal(err)
+		}
+		write = w.WritePacket
+	}
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, ip := range packets {
+		// Destination MAC, source MAC, EtherType IPv4
+		frame := append([]byte{0, 1, 2, 3, 4, 5, 0, 1, 2, 3, 4, 6, 0x08, 0x00}, ip...)
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Second), CaptureLength: len(frame), Length: len(frame)}
+		if err := write(ci, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCaptureAnalyzer_FlowVerdicts(t *testing.T) {
+	for _, ng := range []bool{false, true} {
+		name := "pcap"
+		if ng {
+			name = "pcapng"
+		}
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "capture."+name)
+			writeCapture(t, path, ng,
+				tcpPacket(t, "10.0.0.3", 40000, []byte("\x13BitTorrent protocol")),
+				tcpPacket(t, "10.0.0.4", 40001, []byte("GET / HTTP/1.1\r\n\r\n")),
+				tcpPacket(t, "10.0.0.3", 40000, []byte("GET / HTTP/1.1\r\n\r\n")),
+				tcpPacket(t, "10.0.0.5", 40002, []byte("\x13BitTorrent protocol")),
+			)
+
+			config := DefaultConfig()
+			config.Allowlist = []string{"10.0.0.5"}
+			c, err := NewCaptureAnalyzer(config)
+			if err != nil {
+				t.Fatalf("NewCaptureAnalyzer() failed: %v", err)
+			}
+			if err := c.AnalyzePath(path); err != nil {
+				t.Fatalf("AnalyzePath() failed: %v", err)
+			}
+
+			flows := c.Flows()
+			if len(flows) != 3 {
+				t.Fatalf("Flows() = %+v, want 3 flows", flows)
+			}
+			want := []struct {
+				src, verdict string
+				packets      int
+			}{
+				{"10.0.0.3:40000", CaptureBitTorrent, 2},
+				{"10.0.0.4:40001", CaptureClean, 1},
+				{"10.0.0.5:40002", CaptureAllowlisted, 1},
+			}
+			for i, w := range want {
+				if f := flows[i]; f.Src != w.src || f.Verdict != w.verdict || f.Packets != w.packets {
+					t.Errorf("Flow %d = %+v, want %s %s with %d packets", i, f, w.src, w.verdict, w.packets)
+				}
+			}
+			if f := flows[0]; f.Reason == "" || f.DetectedAt != 1 || f.Dst != "10.0.0.1:6881" || f.LastSeen.Sub(f.FirstSeen) != 2*time.Second {
+				t.Errorf("Detected flow = %+v", f)
+			}
+
+			summary := c.Summary()
+			if summary.Files != 1 || summary.Packets != 4 || summary.IPPackets != 4 || summary.Flows != 3 || summary.BitTorrentFlows != 1 {
+				t.Errorf("Summary() = %+v", summary)
+			}
+			if summary.Reasons[flows[0].Reason] != 1 {
+				t.Errorf("Summary().Reasons = %v", summary.Reasons)
+			}
+		})
+	}
+}
+
+func TestCaptureAnalyzer_Directory(t *testing.T) {
+	c, err := NewCaptureAnalyzer(DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewCaptureAnalyzer() failed: %v", err)
+	}
+	if err := c.AnalyzePath("../../test/testdata/pcap/true-positive"); err != nil {
+		t.Fatalf("AnalyzePath() failed: %v", err)
+	}
+	summary := c.Summary()
+	if summary.Files < 2 || summary.BitTorrentFlows == 0 {
+		t.Errorf("Summary() = %+v, want BitTorrent flows across several files", summary)
+	}
+}
+
+func TestCaptureAnalyzer_InvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.pcap")
+	if err := os.WriteFile(path, []byte("not a capture"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCaptureAnalyzer(DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewCaptureAnalyzer() failed: %v", err)
+	}
+	if err := c.AnalyzeFile(path); err == nil {
+		t.Error("AnalyzeFile() should fail for a file that is not a capture")
+	}
+	if err := c.AnalyzePath(filepath.Join(t.TempDir(), "missing.pcap")); err == nil {
+		t.Error("AnalyzePath() should fail for a missing file")
+	}
+}
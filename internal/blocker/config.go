@@ -1,33 +1,308 @@
 package blocker
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/example/BitTorrentBlocker/internal/enforcer"
+	"github.com/example/BitTorrentBlocker/internal/xdp"
+)
+
 // Config holds the configuration for the BitTorrent blocker
+// The json tags are the keys used in configuration files (see LoadConfig).
 type Config struct {
-	Interfaces       []string // Network interfaces to monitor (e.g., ["eth0", "wg0"]) - used for XDP
-	QueueNum         int      // NFQUEUE number (0-65535, default: 0)
-	BanDuration      int      // Duration in seconds
-	LogLevel         string   // Logging level: error, warn, info, debug
-	DetectionLogPath string   // Path to detection log file (empty = disabled)
-	MonitorOnly      bool     // If true, only log detections without banning IPs
-	BlockSOCKS       bool     // If true, block SOCKS proxy connections (default: false to reduce false positives)
+	Interfaces        []string `json:"interfaces"`        // Network interfaces to monitor (e.g., ["eth0", "wg0"]) - used for XDP
+	QueueNum          int      `json:"queueNum"`          // First NFQUEUE number (0-65535, default: 0)
+	QueueCount        int      `json:"queueCount"`        // Number of consecutive queues starting at QueueNum (matches iptables --queue-balance)
+	QueueMaxLen       int      `json:"queueMaxLen"`       // Maximum packets held by the kernel per queue
+	QueueBypass       bool     `json:"queueBypass"`       // If true, accept packets when a queue is full instead of dropping them (--queue-bypass semantics)
+	BanDuration       int      `json:"banDuration"`       // Duration in seconds (unless BanLadder is set)
+	LogLevel          string   `json:"logLevel"`          // Logging level: error, warn, info, debug
+	DetectionLogPath  string   `json:"detectionLogPath"`  // Path to detection log file (empty = disabled)
+	DetectionPcapPath string   `json:"detectionPcapPath"` // Path to a pcapng file receiving every detected packet (empty = disabled)
+	BanDBPath         string   `json:"banDbPath"`         // Path to the persistent ban journal, replayed on startup (empty = bans are kept in memory only)
+	MonitorOnly       bool     `json:"monitorOnly"`       // If true, only log detections without banning IPs
+	BlockSOCKS        bool     `json:"blockSocks"`        // If true, block SOCKS proxy connections (same as Detectors ["socks=on"])
+	MetricsAddr       string   `json:"metricsAddr"`       // Listen address for the Prometheus /metrics endpoint, e.g. ":9100" (empty = disabled)
+
+	// DPI pipeline: per-detector modes "id=on|off|log" overriding the built-in defaults (see DetectorStatuses)
+	Detectors []string `json:"detectors"` // e.g. ["mse=log", "dht_nodes=on"]
+
+	// Process log output (see LogLevel)
+	LogFormat          string   `json:"logFormat"`          // "text", "json", "journald" or "syslog"
+	LogComponentLevels []string `json:"logComponentLevels"` // Per-component levels overriding LogLevel, e.g. ["xdp=debug"]
+
+	// Detection log output (see DetectionLogPath); the rotation limits apply to DetectionPcapPath too
+	DetectionLogFormat          string `json:"detectionLogFormat"`          // "text" (hex dump blocks) or "json" (one object per line)
+	DetectionLogPayloadBytes    int    `json:"detectionLogPayloadBytes"`    // Payload bytes logged per detection (0 = payload not logged)
+	DetectionLogPayloadEncoding string `json:"detectionLogPayloadEncoding"` // Payload encoding of the json format: "hex" or "base64"
+	DetectionLogMaxSize         int    `json:"detectionLogMaxSize"`         // Rotate the detection log at this size in MB (0 = no size limit)
+	DetectionLogMaxAge          int    `json:"detectionLogMaxAge"`          // Rotate the detection log at this age in seconds (0 = no age limit)
+	DetectionLogMaxFiles        int    `json:"detectionLogMaxFiles"`        // Rotated detection logs kept (0 = keep all)
+	DetectionLogCompress        bool   `json:"detectionLogCompress"`        // gzip rotated detection logs
+	DetectionLogQuota           int    `json:"detectionLogQuota"`           // MB of active and rotated logs above which payloads are no longer logged (0 = no quota)
+
+	// Escalating bans: each detection ban is a strike, and repeat offenders climb the ladder
+	BanLadder       []int `json:"banLadder"`       // Ban durations in seconds for the 1st, 2nd, ... strike, e.g. [600, 3600, 86400, 604800] (empty = always BanDuration)
+	BanStrikeWindow int   `json:"banStrikeWindow"` // Seconds after the latest strike until the strikes no longer count
+	BanStrikeDecay  int   `json:"banStrikeDecay"`  // Seconds without a new strike after which one strike is forgiven (0 = no decay)
+
+	// Evidence before banning: detections below the threshold are dropped inline without a ban
+	BanEvidence        int      `json:"banEvidence"`        // Detections within BanEvidenceWindow needed to ban (1 = ban on the first)
+	BanEvidenceWindow  int      `json:"banEvidenceWindow"`  // Window in seconds
+	BanEvidenceCount   string   `json:"banEvidenceCount"`   // What counts: "detections", "detectors" (distinct reasons) or "flows" (distinct flows)
+	BanEvidenceReasons []string `json:"banEvidenceReasons"` // Per-reason thresholds overriding BanEvidence, e.g. ["BitTorrent Signature=1"]
+
+	// Ban event webhooks: ban, unban and expire events POSTed as JSON batches
+	WebhookURLs       []string `json:"webhookUrls"`       // Endpoints receiving every event (empty = disabled)
+	WebhookSecret     string   `json:"webhookSecret"`     // HMAC-SHA256 key signing each request (empty = unsigned)
+	WebhookBatchSize  int      `json:"webhookBatchSize"`  // Maximum events per request
+	WebhookBatchDelay int      `json:"webhookBatchDelay"` // Seconds to wait for a batch to fill (0 = send right away)
+	WebhookTimeout    int      `json:"webhookTimeout"`    // Request timeout in seconds
+	WebhookMaxBackoff int      `json:"webhookMaxBackoff"` // Maximum delay between retries in seconds
+	WebhookQueueDir   string   `json:"webhookQueueDir"`   // Directory of the on-disk queues of undelivered events (empty = memory only)
+	WebhookQueueSize  int      `json:"webhookQueueSize"`  // Undelivered events kept per endpoint; the oldest are dropped beyond it
+
+	// Control socket for ban management ("btblocker ctl")
+	ControlSocket      string `json:"controlSocket"`      // Unix socket path (empty = disabled)
+	ControlSocketGroup string `json:"controlSocketGroup"` // Group allowed to use the socket besides root (empty = root only)
+
+	// Allowlist: traffic from or to these is never inspected, dropped or banned
+	Allowlist  []string `json:"allowlist"`  // Addresses or CIDRs (IPv4 and IPv6), also enforced by the XDP program
+	AllowPorts []int    `json:"allowPorts"` // Ports, in addition to the built-in WhitelistPorts
+
+	// Enforcement backend for bans: "xdp", "nftables", "ipset" or "none"
+	EnforcementBackend  string `json:"enforcementBackend"`
+	EnforcementTeardown bool   `json:"enforcementTeardown"` // If true, remove the nftables table or ipsets on exit, lifting their bans
 
 	// XDP configuration (optional fast-path for NFQUEUE + DPI architecture)
-	XDPMode         string // XDP mode: "generic" (compatible) or "native" (faster, driver support required)
-	CleanupInterval int    // Cleanup interval for expired IPs in seconds (default: 300 = 5 minutes)
+	XDPMode         string `json:"xdpMode"`         // XDP mode: "generic" (compatible) or "native" (faster, driver support required)
+	CleanupInterval int    `json:"cleanupInterval"` // Cleanup interval for expired IPs (XDP map and ban journal) in seconds (default: 300 = 5 minutes)
+	XDPPinPath      string `json:"xdpPinPath"`      // bpffs directory for pinned maps, so bans survive restarts (empty = no pinning)
+	XDPKeepAttached bool   `json:"xdpKeepAttached"` // If true, leave the XDP program attached on exit so enforcement has no gap during restarts
+
+	// Subnet ban aggregation (XDP backend): more than SubnetBanThreshold bans inside one
+	// /SubnetBanPrefix4 or /SubnetBanPrefix6 within SubnetBanWindow become a single prefix ban
+	SubnetBanThreshold int `json:"subnetBanThreshold"` // 0 = disabled
+	SubnetBanWindow    int `json:"subnetBanWindow"`    // Window in seconds
+	SubnetBanPrefix4   int `json:"subnetBanPrefix4"`   // IPv4 prefix length bans are grouped by
+	SubnetBanPrefix6   int `json:"subnetBanPrefix6"`   // IPv6 prefix length bans are grouped by
+
+	// Flow tracking (per-connection state shared across packets)
+	FlowTableSize    int `json:"flowTableSize"`    // Maximum number of tracked flows (0 = disable flow tracking)
+	FlowTimeout      int `json:"flowTimeout"`      // Idle timeout for flows in seconds
+	FlowInspectBytes int `json:"flowInspectBytes"` // Payload bytes accumulated per flow direction for multi-packet detectors
+	FlowMaxPackets   int `json:"flowMaxPackets"`   // Packets inspected before an undetected flow is considered clean
 }
 
 // DefaultConfig returns a configuration with recommended defaults
 func DefaultConfig() Config {
 	return Config{
-		Interfaces:       []string{"eth0"}, // Default interface (used for XDP fast-path)
-		QueueNum:         0,                // Default NFQUEUE number
-		BanDuration:      18000,            // 5 hours in seconds
-		LogLevel:         "info",
-		DetectionLogPath: "",    // Disabled by default
-		MonitorOnly:      false, // Enable blocking by default
-		BlockSOCKS:       false, // Disabled by default to avoid false positives with legitimate proxies
+		Interfaces:        []string{"eth0"}, // Default interface (used for XDP fast-path)
+		QueueNum:          0,                // Default NFQUEUE number
+		QueueCount:        1,                // Single queue
+		QueueMaxLen:       1024,             // Queue up to 1024 packets per queue
+		QueueBypass:       false,            // Drop on overflow (fail closed)
+		BanDuration:       18000,            // 5 hours in seconds
+		LogLevel:          "info",
+		DetectionLogPath:  "",    // Disabled by default
+		DetectionPcapPath: "",    // Disabled by default
+		BanDBPath:         "",    // Bans are not persisted by default
+		MonitorOnly:       false, // Enable blocking by default
+		BlockSOCKS:        false, // Disabled by default to avoid false positives with legitimate proxies
+		MetricsAddr:       "",    // Metrics endpoint disabled by default
+
+		Detectors: []string{}, // Built-in defaults
+
+		LogFormat:          LogFormatText,
+		LogComponentLevels: []string{}, // Every component at LogLevel
+
+		DetectionLogFormat:          DetectionLogText,
+		DetectionLogPayloadBytes:    DefaultDetectionLogPayloadBytes,
+		DetectionLogPayloadEncoding: "hex",
+		DetectionLogMaxSize:         100, // 100 MB per file
+		DetectionLogMaxAge:          0,   // No age limit
+		DetectionLogMaxFiles:        5,
+		DetectionLogCompress:        true,
+		DetectionLogQuota:           0, // No quota
+
+		BanLadder:       []int{}, // Fixed BanDuration
+		BanStrikeWindow: 2592000, // 30 days
+		BanStrikeDecay:  604800,  // 7 days
+
+		BanEvidence:        1,   // Ban on the first detection
+		BanEvidenceWindow:  600, // 10 minutes
+		BanEvidenceCount:   EvidenceDetections,
+		BanEvidenceReasons: []string{},
+
+		WebhookURLs:       []string{}, // Disabled by default
+		WebhookSecret:     "",
+		WebhookBatchSize:  100,
+		WebhookBatchDelay: 5,
+		WebhookTimeout:    10,
+		WebhookMaxBackoff: 300, // 5 minutes
+		WebhookQueueDir:   "",  // Memory only
+		WebhookQueueSize:  100000,
+
+		ControlSocket:      DefaultControlSocket,
+		ControlSocketGroup: "",
+
+		Allowlist:  []string{}, // Nothing allowlisted by default
+		AllowPorts: []int{},
+
+		EnforcementBackend:  "xdp", // XDP fast-path, nftables or ipset for hosts without XDP
+		EnforcementTeardown: false, // Kernel bans survive restarts by default
 
 		// XDP defaults (optional fast-path for known IPs)
 		XDPMode:         "generic", // Generic mode for maximum compatibility
 		CleanupInterval: 300,       // Cleanup every 5 minutes
+		XDPPinPath:      "/sys/fs/bpf/btblocker",
+		XDPKeepAttached: false, // Detach on exit by default
+
+		// Subnet ban aggregation defaults (disabled until a threshold is set)
+		SubnetBanThreshold: 0,
+		SubnetBanWindow:    3600, // 1 hour
+		SubnetBanPrefix4:   24,
+		SubnetBanPrefix6:   48,
+
+		// Flow tracking defaults
+		FlowTableSize:    65536, // 64k concurrent flows
+		FlowTimeout:      120,   // 2 minutes idle
+		FlowInspectBytes: 2048,  // Covers MSE key exchange with maximum padding
+		FlowMaxPackets:   16,    // Give up DPI after 16 payload packets
+	}
+}
+
+// Validate checks every field and returns the first invalid one
+func (c Config) Validate() error {
+	if c.QueueNum < 0 || c.QueueNum > 65535 {
+		return fmt.Errorf("invalid queue number: %d (must be 0-65535)", c.QueueNum)
+	}
+	if c.QueueCount < 1 || c.QueueNum+c.QueueCount-1 > 65535 {
+		return fmt.Errorf("invalid queue count: %d (queues %d-%d must be within 0-65535)",
+			c.QueueCount, c.QueueNum, c.QueueNum+c.QueueCount-1)
+	}
+	if c.QueueMaxLen < 1 {
+		return fmt.Errorf("invalid queue length: %d (must be positive)", c.QueueMaxLen)
+	}
+	for _, iface := range c.Interfaces {
+		if strings.TrimSpace(iface) == "" || strings.ContainsAny(iface, " ,/") {
+			return fmt.Errorf("invalid interface name %q", iface)
+		}
+	}
+	if _, err := NewAllowlist(c.Allowlist, c.AllowPorts); err != nil {
+		return err
+	}
+	if c.BanDuration < 1 {
+		return fmt.Errorf("invalid ban duration: %d (must be positive)", c.BanDuration)
+	}
+	for _, seconds := range c.BanLadder {
+		if seconds < 1 {
+			return fmt.Errorf("invalid ban ladder step: %d (must be positive)", seconds)
+		}
+	}
+	if len(c.BanLadder) > 0 && (c.BanStrikeWindow < 1 || c.BanStrikeDecay < 0) {
+		return fmt.Errorf("invalid strike window %d or decay %d (window must be positive, decay 0 or more)",
+			c.BanStrikeWindow, c.BanStrikeDecay)
+	}
+	if c.BanEvidence < 1 || c.BanEvidenceWindow < 1 {
+		return fmt.Errorf("invalid ban evidence %d within %d seconds (both must be positive)", c.BanEvidence, c.BanEvidenceWindow)
+	}
+	switch c.BanEvidenceCount {
+	case EvidenceDetections, EvidenceDetectors, EvidenceFlows:
+	default:
+		return fmt.Errorf("invalid ban evidence count %q (must be %s, %s or %s)",
+			c.BanEvidenceCount, EvidenceDetections, EvidenceDetectors, EvidenceFlows)
+	}
+	if _, err := parseEvidenceReasons(c.BanEvidenceReasons); err != nil {
+		return err
+	}
+	if _, err := parseDetectorModes(c.Detectors); err != nil {
+		return err
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	switch c.LogFormat {
+	case LogFormatText, LogFormatJSON, LogFormatJournald, LogFormatSyslog:
+	default:
+		return fmt.Errorf("invalid log format %q (must be %s, %s, %s or %s)",
+			c.LogFormat, LogFormatText, LogFormatJSON, LogFormatJournald, LogFormatSyslog)
+	}
+	if _, err := parseComponentLevels(c.LogComponentLevels); err != nil {
+		return err
+	}
+	if err := validateDetectionLogOptions(detectionLogOptions(c)); err != nil {
+		return err
+	}
+	if len(c.WebhookURLs) > 0 {
+		if c.WebhookBatchSize < 1 || c.WebhookTimeout < 1 || c.WebhookMaxBackoff < 1 || c.WebhookQueueSize < 1 {
+			return fmt.Errorf("invalid webhook limits: batch size %d, timeout %d, max backoff %d, queue size %d (must be positive)",
+				c.WebhookBatchSize, c.WebhookTimeout, c.WebhookMaxBackoff, c.WebhookQueueSize)
+		}
+		if err := webhookOptions(c, nil).Validate(); err != nil {
+			return err
+		}
+	}
+	if err := enforcer.ValidateBackend(c.EnforcementBackend); err != nil {
+		return err
+	}
+	if c.XDPMode != "" {
+		if err := xdp.ValidateMode(c.XDPMode); err != nil {
+			return err
+		}
+	}
+	if c.CleanupInterval < 1 {
+		return fmt.Errorf("invalid cleanup interval: %d (must be positive)", c.CleanupInterval)
+	}
+	if c.SubnetBanThreshold < 0 {
+		return fmt.Errorf("invalid subnet ban threshold: %d (must be 0 or more)", c.SubnetBanThreshold)
+	}
+	if c.SubnetBanThreshold > 0 {
+		if c.SubnetBanWindow < 1 {
+			return fmt.Errorf("invalid subnet ban window: %d (must be positive)", c.SubnetBanWindow)
+		}
+		if c.SubnetBanPrefix4 < 1 || c.SubnetBanPrefix4 > 32 {
+			return fmt.Errorf("invalid subnet ban IPv4 prefix length: %d (must be 1-32)", c.SubnetBanPrefix4)
+		}
+		if c.SubnetBanPrefix6 < 1 || c.SubnetBanPrefix6 > 128 {
+			return fmt.Errorf("invalid subnet ban IPv6 prefix length: %d (must be 1-128)", c.SubnetBanPrefix6)
+		}
+	}
+	if c.FlowTableSize < 0 {
+		return fmt.Errorf("invalid flow table size: %d (must be 0 or more)", c.FlowTableSize)
+	}
+	if c.FlowTableSize > 0 {
+		if c.FlowTimeout < 1 {
+			return fmt.Errorf("invalid flow timeout: %d (must be positive)", c.FlowTimeout)
+		}
+		if c.FlowInspectBytes < 0 || c.FlowMaxPackets < 0 {
+			return fmt.Errorf("invalid flow inspection limits: %d bytes, %d packets (must be 0 or more)",
+				c.FlowInspectBytes, c.FlowMaxPackets)
+		}
+	}
+	return nil
+}
+
+// ParseQueueRange parses a queue specification of the form "N" or "N-M"
+// (the same syntax as iptables --queue-balance) and returns the first queue
+// number and the number of queues in the range
+func ParseQueueRange(s string) (first, count int, err error) {
+	lo, hi, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	first, err = strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid queue number %q", lo)
+	}
+	last := first
+	if isRange {
+		last, err = strconv.Atoi(strings.TrimSpace(hi))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid queue number %q", hi)
+		}
+	}
+	if first < 0 || last > 65535 || last < first {
+		return 0, 0, fmt.Errorf("invalid queue range %q (must be within 0-65535, low to high)", s)
 	}
+	return first, last - first + 1, nil
 }
@@ -0,0 +1,388 @@
+package blocker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// configField describes how one Config field is set outside of Go code
+// key is the file key (the field's json tag); the flag name is key in kebab-case.
+// live fields can be changed by a reload; the others need a restart.
+type configField struct {
+	key  string
+	env  string
+	help string
+	live bool
+}
+
+// configFields lists every Config field that can be set from a file, the
+// environment or the command line. TestConfigFieldsCoverConfig keeps it complete.
+var configFields = []configField{
+	{"interfaces", "INTERFACE", "Comma-separated network interfaces for the XDP fast-path", false},
+	{"queueNum", "QUEUE_NUM", `NFQUEUE number, or range "N-M" matching iptables --queue-balance`, false},
+	{"queueCount", "QUEUE_COUNT", "Number of consecutive queues starting at queueNum", false},
+	{"queueMaxLen", "QUEUE_MAXLEN", "Maximum packets held by the kernel per queue", false},
+	{"queueBypass", "QUEUE_BYPASS", "Accept packets when a queue is full instead of dropping them", false},
+	{"banDuration", "BAN_DURATION", "Ban duration in seconds", true},
+	{"logLevel", "LOG_LEVEL", "Log level: error, warn, info or debug", true},
+	{"logFormat", "LOG_FORMAT", "Log output: text, json, journald or syslog", false},
+	{"logComponentLevels", "LOG_COMPONENT_LEVELS", `Comma-separated per-component levels, e.g. "xdp=debug,blocker=info"`, true},
+	{"detectionLogPath", "DETECTION_LOG", "Detection log file (empty = disabled)", false},
+	{"detectionPcapPath", "DETECTION_PCAP", "pcapng file receiving every detected packet (empty = disabled)", false},
+	{"banDbPath", "BAN_DB", "Persistent ban journal (empty = in-memory only)", false},
+	{"monitorOnly", "MONITOR_ONLY", "Only log detections, never ban or drop", true},
+	{"blockSocks", "BLOCK_SOCKS", "Block SOCKS proxy connections", true},
+	{"detectors", "DETECTORS", `Comma-separated detector modes "id=on|off|log", e.g. "mse=log,dht_nodes=on"`, true},
+	{"detectionLogFormat", "DETECTION_LOG_FORMAT", "Detection log format: text or json", false},
+	{"detectionLogPayloadBytes", "DETECTION_LOG_PAYLOAD_BYTES", "Payload bytes logged per detection (0 = none)", false},
+	{"detectionLogPayloadEncoding", "DETECTION_LOG_PAYLOAD_ENCODING", "Payload encoding of the json detection log: hex or base64", false},
+	{"detectionLogMaxSize", "DETECTION_LOG_MAX_SIZE", "Rotate the detection log at this size in MB (0 = no size limit)", false},
+	{"detectionLogMaxAge", "DETECTION_LOG_MAX_AGE", "Rotate the detection log at this age in seconds (0 = no age limit)", false},
+	{"detectionLogMaxFiles", "DETECTION_LOG_MAX_FILES", "Rotated detection logs kept (0 = keep all)", false},
+	{"detectionLogCompress", "DETECTION_LOG_COMPRESS", "gzip rotated detection logs", false},
+	{"detectionLogQuota", "DETECTION_LOG_QUOTA", "MB of detection logs above which payloads are no longer logged (0 = no quota)", false},
+	{"metricsAddr", "METRICS_ADDR", "Prometheus /metrics listen address (empty = disabled)", false},
+	{"banLadder", "BAN_LADDER", "Comma-separated ban durations in seconds for the 1st, 2nd, ... strike (empty = always banDuration)", true},
+	{"banStrikeWindow", "BAN_STRIKE_WINDOW", "Seconds after the latest strike until the strikes no longer count", true},
+	{"banStrikeDecay", "BAN_STRIKE_DECAY", "Seconds without a new strike after which one strike is forgiven (0 = no decay)", true},
+	{"banEvidence", "BAN_EVIDENCE", "Detections within banEvidenceWindow needed to ban (1 = ban on the first)", true},
+	{"banEvidenceWindow", "BAN_EVIDENCE_WINDOW", "Seconds a detection counts towards banEvidence", true},
+	{"banEvidenceCount", "BAN_EVIDENCE_COUNT", "What counts towards banEvidence: detections, detectors or flows", true},
+	{"banEvidenceReasons", "BAN_EVIDENCE_REASONS", `Comma-separated per-reason thresholds "reason=N" overriding banEvidence`, true},
+	{"webhookUrls", "WEBHOOK_URLS", "Comma-separated URLs receiving ban, unban and expire events (empty = disabled)", false},
+	{"webhookSecret", "WEBHOOK_SECRET", "HMAC-SHA256 key signing webhook requests (empty = unsigned)", false},
+	{"webhookBatchSize", "WEBHOOK_BATCH_SIZE", "Maximum events per webhook request", false},
+	{"webhookBatchDelay", "WEBHOOK_BATCH_DELAY", "Seconds to wait for a webhook batch to fill (0 = send right away)", false},
+	{"webhookTimeout", "WEBHOOK_TIMEOUT", "Webhook request timeout in seconds", false},
+	{"webhookMaxBackoff", "WEBHOOK_MAX_BACKOFF", "Maximum delay between webhook retries in seconds", false},
+	{"webhookQueueDir", "WEBHOOK_QUEUE_DIR", "Directory keeping undelivered webhook events across restarts (empty = memory only)", false},
+	{"webhookQueueSize", "WEBHOOK_QUEUE_SIZE", "Undelivered webhook events kept per endpoint", false},
+	{"controlSocket", "CONTROL_SOCKET", "Unix socket for btblocker ctl (empty = disabled)", false},
+	{"controlSocketGroup", "CONTROL_SOCKET_GROUP", "Group allowed to use the control socket (empty = root only)", false},
+	{"allowlist", "ALLOWLIST", "Comma-separated addresses or CIDRs that are never banned", true},
+	{"allowPorts", "ALLOW_PORTS", "Comma-separated ports that are never inspected", true},
+	{"enforcementBackend", "ENFORCEMENT_BACKEND", "Ban enforcement: xdp, nftables, ipset or none", false},
+	{"enforcementTeardown", "ENFORCEMENT_TEARDOWN", "Remove the nftables table or ipsets on exit, lifting their bans", false},
+	{"xdpMode", "XDP_MODE", "XDP mode: generic, native, offload or auto", false},
+	{"cleanupInterval", "XDP_CLEANUP_INTERVAL", "Interval in seconds between removals of expired bans", false},
+	{"xdpPinPath", "XDP_PIN_PATH", "bpffs directory for pinned XDP maps (empty = no pinning)", false},
+	{"xdpKeepAttached", "XDP_KEEP_ATTACHED", "Leave the XDP program attached on exit", false},
+	{"subnetBanThreshold", "SUBNET_BAN_THRESHOLD", "Ban a whole prefix once more than this many of its addresses are banned (0 = disabled, XDP only)", true},
+	{"subnetBanWindow", "SUBNET_BAN_WINDOW", "Window in seconds for subnet ban aggregation", true},
+	{"subnetBanPrefix4", "SUBNET_BAN_PREFIX4", "IPv4 prefix length for subnet ban aggregation", true},
+	{"subnetBanPrefix6", "SUBNET_BAN_PREFIX6", "IPv6 prefix length for subnet ban aggregation", true},
+	{"flowTableSize", "FLOW_TABLE_SIZE", "Maximum tracked flows (0 = per-packet analysis only)", false},
+	{"flowTimeout", "FLOW_TIMEOUT", "Flow idle timeout in seconds", false},
+	{"flowInspectBytes", "FLOW_INSPECT_BYTES", "Payload bytes reassembled per flow direction", true},
+	{"flowMaxPackets", "FLOW_MAX_PACKETS", "Packets inspected before a flow is considered clean", true},
+}
+
+// mergeLiveConfig applies the live settings of next to current
+// It returns the merged configuration and the keys of settings that differ
+// but can only change with a restart (those keep their current values).
+func mergeLiveConfig(current, next Config) (merged Config, restart []string) {
+	merged = current
+	for _, f := range configFields {
+		from, _ := configValue(&next, f.key)
+		to, _ := configValue(&merged, f.key)
+		if reflect.DeepEqual(from.Interface(), to.Interface()) {
+			continue
+		}
+		if f.live {
+			to.Set(from)
+		} else {
+			restart = append(restart, f.key)
+		}
+	}
+	return merged, restart
+}
+
+// flagName converts a file key to its command-line flag name (queueMaxLen -> queue-max-len)
+func flagName(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('-')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// configValue returns the settable Config field for a file key
+func configValue(config *Config, key string) (reflect.Value, bool) {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("json") == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// setConfigString parses a textual value (from the environment, a flag or a
+// flat configuration file) into the field for key
+func setConfigString(config *Config, key, value string) error {
+	// Queue ranges are accepted wherever a queue number is given as text
+	if key == "queueNum" && strings.Contains(value, "-") {
+		first, count, err := ParseQueueRange(value)
+		if err != nil {
+			return err
+		}
+		config.QueueNum, config.QueueCount = first, count
+		return nil
+	}
+
+	field, ok := configValue(config, key)
+	if !ok {
+		return fmt.Errorf("unknown configuration key %q", key)
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: must be an integer", value, key)
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: must be true or false", value, key)
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		items := splitList(value)
+		if field.Type().Elem().Kind() == reflect.String {
+			field.Set(reflect.ValueOf(items))
+			break
+		}
+		ints := make([]int, len(items))
+		for i, item := range items {
+			n, err := strconv.Atoi(item)
+			if err != nil {
+				return fmt.Errorf("invalid value %q for %s: must be a list of integers", value, key)
+			}
+			ints[i] = n
+		}
+		field.Set(reflect.ValueOf(ints))
+	default:
+		return fmt.Errorf("unsupported configuration field %s", key)
+	}
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty items
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// LoadConfigFile overlays the settings in a JSON, YAML, TOML or flat key/value file onto config
+// The format is chosen by extension: .json is decoded as JSON; .yaml, .yml,
+// .toml and .conf are read with parseFlatConfig, which covers the flat subset
+// of YAML and TOML that the configuration needs (top-level keys, scalars and
+// one-line lists). Unknown keys and mistyped values are errors.
+func LoadConfigFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(config); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	case ".yaml", ".yml", ".toml", ".conf":
+		values, err := parseFlatConfig(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for _, kv := range values {
+			if err := setConfigString(config, kv.key, kv.value); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, kv.line, err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported config file format %q (want .json, .yaml, .yml, .toml or .conf)", ext)
+	}
+}
+
+// flatValue is one key/value pair from a flat configuration file
+type flatValue struct {
+	key, value string
+	line       int
+}
+
+// parseFlatConfig parses the flat key/value configuration format
+// One "key = value" (TOML) or "key: value" (YAML) per line; # starts a comment
+// and a YAML "---" document marker is skipped. Values may be quoted, lists are
+// written as [a, b] or a, b on one line. Sections, tables, block lists and
+// nesting are rejected. Lists are returned comma-joined, the form
+// setConfigString expects.
+func parseFlatConfig(data []byte) ([]flatValue, error) {
+	var values []flatValue
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		switch {
+		case line == "" || line == "---":
+			continue
+		case strings.HasPrefix(line, "["):
+			return nil, fmt.Errorf("line %d: sections are not supported, keys must be top-level", lineNum)
+		case strings.HasPrefix(line, "- "):
+			return nil, fmt.Errorf("line %d: block lists are not supported, write lists on one line as [a, b]", lineNum)
+		}
+
+		// Keys never contain a separator, values may (e.g. "127.0.0.1:9100")
+		sep := strings.IndexAny(line, "=:")
+		if sep < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNum)
+		}
+		key, value := strings.TrimSpace(line[:sep]), strings.TrimSpace(line[sep+1:])
+		if strings.HasPrefix(value, "[") {
+			if !strings.HasSuffix(value, "]") {
+				return nil, fmt.Errorf("line %d: lists must be written on one line", lineNum)
+			}
+			items := strings.Split(value[1:len(value)-1], ",")
+			for i, item := range items {
+				items[i] = unquote(strings.TrimSpace(item))
+			}
+			value = strings.Join(items, ",")
+		} else {
+			value = unquote(value)
+		}
+		values = append(values, flatValue{key: key, value: value, line: lineNum})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// stripComment removes a trailing # comment that is not inside quotes
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// unquote removes matching single or double quotes around a value
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		if s[0] == '"' {
+			if u, err := strconv.Unquote(s); err == nil {
+				return u
+			}
+		}
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// ApplyEnv overlays settings from environment variables onto config
+// lookup is usually os.LookupEnv. Empty variables are ignored, except for
+// string settings where an empty value clears the setting (e.g. XDP_PIN_PATH=).
+func ApplyEnv(config *Config, lookup func(string) (string, bool)) error {
+	for _, f := range configFields {
+		value, ok := lookup(f.env)
+		if !ok {
+			continue
+		}
+		if field, _ := configValue(config, f.key); value == "" && field.Kind() != reflect.String {
+			continue
+		}
+		if err := setConfigString(config, f.key, value); err != nil {
+			return fmt.Errorf("%s: %w", f.env, err)
+		}
+	}
+	return nil
+}
+
+// ConfigFlags registers a command-line flag for every Config field plus --config
+type ConfigFlags struct {
+	path string
+	set  []flatValue // Flags given on the command line, in order
+}
+
+// NewConfigFlags registers the configuration flags on fs
+func NewConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	cf := &ConfigFlags{}
+	fs.StringVar(&cf.path, "config", "", "Configuration file: JSON (.json), YAML (.yaml, .yml), TOML (.toml) or flat key = value lines (.conf)")
+
+	defaults := DefaultConfig()
+	for _, f := range configFields {
+		key := f.key
+		field, _ := configValue(&defaults, key)
+		help := fmt.Sprintf("%s (env %s)", f.help, f.env)
+		record := func(value string) error {
+			cf.set = append(cf.set, flatValue{key: key, value: value})
+			return nil
+		}
+		if field.Kind() == reflect.Bool {
+			fs.BoolFunc(flagName(key), help, record)
+		} else {
+			fs.Func(flagName(key), help, record)
+		}
+	}
+	return cf
+}
+
+// Load builds the effective configuration
+// Precedence, highest first: command-line flags, environment variables,
+// the --config file, DefaultConfig. The result is validated.
+func (cf *ConfigFlags) Load(lookupEnv func(string) (string, bool)) (Config, error) {
+	config := DefaultConfig()
+	if cf.path != "" {
+		if err := LoadConfigFile(cf.path, &config); err != nil {
+			return config, err
+		}
+	}
+	if err := ApplyEnv(&config, lookupEnv); err != nil {
+		return config, err
+	}
+	for _, kv := range cf.set {
+		if err := setConfigString(&config, kv.key, kv.value); err != nil {
+			return config, fmt.Errorf("--%s: %w", flagName(kv.key), err)
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,243 @@
+package blocker
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile writes a config file with the given name into a temp dir
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// envMap returns a lookup function over a fixed environment
+func envMap(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+func TestConfigFieldsCoverConfig(t *testing.T) {
+	known := make(map[string]bool)
+	for _, f := range configFields {
+		known[f.key] = true
+	}
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		key := typ.Field(i).Tag.Get("json")
+		if key == "" || !known[key] {
+			t.Errorf("Config.%s (key %q) has no entry in configFields", typ.Field(i).Name, key)
+		}
+		delete(known, key)
+	}
+	for key := range known {
+		t.Errorf("configFields entry %q does not match a Config field", key)
+	}
+}
+
+func TestFlagName(t *testing.T) {
+	tests := map[string]string{
+		"interfaces":      "interfaces",
+		"queueMaxLen":     "queue-max-len",
+		"banDbPath":       "ban-db-path",
+		"xdpKeepAttached": "xdp-keep-attached",
+	}
+	for key, want := range tests {
+		if got := flagName(key); got != want {
+			t.Errorf("flagName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestLoadConfigFile_Formats(t *testing.T) {
+	want := DefaultConfig()
+	want.Interfaces = []string{"eth0", "wg0"}
+	want.QueueNum, want.QueueCount = 2, 4
+	want.MonitorOnly = true
+	want.MetricsAddr = "127.0.0.1:9100"
+
+	files := map[string]string{
+		"config.json": `{"interfaces": ["eth0", "wg0"], "queueNum": 2, "queueCount": 4,
+			"monitorOnly": true, "metricsAddr": "127.0.0.1:9100"}`,
+		"btblocker.conf": `# btblocker
+interfaces = ["eth0", "wg0"]
+queueNum = 2
+queueCount = 4
+monitorOnly = true
+metricsAddr = "127.0.0.1:9100" # scrape me
+`,
+		"colons.conf": `interfaces: eth0, wg0
+queueNum: "2-5"
+monitorOnly: true  # log only
+metricsAddr: 127.0.0.1:9100
+`,
+		"config.yaml": `---
+# btblocker
+interfaces: [eth0, wg0]
+queueNum: "2-5"
+monitorOnly: true
+metricsAddr: "127.0.0.1:9100"
+`,
+		"config.yml": `interfaces: ["eth0", "wg0"]
+queueNum: 2-5
+monitorOnly: true
+metricsAddr: 127.0.0.1:9100
+`,
+		"config.toml": `# btblocker
+interfaces = ["eth0", "wg0"]
+queueNum = "2-5"
+monitorOnly = true
+metricsAddr = "127.0.0.1:9100"
+`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			config := DefaultConfig()
+			if err := LoadConfigFile(writeConfigFile(t, name, content), &config); err != nil {
+				t.Fatalf("LoadConfigFile() failed: %v", err)
+			}
+			if !reflect.DeepEqual(config, want) {
+				t.Errorf("LoadConfigFile() = %+v, want %+v", config, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile_Errors(t *testing.T) {
+	tests := []struct {
+		name, file, content, wantErr string
+	}{
+		{"JSON unknown key", "c.json", `{"queueNumber": 1}`, "unknown field"},
+		{"JSON wrong type", "c.json", `{"queueNum": "1"}`, "cannot unmarshal"},
+		{"Flat unknown key", "c.conf", "banTime = 5\n", `unknown configuration key "banTime"`},
+		{"Flat bad bool", "c.conf", "monitorOnly: maybe\n", "must be true or false"},
+		{"Flat bad int", "c.conf", "banDuration = \"5h\"\n", "must be an integer"},
+		{"Flat section", "c.conf", "[xdp]\nmode = \"native\"\n", "sections are not supported"},
+		{"Flat nested list", "c.conf", "interfaces:\n  - eth0\n", "block lists are not supported"},
+		{"YAML unknown key", "c.yaml", "banTime: 5\n", `unknown configuration key "banTime"`},
+		{"YAML block list", "c.yaml", "interfaces:\n  - eth0\n", "block lists are not supported"},
+		{"YAML nesting", "c.yml", "xdp:\n  mode: native\n", `unknown configuration key "xdp"`},
+		{"TOML table", "c.toml", "[xdp]\nmode = \"native\"\n", "sections are not supported"},
+		{"TOML bad int", "c.toml", "banDuration = \"5h\"\n", "must be an integer"},
+		{"Unknown format", "c.ini", "queueNum=1\n", "unsupported config file format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			err := LoadConfigFile(writeConfigFile(t, tt.file, tt.content), &config)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfigFile() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	config := DefaultConfig()
+	err := ApplyEnv(&config, envMap(map[string]string{
+		"QUEUE_NUM":    "0-7",
+		"INTERFACE":    "eth0, wg0,",
+		"MONITOR_ONLY": "1",
+		"BAN_DURATION": "", // Ignored
+		"XDP_PIN_PATH": "", // Clears the setting
+		"ALLOW_PORTS":  "22, 443",
+	}))
+	if err != nil {
+		t.Fatalf("ApplyEnv() failed: %v", err)
+	}
+	if config.QueueNum != 0 || config.QueueCount != 8 {
+		t.Errorf("QUEUE_NUM range: got %d+%d, want 0+8", config.QueueNum, config.QueueCount)
+	}
+	if !reflect.DeepEqual(config.Interfaces, []string{"eth0", "wg0"}) {
+		t.Errorf("Interfaces = %v", config.Interfaces)
+	}
+	if !reflect.DeepEqual(config.AllowPorts, []int{22, 443}) {
+		t.Errorf("AllowPorts = %v", config.AllowPorts)
+	}
+	if !config.MonitorOnly || config.BanDuration != 18000 || config.XDPPinPath != "" {
+		t.Errorf("Unexpected config: %+v", config)
+	}
+
+	if err := ApplyEnv(&config, envMap(map[string]string{"QUEUE_MAXLEN": "lots"})); err == nil ||
+		!strings.Contains(err.Error(), "QUEUE_MAXLEN") {
+		t.Errorf("ApplyEnv() with a bad value: error = %v, want it to name QUEUE_MAXLEN", err)
+	}
+}
+
+func TestConfigFlags_Precedence(t *testing.T) {
+	path := writeConfigFile(t, "btblocker.conf", `banDuration = 100
+logLevel = "debug"
+metricsAddr = ":9100"
+flowTimeout = 30
+`)
+	env := envMap(map[string]string{
+		"BAN_DURATION": "200",
+		"LOG_LEVEL":    "warn",
+		"METRICS_ADDR": ":9200",
+	})
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cf := NewConfigFlags(fs)
+	if err := fs.Parse([]string{"--config", path, "--ban-duration", "300", "--monitor-only"}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := cf.Load(env)
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	if config.BanDuration != 300 {
+		t.Errorf("BanDuration = %d, want 300 (flag beats env and file)", config.BanDuration)
+	}
+	if config.LogLevel != "warn" || config.MetricsAddr != ":9200" {
+		t.Errorf("LogLevel, MetricsAddr = %q, %q; want env values", config.LogLevel, config.MetricsAddr)
+	}
+	if config.FlowTimeout != 30 {
+		t.Errorf("FlowTimeout = %d, want 30 (file beats default)", config.FlowTimeout)
+	}
+	if !config.MonitorOnly || config.QueueMaxLen != 1024 {
+		t.Errorf("MonitorOnly, QueueMaxLen = %v, %d", config.MonitorOnly, config.QueueMaxLen)
+	}
+}
+
+func TestConfigFlags_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{"Queue out of range", []string{"--queue-num", "70000"}, nil},
+		{"Bad log level", nil, map[string]string{"LOG_LEVEL": "verbose"}},
+		{"Bad backend", []string{"--enforcement-backend", "pf"}, nil},
+		{"Bad XDP mode", []string{"--xdp-mode", "turbo"}, nil},
+		{"Bad flag value", []string{"--flow-table-size", "many"}, nil},
+		{"Bad interface", nil, map[string]string{"INTERFACE": "eth0, wg/0"}},
+		{"Bad allowlist", []string{"--allowlist", "10.0.0.0/8,partner"}, nil},
+		{"Bad allow port", nil, map[string]string{"ALLOW_PORTS": "ssh"}},
+		{"Negative subnet ban threshold", []string{"--subnet-ban-threshold", "-1"}, nil},
+		{"Bad subnet ban prefix", []string{"--subnet-ban-threshold", "8"}, map[string]string{"SUBNET_BAN_PREFIX4": "33"}},
+		{"Zero subnet ban window", nil, map[string]string{"SUBNET_BAN_THRESHOLD": "8", "SUBNET_BAN_WINDOW": "0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			cf := NewConfigFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cf.Load(envMap(tt.env)); err == nil {
+				t.Error("Load() should fail")
+			}
+		})
+	}
+}
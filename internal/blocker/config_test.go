@@ -13,13 +13,25 @@ func TestDefaultConfig(t *testing.T) {
 		expected interface{}
 	}{
 		{"QueueNum", config.QueueNum, 0},
+		{"QueueCount", config.QueueCount, 1},
+		{"QueueMaxLen", config.QueueMaxLen, 1024},
+		{"QueueBypass", config.QueueBypass, false},
 		{"Interfaces", len(config.Interfaces) == 1 && config.Interfaces[0] == "eth0", true},
 		{"BanDuration", config.BanDuration, 18000},
 		{"LogLevel", config.LogLevel, "info"},
 		{"DetectionLogPath", config.DetectionLogPath, ""},
+		{"BanDBPath", config.BanDBPath, ""},
 		{"MonitorOnly", config.MonitorOnly, false},
+		{"MetricsAddr", config.MetricsAddr, ""},
+		{"EnforcementBackend", config.EnforcementBackend, "xdp"},
 		{"XDPMode", config.XDPMode, "generic"},
 		{"CleanupInterval", config.CleanupInterval, 300},
+		{"XDPPinPath", config.XDPPinPath, "/sys/fs/bpf/btblocker"},
+		{"XDPKeepAttached", config.XDPKeepAttached, false},
+		{"FlowTableSize", config.FlowTableSize, 65536},
+		{"FlowTimeout", config.FlowTimeout, 120},
+		{"FlowInspectBytes", config.FlowInspectBytes, 2048},
+		{"FlowMaxPackets", config.FlowMaxPackets, 16},
 	}
 
 	for _, tt := range tests {
@@ -146,3 +158,37 @@ func TestConfigInAnalyzer(t *testing.T) {
 		t.Errorf("Config test: should not block non-BitTorrent data, got reason: %s", result.Reason)
 	}
 }
+
+func TestParseQueueRange(t *testing.T) {
+	tests := []struct {
+		input     string
+		wantFirst int
+		wantCount int
+		wantErr   bool
+	}{
+		{"0", 0, 1, false},
+		{"5", 5, 1, false},
+		{"0-7", 0, 8, false},
+		{" 10 - 13 ", 10, 4, false},
+		{"65535", 65535, 1, false},
+		{"3-3", 3, 1, false},
+		{"", 0, 0, true},
+		{"abc", 0, 0, true},
+		{"7-0", 0, 0, true},
+		{"0-65536", 0, 0, true},
+		{"-1", 0, 0, true},
+		{"1-", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			first, count, err := ParseQueueRange(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseQueueRange(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if err == nil && (first != tt.wantFirst || count != tt.wantCount) {
+				t.Errorf("ParseQueueRange(%q) = (%d, %d), want (%d, %d)", tt.input, first, count, tt.wantFirst, tt.wantCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package blocker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DefaultControlSocket is the default path of the control socket
+const DefaultControlSocket = "/run/btblocker/control.sock"
+
+// controlTimeout bounds how long one control request may take to arrive and be answered
+const controlTimeout = 30 * time.Second
+
+// Control socket operations
+const (
+	ControlList   = "list"   // List all bans
+	ControlShow   = "show"   // Show the ban of one IP
+	ControlBan    = "ban"    // Ban an IP manually
+	ControlUnban  = "unban"  // Lift the ban of an IP
+	ControlFlush  = "flush"  // Lift all bans
+	ControlReload = "reload" // Re-read and apply the configuration, like SIGHUP
+)
+
+// ErrNotBanned is returned when a control operation targets an IP that is not banned
+var ErrNotBanned = errors.New("not banned")
+
+// ControlRequest is one request on the control socket (one JSON object per request)
+type ControlRequest struct {
+	Op       string `json:"op"`
+	IP       string `json:"ip,omitempty"`
+	Duration string `json:"duration,omitempty"` // Go duration for "ban", e.g. "2h" (empty = configured ban duration)
+	Reason   string `json:"reason,omitempty"`   // Reason recorded for "ban" (empty = "manual")
+}
+
+// ControlResponse is the answer to a ControlRequest
+type ControlResponse struct {
+	OK      bool      `json:"ok"`
+	Error   string    `json:"error,omitempty"`
+	Bans    []BanInfo `json:"bans,omitempty"`
+	Removed int       `json:"removed,omitempty"` // Bans lifted by "unban" or "flush"
+	Restart []string  `json:"restart,omitempty"` // Changed keys "reload" did not apply because they need a restart
+}
+
+// BanInfo describes one active ban, merged from the enforcement backend and the ban journal
+type BanInfo struct {
+	IP            string    `json:"ip"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	Reason        string    `json:"reason,omitempty"`
+	FirstDetected time.Time `json:"first_detected,omitzero"`
+	Hits          int       `json:"hits,omitempty"`
+
+	// Escalating bans (zero unless the ban ladder is configured)
+	Strikes  int `json:"strikes,omitempty"`   // Strikes that still count
+	NextTier int `json:"next_tier,omitempty"` // Ladder step (1-based) the next detection would reach
+	NextBan  int `json:"next_ban,omitempty"`  // Seconds the next detection would ban for
+
+	// XDP drop statistics (zero with other backends)
+	DroppedPackets uint64    `json:"dropped_packets,omitempty"`
+	DroppedBytes   uint64    `json:"dropped_bytes,omitempty"`
+	LastSeen       time.Time `json:"last_seen,omitzero"`
+}
+
+// Bans returns all active bans, ordered by expiry
+func (b *Blocker) Bans() ([]BanInfo, error) {
+	now := time.Now()
+	esc := b.live.Load().escalation
+	bans := make(map[string]*BanInfo)
+
+	if b.enforcer != nil {
+		list, err := b.enforcer.List()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s bans: %w", b.enforcer.Name(), err)
+		}
+		for _, ban := range list {
+			bans[ban.IP.String()] = &BanInfo{IP: ban.IP.String(), ExpiresAt: ban.ExpiresAt}
+		}
+	}
+	if b.bans != nil {
+		for _, rec := range b.bans.Active(now) {
+			info, ok := bans[rec.IP]
+			if !ok {
+				info = &BanInfo{IP: rec.IP, ExpiresAt: rec.ExpiresAt}
+				bans[rec.IP] = info
+			}
+			info.Reason = rec.Reason
+			info.FirstDetected = rec.FirstDetected
+			info.Hits = rec.Hits
+		}
+	}
+	if b.xdpFilter != nil {
+		for _, blocked := range b.xdpFilter.GetMapManager().GetAllBlockedIPs() {
+			if info, ok := bans[blocked.IP.String()]; ok {
+				info.DroppedPackets = blocked.DroppedPackets
+				info.DroppedBytes = blocked.DroppedBytes
+				info.LastSeen = blocked.LastSeen
+			}
+		}
+	}
+
+	result := make([]BanInfo, 0, len(bans))
+	for _, info := range bans {
+		if esc.enabled() {
+			info.Strikes = b.strikes.get(info.IP, now, esc)
+			info.NextTier = esc.tier(info.Strikes + 1)
+			info.NextBan = int(esc.duration(info.Strikes+1) / time.Second)
+		}
+		if info.ExpiresAt.After(now) {
+			result = append(result, *info)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].ExpiresAt.Equal(result[j].ExpiresAt) {
+			return result[i].ExpiresAt.Before(result[j].ExpiresAt)
+		}
+		return result[i].IP < result[j].IP
+	})
+	return result, nil
+}
+
+// BanInfo returns the active ban of ip, or ErrNotBanned
+func (b *Blocker) BanInfo(ip net.IP) (BanInfo, error) {
+	bans, err := b.Bans()
+	if err != nil {
+		return BanInfo{}, err
+	}
+	for _, info := range bans {
+		if info.IP == ip.String() {
+			return info, nil
+		}
+	}
+	return BanInfo{}, fmt.Errorf("%s: %w", ip, ErrNotBanned)
+}
+
+// Ban bans ip manually, independent of monitor-only mode
+// A zero duration uses the configured ban duration; an empty reason is recorded as "manual".
+func (b *Blocker) Ban(ip net.IP, duration time.Duration, reason string) (BanInfo, error) {
+	live := b.live.Load()
+	if live.allow.ContainsIP(ip) {
+		return BanInfo{}, fmt.Errorf("refusing to ban allowlisted %s", ip)
+	}
+	if b.enforcer == nil && b.bans == nil {
+		return BanInfo{}, fmt.Errorf("no enforcement backend or ban database to hold the ban")
+	}
+	if duration < 0 {
+		return BanInfo{}, fmt.Errorf("invalid ban duration %v", duration)
+	}
+	if duration == 0 {
+		duration = time.Duration(live.config.BanDuration) * time.Second
+	}
+	if reason == "" {
+		reason = "manual"
+	}
+
+	if b.enforcer != nil {
+		if err := b.enforcer.Ban(ip, duration); err != nil {
+			return BanInfo{}, fmt.Errorf("failed to ban %s via %s: %w", ip, b.enforcer.Name(), err)
+		}
+	}
+	now := time.Now()
+	hits := 0
+	if b.bans != nil {
+		if rec, err := b.bans.Record(ip, reason, now, now.Add(duration)); err != nil {
+			b.logger.Error("Failed to persist ban", "ip", ip, "error", err)
+		} else {
+			hits = rec.Hits
+		}
+	}
+	b.logger.Info("Banned via control socket", "ip", ip, "duration", duration, "reason", reason)
+	if b.events != nil {
+		b.events.ban(BanEvent{Time: now, IP: ip.String(), Reason: reason, ExpiresAt: now.Add(duration), Source: BanSourceControl, Hits: hits})
+	}
+
+	return b.BanInfo(ip)
+}
+
+// Unban lifts the ban of ip in the backend and the journal and forgets its flows,
+// strikes and evidence
+// Returns ErrNotBanned if ip had no ban.
+func (b *Blocker) Unban(ip net.IP) error {
+	found := false
+	if b.enforcer != nil {
+		list, err := b.enforcer.List()
+		if err != nil {
+			return fmt.Errorf("failed to list %s bans: %w", b.enforcer.Name(), err)
+		}
+		for _, ban := range list {
+			if !ban.IP.Equal(ip) {
+				continue
+			}
+			if err := b.enforcer.Unban(ip); err != nil {
+				return fmt.Errorf("failed to unban %s via %s: %w", ip, b.enforcer.Name(), err)
+			}
+			found = true
+		}
+	}
+	if b.bans != nil {
+		removed, err := b.bans.Remove(ip)
+		if err != nil {
+			b.logger.Error("Failed to remove ban from ban database", "ip", ip, "error", err)
+		}
+		found = found || removed
+	}
+	if !found {
+		return fmt.Errorf("%s: %w", ip, ErrNotBanned)
+	}
+	if b.flows != nil {
+		b.flows.Forget(ip)
+	}
+	b.strikes.forget(ip.String())
+	b.evidence.forget(ip.String())
+
+	b.logger.Info("Unbanned via control socket", "ip", ip)
+	if b.events != nil {
+		b.events.unban(ip, BanSourceControl)
+	}
+	if b.enforcer != nil && b.enforcer.IsBanned(ip) {
+		return fmt.Errorf("%s unbanned, but still covered by a subnet ban", ip)
+	}
+	return nil
+}
+
+// Flush lifts every ban, clears all strikes and evidence and returns how many IPs were unbanned
+// Subnet bans are kept.
+func (b *Blocker) Flush() (int, error) {
+	unbanned := make(map[string]net.IP)
+	var errs []error
+
+	if b.enforcer != nil {
+		list, err := b.enforcer.List()
+		if err != nil {
+			return 0, fmt.Errorf("failed to list %s bans: %w", b.enforcer.Name(), err)
+		}
+		for _, ban := range list {
+			if err := b.enforcer.Unban(ban.IP); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			unbanned[ban.IP.String()] = ban.IP
+		}
+	}
+	if b.bans != nil {
+		for _, rec := range b.bans.Active(time.Now()) {
+			unbanned[rec.IP] = net.ParseIP(rec.IP)
+		}
+		if _, err := b.bans.RemoveAll(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, ip := range unbanned {
+		if b.flows != nil {
+			b.flows.Forget(ip)
+		}
+		if b.events != nil {
+			b.events.unban(ip, BanSourceControl)
+		}
+	}
+
+	b.strikes.forgetAll()
+	b.evidence.forgetAll()
+
+	b.logger.Info("Flushed bans via control socket", "count", len(unbanned))
+	if len(errs) > 0 {
+		return len(unbanned), fmt.Errorf("failed to lift some bans: %v", errs)
+	}
+	return len(unbanned), nil
+}
+
+// control executes one control request
+func (b *Blocker) control(req ControlRequest) ControlResponse {
+	var ip net.IP
+	switch req.Op {
+	case ControlShow, ControlBan, ControlUnban:
+		if ip = net.ParseIP(req.IP); ip == nil {
+			return ControlResponse{Error: fmt.Sprintf("invalid IP address %q", req.IP)}
+		}
+	}
+
+	var resp ControlResponse
+	var err error
+	switch req.Op {
+	case ControlList:
+		resp.Bans, err = b.Bans()
+	case ControlShow:
+		var info BanInfo
+		if info, err = b.BanInfo(ip); err == nil {
+			resp.Bans = []BanInfo{info}
+		}
+	case ControlBan:
+		var duration time.Duration
+		if req.Duration != "" {
+			if duration, err = time.ParseDuration(req.Duration); err != nil || duration <= 0 {
+				return ControlResponse{Error: fmt.Sprintf("invalid duration %q", req.Duration)}
+			}
+		}
+		var info BanInfo
+		if info, err = b.Ban(ip, duration, req.Reason); err == nil {
+			resp.Bans = []BanInfo{info}
+		}
+	case ControlUnban:
+		if err = b.Unban(ip); err == nil {
+			resp.Removed = 1
+		}
+	case ControlFlush:
+		resp.Removed, err = b.Flush()
+	case ControlReload:
+		resp.Restart, err = b.ReloadConfig()
+	default:
+		return ControlResponse{Error: fmt.Sprintf("unknown operation %q", req.Op)}
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	resp.OK = true
+	return resp
+}
+
+// serveControl starts serving the control socket at path until ctx is canceled
+// The socket is created with mode 0660 and owned by group (if set), so only
+// root and members of that group can connect.
+func (b *Blocker) serveControl(ctx context.Context, path, group string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil { // #nosec G301 - access is restricted on the socket itself
+		return fmt.Errorf("failed to create control socket directory: %w", err)
+	}
+	// Remove a socket left behind by a previous run, but never another kind of file
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("control socket %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove stale control socket: %w", err)
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket %s: %w", path, err)
+	}
+	if err := restrictSocket(path, group); err != nil {
+		ln.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close() // Also removes the socket file
+	}()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					b.logger.Error("Control socket failed", "error", err)
+				}
+				return
+			}
+			go b.handleControl(conn)
+		}
+	}()
+
+	b.logger.Info("Control socket listening", "path", path)
+	return nil
+}
+
+// restrictSocket limits access to the control socket to its owner and group
+func restrictSocket(path, group string) error {
+	if err := os.Chmod(path, 0o660); err != nil {
+		return fmt.Errorf("failed to set control socket permissions: %w", err)
+	}
+	if group == "" {
+		return nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return fmt.Errorf("control socket group: %w", err)
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return fmt.Errorf("control socket group %s: invalid gid %q", group, g.Gid)
+	}
+	if err := os.Chown(path, -1, gid); err != nil {
+		return fmt.Errorf("failed to set control socket group: %w", err)
+	}
+	return nil
+}
+
+// handleControl answers the requests of one control connection until the client closes it
+func (b *Blocker) handleControl(conn net.Conn) {
+	defer conn.Close()
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+		var req ControlRequest
+		if err := dec.Decode(&req); err != nil {
+			if !errors.Is(err, io.EOF) {
+				_ = enc.Encode(ControlResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+			}
+			return
+		}
+		if err := enc.Encode(b.control(req)); err != nil {
+			return
+		}
+	}
+}
+
+// ControlCall sends one request to the control socket at path and returns the response
+// A response with OK unset is returned together with its error message as an error.
+func ControlCall(path string, req ControlRequest) (ControlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return ControlResponse{}, fmt.Errorf("failed to connect to control socket: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return ControlResponse{}, fmt.Errorf("failed to send control request: %w", err)
+	}
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return ControlResponse{}, fmt.Errorf("failed to read control response: %w", err)
+	}
+	if !resp.OK {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,200 @@
+package blocker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	nfqueue "github.com/florianl/go-nfqueue/v2"
+)
+
+func TestControl_BanManagement(t *testing.T) {
+	config := DefaultConfig()
+	config.BanDBPath = filepath.Join(t.TempDir(), "bans.jsonl")
+	config.Allowlist = []string{"192.0.2.0/24"}
+	b := newTestBlocker(t, config)
+	backend := &fakeBackend{banned: make(map[string]time.Duration)}
+	b.enforcer = backend
+
+	// Manual ban with a duration and reason
+	resp := b.control(ControlRequest{Op: ControlBan, IP: "198.51.100.7", Duration: "2h", Reason: "ticket 4711"})
+	if !resp.OK || len(resp.Bans) != 1 {
+		t.Fatalf("ban response = %+v", resp)
+	}
+	if ban := resp.Bans[0]; ban.Reason != "ticket 4711" || ban.Hits != 1 || time.Until(ban.ExpiresAt) < time.Hour {
+		t.Errorf("Manual ban = %+v", ban)
+	}
+	if backend.banned["198.51.100.7"] != 2*time.Hour {
+		t.Errorf("Backend ban duration = %v, want 2h", backend.banned["198.51.100.7"])
+	}
+
+	// Default duration and reason
+	if resp := b.control(ControlRequest{Op: ControlBan, IP: "198.51.100.8"}); !resp.OK || resp.Bans[0].Reason != "manual" {
+		t.Errorf("ban with defaults = %+v", resp)
+	}
+	if backend.banned["198.51.100.8"] != 5*time.Hour {
+		t.Errorf("Default ban duration = %v, want 5h", backend.banned["198.51.100.8"])
+	}
+
+	if resp := b.control(ControlRequest{Op: ControlList}); !resp.OK || len(resp.Bans) != 2 || resp.Bans[0].IP != "198.51.100.7" {
+		t.Errorf("list response = %+v, want 2 bans ordered by expiry", resp)
+	}
+	if resp := b.control(ControlRequest{Op: ControlShow, IP: "198.51.100.8"}); !resp.OK || resp.Bans[0].IP != "198.51.100.8" {
+		t.Errorf("show response = %+v", resp)
+	}
+
+	// Unban lifts the ban in the backend and the journal
+	if resp := b.control(ControlRequest{Op: ControlUnban, IP: "198.51.100.7"}); !resp.OK || resp.Removed != 1 {
+		t.Errorf("unban response = %+v", resp)
+	}
+	if backend.IsBanned(net.ParseIP("198.51.100.7")) || b.bans.IsBanned(net.ParseIP("198.51.100.7"), time.Now()) {
+		t.Error("Unbanned IP is still banned")
+	}
+	if err := b.Unban(net.ParseIP("198.51.100.7")); !errors.Is(err, ErrNotBanned) {
+		t.Errorf("Unban() of an unbanned IP: error = %v, want ErrNotBanned", err)
+	}
+	if resp := b.control(ControlRequest{Op: ControlShow, IP: "198.51.100.7"}); resp.OK || !strings.Contains(resp.Error, "not banned") {
+		t.Errorf("show of an unbanned IP = %+v", resp)
+	}
+
+	if resp := b.control(ControlRequest{Op: ControlFlush}); !resp.OK || resp.Removed != 1 {
+		t.Errorf("flush response = %+v, want 1 removed", resp)
+	}
+	if resp := b.control(ControlRequest{Op: ControlList}); !resp.OK || len(resp.Bans) != 0 {
+		t.Errorf("list after flush = %+v", resp)
+	}
+}
+
+func TestControl_InvalidRequests(t *testing.T) {
+	config := DefaultConfig()
+	config.Allowlist = []string{"192.0.2.0/24"}
+	b := newTestBlocker(t, config)
+	b.enforcer = &fakeBackend{banned: make(map[string]time.Duration)}
+
+	tests := []struct {
+		name string
+		req  ControlRequest
+	}{
+		{"Unknown op", ControlRequest{Op: "restart"}},
+		{"Missing IP", ControlRequest{Op: ControlShow}},
+		{"Bad IP", ControlRequest{Op: ControlBan, IP: "host.example"}},
+		{"Bad duration", ControlRequest{Op: ControlBan, IP: "198.51.100.1", Duration: "forever"}},
+		{"Negative duration", ControlRequest{Op: ControlBan, IP: "198.51.100.1", Duration: "-1h"}},
+		{"Allowlisted IP", ControlRequest{Op: ControlBan, IP: "192.0.2.10"}},
+		{"Unban unknown IP", ControlRequest{Op: ControlUnban, IP: "198.51.100.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := b.control(tt.req); resp.OK || resp.Error == "" {
+				t.Errorf("control(%+v) = %+v, want an error", tt.req, resp)
+			}
+		})
+	}
+}
+
+func TestControl_UnbanForgetsFlows(t *testing.T) {
+	b := newTestBlocker(t, DefaultConfig())
+	b.enforcer = &fakeBackend{banned: make(map[string]time.Duration)}
+
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, []byte("\x13BitTorrent protocol")), 0); v != nfqueue.NfDrop {
+		t.Fatalf("BitTorrent handshake verdict = %d, want NfDrop", v)
+	}
+	if err := b.Unban(net.ParseIP("10.0.0.3")); err != nil {
+		t.Fatalf("Unban() failed: %v", err)
+	}
+
+	// The flow classified as BitTorrent is forgotten, so its next clean packet passes
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, []byte("GET / HTTP/1.1\r\n\r\n")), 0); v != nfqueue.NfAccept {
+		t.Errorf("Verdict after unban = %d, want NfAccept", v)
+	}
+}
+
+func TestControl_Reload(t *testing.T) {
+	b := newTestBlocker(t, DefaultConfig())
+	if resp := b.control(ControlRequest{Op: ControlReload}); resp.OK {
+		t.Error("reload without a configuration source should fail")
+	}
+
+	next := b.Config()
+	next.BanDuration = 60
+	next.QueueMaxLen = 2048 // Needs a restart
+	b.SetConfigSource(func() (Config, error) { return next, nil })
+	resp := b.control(ControlRequest{Op: ControlReload})
+	if !resp.OK || !reflect.DeepEqual(resp.Restart, []string{"queueMaxLen"}) {
+		t.Errorf("reload = %+v, want OK with queueMaxLen needing a restart", resp)
+	}
+	if got := b.Config().BanDuration; got != 60 {
+		t.Errorf("BanDuration after reload = %d, want 60", got)
+	}
+
+	b.SetConfigSource(func() (Config, error) { return Config{}, errors.New("bad file") })
+	if resp := b.control(ControlRequest{Op: ControlReload}); resp.OK || !strings.Contains(resp.Error, "bad file") {
+		t.Errorf("reload of a bad configuration = %+v", resp)
+	}
+	if got := b.Config().BanDuration; got != 60 {
+		t.Errorf("BanDuration after a failed reload = %d, want 60", got)
+	}
+}
+
+func TestControl_Socket(t *testing.T) {
+	b := newTestBlocker(t, DefaultConfig())
+	b.enforcer = &fakeBackend{banned: make(map[string]time.Duration)}
+
+	path := filepath.Join(t.TempDir(), "run", "control.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := b.serveControl(ctx, path, ""); err != nil {
+		t.Fatalf("serveControl() failed: %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Control socket not created: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o660 {
+		t.Errorf("Control socket mode = %o, want 660", perm)
+	}
+
+	if _, err := ControlCall(path, ControlRequest{Op: ControlBan, IP: "2001:db8::5", Duration: "10m"}); err != nil {
+		t.Fatalf("ban via socket failed: %v", err)
+	}
+	resp, err := ControlCall(path, ControlRequest{Op: ControlList})
+	if err != nil || len(resp.Bans) != 1 || resp.Bans[0].IP != "2001:db8::5" {
+		t.Errorf("list via socket = %+v, %v", resp, err)
+	}
+	if _, err := ControlCall(path, ControlRequest{Op: ControlUnban, IP: "2001:db8::6"}); err == nil || !strings.Contains(err.Error(), "not banned") {
+		t.Errorf("unban of an unknown IP via socket: error = %v", err)
+	}
+
+	// Malformed requests get an error response
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("{not json\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := make([]byte, 256)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _ := conn.Read(buf)
+	if !strings.Contains(string(buf[:n]), `"ok":false`) {
+		t.Errorf("Response to a malformed request = %q", buf[:n])
+	}
+
+	// A stale socket is replaced, other files are not
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.serveControl(context.Background(), path, ""); err == nil {
+		t.Error("serveControl() should refuse to replace a regular file")
+	}
+}
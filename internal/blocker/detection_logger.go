@@ -1,105 +1,328 @@
 package blocker
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
 	"sync"
 	"time"
 )
 
+// Detection log formats
+const (
+	DetectionLogText = "text" // Human-readable block with hex and ASCII dumps
+	DetectionLogJSON = "json" // One JSON object per line
+)
+
+// Actions recorded for a detection
+const (
+	DetectionActionMonitor = "monitor" // Monitor-only mode, packet accepted
+	DetectionActionLog     = "log"     // Log-only detector, packet accepted
+	DetectionActionDrop    = "drop"    // Packet dropped, IP not banned
+	DetectionActionBan     = "ban"     // Packet dropped and IP banned
+)
+
+// DefaultDetectionLogPayloadBytes is the default number of payload bytes logged per detection
+const DefaultDetectionLogPayloadBytes = 512
+
+// DetectionLogOptions configures the detection log output
+type DetectionLogOptions struct {
+	Format          string // DetectionLogText or DetectionLogJSON
+	MaxPayloadBytes int    // Payload bytes logged per detection (0 = payload not logged)
+	PayloadEncoding string // "hex" or "base64" (JSON format only)
+	PcapPath        string // Also write the detected packets to this pcapng file (empty = disabled)
+	Rotation        LogRotation
+}
+
+// Detection is one detected packet as written to the detection log
+type Detection struct {
+	Timestamp time.Time
+	Interface string // Packet source, e.g. "nfq0"
+	Queue     uint16 // NFQUEUE the packet arrived on
+	Protocol  string // TCP or UDP
+	SrcIP     string
+	SrcPort   uint16
+	DstIP     string
+	DstPort   uint16
+	Reason    string
+	Action    string // One of the DetectionAction* constants
+	Payload   []byte // Application-layer payload (text and JSON formats)
+	Packet    []byte // Full IP packet (pcapng output)
+}
+
+// detectionRecord is the JSON-lines form of a Detection
+type detectionRecord struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Interface     string    `json:"interface"`
+	Protocol      string    `json:"protocol"`
+	SrcIP         string    `json:"src_ip"`
+	SrcPort       uint16    `json:"src_port"`
+	DstIP         string    `json:"dst_ip"`
+	DstPort       uint16    `json:"dst_port"`
+	Reason        string    `json:"reason"`
+	Action        string    `json:"action"`
+	PayloadLen    int       `json:"payload_len"`
+	PayloadHex    string    `json:"payload_hex,omitempty"`
+	PayloadBase64 string    `json:"payload_base64,omitempty"`
+	Truncated     bool      `json:"truncated,omitempty"`      // Payload cut to MaxPayloadBytes
+	QuotaExceeded bool      `json:"quota_exceeded,omitempty"` // Payload left out because the log is over its disk quota
+}
+
 // DetectionLogger logs detailed packet information for detected BitTorrent traffic
 // This helps analyze false positives and improve detection algorithms
 type DetectionLogger struct {
-	file   *os.File
+	file   *logFile // Text or JSON log, nil if disabled
+	pcap   *logFile // pcapng capture, nil if disabled
 	mu     sync.Mutex
 	active bool
+	opts   DetectionLogOptions
 }
 
-// NewDetectionLogger creates a new detection logger
+// NewDetectionLogger creates a new detection logger writing the text format
 // If logPath is empty, detection logging is disabled
 func NewDetectionLogger(logPath string) (*DetectionLogger, error) {
-	if logPath == "" {
-		return &DetectionLogger{active: false}, nil
+	return NewDetectionLoggerWithOptions(logPath, DetectionLogOptions{
+		Format:          DetectionLogText,
+		MaxPayloadBytes: DefaultDetectionLogPayloadBytes,
+		PayloadEncoding: "hex",
+	})
+}
+
+// NewDetectionLoggerWithOptions creates a new detection logger with the given output options
+// If both logPath and opts.PcapPath are empty, detection logging is disabled
+func NewDetectionLoggerWithOptions(logPath string, opts DetectionLogOptions) (*DetectionLogger, error) {
+	if err := validateDetectionLogOptions(opts); err != nil {
+		return nil, err
+	}
+	dl := &DetectionLogger{opts: opts}
+
+	if logPath != "" {
+		file, err := openLogFile(logPath, opts.Rotation, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open detection log file: %w", err)
+		}
+		dl.file = file
+	}
+	if opts.PcapPath != "" {
+		pcap, err := openLogFile(opts.PcapPath, opts.Rotation, pcapngHeader())
+		if err != nil {
+			if dl.file != nil {
+				_ = dl.file.Close()
+			}
+			return nil, fmt.Errorf("failed to open detection pcapng file: %w", err)
+		}
+		dl.pcap = pcap
 	}
 
-	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open detection log file: %w", err)
+	dl.active = dl.file != nil || dl.pcap != nil
+	return dl, nil
+}
+
+// detectionLogOptions returns the detection log options of config
+func detectionLogOptions(config Config) DetectionLogOptions {
+	const mb = 1 << 20
+	return DetectionLogOptions{
+		Format:          config.DetectionLogFormat,
+		MaxPayloadBytes: config.DetectionLogPayloadBytes,
+		PayloadEncoding: config.DetectionLogPayloadEncoding,
+		PcapPath:        config.DetectionPcapPath,
+		Rotation: LogRotation{
+			MaxSize:  int64(config.DetectionLogMaxSize) * mb,
+			MaxAge:   time.Duration(config.DetectionLogMaxAge) * time.Second,
+			MaxFiles: config.DetectionLogMaxFiles,
+			Compress: config.DetectionLogCompress,
+			Quota:    int64(config.DetectionLogQuota) * mb,
+		},
 	}
+}
 
-	return &DetectionLogger{
-		file:   file,
-		active: true,
-	}, nil
+// validateDetectionLogOptions checks the detection log options
+func validateDetectionLogOptions(opts DetectionLogOptions) error {
+	switch opts.Format {
+	case DetectionLogText, DetectionLogJSON:
+	default:
+		return fmt.Errorf("invalid detection log format: %q (must be %s or %s)", opts.Format, DetectionLogText, DetectionLogJSON)
+	}
+	if opts.MaxPayloadBytes < 0 || opts.MaxPayloadBytes > 65535 {
+		return fmt.Errorf("invalid detection log payload size: %d (must be 0-65535)", opts.MaxPayloadBytes)
+	}
+	switch opts.PayloadEncoding {
+	case "hex", "base64":
+	default:
+		return fmt.Errorf("invalid detection log payload encoding: %q (must be hex or base64)", opts.PayloadEncoding)
+	}
+	r := opts.Rotation
+	if r.MaxSize < 0 || r.MaxAge < 0 || r.MaxFiles < 0 || r.Quota < 0 {
+		return fmt.Errorf("invalid detection log rotation: size %d, age %v, files %d, quota %d (must be 0 or more)",
+			r.MaxSize, r.MaxAge, r.MaxFiles, r.Quota)
+	}
+	return nil
 }
 
 // LogDetection logs detailed information about a detected packet
-func (dl *DetectionLogger) LogDetection(
-	timestamp time.Time,
-	iface string,
-	protocol string,
-	srcIP string,
-	srcPort uint16,
-	dstIP string,
-	dstPort uint16,
-	reason string,
-	payload []byte,
-) {
+// Once the log is over its disk quota only metadata is logged, without payload;
+// a pcapng file over its quota receives no more packets.
+func (dl *DetectionLogger) LogDetection(d Detection) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
 	if !dl.active {
 		return
 	}
+	if dl.pcap != nil && len(d.Packet) > 0 && !dl.pcap.OverQuota() {
+		_, _ = dl.pcap.Write(pcapngPacket(d.Timestamp, d.Packet, detectionComments(d)...))
+	}
+	if dl.file == nil {
+		return
+	}
 
-	dl.mu.Lock()
-	defer dl.mu.Unlock()
-
-	// Limit payload to first 512 bytes to keep logs manageable
-	maxPayloadLen := 512
-	payloadToLog := payload
+	// Limit the payload to keep logs manageable
+	payloadToLog := d.Payload
 	truncated := false
-	if len(payload) > maxPayloadLen {
-		payloadToLog = payload[:maxPayloadLen]
+	if len(payloadToLog) > dl.opts.MaxPayloadBytes {
+		payloadToLog = payloadToLog[:dl.opts.MaxPayloadBytes]
 		truncated = true
 	}
+	overQuota := dl.file.OverQuota()
+	if overQuota {
+		payloadToLog, truncated = nil, false
+	}
 
-	// Write log entry
-	fmt.Fprintf(dl.file, "================================================================================\n")
-	fmt.Fprintf(dl.file, "Timestamp:    %s\n", timestamp.Format("2006-01-02 15:04:05.000"))
-	fmt.Fprintf(dl.file, "Interface:    %s\n", iface)
-	fmt.Fprintf(dl.file, "Protocol:     %s\n", protocol)
-	fmt.Fprintf(dl.file, "Source:       %s:%d\n", srcIP, srcPort)
-	fmt.Fprintf(dl.file, "Destination:  %s:%d\n", dstIP, dstPort)
-	fmt.Fprintf(dl.file, "Detection:    %s\n", reason)
-	fmt.Fprintf(dl.file, "Payload Size: %d bytes", len(payload))
-	if truncated {
-		fmt.Fprintf(dl.file, " (showing first %d bytes)\n", maxPayloadLen)
+	var entry bytes.Buffer
+	if dl.opts.Format == DetectionLogJSON {
+		dl.formatJSON(&entry, d, payloadToLog, truncated, overQuota)
 	} else {
-		fmt.Fprintf(dl.file, "\n")
+		dl.formatText(&entry, d, payloadToLog, truncated, overQuota)
+	}
+	// Written in one piece so an entry never straddles a rotation
+	_, _ = dl.file.Write(entry.Bytes())
+}
+
+// formatText formats one detection as a human-readable block
+func (dl *DetectionLogger) formatText(w *bytes.Buffer, d Detection, payload []byte, truncated, overQuota bool) {
+	fmt.Fprintf(w, "================================================================================\n")
+	fmt.Fprintf(w, "Timestamp:    %s\n", d.Timestamp.Format("2006-01-02 15:04:05.000"))
+	fmt.Fprintf(w, "Interface:    %s\n", d.Interface)
+	fmt.Fprintf(w, "Protocol:     %s\n", d.Protocol)
+	fmt.Fprintf(w, "Source:       %s:%d\n", d.SrcIP, d.SrcPort)
+	fmt.Fprintf(w, "Destination:  %s:%d\n", d.DstIP, d.DstPort)
+	fmt.Fprintf(w, "Detection:    %s\n", d.Reason)
+	if d.Action != "" {
+		fmt.Fprintf(w, "Action:       %s\n", d.Action)
+	}
+	fmt.Fprintf(w, "Payload Size: %d bytes", len(d.Payload))
+	switch {
+	case overQuota:
+		fmt.Fprintf(w, " (payload not logged, log quota exceeded)\n\n")
+		return
+	case dl.opts.MaxPayloadBytes == 0:
+		fmt.Fprintf(w, " (payload not logged)\n\n")
+		return
+	case truncated:
+		fmt.Fprintf(w, " (showing first %d bytes)\n", dl.opts.MaxPayloadBytes)
+	default:
+		fmt.Fprintf(w, "\n")
+	}
+	fmt.Fprintf(w, "\n")
+
+	// Hex dump
+	fmt.Fprintf(w, "Hex Dump:\n")
+	fmt.Fprintf(w, "%s\n", hexDump(payload))
+	fmt.Fprintf(w, "\n")
+
+	// ASCII representation (printable characters only)
+	fmt.Fprintf(w, "ASCII (printable only):\n")
+	fmt.Fprintf(w, "%s\n", asciiDump(payload))
+	fmt.Fprintf(w, "\n")
+}
+
+// formatJSON formats one detection as a single JSON line
+func (dl *DetectionLogger) formatJSON(w *bytes.Buffer, d Detection, payload []byte, truncated, overQuota bool) {
+	rec := detectionRecord{
+		Timestamp:     d.Timestamp,
+		Interface:     d.Interface,
+		Protocol:      d.Protocol,
+		SrcIP:         d.SrcIP,
+		SrcPort:       d.SrcPort,
+		DstIP:         d.DstIP,
+		DstPort:       d.DstPort,
+		Reason:        d.Reason,
+		Action:        d.Action,
+		PayloadLen:    len(d.Payload),
+		Truncated:     truncated,
+		QuotaExceeded: overQuota,
+	}
+	if len(payload) > 0 {
+		if dl.opts.PayloadEncoding == "base64" {
+			rec.PayloadBase64 = base64.StdEncoding.EncodeToString(payload)
+		} else {
+			rec.PayloadHex = hexEncode(payload)
+		}
+	}
+
+	// Encode appends the newline
+	_ = json.NewEncoder(w).Encode(rec)
+}
+
+// detectionComments returns the pcapng packet comments of a detection
+func detectionComments(d Detection) []string {
+	comments := []string{
+		"reason: " + d.Reason,
+		fmt.Sprintf("queue: %d", d.Queue),
 	}
-	fmt.Fprintf(dl.file, "\n")
+	switch d.Action {
+	case "":
+	case DetectionActionMonitor, DetectionActionLog:
+		comments = append(comments, "verdict: accept", "action: "+d.Action)
+	default:
+		comments = append(comments, "verdict: drop", "action: "+d.Action)
+	}
+	return comments
+}
 
-	// Write hex dump
-	fmt.Fprintf(dl.file, "Hex Dump:\n")
-	fmt.Fprintf(dl.file, "%s\n", hexDump(payloadToLog))
-	fmt.Fprintf(dl.file, "\n")
+// Reopen closes and reopens the log files, after they were moved by an external logrotate
+func (dl *DetectionLogger) Reopen() error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
 
-	// Write ASCII representation (printable characters only)
-	fmt.Fprintf(dl.file, "ASCII (printable only):\n")
-	fmt.Fprintf(dl.file, "%s\n", asciiDump(payloadToLog))
-	fmt.Fprintf(dl.file, "\n")
+	if dl.file != nil {
+		if err := dl.file.Reopen(); err != nil {
+			return fmt.Errorf("failed to reopen detection log file: %w", err)
+		}
+	}
+	if dl.pcap != nil {
+		if err := dl.pcap.Reopen(); err != nil {
+			return fmt.Errorf("failed to reopen detection pcapng file: %w", err)
+		}
+	}
+	return nil
 }
 
 // Close closes the detection log file
+// Safe to call while other goroutines are still logging
 func (dl *DetectionLogger) Close() error {
-	if !dl.active || dl.file == nil {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if !dl.active {
 		return nil
 	}
 
-	// Close the file and set it to nil to prevent double-close
-	err := dl.file.Close()
-	dl.file = nil
+	// Close the files and set them to nil to prevent double-close
+	var errs []error
+	if dl.file != nil {
+		errs = append(errs, dl.file.Close())
+		dl.file = nil
+	}
+	if dl.pcap != nil {
+		errs = append(errs, dl.pcap.Close())
+		dl.pcap = nil
+	}
 	dl.active = false
-	return err
+	return errors.Join(errs...)
 }
 
 // hexDump creates a formatted hex dump similar to hexdump -C
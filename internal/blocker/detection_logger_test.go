@@ -1,7 +1,9 @@
 package blocker
 
 import (
+	"encoding/json"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -77,17 +79,17 @@ func TestDetectionLogger_LogDetection(t *testing.T) {
 	timestamp := time.Date(2024, 1, 15, 18, 46, 57, 123000000, time.UTC)
 
 	// Log detection
-	logger.LogDetection(
-		timestamp,
-		"eth0",
-		"TCP",
-		"192.168.1.100",
-		51234,
-		"8.8.8.8",
-		6881,
-		"UDP Tracker Protocol",
-		payload,
-	)
+	logger.LogDetection(Detection{
+		Timestamp: timestamp,
+		Interface: "eth0",
+		Protocol:  "TCP",
+		SrcIP:     "192.168.1.100",
+		SrcPort:   51234,
+		DstIP:     "8.8.8.8",
+		DstPort:   6881,
+		Reason:    "UDP Tracker Protocol",
+		Payload:   payload,
+	})
 
 	// Read log file
 	content, err := os.ReadFile(logPath)
@@ -144,17 +146,17 @@ func TestDetectionLogger_LogDetection_LargePayload(t *testing.T) {
 	timestamp := time.Now()
 
 	// Log detection
-	logger.LogDetection(
-		timestamp,
-		"eth0",
-		"UDP",
-		"192.168.1.100",
-		12345,
-		"10.0.0.1",
-		6881,
-		"Test Detection",
-		payload,
-	)
+	logger.LogDetection(Detection{
+		Timestamp: timestamp,
+		Interface: "eth0",
+		Protocol:  "UDP",
+		SrcIP:     "192.168.1.100",
+		SrcPort:   12345,
+		DstIP:     "10.0.0.1",
+		DstPort:   6881,
+		Reason:    "Test Detection",
+		Payload:   payload,
+	})
 
 	// Read log file
 	content, err := os.ReadFile(logPath)
@@ -190,17 +192,17 @@ func TestDetectionLogger_Disabled(t *testing.T) {
 	}
 
 	// Call LogDetection - should not panic
-	logger.LogDetection(
-		time.Now(),
-		"eth0",
-		"TCP",
-		"192.168.1.1",
-		1234,
-		"8.8.8.8",
-		80,
-		"Test",
-		[]byte("test"),
-	)
+	logger.LogDetection(Detection{
+		Timestamp: time.Now(),
+		Interface: "eth0",
+		Protocol:  "TCP",
+		SrcIP:     "192.168.1.1",
+		SrcPort:   1234,
+		DstIP:     "8.8.8.8",
+		DstPort:   80,
+		Reason:    "Test",
+		Payload:   []byte("test"),
+	})
 
 	// No file should be created
 	if logger.file != nil {
@@ -375,17 +377,17 @@ func TestDetectionLogger_ConcurrentWrites(t *testing.T) {
 	done := make(chan bool)
 	for i := 0; i < 10; i++ {
 		go func(id int) {
-			logger.LogDetection(
-				time.Now(),
-				"eth0",
-				"TCP",
-				"192.168.1.100",
-				uint16(1000+id),
-				"8.8.8.8",
-				6881,
-				"Test Detection",
-				[]byte("test payload"),
-			)
+			logger.LogDetection(Detection{
+				Timestamp: time.Now(),
+				Interface: "eth0",
+				Protocol:  "TCP",
+				SrcIP:     "192.168.1.100",
+				SrcPort:   uint16(1000 + id),
+				DstIP:     "8.8.8.8",
+				DstPort:   6881,
+				Reason:    "Test Detection",
+				Payload:   []byte("test payload"),
+			})
 			done <- true
 		}(i)
 	}
@@ -440,3 +442,172 @@ func TestHexEncode(t *testing.T) {
 		})
 	}
 }
+
+func TestDetectionLogger_JSON(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "detections.jsonl")
+
+	logger, err := NewDetectionLoggerWithOptions(logPath, DetectionLogOptions{
+		Format:          DetectionLogJSON,
+		MaxPayloadBytes: 4,
+		PayloadEncoding: "hex",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	timestamp := time.Date(2024, 1, 15, 18, 46, 57, 123000000, time.UTC)
+	logger.LogDetection(Detection{
+		Timestamp: timestamp,
+		Interface: "nfq0",
+		Protocol:  "UDP",
+		SrcIP:     "192.168.1.100",
+		SrcPort:   51234,
+		DstIP:     "8.8.8.8",
+		DstPort:   6881,
+		Reason:    "UDP Tracker Protocol",
+		Action:    DetectionActionBan,
+		Payload:   []byte{0x00, 0x00, 0x04, 0x17, 0x27, 0x10},
+	})
+	logger.LogDetection(Detection{
+		Timestamp: timestamp,
+		Interface: "nfq0",
+		Protocol:  "TCP",
+		SrcIP:     "10.0.0.1",
+		SrcPort:   1234,
+		DstIP:     "10.0.0.2",
+		DstPort:   80,
+		Reason:    "BitTorrent handshake",
+		Action:    DetectionActionMonitor,
+		Payload:   []byte{0x13},
+	})
+
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 JSON lines, got %d:\n%s", len(lines), content)
+	}
+
+	var first map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatalf("Line is not valid JSON: %v\n%s", err, lines[0])
+	}
+	want := map[string]any{
+		"timestamp":   "2024-01-15T18:46:57.123Z",
+		"interface":   "nfq0",
+		"protocol":    "UDP",
+		"src_ip":      "192.168.1.100",
+		"src_port":    float64(51234),
+		"dst_ip":      "8.8.8.8",
+		"dst_port":    float64(6881),
+		"reason":      "UDP Tracker Protocol",
+		"action":      "ban",
+		"payload_len": float64(6),
+		"payload_hex": "00000417",
+		"truncated":   true,
+	}
+	for key, value := range want {
+		if first[key] != value {
+			t.Errorf("%s = %v, want %v", key, first[key], value)
+		}
+	}
+
+	var second map[string]any
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatalf("Line is not valid JSON: %v\n%s", err, lines[1])
+	}
+	if second["action"] != "monitor" || second["payload_hex"] != "13" {
+		t.Errorf("Second line = %v, want action monitor and payload_hex 13", second)
+	}
+	if _, ok := second["truncated"]; ok {
+		t.Error("Untruncated payload should not be marked truncated")
+	}
+}
+
+func TestDetectionLogger_JSON_Base64(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "detections.jsonl")
+
+	logger, err := NewDetectionLoggerWithOptions(logPath, DetectionLogOptions{
+		Format:          DetectionLogJSON,
+		MaxPayloadBytes: 512,
+		PayloadEncoding: "base64",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	logger.LogDetection(Detection{Timestamp: time.Now(), Payload: []byte("hello")})
+
+	var rec map[string]any
+	content, _ := os.ReadFile(logPath)
+	if err := json.Unmarshal(content, &rec); err != nil {
+		t.Fatalf("Log is not valid JSON: %v\n%s", err, content)
+	}
+	if rec["payload_base64"] != "aGVsbG8=" {
+		t.Errorf("payload_base64 = %v, want aGVsbG8=", rec["payload_base64"])
+	}
+	if _, ok := rec["payload_hex"]; ok {
+		t.Error("payload_hex should be omitted with base64 encoding")
+	}
+}
+
+func TestDetectionLogger_PayloadCap(t *testing.T) {
+	payload := make([]byte, 100)
+
+	tests := []struct {
+		name     string
+		max      int
+		expected string
+	}{
+		{"truncated", 16, "Payload Size: 100 bytes (showing first 16 bytes)"},
+		{"not logged", 0, "Payload Size: 100 bytes (payload not logged)"},
+		{"fits", 100, "Payload Size: 100 bytes\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "detections.log")
+			logger, err := NewDetectionLoggerWithOptions(logPath, DetectionLogOptions{
+				Format:          DetectionLogText,
+				MaxPayloadBytes: tt.max,
+				PayloadEncoding: "hex",
+			})
+			if err != nil {
+				t.Fatalf("Failed to create logger: %v", err)
+			}
+			logger.LogDetection(Detection{Timestamp: time.Now(), Payload: payload})
+			logger.Close()
+
+			content, _ := os.ReadFile(logPath)
+			if !strings.Contains(string(content), tt.expected) {
+				t.Errorf("Log missing %q:\n%s", tt.expected, content)
+			}
+			if tt.max == 0 && strings.Contains(string(content), "Hex Dump:") {
+				t.Error("Payload should not be dumped with a payload cap of 0")
+			}
+		})
+	}
+}
+
+func TestNewDetectionLoggerWithOptions_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		opts DetectionLogOptions
+	}{
+		{"unknown format", DetectionLogOptions{Format: "xml", MaxPayloadBytes: 512, PayloadEncoding: "hex"}},
+		{"negative payload cap", DetectionLogOptions{Format: DetectionLogText, MaxPayloadBytes: -1, PayloadEncoding: "hex"}},
+		{"unknown encoding", DetectionLogOptions{Format: DetectionLogJSON, MaxPayloadBytes: 512, PayloadEncoding: "base32"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDetectionLoggerWithOptions("", tt.opts); err == nil {
+				t.Error("Expected an error for invalid options")
+			}
+		})
+	}
+}
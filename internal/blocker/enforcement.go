@@ -0,0 +1,85 @@
+package blocker
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/example/BitTorrentBlocker/internal/enforcer"
+	"github.com/example/BitTorrentBlocker/internal/xdp"
+)
+
+// newEnforcer sets up the configured enforcement backend
+// Failures are logged and leave the blocker without kernel bans (nil backend):
+// detected packets are still dropped inline by NFQUEUE.
+func newEnforcer(config Config, logs *Logger) enforcer.Backend {
+	logger := logs.Component(LogComponentEnforcer)
+	switch config.EnforcementBackend {
+	case enforcer.BackendXDP:
+		return newXDPEnforcer(config, logger, logs.Component(LogComponentXDP))
+
+	case enforcer.BackendNFTables:
+		backend, err := enforcer.NewNFTables()
+		if err != nil {
+			logger.Warn("Failed to initialize nftables backend, continuing without kernel bans", "error", err)
+			return nil
+		}
+		logger.Info("nftables backend initialized", "table", "inet "+enforcer.NFTablesTable)
+		return backend
+
+	case enforcer.BackendIPSet:
+		backend, err := enforcer.NewIPSet()
+		if err != nil {
+			logger.Warn("Failed to initialize ipset backend, continuing without kernel bans", "error", err)
+			return nil
+		}
+		logger.Info("ipset backend initialized", "set4", enforcer.IPSetName4, "set6", enforcer.IPSetName6)
+		return backend
+	}
+
+	logger.Info("Kernel enforcement disabled", "backend", config.EnforcementBackend)
+	return nil
+}
+
+// newXDPEnforcer loads the XDP filter for fast-path blocking
+// xdpLogger is handed to the filter for its own events (map maintenance).
+func newXDPEnforcer(config Config, logger, xdpLogger *slog.Logger) enforcer.Backend {
+	if len(config.Interfaces) == 0 || config.Interfaces[0] == "" {
+		return nil
+	}
+
+	logger.Info("Initializing XDP filter", "interfaces", strings.Join(config.Interfaces, ","), "mode", config.XDPMode)
+	xdpFilter, err := xdp.NewXDPFilterWithOptions(xdp.Options{
+		Interfaces:   config.Interfaces,
+		Mode:         config.XDPMode,
+		PinPath:      config.XDPPinPath,
+		KeepAttached: config.XDPKeepAttached,
+		Logger:       xdpLogger,
+	})
+	if err != nil {
+		logger.Warn("Failed to initialize XDP filter, continuing without XDP fast-path (consider the nftables backend)", "error", err)
+		return nil
+	}
+
+	for _, iface := range xdpFilter.GetInterfaces() {
+		if iface.Attached && iface.Reused {
+			logger.Info("XDP already attached, kept from previous run and updated in place", "interface", iface.Name)
+		} else if iface.Attached {
+			logger.Info("XDP attached", "interface", iface.Name, "mode", iface.AttachMode)
+		} else {
+			logger.Warn("XDP not attached", "interface", iface.Name, "error", iface.Error)
+		}
+	}
+	logger.Info("XDP filter initialized successfully")
+	return enforcer.NewXDP(xdpFilter)
+}
+
+// aggregationPolicy returns the XDP subnet ban aggregation policy for config
+func aggregationPolicy(config Config) xdp.AggregationPolicy {
+	return xdp.AggregationPolicy{
+		Threshold:  config.SubnetBanThreshold,
+		Window:     time.Duration(config.SubnetBanWindow) * time.Second,
+		PrefixLen4: config.SubnetBanPrefix4,
+		PrefixLen6: config.SubnetBanPrefix6,
+	}
+}
@@ -0,0 +1,144 @@
+package blocker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/example/BitTorrentBlocker/internal/webhook"
+)
+
+// Ban event types
+const (
+	BanEventBan    = "ban"    // An address was banned (detection or control socket)
+	BanEventUnban  = "unban"  // A ban was lifted early
+	BanEventExpire = "expire" // A ban ran out
+)
+
+// Ban event sources
+const (
+	BanSourceDetection = "detection" // Banned by DPI on the packet path
+	BanSourceControl   = "control"   // Banned or unbanned through the control socket
+	BanSourceAllowlist = "allowlist" // Unbanned because the address is allowlisted
+)
+
+// BanEvent is one change of the ban state of an address, as posted to webhooks
+type BanEvent struct {
+	ID        string    `json:"id"` // Unique per event; deliveries may be retried, receivers can deduplicate on it
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason,omitempty"`    // AnalysisResult.Reason, or the reason given to "btblocker ctl ban"
+	ExpiresAt time.Time `json:"expires_at,omitzero"` // When the ban ends (ban and expire events)
+	Source    string    `json:"source,omitempty"`    // BanSource* (ban and unban events)
+	Hits      int       `json:"hits,omitempty"`      // Times the address was banned, if the ban database is enabled
+	Strikes   int       `json:"strikes,omitempty"`   // Strike count that set the ban duration (escalating bans)
+	Interface string    `json:"interface,omitempty"` // NFQUEUE the detection came from (detection bans)
+}
+
+// trackedBan is a ban announced to the event sink and not yet lifted or expired
+type trackedBan struct {
+	reason    string
+	expiresAt time.Time
+}
+
+// banEvents turns ban state changes into events for the webhook sender
+// It remembers announced bans so it can report their expiry: kernel backends
+// expire bans on their own, without telling user space which ones.
+type banEvents struct {
+	sender *webhook.Sender
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	active map[string]trackedBan // IP -> ban
+}
+
+// newBanEvents starts the webhook sender configured in config
+func newBanEvents(config Config, logger *slog.Logger) (*banEvents, error) {
+	sender, err := webhook.New(webhookOptions(config, logger))
+	if err != nil {
+		return nil, err
+	}
+	return &banEvents{sender: sender, logger: logger, active: make(map[string]trackedBan)}, nil
+}
+
+// webhookOptions converts the webhook settings of config (seconds) to sender options
+func webhookOptions(config Config, logger *slog.Logger) webhook.Options {
+	return webhook.Options{
+		URLs:       config.WebhookURLs,
+		Secret:     config.WebhookSecret,
+		BatchSize:  config.WebhookBatchSize,
+		BatchDelay: time.Duration(config.WebhookBatchDelay) * time.Second,
+		Timeout:    time.Duration(config.WebhookTimeout) * time.Second,
+		MaxBackoff: time.Duration(config.WebhookMaxBackoff) * time.Second,
+		QueueDir:   config.WebhookQueueDir,
+		QueueSize:  config.WebhookQueueSize,
+		Logger:     logger,
+	}
+}
+
+// track remembers a ban that was already announced (restored on startup) without sending an event
+func (e *banEvents) track(ip, reason string, expiresAt time.Time) {
+	e.mu.Lock()
+	e.active[ip] = trackedBan{reason: reason, expiresAt: expiresAt}
+	e.mu.Unlock()
+}
+
+// ban reports a new or extended ban
+func (e *banEvents) ban(ev BanEvent) {
+	e.track(ev.IP, ev.Reason, ev.ExpiresAt)
+	ev.Type = BanEventBan
+	e.send(ev)
+}
+
+// unban reports a ban lifted early
+func (e *banEvents) unban(ip net.IP, source string) {
+	key := ip.String()
+	e.mu.Lock()
+	ban := e.active[key]
+	delete(e.active, key)
+	e.mu.Unlock()
+	e.send(BanEvent{Type: BanEventUnban, IP: key, Reason: ban.reason, Source: source})
+}
+
+// expire reports every tracked ban that ended by now
+func (e *banEvents) expire(now time.Time) {
+	var expired []BanEvent
+	e.mu.Lock()
+	for ip, ban := range e.active {
+		if !ban.expiresAt.After(now) {
+			expired = append(expired, BanEvent{Type: BanEventExpire, IP: ip, Reason: ban.reason, ExpiresAt: ban.expiresAt})
+			delete(e.active, ip)
+		}
+	}
+	e.mu.Unlock()
+	for _, ev := range expired {
+		e.send(ev)
+	}
+}
+
+// send stamps an event and hands it to the sender (never blocks)
+func (e *banEvents) send(ev BanEvent) {
+	ev.ID = newEventID()
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if err := e.sender.Send(ev); err != nil {
+		e.logger.Error("Failed to send ban event", "ip", ev.IP, "type", ev.Type, "error", err)
+	}
+}
+
+// Close stops the sender
+func (e *banEvents) Close() error {
+	return e.sender.Close()
+}
+
+// newEventID returns a random 128-bit event ID
+func newEventID() string {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,131 @@
+package blocker
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/example/BitTorrentBlocker/internal/webhook"
+)
+
+// webhookRecorder collects the ban events posted to it
+type webhookRecorder struct {
+	mu     sync.Mutex
+	events []BanEvent
+}
+
+func (r *webhookRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	if req.Header.Get(webhook.HeaderSignature) != webhook.Sign("hook-secret", req.Header.Get(webhook.HeaderTimestamp), body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var payload struct {
+		Events []BanEvent `json:"events"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	r.events = append(r.events, payload.Events...)
+	r.mu.Unlock()
+}
+
+// wait returns the first n events received
+func (r *webhookRecorder) wait(t *testing.T, n int) []BanEvent {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		events := append([]BanEvent(nil), r.events...)
+		r.mu.Unlock()
+		if len(events) >= n {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Received %d events, want %d: %+v", len(events), n, events)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBanEvents_Webhook(t *testing.T) {
+	rec := &webhookRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	config := DefaultConfig()
+	config.FlowTableSize = 0
+	config.WebhookURLs = []string{srv.URL}
+	config.WebhookSecret = "hook-secret"
+	config.WebhookBatchDelay = 0 // Send right away
+	b := newTestBlocker(t, config)
+	b.enforcer = &fakeBackend{banned: make(map[string]time.Duration)}
+
+	// A detection bans and announces the peer with the detector's reason
+	b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, []byte("\x13BitTorrent protocol")), 4)
+	// Control socket unban, and a manual ban that expires
+	if err := b.Unban(net.ParseIP("10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Ban(net.ParseIP("198.51.100.7"), time.Second, "ticket 4711"); err != nil {
+		t.Fatal(err)
+	}
+	b.events.expire(time.Now().Add(2 * time.Second))
+
+	events := rec.wait(t, 4)
+	ban, unban, manual, expire := events[0], events[1], events[2], events[3]
+	if ban.Type != BanEventBan || ban.IP != "10.0.0.3" || ban.Reason == "" || ban.Source != BanSourceDetection ||
+		ban.Interface != "nfq4" || time.Until(ban.ExpiresAt) < 4*time.Hour {
+		t.Errorf("Detection ban event = %+v", ban)
+	}
+	if unban.Type != BanEventUnban || unban.IP != "10.0.0.3" || unban.Reason != ban.Reason || unban.Source != BanSourceControl {
+		t.Errorf("Unban event = %+v", unban)
+	}
+	if manual.Type != BanEventBan || manual.Reason != "ticket 4711" || manual.Source != BanSourceControl {
+		t.Errorf("Manual ban event = %+v", manual)
+	}
+	if expire.Type != BanEventExpire || expire.IP != "198.51.100.7" || expire.Reason != "ticket 4711" || expire.ExpiresAt.IsZero() {
+		t.Errorf("Expire event = %+v", expire)
+	}
+	seen := make(map[string]bool)
+	for _, ev := range events {
+		if ev.ID == "" || seen[ev.ID] {
+			t.Errorf("Event ID %q missing or reused", ev.ID)
+		}
+		seen[ev.ID] = true
+	}
+}
+
+func TestBanEvents_SlowEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	config := DefaultConfig()
+	config.FlowTableSize = 0
+	config.WebhookURLs = []string{srv.URL}
+	b := newTestBlocker(t, config)
+	b.enforcer = &fakeBackend{banned: make(map[string]time.Duration)}
+
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		src := net.IPv4(10, 1, byte(i/250), byte(i%250+1)).String()
+		b.processNFQPacket(tcpPacket(t, src, 40000, []byte("\x13BitTorrent protocol")), 0)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Processing 200 detections took %v with a stalled webhook endpoint", elapsed)
+	}
+}
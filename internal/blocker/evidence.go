@@ -0,0 +1,179 @@
+package blocker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What counts towards the evidence threshold (Config.BanEvidenceCount)
+const (
+	EvidenceDetections = "detections" // Every detection
+	EvidenceDetectors  = "detectors"  // Detections with distinct reasons
+	EvidenceFlows      = "flows"      // Detections in distinct flows
+)
+
+// maxEvidenceHits bounds the detections remembered per address
+const maxEvidenceHits = 256
+
+// evidencePolicy decides when the detections of an address are enough for a ban
+type evidencePolicy struct {
+	threshold int            // Detections needed within window
+	window    time.Duration  // How long a detection counts
+	count     string         // Evidence* constant
+	reasons   map[string]int // Per-reason thresholds overriding threshold
+}
+
+// newEvidencePolicy returns the evidence settings of config
+func newEvidencePolicy(config Config) (evidencePolicy, error) {
+	reasons, err := parseEvidenceReasons(config.BanEvidenceReasons)
+	if err != nil {
+		return evidencePolicy{}, err
+	}
+	return evidencePolicy{
+		threshold: config.BanEvidence,
+		window:    time.Duration(config.BanEvidenceWindow) * time.Second,
+		count:     config.BanEvidenceCount,
+		reasons:   reasons,
+	}, nil
+}
+
+// parseEvidenceReasons parses per-reason thresholds of the form "reason=N"
+// Reasons are AnalysisResult.Reason values and may contain spaces.
+func parseEvidenceReasons(specs []string) (map[string]int, error) {
+	reasons := make(map[string]int, len(specs))
+	for _, spec := range specs {
+		i := strings.LastIndexByte(spec, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid evidence threshold %q (must be reason=N)", spec)
+		}
+		reason := strings.TrimSpace(spec[:i])
+		n, err := strconv.Atoi(strings.TrimSpace(spec[i+1:]))
+		if err != nil || n < 1 || reason == "" {
+			return nil, fmt.Errorf("invalid evidence threshold %q (must be reason=N with N of 1 or more)", spec)
+		}
+		reasons[reason] = n
+	}
+	return reasons, nil
+}
+
+// thresholdFor returns the detections needed to ban for reason
+func (p evidencePolicy) thresholdFor(reason string) int {
+	if n, ok := p.reasons[reason]; ok {
+		return n
+	}
+	return p.threshold
+}
+
+// evidenceHit is one detection remembered towards a ban
+type evidenceHit struct {
+	at     time.Time
+	reason string
+	flow   FlowKey
+}
+
+// evidenceTable accumulates the detections of addresses that are not banned yet
+// All methods are safe for concurrent use.
+type evidenceTable struct {
+	mu   sync.Mutex
+	hits map[string][]evidenceHit // IP -> detections within the window, oldest first
+}
+
+func newEvidenceTable() *evidenceTable {
+	return &evidenceTable{hits: make(map[string][]evidenceHit)}
+}
+
+// add records a detection from ip and returns the evidence against it, the
+// threshold of the detection's reason, and whether the evidence reaches it
+// Reaching the threshold clears the evidence of ip, since it is banned next.
+func (t *evidenceTable) add(ip string, hit evidenceHit, p evidencePolicy) (count, needed int, ban bool) {
+	needed = p.thresholdFor(hit.reason)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if needed <= 1 {
+		delete(t.hits, ip)
+		return 1, needed, true
+	}
+
+	hits := pruneEvidence(t.hits[ip], hit.at.Add(-p.window))
+	if len(hits) >= maxEvidenceHits {
+		hits = hits[1:]
+	}
+	hits = append(hits, hit)
+	count = countEvidence(hits, p.count)
+	if count >= needed {
+		delete(t.hits, ip)
+		return count, needed, true
+	}
+	t.hits[ip] = hits
+	return count, needed, false
+}
+
+// pruneEvidence drops the detections before cutoff
+func pruneEvidence(hits []evidenceHit, cutoff time.Time) []evidenceHit {
+	i := 0
+	for i < len(hits) && hits[i].at.Before(cutoff) {
+		i++
+	}
+	return hits[i:]
+}
+
+// countEvidence counts the detections, distinct reasons or distinct flows in hits
+func countEvidence(hits []evidenceHit, mode string) int {
+	switch mode {
+	case EvidenceDetectors:
+		seen := make(map[string]struct{}, len(hits))
+		for _, h := range hits {
+			seen[h.reason] = struct{}{}
+		}
+		return len(seen)
+	case EvidenceFlows:
+		seen := make(map[FlowKey]struct{}, len(hits))
+		for _, h := range hits {
+			seen[h.flow] = struct{}{}
+		}
+		return len(seen)
+	}
+	return len(hits)
+}
+
+// forget clears the evidence against ip
+func (t *evidenceTable) forget(ip string) {
+	t.mu.Lock()
+	delete(t.hits, ip)
+	t.mu.Unlock()
+}
+
+// forgetAll clears all evidence
+func (t *evidenceTable) forgetAll() {
+	t.mu.Lock()
+	t.hits = make(map[string][]evidenceHit)
+	t.mu.Unlock()
+}
+
+// expire drops the addresses whose detections all fell out of the window and returns how many
+func (t *evidenceTable) expire(now time.Time, window time.Duration) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed := 0
+	for ip, hits := range t.hits {
+		if hits = pruneEvidence(hits, now.Add(-window)); len(hits) == 0 {
+			delete(t.hits, ip)
+			removed++
+		} else {
+			t.hits[ip] = hits
+		}
+	}
+	return removed
+}
+
+// len returns the number of addresses with evidence against them
+func (t *evidenceTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.hits)
+}
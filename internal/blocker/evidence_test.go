@@ -0,0 +1,146 @@
+package blocker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	nfqueue "github.com/florianl/go-nfqueue/v2"
+)
+
+func TestParseEvidenceReasons(t *testing.T) {
+	reasons, err := parseEvidenceReasons([]string{"BitTorrent Signature=1", " uTP Protocol (BEP 29) = 5 "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reasons["BitTorrent Signature"] != 1 || reasons["uTP Protocol (BEP 29)"] != 5 {
+		t.Errorf("parseEvidenceReasons() = %v", reasons)
+	}
+	for _, spec := range []string{"BitTorrent Signature", "=2", "MSE/PE Encryption=0", "MSE/PE Encryption=x"} {
+		if _, err := parseEvidenceReasons([]string{spec}); err == nil {
+			t.Errorf("parseEvidenceReasons(%q) should fail", spec)
+		}
+	}
+}
+
+func TestEvidenceTable_Counting(t *testing.T) {
+	flowA := FlowKey{LowPort: 1}
+	flowB := FlowKey{LowPort: 2}
+	now := time.Now()
+
+	for _, tt := range []struct {
+		count string
+		hits  []evidenceHit
+		ban   bool // After the last hit
+	}{
+		{EvidenceDetections, []evidenceHit{{reason: "a", flow: flowA}, {reason: "a", flow: flowA}}, true},
+		{EvidenceDetectors, []evidenceHit{{reason: "a", flow: flowA}, {reason: "a", flow: flowB}}, false},
+		{EvidenceDetectors, []evidenceHit{{reason: "a", flow: flowA}, {reason: "b", flow: flowA}}, true},
+		{EvidenceFlows, []evidenceHit{{reason: "a", flow: flowA}, {reason: "b", flow: flowA}}, false},
+		{EvidenceFlows, []evidenceHit{{reason: "a", flow: flowA}, {reason: "a", flow: flowB}}, true},
+	} {
+		p := evidencePolicy{threshold: 2, window: time.Minute, count: tt.count}
+		tbl := newEvidenceTable()
+		var ban bool
+		for i, hit := range tt.hits {
+			hit.at = now.Add(time.Duration(i) * time.Second)
+			_, _, ban = tbl.add("10.0.0.1", hit, p)
+			if ban && i < len(tt.hits)-1 {
+				t.Errorf("%s: banned after hit %d", tt.count, i+1)
+			}
+		}
+		if ban != tt.ban {
+			t.Errorf("%s %+v: ban = %v, want %v", tt.count, tt.hits, ban, tt.ban)
+		}
+		if ban && tbl.len() != 0 {
+			t.Errorf("%s: evidence kept after the ban", tt.count)
+		}
+	}
+}
+
+func TestEvidenceTable_Window(t *testing.T) {
+	p := evidencePolicy{threshold: 2, window: time.Minute, count: EvidenceDetections, reasons: map[string]int{"sure": 1}}
+	tbl := newEvidenceTable()
+	now := time.Now()
+
+	tbl.add("10.0.0.1", evidenceHit{at: now, reason: "maybe"}, p)
+	if _, _, ban := tbl.add("10.0.0.1", evidenceHit{at: now.Add(2 * time.Minute), reason: "maybe"}, p); ban {
+		t.Error("Detections further apart than the window must not ban")
+	}
+	if _, needed, ban := tbl.add("10.0.0.2", evidenceHit{at: now, reason: "sure"}, p); !ban || needed != 1 {
+		t.Errorf("Per-reason threshold 1: ban = %v, needed = %d", ban, needed)
+	}
+	if removed := tbl.expire(now.Add(5*time.Minute), p.window); removed != 1 || tbl.len() != 0 {
+		t.Errorf("expire() removed %d, %d left, want 1, 0", removed, tbl.len())
+	}
+}
+
+func TestProcessNFQPacket_EvidenceThreshold(t *testing.T) {
+	config := DefaultConfig()
+	config.FlowTableSize = 0
+	config.BanEvidence = 2
+	b := newTestBlocker(t, config)
+	backend := &fakeBackend{banned: make(map[string]time.Duration)}
+	b.enforcer = backend
+	handshake := []byte("\x13BitTorrent protocol")
+
+	// The first detection is dropped inline without a ban
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, handshake), 0); v != nfqueue.NfDrop {
+		t.Errorf("Verdict below the threshold = %d, want NfDrop", v)
+	}
+	if backend.IsBanned(net.ParseIP("10.0.0.3")) {
+		t.Error("Banned after one detection with banEvidence 2")
+	}
+	b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40001, handshake), 0)
+	if !backend.IsBanned(net.ParseIP("10.0.0.3")) {
+		t.Error("Not banned after two detections")
+	}
+
+	// High-certainty reasons can still ban right away
+	next := b.Config()
+	next.BanEvidenceReasons = []string{"BitTorrent Signature=1"}
+	if _, err := b.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+	b.processNFQPacket(tcpPacket(t, "10.0.0.4", 40000, handshake), 0)
+	if !backend.IsBanned(net.ParseIP("10.0.0.4")) {
+		t.Error("Per-reason threshold 1 did not ban on the first detection")
+	}
+}
+
+func TestProcessNFQPacket_EvidenceLongFlow(t *testing.T) {
+	config := DefaultConfig()
+	config.BanEvidence = 3
+	config.BanEvidenceCount = EvidenceDetections
+	b := newTestBlocker(t, config)
+	backend := &fakeBackend{banned: make(map[string]time.Duration)}
+	b.enforcer = backend
+	src := net.ParseIP("10.0.0.5")
+
+	// Later packets of the classified flow are dropped from the flow table and
+	// still count as detections, so one long flow reaches the threshold
+	b.processNFQPacket(tcpPacket(t, "10.0.0.5", 40000, []byte("\x13BitTorrent protocol")), 0)
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.5", 40000, []byte("piece data")), 0); v != nfqueue.NfDrop {
+		t.Errorf("Verdict for the classified flow = %d, want NfDrop", v)
+	}
+	if backend.IsBanned(src) {
+		t.Error("Banned after two detections with banEvidence 3")
+	}
+
+	// Replies are dropped but are no evidence against either endpoint
+	for i := 0; i < 3; i++ {
+		if v := b.processNFQPacket(tcpReply(t, "10.0.0.5", 40000, []byte("HTTP/1.1 200 OK\r\n\r\n")), 0); v != nfqueue.NfDrop {
+			t.Errorf("Verdict for a reply in the classified flow = %d, want NfDrop", v)
+		}
+	}
+	if backend.IsBanned(net.ParseIP("10.0.0.1")) {
+		t.Error("Reply sender banned for the detected endpoint's flow")
+	}
+	if backend.IsBanned(src) {
+		t.Error("Replies counted as evidence against the detected endpoint")
+	}
+	b.processNFQPacket(tcpPacket(t, "10.0.0.5", 40000, []byte("piece data")), 0)
+	if !backend.IsBanned(src) {
+		t.Error("Not banned after three packets of a classified flow")
+	}
+}
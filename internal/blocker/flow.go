@@ -0,0 +1,212 @@
+package blocker
+
+import (
+	"bytes"
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// FlowDirection tells which side of a flow sent a packet
+type FlowDirection int
+
+// Flow directions, relative to the first packet seen for the flow
+const (
+	FlowOriginal FlowDirection = iota // Same direction as the first packet seen
+	FlowReply                         // Opposite direction
+)
+
+// FlowVerdict is the classification reached for a flow
+type FlowVerdict int
+
+// Flow verdicts
+const (
+	FlowUndecided  FlowVerdict = iota // Still inspecting packets
+	FlowBitTorrent                    // Detected as BitTorrent, all further packets are blocked
+	FlowClean                         // Inspected enough packets without a detection, DPI is skipped
+)
+
+// FlowKey identifies a bidirectional flow by its 5-tuple
+// Endpoints are stored in canonical order so both directions map to the same key
+type FlowKey struct {
+	LowIP    [16]byte
+	HighIP   [16]byte
+	LowPort  uint16
+	HighPort uint16
+	UDP      bool
+}
+
+// Flow holds the state carried across packets of one connection
+type Flow struct {
+	mu sync.Mutex
+
+	Key       FlowKey
+	FirstSeen time.Time
+	Packets   [2]uint64 // Packets with payload seen, indexed by FlowDirection
+	Bytes     [2]uint64 // Payload bytes seen, indexed by FlowDirection
+	Verdict   FlowVerdict
+	Reason    string        // Detection reason once Verdict is FlowBitTorrent
+	Detected  FlowDirection // Direction of the packet that was detected
+
+	originalLow bool      // True if the original direction is LowIP -> HighIP
+	prefix      [2][]byte // First N payload bytes of each direction
+	inspected   int       // Packets that went through DPI
+	lastSeen    time.Time // Guarded by the FlowTable lock
+	elem        *list.Element
+}
+
+// appendPrefix accumulates payload into the per-direction prefix buffer, up to limit bytes
+// Returns the accumulated prefix for the direction
+func (f *Flow) appendPrefix(dir FlowDirection, payload []byte, limit int) []byte {
+	buf := f.prefix[dir]
+	if room := limit - len(buf); room > 0 {
+		if len(payload) > room {
+			payload = payload[:room]
+		}
+		buf = append(buf, payload...)
+		f.prefix[dir] = buf
+	}
+	return buf
+}
+
+// FlowTable tracks active flows with idle timeouts and a bounded size
+// When the table is full, the least recently used flow is evicted
+type FlowTable struct {
+	mu          sync.Mutex
+	flows       map[FlowKey]*Flow
+	lru         *list.List // Front = most recently used
+	maxFlows    int
+	idleTimeout time.Duration
+}
+
+// NewFlowTable creates a flow table holding at most maxFlows flows
+// Flows idle for longer than idleTimeout are treated as new connections
+func NewFlowTable(maxFlows int, idleTimeout time.Duration) *FlowTable {
+	return &FlowTable{
+		flows:       make(map[FlowKey]*Flow),
+		lru:         list.New(),
+		maxFlows:    maxFlows,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Track returns the flow a packet belongs to (creating it if needed) and the
+// direction of the packet within that flow
+func (t *FlowTable) Track(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, isUDP bool, now time.Time) (*Flow, FlowDirection) {
+	key, srcIsLow := makeFlowKey(srcIP, srcPort, dstIP, dstPort, isUDP)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	flow, exists := t.flows[key]
+	if exists && now.Sub(flow.lastSeen) > t.idleTimeout {
+		// Idle flow with a reused 5-tuple: start over
+		t.remove(flow)
+		exists = false
+	}
+
+	if !exists {
+		if t.maxFlows > 0 && len(t.flows) >= t.maxFlows {
+			if oldest := t.lru.Back(); oldest != nil {
+				t.remove(oldest.Value.(*Flow))
+			}
+		}
+		flow = &Flow{
+			Key:         key,
+			FirstSeen:   now,
+			originalLow: srcIsLow,
+		}
+		flow.elem = t.lru.PushFront(flow)
+		t.flows[key] = flow
+	} else {
+		t.lru.MoveToFront(flow.elem)
+	}
+	flow.lastSeen = now
+
+	dir := FlowOriginal
+	if srcIsLow != flow.originalLow {
+		dir = FlowReply
+	}
+	return flow, dir
+}
+
+// Expire removes flows idle for longer than the idle timeout
+// Returns the number of flows removed
+func (t *FlowTable) Expire(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removed := 0
+	for elem := t.lru.Back(); elem != nil; {
+		flow := elem.Value.(*Flow)
+		if now.Sub(flow.lastSeen) <= t.idleTimeout {
+			break // Everything further towards the front is more recent
+		}
+		elem = elem.Prev()
+		t.remove(flow)
+		removed++
+	}
+	return removed
+}
+
+// Forget removes every flow with ip at either end
+// Used when a ban is lifted, so flows already classified as BitTorrent stop being dropped.
+// Returns the number of flows removed.
+func (t *FlowTable) Forget(ip net.IP) int {
+	var addr [16]byte
+	copy(addr[:], ip.To16())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removed := 0
+	for key, flow := range t.flows {
+		if key.LowIP == addr || key.HighIP == addr {
+			t.remove(flow)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Len returns the number of tracked flows
+func (t *FlowTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.flows)
+}
+
+// remove deletes a flow from the table (caller must hold t.mu)
+func (t *FlowTable) remove(flow *Flow) {
+	t.lru.Remove(flow.elem)
+	delete(t.flows, flow.Key)
+}
+
+// makeFlowKey builds the canonical key for a 5-tuple
+// Returns the key and whether the source endpoint is the "low" endpoint
+func makeFlowKey(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16, isUDP bool) (FlowKey, bool) {
+	var src, dst [16]byte
+	copy(src[:], srcIP.To16())
+	copy(dst[:], dstIP.To16())
+
+	srcIsLow := compareEndpoints(src, srcPort, dst, dstPort) <= 0
+	if srcIsLow {
+		return FlowKey{LowIP: src, HighIP: dst, LowPort: srcPort, HighPort: dstPort, UDP: isUDP}, true
+	}
+	return FlowKey{LowIP: dst, HighIP: src, LowPort: dstPort, HighPort: srcPort, UDP: isUDP}, false
+}
+
+// compareEndpoints orders two (IP, port) endpoints
+func compareEndpoints(ipA [16]byte, portA uint16, ipB [16]byte, portB uint16) int {
+	if c := bytes.Compare(ipA[:], ipB[:]); c != 0 {
+		return c
+	}
+	switch {
+	case portA < portB:
+		return -1
+	case portA > portB:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,230 @@
+package blocker
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFlowTable_TrackDirections(t *testing.T) {
+	table := NewFlowTable(16, time.Minute)
+	now := time.Now()
+	client, server := net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1")
+
+	flow1, dir1 := table.Track(client, 51413, server, 6881, false, now)
+	flow2, dir2 := table.Track(server, 6881, client, 51413, false, now)
+
+	if flow1 != flow2 {
+		t.Fatal("Both directions of a connection should map to the same flow")
+	}
+	if dir1 != FlowOriginal {
+		t.Errorf("First packet direction = %v, want FlowOriginal", dir1)
+	}
+	if dir2 != FlowReply {
+		t.Errorf("Reverse packet direction = %v, want FlowReply", dir2)
+	}
+
+	// Different protocol or port means a different flow
+	if udpFlow, _ := table.Track(client, 51413, server, 6881, true, now); udpFlow == flow1 {
+		t.Error("UDP and TCP with the same ports should be different flows")
+	}
+	if other, _ := table.Track(client, 51414, server, 6881, false, now); other == flow1 {
+		t.Error("Different source port should be a different flow")
+	}
+	if table.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", table.Len())
+	}
+}
+
+func TestFlowTable_IPv6(t *testing.T) {
+	table := NewFlowTable(16, time.Minute)
+	now := time.Now()
+	a, b := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+
+	flow1, _ := table.Track(a, 1000, b, 2000, true, now)
+	flow2, dir := table.Track(b, 2000, a, 1000, true, now)
+	if flow1 != flow2 || dir != FlowReply {
+		t.Error("IPv6 reply should map to the same flow in the reply direction")
+	}
+}
+
+func TestFlowTable_IdleTimeout(t *testing.T) {
+	table := NewFlowTable(16, time.Minute)
+	start := time.Now()
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	flow1, _ := table.Track(src, 1000, dst, 2000, false, start)
+	flow1.Verdict = FlowBitTorrent
+
+	// Activity within the timeout keeps the flow alive
+	if flow2, _ := table.Track(src, 1000, dst, 2000, false, start.Add(50*time.Second)); flow2 != flow1 {
+		t.Error("Flow should still be active within the idle timeout")
+	}
+
+	// Reusing the 5-tuple after the flow went idle starts a new flow
+	flow3, _ := table.Track(src, 1000, dst, 2000, false, start.Add(5*time.Minute))
+	if flow3 == flow1 {
+		t.Error("Idle flow should be replaced by a new one")
+	}
+	if flow3.Verdict != FlowUndecided {
+		t.Errorf("New flow verdict = %v, want FlowUndecided", flow3.Verdict)
+	}
+}
+
+func TestFlowTable_Expire(t *testing.T) {
+	table := NewFlowTable(16, time.Minute)
+	start := time.Now()
+	dst := net.ParseIP("10.0.0.254")
+
+	for i := 0; i < 5; i++ {
+		src := net.IPv4(10, 0, 0, byte(i+1))
+		table.Track(src, 1000, dst, 2000, false, start.Add(time.Duration(i)*time.Minute))
+	}
+
+	// At start+4m30s, flows last seen at 0m, 1m, 2m and 3m are idle for more than a minute
+	removed := table.Expire(start.Add(4*time.Minute + 30*time.Second))
+	if removed != 4 {
+		t.Errorf("Expire() removed %d flows, want 4", removed)
+	}
+	if table.Len() != 1 {
+		t.Errorf("Len() = %d after expiry, want 1", table.Len())
+	}
+}
+
+func TestFlowTable_BoundedSize(t *testing.T) {
+	table := NewFlowTable(3, time.Hour)
+	now := time.Now()
+	dst := net.ParseIP("10.0.0.254")
+
+	first, _ := table.Track(net.ParseIP("10.0.0.1"), 1000, dst, 2000, false, now)
+	table.Track(net.ParseIP("10.0.0.2"), 1000, dst, 2000, false, now)
+	table.Track(net.ParseIP("10.0.0.3"), 1000, dst, 2000, false, now)
+
+	// Touch the first flow so the second becomes least recently used
+	table.Track(net.ParseIP("10.0.0.1"), 1000, dst, 2000, false, now)
+	table.Track(net.ParseIP("10.0.0.4"), 1000, dst, 2000, false, now)
+
+	if table.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3 (bounded)", table.Len())
+	}
+	if again, _ := table.Track(net.ParseIP("10.0.0.1"), 1000, dst, 2000, false, now); again != first {
+		t.Error("Recently used flow should not have been evicted")
+	}
+}
+
+func TestAnalyzeFlow_SplitHandshake(t *testing.T) {
+	analyzer := NewAnalyzer(DefaultConfig())
+	table := NewFlowTable(16, time.Minute)
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	handshake := []byte("\x13BitTorrent protocol\x00\x00\x00\x00\x00\x10\x00\x05")
+
+	// Neither half of the handshake matches on its own
+	first, second := handshake[:10], handshake[10:]
+	if analyzer.AnalyzePacket(first, false).ShouldBlock || analyzer.AnalyzePacket(second, false).ShouldBlock {
+		t.Fatal("Test setup: handshake halves should not be detected individually")
+	}
+
+	flow, dir := table.Track(src, 40000, dst, 6881, false, time.Now())
+	if result := analyzer.AnalyzeFlow(flow, dir, first, false, dst.String(), 6881); result.ShouldBlock {
+		t.Fatal("First segment alone should not be detected")
+	}
+
+	flow, dir = table.Track(src, 40000, dst, 6881, false, time.Now())
+	result := analyzer.AnalyzeFlow(flow, dir, second, false, dst.String(), 6881)
+	if !result.ShouldBlock {
+		t.Fatal("Handshake split across two segments should be detected")
+	}
+	if result.FromFlow {
+		t.Error("First detection should not be marked as a cached flow verdict")
+	}
+	if flow.Verdict != FlowBitTorrent {
+		t.Errorf("Flow verdict = %v, want FlowBitTorrent", flow.Verdict)
+	}
+}
+
+func TestAnalyzeFlow_SplitMSE(t *testing.T) {
+	analyzer := NewAnalyzer(DefaultConfig())
+	table := NewFlowTable(16, time.Minute)
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	// DH public key in the first segment, VC and crypto_provide in the second
+	payload := make([]byte, 200)
+	for i := 0; i < 96; i++ {
+		payload[i] = byte((i*173 + 17) % 256)
+	}
+	for i := 96; i < 110; i++ {
+		payload[i] = byte((i * 7) % 256)
+	}
+	payload[121] = 0x02 // VC at 110-117 (zeros), crypto_provide = RC4
+
+	var result AnalysisResult
+	for _, segment := range [][]byte{payload[:96], payload[96:]} {
+		flow, dir := table.Track(src, 40000, dst, 51413, false, time.Now())
+		result = analyzer.AnalyzeFlow(flow, dir, segment, false, dst.String(), 51413)
+	}
+
+	if !result.ShouldBlock || result.Reason != "MSE/PE Encryption" {
+		t.Errorf("MSE split across segments: got %+v, want MSE/PE Encryption detection", result)
+	}
+}
+
+func TestAnalyzeFlow_CachedVerdict(t *testing.T) {
+	analyzer := NewAnalyzer(DefaultConfig())
+	table := NewFlowTable(16, time.Minute)
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	flow, dir := table.Track(src, 40000, dst, 6881, false, time.Now())
+	first := analyzer.AnalyzeFlow(flow, dir, []byte("\x13BitTorrent protocol"), false, dst.String(), 6881)
+	if !first.ShouldBlock || first.FromFlow {
+		t.Fatalf("Handshake should be detected fresh, got %+v", first)
+	}
+
+	// Any later packet (even one that would not match) reuses the verdict
+	flow, dir = table.Track(dst, 6881, src, 40000, false, time.Now())
+	second := analyzer.AnalyzeFlow(flow, dir, []byte("harmless data"), false, src.String(), 40000)
+	if !second.ShouldBlock || !second.FromFlow || second.Reason != first.Reason {
+		t.Errorf("Later packet should reuse flow verdict, got %+v", second)
+	}
+
+	if flow.Packets[FlowOriginal] != 1 || flow.Packets[FlowReply] != 1 {
+		t.Errorf("Packets = %v, want [1 1]", flow.Packets)
+	}
+	if flow.Bytes[FlowReply] != uint64(len("harmless data")) {
+		t.Errorf("Reply bytes = %d, want %d", flow.Bytes[FlowReply], len("harmless data"))
+	}
+}
+
+func TestAnalyzeFlow_CleanAfterMaxPackets(t *testing.T) {
+	config := DefaultConfig()
+	config.FlowMaxPackets = 3
+	analyzer := NewAnalyzer(config)
+	table := NewFlowTable(16, time.Minute)
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	var flow *Flow
+	for i := 0; i < 3; i++ {
+		var dir FlowDirection
+		flow, dir = table.Track(src, 40000, dst, 8080, false, time.Now())
+		if result := analyzer.AnalyzeFlow(flow, dir, []byte("plain application data"), false, dst.String(), 8080); result.ShouldBlock {
+			t.Fatalf("Packet %d should not be detected", i)
+		}
+	}
+	if flow.Verdict != FlowClean {
+		t.Fatalf("Flow verdict = %v after %d packets, want FlowClean", flow.Verdict, config.FlowMaxPackets)
+	}
+
+	// DPI is skipped for the rest of the flow, even for BitTorrent-looking data
+	flow, dir := table.Track(src, 40000, dst, 8080, false, time.Now())
+	result := analyzer.AnalyzeFlow(flow, dir, []byte("\x13BitTorrent protocol"), false, dst.String(), 8080)
+	if result.ShouldBlock || !result.FromFlow {
+		t.Errorf("Clean flow should skip DPI, got %+v", result)
+	}
+}
+
+func TestAnalyzeFlow_NilFlow(t *testing.T) {
+	analyzer := NewAnalyzer(DefaultConfig())
+	result := analyzer.AnalyzeFlow(nil, FlowOriginal, []byte("\x13BitTorrent protocol"), false, "", 0)
+	if !result.ShouldBlock || result.FromFlow {
+		t.Errorf("Nil flow should fall back to single-packet analysis, got %+v", result)
+	}
+}
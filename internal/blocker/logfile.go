@@ -0,0 +1,231 @@
+package blocker
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rotatedSuffix is the timestamp appended to rotated log files; it sorts chronologically
+const rotatedSuffix = "20060102-150405.000"
+
+// LogRotation limits the disk space used by a log file
+// Rotated files are named <path>.<timestamp>, with .gz appended once compressed.
+type LogRotation struct {
+	MaxSize  int64         // Rotate once the file would exceed this many bytes (0 = no size limit)
+	MaxAge   time.Duration // Rotate once the file is this old (0 = no age limit)
+	MaxFiles int           // Rotated files kept, oldest are removed first (0 = keep all)
+	Compress bool          // gzip rotated files in the background
+	Quota    int64         // Bytes of active and rotated files above which the log is over quota (0 = no quota)
+}
+
+// logFile is an append-only log file with size- and age-based rotation
+// Writes are not synchronized; DetectionLogger serializes them.
+type logFile struct {
+	path     string
+	rotation LogRotation
+	header   []byte // Written at the start of every new file (file format header)
+	now      func() time.Time
+
+	file    *os.File
+	size    int64     // Bytes in the active file
+	started time.Time // When the active file was opened (age limit)
+
+	rotated atomic.Int64   // Bytes in retained rotated files, updated by prune
+	pruneMu sync.Mutex     // Serializes prune between writers and compression
+	wg      sync.WaitGroup // Background compressions
+}
+
+// openLogFile opens path for appending, creating it if needed
+// header, if any, starts every file the logFile creates.
+func openLogFile(path string, rotation LogRotation, header []byte) (*logFile, error) {
+	lf := &logFile{path: path, rotation: rotation, header: header, now: time.Now}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	lf.prune()
+	return lf, nil
+}
+
+// open opens the active file and records its current size
+func (lf *logFile) open() error {
+	file, err := os.OpenFile(lf.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	size := fi.Size()
+	if size == 0 && len(lf.header) > 0 {
+		n, err := file.Write(lf.header)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		size = int64(n)
+	}
+	lf.file, lf.size, lf.started = file, size, lf.now()
+	return nil
+}
+
+// Write appends one entry, rotating first if the entry would break a limit
+// An entry is never split across files.
+func (lf *logFile) Write(p []byte) (int, error) {
+	if lf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if lf.size > int64(len(lf.header)) && lf.shouldRotate(int64(len(p))) {
+		if err := lf.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate %s: %w", lf.path, err)
+		}
+	}
+	n, err := lf.file.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// shouldRotate reports whether the active file must be rotated before writing n bytes
+func (lf *logFile) shouldRotate(n int64) bool {
+	if lf.rotation.MaxSize > 0 && lf.size+n > lf.rotation.MaxSize {
+		return true
+	}
+	return lf.rotation.MaxAge > 0 && lf.now().Sub(lf.started) >= lf.rotation.MaxAge
+}
+
+// rotate renames the active file aside and starts a new one
+func (lf *logFile) rotate() error {
+	if err := lf.file.Close(); err != nil {
+		return err
+	}
+	lf.file = nil
+	name := lf.path + "." + lf.now().Format(rotatedSuffix)
+	if err := os.Rename(lf.path, name); err != nil {
+		// Keep logging to the old file rather than stopping altogether
+		_ = lf.open()
+		return err
+	}
+	if err := lf.open(); err != nil {
+		return err
+	}
+
+	if !lf.rotation.Compress {
+		lf.prune()
+		return nil
+	}
+	lf.wg.Add(1)
+	go func() {
+		defer lf.wg.Done()
+		_ = compressFile(name) // On failure the uncompressed file is kept
+		lf.prune()
+	}()
+	return nil
+}
+
+// Reopen closes and reopens the file at path, for external rotation (logrotate)
+func (lf *logFile) Reopen() error {
+	if lf.file != nil {
+		if err := lf.file.Close(); err != nil {
+			return err
+		}
+		lf.file = nil
+	}
+	if err := lf.open(); err != nil {
+		return err
+	}
+	lf.prune()
+	return nil
+}
+
+// OverQuota reports whether the active and rotated files exceed the quota
+func (lf *logFile) OverQuota() bool {
+	return lf.rotation.Quota > 0 && lf.size+lf.rotated.Load() > lf.rotation.Quota
+}
+
+// Close closes the active file and waits for background compression
+func (lf *logFile) Close() error {
+	var err error
+	if lf.file != nil {
+		err = lf.file.Close()
+		lf.file = nil
+	}
+	lf.wg.Wait()
+	return err
+}
+
+// prune removes the oldest rotated files beyond MaxFiles and totals the rest
+func (lf *logFile) prune() {
+	lf.pruneMu.Lock()
+	defer lf.pruneMu.Unlock()
+
+	files := rotatedLogFiles(lf.path)
+	if lf.rotation.MaxFiles > 0 && len(files) > lf.rotation.MaxFiles {
+		for _, name := range files[:len(files)-lf.rotation.MaxFiles] {
+			_ = os.Remove(name)
+		}
+		files = files[len(files)-lf.rotation.MaxFiles:]
+	}
+
+	var total int64
+	for _, name := range files {
+		if fi, err := os.Stat(name); err == nil {
+			total += fi.Size()
+		}
+	}
+	lf.rotated.Store(total)
+}
+
+// rotatedLogFiles lists the rotated files of path, oldest first
+func rotatedLogFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	var files []string
+	for _, name := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, path+"."), ".gz")
+		if _, err := time.Parse(rotatedSuffix, stamp); err == nil {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// compressFile replaces name with name.gz
+func compressFile(name string) error {
+	src, err := os.Open(name) // #nosec G304 - rotated log file
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Written under a temporary name so a partial file is never taken for a rotated log
+	tmp := name + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644) // #nosec G304 - rotated log file
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+".gz")
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(name)
+}
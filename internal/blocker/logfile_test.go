@@ -0,0 +1,171 @@
+package blocker
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFile_SizeRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "detections.log")
+	lf, err := openLogFile(path, LogRotation{MaxSize: 100, MaxFiles: 2}, nil)
+	if err != nil {
+		t.Fatalf("openLogFile() error = %v", err)
+	}
+	clock := time.Date(2024, 1, 15, 18, 0, 0, 0, time.UTC)
+	lf.now = func() time.Time { clock = clock.Add(time.Second); return clock }
+
+	entry := []byte(strings.Repeat("x", 39) + "\n")
+	for i := 0; i < 10; i++ {
+		if _, err := lf.Write(entry); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := lf.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// 2 entries per file: 4 rotations happened, the 2 newest rotated files are kept
+	rotated := rotatedLogFiles(path)
+	if len(rotated) != 2 {
+		t.Fatalf("Rotated files = %v, want 2", rotated)
+	}
+	for _, name := range append(rotated, path) {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != 80 {
+			t.Errorf("%s is %d bytes, want 80 (entries must not be split)", name, fi.Size())
+		}
+	}
+}
+
+func TestLogFile_AgeRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "detections.log")
+	lf, err := openLogFile(path, LogRotation{MaxAge: time.Hour}, nil)
+	if err != nil {
+		t.Fatalf("openLogFile() error = %v", err)
+	}
+	defer lf.Close()
+	clock := time.Now()
+	lf.now = func() time.Time { return clock }
+	lf.started = clock
+
+	_, _ = lf.Write([]byte("first\n"))
+	clock = clock.Add(30 * time.Minute)
+	_, _ = lf.Write([]byte("second\n"))
+	if n := len(rotatedLogFiles(path)); n != 0 {
+		t.Fatalf("Rotated after 30 minutes (%d files)", n)
+	}
+
+	clock = clock.Add(30 * time.Minute)
+	_, _ = lf.Write([]byte("third\n"))
+	rotated := rotatedLogFiles(path)
+	if len(rotated) != 1 {
+		t.Fatalf("Rotated files = %v, want 1 after an hour", rotated)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "third\n" {
+		t.Errorf("Active file = %q, want only the entry after rotation", content)
+	}
+}
+
+func TestLogFile_Compress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "detections.log")
+	lf, err := openLogFile(path, LogRotation{MaxSize: 10, Compress: true}, nil)
+	if err != nil {
+		t.Fatalf("openLogFile() error = %v", err)
+	}
+	_, _ = lf.Write([]byte("0123456789"))
+	_, _ = lf.Write([]byte("abc"))
+	_ = lf.Close() // Waits for compression
+
+	rotated := rotatedLogFiles(path)
+	if len(rotated) != 1 || !strings.HasSuffix(rotated[0], ".gz") {
+		t.Fatalf("Rotated files = %v, want one .gz file", rotated)
+	}
+	f, err := os.Open(rotated[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Rotated file is not gzip: %v", err)
+	}
+	content, _ := io.ReadAll(zr)
+	if string(content) != "0123456789" {
+		t.Errorf("Decompressed content = %q, want 0123456789", content)
+	}
+}
+
+func TestLogFile_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "detections.log")
+	lf, err := openLogFile(path, LogRotation{}, nil)
+	if err != nil {
+		t.Fatalf("openLogFile() error = %v", err)
+	}
+	defer lf.Close()
+
+	_, _ = lf.Write([]byte("before\n"))
+	// What logrotate does before sending SIGUSR1
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lf.Reopen(); err != nil {
+		t.Fatalf("Reopen() error = %v", err)
+	}
+	_, _ = lf.Write([]byte("after\n"))
+
+	if content, _ := os.ReadFile(path + ".1"); string(content) != "before\n" {
+		t.Errorf("Moved file = %q, want before", content)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "after\n" {
+		t.Errorf("Reopened file = %q, want after", content)
+	}
+}
+
+func TestDetectionLogger_Quota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "detections.jsonl")
+	logger, err := NewDetectionLoggerWithOptions(path, DetectionLogOptions{
+		Format:          DetectionLogJSON,
+		MaxPayloadBytes: 512,
+		PayloadEncoding: "hex",
+		Rotation:        LogRotation{Quota: 1000},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	payload := make([]byte, 300) // About 850 bytes per entry
+	logger.LogDetection(Detection{Timestamp: time.Now(), Action: DetectionActionBan, Payload: payload})
+	logger.LogDetection(Detection{Timestamp: time.Now(), Action: DetectionActionBan, Payload: payload})
+	logger.LogDetection(Detection{Timestamp: time.Now(), Action: DetectionActionBan, Payload: payload})
+
+	content, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %d", len(lines))
+	}
+	for i, line := range lines {
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("Line %d is not valid JSON: %v", i, err)
+		}
+		_, hasPayload := rec["payload_hex"]
+		overQuota := rec["quota_exceeded"] == true
+		wantOverQuota := i == 2 // The quota is exceeded after the second entry
+		if overQuota != wantOverQuota || hasPayload == wantOverQuota {
+			t.Errorf("Line %d: payload logged = %v, quota_exceeded = %v, want quota_exceeded %v", i, hasPayload, overQuota, wantOverQuota)
+		}
+		if rec["payload_len"] != float64(300) {
+			t.Errorf("Line %d: payload_len = %v, want 300", i, rec["payload_len"])
+		}
+	}
+}
@@ -1,67 +1,261 @@
 package blocker
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// LogLevel represents logging verbosity
-type LogLevel int
+// Log output formats
+const (
+	LogFormatText     = "text"     // key=value lines on stderr
+	LogFormatJSON     = "json"     // One JSON object per line on stderr
+	LogFormatJournald = "journald" // Native systemd-journald protocol, attributes become journal fields
+	LogFormatSyslog   = "syslog"   // Local syslog socket, attributes appended to the message
+)
 
-// Log levels in increasing order of verbosity
+// Log components; each has its own level (see Config.LogComponentLevels)
 const (
-	LogLevelError LogLevel = iota
-	LogLevelWarn
-	LogLevelInfo
-	LogLevelDebug
+	LogComponentBlocker  = "blocker"  // Packet processing, bans, configuration, control socket
+	LogComponentXDP      = "xdp"      // XDP program loading and map maintenance
+	LogComponentEnforcer = "enforcer" // Enforcement backend setup
+	LogComponentWebhook  = "webhook"  // Ban event delivery
 )
 
-// Logger wraps standard log with level support
+// logComponents lists every component with its own level
+var logComponents = []string{LogComponentBlocker, LogComponentXDP, LogComponentEnforcer, LogComponentWebhook}
+
+// Logger is the structured logger shared by all components
+// Each component logs through its own *slog.Logger (see Component), tagged with
+// a component attribute. Levels can be changed while other goroutines log
+// (configuration reload).
 type Logger struct {
-	level LogLevel
+	closer  io.Closer // Connection of the journald and syslog outputs (nil for stderr)
+	levels  map[string]*slog.LevelVar
+	loggers map[string]*slog.Logger
+}
+
+// NewLogger creates a logger writing in format to w (text and JSON formats),
+// or to the local journald or syslog socket; every component starts at info
+func NewLogger(format string, w io.Writer) (*Logger, error) {
+	// The output accepts every level; componentHandler does the filtering
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	l := &Logger{levels: make(map[string]*slog.LevelVar), loggers: make(map[string]*slog.Logger)}
+
+	var handler slog.Handler
+	switch format {
+	case LogFormatText, "":
+		handler = slog.NewTextHandler(w, opts)
+	case LogFormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	case LogFormatJournald, LogFormatSyslog:
+		sink, closer, err := openLogSink(format)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s log output: %w", format, err)
+		}
+		handler, l.closer = &sinkHandler{sink: sink}, closer
+	default:
+		return nil, fmt.Errorf("invalid log format %q (must be %s, %s, %s or %s)",
+			format, LogFormatText, LogFormatJSON, LogFormatJournald, LogFormatSyslog)
+	}
+
+	for _, name := range logComponents {
+		level := new(slog.LevelVar)
+		level.Set(slog.LevelInfo)
+		l.levels[name] = level
+		l.loggers[name] = slog.New(&componentHandler{level: level, next: handler}).With("component", name)
+	}
+	return l, nil
+}
+
+// Component returns the logger of a component (one of the LogComponent* constants)
+func (l *Logger) Component(name string) *slog.Logger {
+	if logger, ok := l.loggers[name]; ok {
+		return logger
+	}
+	return l.loggers[LogComponentBlocker]
 }
 
-// NewLogger creates a logger with the specified level
-func NewLogger(levelStr string) *Logger {
-	var level LogLevel
-	switch levelStr {
+// SetLevels sets the level of every component to level, then applies the
+// "component=level" overrides of components
+func (l *Logger) SetLevels(level string, components []string) error {
+	base, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	overrides, err := parseComponentLevels(components)
+	if err != nil {
+		return err
+	}
+	for name, v := range l.levels {
+		if override, ok := overrides[name]; ok {
+			v.Set(override)
+		} else {
+			v.Set(base)
+		}
+	}
+	return nil
+}
+
+// Level returns the current level of a component
+func (l *Logger) Level(component string) slog.Level {
+	if v, ok := l.levels[component]; ok {
+		return v.Level()
+	}
+	return slog.LevelInfo
+}
+
+// Close closes the journald or syslog connection
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// parseLogLevel converts a configured level (error, warn, info, debug) to a slog level
+func parseLogLevel(level string) (slog.Level, error) {
+	switch level {
 	case "error":
-		level = LogLevelError
+		return slog.LevelError, nil
 	case "warn":
-		level = LogLevelWarn
+		return slog.LevelWarn, nil
 	case "info":
-		level = LogLevelInfo
+		return slog.LevelInfo, nil
 	case "debug":
-		level = LogLevelDebug
-	default:
-		level = LogLevelInfo
+		return slog.LevelDebug, nil
 	}
-	return &Logger{level: level}
+	return slog.LevelInfo, fmt.Errorf("invalid log level %q (must be error, warn, info or debug)", level)
 }
 
-// Error logs an error message
-func (l *Logger) Error(format string, v ...interface{}) {
-	if l.level >= LogLevelError {
-		log.Printf("[ERROR] "+format, v...)
+// parseComponentLevels parses "component=level" entries such as "xdp=debug"
+func parseComponentLevels(entries []string) (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level, len(entries))
+	for _, entry := range entries {
+		name, level, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		name = strings.TrimSpace(name)
+		if !ok || !slices.Contains(logComponents, name) {
+			return nil, fmt.Errorf("invalid component log level %q (must be COMPONENT=LEVEL, components: %s)",
+				entry, strings.Join(logComponents, ", "))
+		}
+		l, err := parseLogLevel(strings.TrimSpace(level))
+		if err != nil {
+			return nil, fmt.Errorf("component %s: %w", name, err)
+		}
+		levels[name] = l
 	}
+	return levels, nil
 }
 
-// Warn logs a warning message
-func (l *Logger) Warn(format string, v ...interface{}) {
-	if l.level >= LogLevelWarn {
-		log.Printf("[WARN] "+format, v...)
+// componentHandler drops records below the level of its component
+type componentHandler struct {
+	level *slog.LevelVar
+	next  slog.Handler
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.next.Handle(ctx, r)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &componentHandler{level: h.level, next: h.next.WithAttrs(attrs)}
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return &componentHandler{level: h.level, next: h.next.WithGroup(name)}
+}
+
+// logField is one flattened attribute; group members are named "group.key"
+type logField struct {
+	key   string
+	value string
+}
+
+// logSink writes one record to an output without native slog support
+type logSink func(level slog.Level, msg string, fields []logField) error
+
+// sinkHandler flattens records into fields for a logSink (journald, syslog)
+type sinkHandler struct {
+	sink   logSink
+	fields []logField // From WithAttrs
+	group  string     // Key prefix from WithGroup
+}
+
+func (h *sinkHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *sinkHandler) Handle(_ context.Context, r slog.Record) error {
+	fields := append([]logField(nil), h.fields...)
+	r.Attrs(func(a slog.Attr) bool {
+		fields = appendLogField(fields, h.group, a)
+		return true
+	})
+	return h.sink(r.Level, r.Message, fields)
+}
+
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fields := append([]logField(nil), h.fields...)
+	for _, a := range attrs {
+		fields = appendLogField(fields, h.group, a)
 	}
+	return &sinkHandler{sink: h.sink, fields: fields, group: h.group}
 }
 
-// Info logs an informational message
-func (l *Logger) Info(format string, v ...interface{}) {
-	if l.level >= LogLevelInfo {
-		log.Printf("[INFO] "+format, v...)
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &sinkHandler{sink: h.sink, fields: h.fields, group: h.group + name + "."}
+}
+
+// appendLogField appends a, flattening groups into prefixed keys
+func appendLogField(fields []logField, prefix string, a slog.Attr) []logField {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, member := range v.Group() {
+			fields = appendLogField(fields, prefix, member)
+		}
+		return fields
+	}
+	if a.Key == "" {
+		return fields
+	}
+	var value string
+	switch v.Kind() {
+	case slog.KindTime:
+		value = v.Time().Format(time.RFC3339Nano)
+	default:
+		value = v.String()
 	}
+	return append(fields, logField{key: prefix + a.Key, value: value})
 }
 
-// Debug logs a debug message
-func (l *Logger) Debug(format string, v ...interface{}) {
-	if l.level >= LogLevelDebug {
-		log.Printf("[DEBUG] "+format, v...)
+// formatLogLine renders a message and its fields as "msg key=value ..."
+func formatLogLine(msg string, fields []logField) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, f := range fields {
+		b.WriteByte(' ')
+		b.WriteString(f.key)
+		b.WriteByte('=')
+		if f.value == "" || strings.ContainsAny(f.value, " =\"\n\t") {
+			b.WriteString(strconv.Quote(f.value))
+		} else {
+			b.WriteString(f.value)
+		}
 	}
+	return b.String()
 }
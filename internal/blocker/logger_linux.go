@@ -0,0 +1,113 @@
+//go:build linux
+
+package blocker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"strings"
+)
+
+// journaldSocket is the native protocol socket of systemd-journald
+const journaldSocket = "/run/systemd/journal/socket"
+
+// logIdentifier is the syslog identifier of every record
+const logIdentifier = "btblocker"
+
+// openLogSink connects to the journald or syslog socket
+func openLogSink(format string) (logSink, io.Closer, error) {
+	if format == LogFormatSyslog {
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, logIdentifier)
+		if err != nil {
+			return nil, nil, err
+		}
+		return syslogSink(w), w, nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, nil, err
+	}
+	return journaldSink(conn), conn, nil
+}
+
+// syslogSink writes records as "msg key=value ..." at the matching syslog severity
+func syslogSink(w *syslog.Writer) logSink {
+	return func(level slog.Level, msg string, fields []logField) error {
+		line := formatLogLine(msg, fields)
+		switch {
+		case level >= slog.LevelError:
+			return w.Err(line)
+		case level >= slog.LevelWarn:
+			return w.Warning(line)
+		case level >= slog.LevelInfo:
+			return w.Info(line)
+		default:
+			return w.Debug(line)
+		}
+	}
+}
+
+// journaldSink sends one datagram per record; every attribute becomes a journal
+// field (src_ip becomes SRC_IP) and is repeated in MESSAGE for plain journalctl output
+func journaldSink(conn *net.UnixConn) logSink {
+	return func(level slog.Level, msg string, fields []logField) error {
+		priority := 7 // debug
+		switch {
+		case level >= slog.LevelError:
+			priority = 3
+		case level >= slog.LevelWarn:
+			priority = 4
+		case level >= slog.LevelInfo:
+			priority = 6
+		}
+
+		var buf bytes.Buffer
+		appendJournalField(&buf, "MESSAGE", formatLogLine(msg, fields))
+		appendJournalField(&buf, "PRIORITY", fmt.Sprint(priority))
+		appendJournalField(&buf, "SYSLOG_IDENTIFIER", logIdentifier)
+		for _, f := range fields {
+			if name := journalFieldName(f.key); name != "" {
+				appendJournalField(&buf, name, f.value)
+			}
+		}
+		_, err := conn.Write(buf.Bytes())
+		return err
+	}
+}
+
+// appendJournalField encodes one field; values with newlines use the length-prefixed form
+func appendJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName maps an attribute key to a journal field name: upper case
+// letters, digits and underscores, not starting with an underscore or digit
+func journalFieldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	s := strings.TrimLeft(string(name), "_0123456789")
+	if len(s) > 64 {
+		s = s[:64]
+	}
+	return s
+}
@@ -0,0 +1,55 @@
+package blocker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournaldSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	logger := slog.New(&sinkHandler{sink: journaldSink(conn)})
+	logger.Warn("Detection", "src_ip", "10.0.0.3", "_hidden", "x", "multi-line", "a\nb")
+
+	buf := make([]byte, 4096)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagram := buf[:n]
+
+	for _, field := range []string{
+		"MESSAGE=Detection src_ip=10.0.0.3 _hidden=x multi-line=\"a\\nb\"\n",
+		"PRIORITY=4\n",
+		"SYSLOG_IDENTIFIER=btblocker\n",
+		"SRC_IP=10.0.0.3\n",
+		"HIDDEN=x\n", // Leading underscores are reserved for trusted fields
+	} {
+		if !bytes.Contains(datagram, []byte(field)) {
+			t.Errorf("Datagram missing %q:\n%q", field, datagram)
+		}
+	}
+
+	// Values with newlines use the length-prefixed form
+	var framed bytes.Buffer
+	framed.WriteString("MULTI_LINE\n")
+	_ = binary.Write(&framed, binary.LittleEndian, uint64(3))
+	framed.WriteString("a\nb\n")
+	if !bytes.Contains(datagram, framed.Bytes()) {
+		t.Errorf("Datagram missing length-prefixed MULTI_LINE:\n%q", datagram)
+	}
+}
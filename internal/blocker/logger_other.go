@@ -0,0 +1,14 @@
+//go:build !linux
+
+package blocker
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// openLogSink is not supported where the blocker cannot run; see logger_linux.go
+func openLogSink(format string) (logSink, io.Closer, error) {
+	return nil, nil, fmt.Errorf("%s output is not supported on %s", format, runtime.GOOS)
+}
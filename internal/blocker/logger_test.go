@@ -2,232 +2,188 @@ package blocker
 
 import (
 	"bytes"
-	"log"
+	"encoding/json"
+	"log/slog"
 	"strings"
 	"testing"
 )
 
-func TestNewLogger(t *testing.T) {
+func TestNewLogger_Formats(t *testing.T) {
 	tests := []struct {
-		name     string
-		levelStr string
-		want     LogLevel
+		format  string
+		want    string
+		wantErr bool
 	}{
-		{"Error level", "error", LogLevelError},
-		{"Warn level", "warn", LogLevelWarn},
-		{"Info level", "info", LogLevelInfo},
-		{"Debug level", "debug", LogLevelDebug},
-		{"Default (invalid)", "invalid", LogLevelInfo},
-		{"Default (empty)", "", LogLevelInfo},
+		{LogFormatText, `level=INFO msg="BitTorrent detected" component=blocker src_ip=10.0.0.3 dst_port=6881`, false},
+		{LogFormatJSON, `"msg":"BitTorrent detected","component":"blocker","src_ip":"10.0.0.3","dst_port":6881`, false},
+		{"", `level=INFO msg="BitTorrent detected"`, false},
+		{"xml", "", true},
 	}
 
 	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			logger := NewLogger(tt.levelStr)
-			if logger.level != tt.want {
-				t.Errorf("NewLogger(%q).level = %v, want %v", tt.levelStr, logger.level, tt.want)
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			logs, err := NewLogger(tt.format, &buf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewLogger(%q) error = %v, wantErr %v", tt.format, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			logs.Component(LogComponentBlocker).Info("BitTorrent detected", "src_ip", "10.0.0.3", "dst_port", 6881)
+			if !strings.Contains(buf.String(), tt.want) {
+				t.Errorf("Output = %q, want it to contain %q", buf.String(), tt.want)
 			}
 		})
 	}
 }
 
-func TestLoggerLevels(t *testing.T) {
+func TestLogger_Levels(t *testing.T) {
 	tests := []struct {
-		name          string
-		loggerLevel   string
-		testFunc      func(*Logger)
-		shouldLog     bool
-		expectedLevel string
+		name       string
+		level      string
+		components []string
+		logged     map[string][]slog.Level // Component -> levels that must be logged
+		dropped    map[string][]slog.Level // Component -> levels that must not be logged
 	}{
-		// Error logs
 		{
-			name:          "Error logs at error level",
-			loggerLevel:   "error",
-			testFunc:      func(l *Logger) { l.Error("test error") },
-			shouldLog:     true,
-			expectedLevel: "[ERROR]",
+			name:    "Info everywhere",
+			level:   "info",
+			logged:  map[string][]slog.Level{LogComponentBlocker: {slog.LevelInfo, slog.LevelError}, LogComponentXDP: {slog.LevelInfo}},
+			dropped: map[string][]slog.Level{LogComponentBlocker: {slog.LevelDebug}, LogComponentXDP: {slog.LevelDebug}},
 		},
 		{
-			name:          "Error logs at warn level",
-			loggerLevel:   "warn",
-			testFunc:      func(l *Logger) { l.Error("test error") },
-			shouldLog:     true,
-			expectedLevel: "[ERROR]",
+			name:       "Debug for xdp only",
+			level:      "info",
+			components: []string{"xdp=debug"},
+			logged:     map[string][]slog.Level{LogComponentXDP: {slog.LevelDebug}, LogComponentBlocker: {slog.LevelInfo}},
+			dropped:    map[string][]slog.Level{LogComponentBlocker: {slog.LevelDebug}, LogComponentEnforcer: {slog.LevelDebug}},
 		},
 		{
-			name:          "Error logs at info level",
-			loggerLevel:   "info",
-			testFunc:      func(l *Logger) { l.Error("test error") },
-			shouldLog:     true,
-			expectedLevel: "[ERROR]",
-		},
-		{
-			name:          "Error logs at debug level",
-			loggerLevel:   "debug",
-			testFunc:      func(l *Logger) { l.Error("test error") },
-			shouldLog:     true,
-			expectedLevel: "[ERROR]",
-		},
-
-		// Warn logs
-		{
-			name:          "Warn doesn't log at error level",
-			loggerLevel:   "error",
-			testFunc:      func(l *Logger) { l.Warn("test warning") },
-			shouldLog:     false,
-			expectedLevel: "",
-		},
-		{
-			name:          "Warn logs at warn level",
-			loggerLevel:   "warn",
-			testFunc:      func(l *Logger) { l.Warn("test warning") },
-			shouldLog:     true,
-			expectedLevel: "[WARN]",
-		},
-		{
-			name:          "Warn logs at info level",
-			loggerLevel:   "info",
-			testFunc:      func(l *Logger) { l.Warn("test warning") },
-			shouldLog:     true,
-			expectedLevel: "[WARN]",
-		},
-
-		// Info logs
-		{
-			name:          "Info doesn't log at error level",
-			loggerLevel:   "error",
-			testFunc:      func(l *Logger) { l.Info("test info") },
-			shouldLog:     false,
-			expectedLevel: "",
-		},
-		{
-			name:          "Info doesn't log at warn level",
-			loggerLevel:   "warn",
-			testFunc:      func(l *Logger) { l.Info("test info") },
-			shouldLog:     false,
-			expectedLevel: "",
-		},
-		{
-			name:          "Info logs at info level",
-			loggerLevel:   "info",
-			testFunc:      func(l *Logger) { l.Info("test info") },
-			shouldLog:     true,
-			expectedLevel: "[INFO]",
-		},
-		{
-			name:          "Info logs at debug level",
-			loggerLevel:   "debug",
-			testFunc:      func(l *Logger) { l.Info("test info") },
-			shouldLog:     true,
-			expectedLevel: "[INFO]",
-		},
-
-		// Debug logs
-		{
-			name:          "Debug doesn't log at error level",
-			loggerLevel:   "error",
-			testFunc:      func(l *Logger) { l.Debug("test debug") },
-			shouldLog:     false,
-			expectedLevel: "",
-		},
-		{
-			name:          "Debug doesn't log at warn level",
-			loggerLevel:   "warn",
-			testFunc:      func(l *Logger) { l.Debug("test debug") },
-			shouldLog:     false,
-			expectedLevel: "",
-		},
-		{
-			name:          "Debug doesn't log at info level",
-			loggerLevel:   "info",
-			testFunc:      func(l *Logger) { l.Debug("test debug") },
-			shouldLog:     false,
-			expectedLevel: "",
-		},
-		{
-			name:          "Debug logs at debug level",
-			loggerLevel:   "debug",
-			testFunc:      func(l *Logger) { l.Debug("test debug") },
-			shouldLog:     true,
-			expectedLevel: "[DEBUG]",
+			name:       "Quiet blocker",
+			level:      "debug",
+			components: []string{" blocker = error "},
+			logged:     map[string][]slog.Level{LogComponentBlocker: {slog.LevelError}, LogComponentEnforcer: {slog.LevelDebug}},
+			dropped:    map[string][]slog.Level{LogComponentBlocker: {slog.LevelWarn}},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Capture log output
 			var buf bytes.Buffer
-			log.SetOutput(&buf)
-			defer log.SetOutput(nil)
-
-			logger := NewLogger(tt.loggerLevel)
-			tt.testFunc(logger)
-
-			output := buf.String()
-			if tt.shouldLog {
-				if output == "" {
-					t.Errorf("Expected log output but got none")
+			logs, err := NewLogger(LogFormatText, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := logs.SetLevels(tt.level, tt.components); err != nil {
+				t.Fatalf("SetLevels() error = %v", err)
+			}
+			for component, levels := range tt.logged {
+				for _, level := range levels {
+					buf.Reset()
+					logs.Component(component).Log(t.Context(), level, "test")
+					if !strings.Contains(buf.String(), "component="+component) {
+						t.Errorf("%s at %v not logged", component, level)
+					}
 				}
-				if !strings.Contains(output, tt.expectedLevel) {
-					t.Errorf("Expected log to contain %q, got: %q", tt.expectedLevel, output)
+			}
+			for component, levels := range tt.dropped {
+				for _, level := range levels {
+					buf.Reset()
+					logs.Component(component).Log(t.Context(), level, "test")
+					if buf.Len() > 0 {
+						t.Errorf("%s at %v logged: %q", component, level, buf.String())
+					}
 				}
-			} else if output != "" {
-				t.Errorf("Expected no log output but got: %q", output)
 			}
 		})
 	}
 }
 
-func TestLoggerFormatting(t *testing.T) {
-	tests := []struct {
-		name         string
-		logFunc      func(*Logger)
-		expectedText string
+func TestLogger_SetLevelsInvalid(t *testing.T) {
+	logs, err := NewLogger(LogFormatText, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		level      string
+		components []string
 	}{
-		{
-			name: "Error with formatting",
-			logFunc: func(l *Logger) {
-				l.Error("error code %d: %s", 404, "not found")
-			},
-			expectedText: "error code 404: not found",
-		},
-		{
-			name: "Warn with formatting",
-			logFunc: func(l *Logger) {
-				l.Warn("warning: %s", "low disk space")
-			},
-			expectedText: "warning: low disk space",
-		},
-		{
-			name: "Info with formatting",
-			logFunc: func(l *Logger) {
-				l.Info("server started on port %d", 8080)
-			},
-			expectedText: "server started on port 8080",
-		},
-		{
-			name: "Debug with formatting",
-			logFunc: func(l *Logger) {
-				l.Debug("processing %d items", 100)
-			},
-			expectedText: "processing 100 items",
-		},
+		{"loud", nil},
+		{"info", []string{"xdp"}},
+		{"info", []string{"kernel=debug"}},
+		{"info", []string{"xdp=loud"}},
+	} {
+		if err := logs.SetLevels(tt.level, tt.components); err == nil {
+			t.Errorf("SetLevels(%q, %q) should fail", tt.level, tt.components)
+		}
+	}
+	if got := logs.Level(LogComponentXDP); got != slog.LevelInfo {
+		t.Errorf("Rejected SetLevels changed the xdp level to %v", got)
 	}
+}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// Capture log output
-			var buf bytes.Buffer
-			log.SetOutput(&buf)
-			defer log.SetOutput(nil)
+func TestSinkHandler(t *testing.T) {
+	var gotLevel slog.Level
+	var gotLine string
+	var gotFields []logField
+	sink := func(level slog.Level, msg string, fields []logField) error {
+		gotLevel, gotLine, gotFields = level, formatLogLine(msg, fields), fields
+		return nil
+	}
 
-			logger := NewLogger("debug")
-			tt.logFunc(logger)
+	logger := slog.New(&sinkHandler{sink: sink}).With("component", "xdp").WithGroup("ban")
+	logger.Warn("Prefix banned", "prefix", "10.0.0.0/24", slog.Group("policy", "window", "1h0m0s"), "reason", "too many bans")
 
-			output := buf.String()
-			if !strings.Contains(output, tt.expectedText) {
-				t.Errorf("Expected log to contain %q, got: %q", tt.expectedText, output)
-			}
-		})
+	if gotLevel != slog.LevelWarn {
+		t.Errorf("Level = %v, want WARN", gotLevel)
+	}
+	want := `Prefix banned component=xdp ban.prefix=10.0.0.0/24 ban.policy.window=1h0m0s ban.reason="too many bans"`
+	if gotLine != want {
+		t.Errorf("Line = %q, want %q", gotLine, want)
+	}
+	if len(gotFields) != 4 || gotFields[2].key != "ban.policy.window" {
+		t.Errorf("Fields = %+v", gotFields)
+	}
+}
+
+func TestProcessNFQPacket_DetectionEvent(t *testing.T) {
+	b := newTestBlocker(t, DefaultConfig())
+	var buf bytes.Buffer
+	logs, err := NewLogger(LogFormatJSON, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.logs, b.logger = logs, logs.Component(LogComponentBlocker)
+
+	b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, []byte("\x13BitTorrent protocol")), 2)
+
+	var event map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("Invalid JSON log line %q: %v", line, err)
+		}
+		if rec["msg"] == "BitTorrent detected" {
+			event = rec
+		}
+	}
+	if event == nil {
+		t.Fatalf("No detection event in %q", buf.String())
+	}
+	for key, want := range map[string]any{
+		"component": LogComponentBlocker,
+		"proto":     "TCP",
+		"src_ip":    "10.0.0.3",
+		"src_port":  float64(40000),
+		"action":    DetectionActionDrop,
+		"queue":     float64(2),
+	} {
+		if event[key] != want {
+			t.Errorf("%s = %v, want %v", key, event[key], want)
+		}
+	}
+	if event["reason"] == "" || event["dst_ip"] == nil || event["dst_port"] == nil {
+		t.Errorf("Detection event missing fields: %v", event)
 	}
 }
@@ -0,0 +1,167 @@
+package blocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/example/BitTorrentBlocker/internal/enforcer"
+	"github.com/example/BitTorrentBlocker/internal/metrics"
+	"github.com/example/BitTorrentBlocker/internal/xdp"
+	nfqueue "github.com/florianl/go-nfqueue/v2"
+)
+
+// detectorLatencyBuckets are histogram bounds in seconds for a single detector call
+// Detectors range from a few nanoseconds (port checks) to about a microsecond (MSE, entropy)
+var detectorLatencyBuckets = []float64{
+	100e-9, 250e-9, 500e-9, 1e-6, 2.5e-6, 5e-6, 10e-6, 25e-6, 100e-6, 1e-3,
+}
+
+// blockerMetrics holds the Prometheus metrics exported by the blocker
+type blockerMetrics struct {
+	registry *metrics.Registry
+
+	packets         *metrics.Counter
+	verdicts        *metrics.CounterVec
+	detections      *metrics.CounterVec
+	detectorLatency *metrics.HistogramVec
+	bannedHits      *metrics.CounterVec
+	allowlisted     *metrics.Counter
+	queueErrors     *metrics.CounterVec
+}
+
+// newBlockerMetrics registers the blocker metrics
+// xdpFilter and flows may be nil, in which case their gauges are not exported
+func newBlockerMetrics(b *Blocker) *blockerMetrics {
+	r := metrics.NewRegistry()
+	m := &blockerMetrics{
+		registry: r,
+		packets: r.NewCounter("btblocker_packets_processed_total",
+			"Packets received from NFQUEUE"),
+		verdicts: r.NewCounterVec("btblocker_verdicts_total",
+			"NFQUEUE verdicts issued", "verdict"),
+		detections: r.NewCounterVec("btblocker_detections_total",
+			"BitTorrent detections by reason (first packet of each detected flow)", "reason"),
+		detectorLatency: r.NewHistogramVec("btblocker_detector_duration_seconds",
+			"Time spent in a single detector call", "detector", detectorLatencyBuckets),
+		bannedHits: r.NewCounterVec("btblocker_blocklist_hits_total",
+			"Packets that reached NFQUEUE from an already banned IP and were dropped", "backend"),
+		allowlisted: r.NewCounter("btblocker_allowlisted_packets_total",
+			"Packets from or to an allowlisted address, accepted without inspection"),
+		queueErrors: r.NewCounterVec("btblocker_nfqueue_errors_total",
+			"Errors reported while reading from NFQUEUE", "queue"),
+	}
+
+	const blockedHelp = "IPs currently banned by the enforcement backend"
+	switch {
+	case b.xdpFilter != nil:
+		mapMgr := b.xdpFilter.GetMapManager()
+		r.NewLabeledGaugeFunc("btblocker_blocked_ips", blockedHelp, "backend", enforcer.BackendXDP, func() float64 {
+			return float64(mapMgr.GetBlockedCount())
+		})
+	case b.enforcer != nil:
+		backend := b.enforcer
+		r.NewLabeledGaugeFunc("btblocker_blocked_ips", blockedHelp, "backend", backend.Name(), func() float64 {
+			bans, err := backend.List()
+			if err != nil {
+				return 0
+			}
+			return float64(len(bans))
+		})
+	case b.bans != nil:
+		// Without a backend the ban journal is enforced inline
+		bans := b.bans
+		r.NewLabeledGaugeFunc("btblocker_blocked_ips", blockedHelp, "backend", enforcer.BackendNone, func() float64 {
+			return float64(len(bans.Active(time.Now())))
+		})
+	}
+
+	if b.xdpFilter != nil {
+		mapMgr := b.xdpFilter.GetMapManager()
+
+		// Counted per CPU by the XDP program itself
+		xdpTotal := func(field func(xdp.Totals) uint64) func() float64 {
+			return func() float64 {
+				totals, err := mapMgr.GetTotals()
+				if err != nil {
+					return 0
+				}
+				return float64(field(totals))
+			}
+		}
+		r.NewCounterFunc("btblocker_xdp_dropped_packets_total", "Packets dropped by the XDP program",
+			xdpTotal(func(t xdp.Totals) uint64 { return t.DroppedPackets }))
+		r.NewCounterFunc("btblocker_xdp_dropped_bytes_total", "Bytes dropped by the XDP program",
+			xdpTotal(func(t xdp.Totals) uint64 { return t.DroppedBytes }))
+		r.NewCounterFunc("btblocker_xdp_passed_packets_total", "Packets passed by the XDP program",
+			xdpTotal(func(t xdp.Totals) uint64 { return t.PassedPackets }))
+	}
+	if b.flows != nil {
+		flows := b.flows
+		r.NewGaugeFunc("btblocker_flows", "Flows currently tracked", func() float64 {
+			return float64(flows.Len())
+		})
+	}
+
+	return m
+}
+
+// observeDetector records the latency of one detector call
+func (m *blockerMetrics) observeDetector(detector string, elapsed time.Duration) {
+	m.detectorLatency.WithLabel(detector).Observe(elapsed)
+}
+
+// countVerdict records an NFQUEUE verdict
+func (m *blockerMetrics) countVerdict(verdict int) {
+	if verdict == nfqueue.NfDrop {
+		m.verdicts.WithLabel("drop").Inc()
+	} else {
+		m.verdicts.WithLabel("accept").Inc()
+	}
+}
+
+// countBlocklistHit records a packet dropped because its source is already banned
+func (m *blockerMetrics) countBlocklistHit(backend string) {
+	m.bannedHits.WithLabel(backend).Inc()
+}
+
+// countQueueError records an NFQUEUE read error
+func (m *blockerMetrics) countQueueError(queueNum uint16) {
+	m.queueErrors.WithLabel(strconv.Itoa(int(queueNum))).Inc()
+}
+
+// serveMetrics starts serving /metrics on addr until ctx is canceled
+// The listener is opened synchronously so a bad address fails startup.
+func (b *Blocker) serveMetrics(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", b.metrics.registry.Handler())
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			b.logger.Error("Metrics endpoint failed", "error", err)
+		}
+	}()
+
+	b.logger.Info("Metrics endpoint listening", "url", "http://"+ln.Addr().String()+"/metrics")
+	return nil
+}
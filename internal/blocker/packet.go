@@ -0,0 +1,89 @@
+package blocker
+
+import (
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packetInfo holds the fields of an IP packet needed for DPI
+type packetInfo struct {
+	srcIP   net.IP
+	dstIP   net.IP
+	srcPort uint16
+	dstPort uint16
+	isUDP   bool
+	isIPv6  bool
+	payload []byte // Application layer payload (TCP/UDP payload)
+}
+
+// decodeOptions are shared by all packet decoding in the NFQUEUE hot path
+var decodeOptions = gopacket.DecodeOptions{
+	Lazy:   true,
+	NoCopy: true, // Zero-copy for performance
+}
+
+// parsePacket decodes a raw IP packet (as delivered by NFQUEUE, without a link layer)
+// Both IPv4 and IPv6 are supported; IPv6 extension headers (hop-by-hop, routing,
+// destination options, AH and the first fragment) are walked to reach TCP/UDP.
+// Returns false if the packet is not TCP or UDP over IP.
+func parsePacket(data []byte) (packetInfo, bool) {
+	var info packetInfo
+	if len(data) == 0 {
+		return info, false
+	}
+
+	// The IP version nibble tells us which decoder to start with
+	var packet gopacket.Packet
+	switch data[0] >> 4 {
+	case 4:
+		packet = gopacket.NewPacket(data, layers.LayerTypeIPv4, decodeOptions)
+		ipLayer, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if !ok {
+			return info, false
+		}
+		info.srcIP, info.dstIP = ipLayer.SrcIP, ipLayer.DstIP
+	case 6:
+		packet = gopacket.NewPacket(data, layers.LayerTypeIPv6, decodeOptions)
+		ipLayer, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		if !ok {
+			return info, false
+		}
+		info.srcIP, info.dstIP = ipLayer.SrcIP, ipLayer.DstIP
+		info.isIPv6 = true
+
+		// gopacket hands every fragment to the fragment decoder, including the
+		// first one which still carries the transport header - decode it ourselves
+		if frag, ok := packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment); ok {
+			if frag.FragmentOffset != 0 {
+				return info, false // Non-first fragment, no transport header
+			}
+			packet = gopacket.NewPacket(frag.Payload, frag.NextHeader.LayerType(), decodeOptions)
+		}
+	default:
+		return info, false
+	}
+
+	return info, parseTransport(packet, &info)
+}
+
+// parseTransport extracts ports and payload from the TCP or UDP layer of a packet
+func parseTransport(packet gopacket.Packet, info *packetInfo) bool {
+	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+		tcp, _ := tcpLayer.(*layers.TCP)
+		info.srcPort, info.dstPort = uint16(tcp.SrcPort), uint16(tcp.DstPort)
+		info.payload = tcp.Payload
+		return true
+	}
+
+	if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
+		udp, _ := udpLayer.(*layers.UDP)
+		info.srcPort, info.dstPort = uint16(udp.SrcPort), uint16(udp.DstPort)
+		info.payload = udp.Payload
+		info.isUDP = true
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,185 @@
+package blocker
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// serializeIPPacket builds a raw IP packet (no link layer) from the given layers
+func serializeIPPacket(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		t.Fatalf("Failed to serialize packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestParsePacket_IPv4TCP(t *testing.T) {
+	payload := []byte("\x13BitTorrent protocol")
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP("10.0.0.1"),
+		DstIP:    net.ParseIP("10.0.0.2"),
+	}
+	tcp := &layers.TCP{SrcPort: 51413, DstPort: 6881, PSH: true, ACK: true, Window: 1024}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+
+	pkt, ok := parsePacket(serializeIPPacket(t, ip, tcp, gopacket.Payload(payload)))
+	if !ok {
+		t.Fatal("parsePacket() failed for IPv4/TCP packet")
+	}
+	if pkt.isIPv6 || pkt.isUDP {
+		t.Errorf("isIPv6=%v isUDP=%v, want false/false", pkt.isIPv6, pkt.isUDP)
+	}
+	if pkt.srcIP.String() != "10.0.0.1" || pkt.dstIP.String() != "10.0.0.2" {
+		t.Errorf("addresses = %s -> %s, want 10.0.0.1 -> 10.0.0.2", pkt.srcIP, pkt.dstIP)
+	}
+	if pkt.srcPort != 51413 || pkt.dstPort != 6881 {
+		t.Errorf("ports = %d -> %d, want 51413 -> 6881", pkt.srcPort, pkt.dstPort)
+	}
+	if !bytes.Equal(pkt.payload, payload) {
+		t.Errorf("payload = %q, want %q", pkt.payload, payload)
+	}
+}
+
+func TestParsePacket_IPv6UDP(t *testing.T) {
+	payload := []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe")
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	udp := &layers.UDP{SrcPort: 6881, DstPort: 6881}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+
+	pkt, ok := parsePacket(serializeIPPacket(t, ip, udp, gopacket.Payload(payload)))
+	if !ok {
+		t.Fatal("parsePacket() failed for IPv6/UDP packet")
+	}
+	if !pkt.isIPv6 || !pkt.isUDP {
+		t.Errorf("isIPv6=%v isUDP=%v, want true/true", pkt.isIPv6, pkt.isUDP)
+	}
+	if pkt.srcIP.String() != "2001:db8::1" || pkt.dstIP.String() != "2001:db8::2" {
+		t.Errorf("addresses = %s -> %s, want 2001:db8::1 -> 2001:db8::2", pkt.srcIP, pkt.dstIP)
+	}
+	if !bytes.Equal(pkt.payload, payload) {
+		t.Errorf("payload = %q, want %q", pkt.payload, payload)
+	}
+
+	// The parsed payload must be detected like an IPv4 one
+	result := NewAnalyzer(DefaultConfig()).AnalyzePacketEx(pkt.payload, pkt.isUDP, pkt.dstIP.String(), pkt.dstPort)
+	if !result.ShouldBlock {
+		t.Error("DHT query over IPv6 should be detected")
+	}
+}
+
+// ipv6ExtHeader builds a minimal 8-byte IPv6 extension header padded with PadN
+func ipv6ExtHeader(next layers.IPProtocol) []byte {
+	return []byte{byte(next), 0, 1, 4, 0, 0, 0, 0}
+}
+
+func TestParsePacket_IPv6ExtensionHeaders(t *testing.T) {
+	payload := []byte("\x13BitTorrent protocol")
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolIPv6Destination,
+		SrcIP:      net.ParseIP("2001:db8::10"),
+		DstIP:      net.ParseIP("2001:db8::20"),
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 51413, PSH: true, ACK: true, Window: 1024}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+	inner := serializeIPPacket(t, tcp, gopacket.Payload(payload))
+
+	// IPv6 -> Destination Options -> TCP
+	var chain []byte
+	chain = append(chain, ipv6ExtHeader(layers.IPProtocolTCP)...)
+	chain = append(chain, inner...)
+
+	pkt, ok := parsePacket(serializeIPPacket(t, ip, gopacket.Payload(chain)))
+	if !ok {
+		t.Fatal("parsePacket() failed to walk IPv6 destination options header")
+	}
+	if pkt.srcPort != 40000 || pkt.dstPort != 51413 {
+		t.Errorf("ports = %d -> %d, want 40000 -> 51413", pkt.srcPort, pkt.dstPort)
+	}
+	if !bytes.Equal(pkt.payload, payload) {
+		t.Errorf("payload = %q, want %q", pkt.payload, payload)
+	}
+}
+
+func TestParsePacket_IPv6Fragments(t *testing.T) {
+	payload := []byte("\x13BitTorrent protocol")
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolIPv6Fragment,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	udp := &layers.UDP{SrcPort: 6881, DstPort: 6882}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+	inner := serializeIPPacket(t, udp, gopacket.Payload(payload))
+
+	build := func(offset uint16) []byte {
+		frag := []byte{byte(layers.IPProtocolUDP), 0, byte(offset >> 5), byte(offset<<3) | 1, 0, 0, 0, 42}
+		return serializeIPPacket(t, ip, gopacket.Payload(append(frag, inner...)))
+	}
+
+	// First fragment carries the UDP header
+	pkt, ok := parsePacket(build(0))
+	if !ok {
+		t.Fatal("parsePacket() failed for first IPv6 fragment")
+	}
+	if !pkt.isUDP || pkt.srcPort != 6881 || pkt.dstPort != 6882 {
+		t.Errorf("first fragment parsed as udp=%v %d -> %d, want UDP 6881 -> 6882", pkt.isUDP, pkt.srcPort, pkt.dstPort)
+	}
+
+	// Later fragments have no transport header
+	if _, ok := parsePacket(build(100)); ok {
+		t.Error("parsePacket() should reject non-first IPv6 fragments")
+	}
+}
+
+func TestParsePacket_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"Empty", nil},
+		{"Unknown IP version", []byte{0x50, 0x00, 0x00, 0x00}},
+		{"Truncated IPv4", []byte{0x45, 0x00}},
+		{"Truncated IPv6", []byte{0x60, 0x00, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := parsePacket(tt.data); ok {
+				t.Errorf("parsePacket(%x) should fail", tt.data)
+			}
+		})
+	}
+
+	// ICMP is neither TCP nor UDP
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    net.ParseIP("10.0.0.1"),
+		DstIP:    net.ParseIP("10.0.0.2"),
+	}
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)}
+	if _, ok := parsePacket(serializeIPPacket(t, ip, icmp)); ok {
+		t.Error("parsePacket() should reject ICMP packets")
+	}
+}
@@ -0,0 +1,100 @@
+package blocker
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Minimal pcapng encoder for detected packets
+// gopacket's NgWriter cannot attach comments to packets, so the three block
+// types needed are written directly: one section header, one interface
+// (raw IPv4/IPv6, nanosecond timestamps) and an enhanced packet block per
+// detection with its comments. See RFC draft-ietf-opsawg-pcapng.
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1A2B3C4D
+
+	pcapngOptEnd         = 0
+	pcapngOptComment     = 1
+	pcapngOptUserAppl    = 4 // Section header: application that wrote the file
+	pcapngOptIfName      = 2 // Interface description: name
+	pcapngOptIfTSResol   = 9 // Interface description: timestamp resolution
+	pcapngLinkTypeRaw    = 101
+	pcapngSnapLen        = 65535
+	pcapngTSResolNanosec = 9
+)
+
+// pcapngHeader returns the section header and interface description blocks that start every file
+func pcapngHeader() []byte {
+	shb := make([]byte, 0, 64)
+	shb = binary.LittleEndian.AppendUint32(shb, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // Version 1.0
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0)) // Section length not specified
+	shb = appendPcapngOption(shb, pcapngOptUserAppl, []byte("btblocker"))
+	shb = appendPcapngOption(shb, pcapngOptEnd, nil)
+
+	idb := make([]byte, 0, 32)
+	idb = binary.LittleEndian.AppendUint16(idb, pcapngLinkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0) // Reserved
+	idb = binary.LittleEndian.AppendUint32(idb, pcapngSnapLen)
+	idb = appendPcapngOption(idb, pcapngOptIfName, []byte("nfqueue"))
+	idb = appendPcapngOption(idb, pcapngOptIfTSResol, []byte{pcapngTSResolNanosec})
+	idb = appendPcapngOption(idb, pcapngOptEnd, nil)
+
+	return appendPcapngBlock(appendPcapngBlock(nil, pcapngSectionHeader, shb), pcapngInterface, idb)
+}
+
+// pcapngPacket returns an enhanced packet block holding one raw IP packet and its comments
+func pcapngPacket(ts time.Time, packet []byte, comments ...string) []byte {
+	captured := packet
+	if len(captured) > pcapngSnapLen {
+		captured = captured[:pcapngSnapLen]
+	}
+	ns := uint64(ts.UnixNano())
+
+	body := make([]byte, 0, 20+len(captured)+64)
+	body = binary.LittleEndian.AppendUint32(body, 0) // Interface ID
+	body = binary.LittleEndian.AppendUint32(body, uint32(ns>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ns))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(captured)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+	body = appendPcapngPadded(body, captured)
+	for _, comment := range comments {
+		body = appendPcapngOption(body, pcapngOptComment, []byte(comment))
+	}
+	if len(comments) > 0 {
+		body = appendPcapngOption(body, pcapngOptEnd, nil)
+	}
+	return appendPcapngBlock(nil, pcapngEnhancedPacket, body)
+}
+
+// appendPcapngBlock appends a block: type, total length, body, total length
+func appendPcapngBlock(dst []byte, blockType uint32, body []byte) []byte {
+	total := uint32(12 + len(body)) // Bodies are already padded to 32 bits
+	dst = binary.LittleEndian.AppendUint32(dst, blockType)
+	dst = binary.LittleEndian.AppendUint32(dst, total)
+	dst = append(dst, body...)
+	return binary.LittleEndian.AppendUint32(dst, total)
+}
+
+// appendPcapngOption appends an option: code, length, value padded to 32 bits
+func appendPcapngOption(dst []byte, code uint16, value []byte) []byte {
+	if len(value) > 0xFFFF {
+		value = value[:0xFFFF]
+	}
+	dst = binary.LittleEndian.AppendUint16(dst, code)
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(len(value)))
+	return appendPcapngPadded(dst, value)
+}
+
+// appendPcapngPadded appends data followed by zeros up to a 32-bit boundary
+func appendPcapngPadded(dst, data []byte) []byte {
+	dst = append(dst, data...)
+	for pad := (4 - len(data)%4) % 4; pad > 0; pad-- {
+		dst = append(dst, 0)
+	}
+	return dst
+}
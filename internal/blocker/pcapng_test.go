@@ -0,0 +1,117 @@
+package blocker
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestDetectionLogger_Pcapng(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "detections.pcapng")
+	logger, err := NewDetectionLoggerWithOptions("", DetectionLogOptions{
+		Format:          DetectionLogText,
+		MaxPayloadBytes: 512,
+		PayloadEncoding: "hex",
+		PcapPath:        path,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	if !logger.active || logger.file != nil {
+		t.Fatal("A pcapng-only logger should be active without a text log")
+	}
+
+	packets := [][]byte{
+		tcpPacket(t, "10.0.0.3", 40000, []byte("\x13BitTorrent protocol")),
+		tcpPacket(t, "10.0.0.4", 40001, []byte("\x13BitTorrent protocol ")), // Odd length exercises padding
+	}
+	ts := time.Date(2024, 1, 15, 18, 46, 57, 123456789, time.UTC)
+	for i, pkt := range packets {
+		logger.LogDetection(Detection{
+			Timestamp: ts.Add(time.Duration(i) * time.Second),
+			Queue:     3,
+			Reason:    "BitTorrent handshake",
+			Action:    DetectionActionBan,
+			Packet:    pkt,
+		})
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, comment := range []string{"reason: BitTorrent handshake", "queue: 3", "verdict: drop", "action: ban"} {
+		if !bytes.Contains(content, []byte(comment)) {
+			t.Errorf("pcapng file missing packet comment %q", comment)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewNgReader(f, pcapgo.NgReaderOptions{})
+	if err != nil {
+		t.Fatalf("Not a valid pcapng file: %v", err)
+	}
+	if r.LinkType() != layers.LinkTypeRaw {
+		t.Errorf("LinkType = %v, want raw IP", r.LinkType())
+	}
+	for i, want := range packets {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatalf("Packet %d: %v", i, err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("Packet %d differs from the detected packet", i)
+		}
+		if wantTS := ts.Add(time.Duration(i) * time.Second); !ci.Timestamp.Equal(wantTS) {
+			t.Errorf("Packet %d timestamp = %v, want %v", i, ci.Timestamp, wantTS)
+		}
+	}
+
+	// Samples can be fed straight back into offline analysis
+	c, err := NewCaptureAnalyzer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AnalyzeFile(path); err != nil {
+		t.Fatalf("AnalyzeFile() error = %v", err)
+	}
+	if got := c.Summary().BitTorrentFlows; got != 2 {
+		t.Errorf("BitTorrent flows = %d, want 2", got)
+	}
+}
+
+func TestProcessNFQPacket_DetectionPcap(t *testing.T) {
+	config := DefaultConfig()
+	config.MonitorOnly = true
+	config.DetectionPcapPath = filepath.Join(t.TempDir(), "detections.pcapng")
+	b := newTestBlocker(t, config)
+
+	pkt := tcpPacket(t, "10.0.0.3", 40000, []byte("\x13BitTorrent protocol"))
+	b.processNFQPacket(pkt, 7)
+	_ = b.detectionLogger.Close()
+
+	content, err := os.ReadFile(config.DetectionPcapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(content, pkt) {
+		t.Error("pcapng file should hold the full IP packet")
+	}
+	for _, comment := range []string{"queue: 7", "verdict: accept", "action: monitor"} {
+		if !bytes.Contains(content, []byte(comment)) {
+			t.Errorf("pcapng file missing packet comment %q", comment)
+		}
+	}
+}
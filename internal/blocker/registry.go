@@ -0,0 +1,183 @@
+package blocker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Transport is the set of transports a detector inspects
+type Transport uint8
+
+const (
+	TransportTCP Transport = 1 << iota
+	TransportUDP
+	TransportAny = TransportTCP | TransportUDP
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportTCP:
+		return "tcp"
+	case TransportUDP:
+		return "udp"
+	case TransportAny:
+		return "tcp,udp"
+	}
+	return fmt.Sprintf("transport(%d)", uint8(t))
+}
+
+// Cost is the cost class of a detector
+// The classes follow the benchmarks in detectors_test.go.
+type Cost uint8
+
+const (
+	CostCheap     Cost = iota // Header checks and short scans, under 5 ns/op
+	CostModerate              // Payload scans, under 100 ns/op
+	CostExpensive             // Statistical checks such as entropy, around 1 µs/op
+)
+
+func (c Cost) String() string {
+	switch c {
+	case CostCheap:
+		return "cheap"
+	case CostModerate:
+		return "moderate"
+	case CostExpensive:
+		return "expensive"
+	}
+	return fmt.Sprintf("cost(%d)", uint8(c))
+}
+
+// Detector is one check of the DPI pipeline
+type Detector interface {
+	ID() string           // Short stable name used in Config.Detectors and metrics, e.g. "utp"
+	Reason() string       // AnalysisResult.Reason of a match
+	Transport() Transport // Transports the detector inspects
+	Cost() Cost           // Cost class, shown by "btblocker config detectors"
+	// Check reports whether payload is BitTorrent traffic
+	// destIP and destPort are empty for reassembled flow prefixes.
+	Check(payload []byte, destIP string, destPort uint16) bool
+}
+
+// Detector modes (Config.Detectors)
+const (
+	DetectorOn      = "on"  // Matches are blocked
+	DetectorOff     = "off" // Not run
+	DetectorLogOnly = "log" // Matches are logged, the packet is accepted
+)
+
+// builtinDetector is a Detector backed by one of the Check* functions
+type builtinDetector struct {
+	id        string
+	reason    string
+	transport Transport
+	cost      Cost
+	stream    int  // Position in the pipeline run on reassembled TCP flow prefixes, 0 = not run there
+	off       bool // Off unless enabled in Config.Detectors
+	check     func(payload []byte, destIP string, destPort uint16) bool
+}
+
+func (d *builtinDetector) ID() string           { return d.id }
+func (d *builtinDetector) Reason() string       { return d.reason }
+func (d *builtinDetector) Transport() Transport { return d.transport }
+func (d *builtinDetector) Cost() Cost           { return d.cost }
+
+func (d *builtinDetector) Check(payload []byte, destIP string, destPort uint16) bool {
+	return d.check(payload, destIP, destPort)
+}
+
+// payloadOnly adapts a check that only looks at the payload
+func payloadOnly(check func([]byte) bool) func([]byte, string, uint16) bool {
+	return func(payload []byte, _ string, _ uint16) bool {
+		return check(payload)
+	}
+}
+
+// detectorRegistry lists the built-in detectors in pipeline order
+// The order is the hand-tuned one of the original TCP and UDP fast paths
+// (mostly cheapest first, socks last); TestDetectorOrder pins it.
+var detectorRegistry = []*builtinDetector{
+	{id: "lsd", reason: "Local Service Discovery (BEP 14)", transport: TransportUDP, cost: CostCheap,
+		check: func(payload []byte, destIP string, destPort uint16) bool {
+			return destIP != "" && CheckLSD(payload, destIP, destPort)
+		}},
+	{id: "utp", reason: "uTP Protocol (BEP 29)", transport: TransportUDP, cost: CostCheap, check: payloadOnly(CheckUTPRobust)},
+	{id: "fast_extension", reason: "FAST Extension Message (BEP 6)", transport: TransportTCP, cost: CostCheap, check: payloadOnly(CheckFASTExtension)},
+	{id: "extended_message", reason: "Extension Protocol Message (BEP 10)", transport: TransportTCP, cost: CostCheap, off: true,
+		check: payloadOnly(CheckExtendedMessage)},
+	{id: "bittorrent_message", reason: "BitTorrent Message Structure", transport: TransportTCP, cost: CostCheap, check: payloadOnly(CheckBitTorrentMessage)},
+	{id: "dht_bencode", reason: "DHT Bencode Structure (BEP 5)", transport: TransportAny, cost: CostCheap, check: payloadOnly(CheckBencodeDHT)},
+	{id: "udp_tracker", reason: "UDP Tracker Protocol", transport: TransportUDP, cost: CostCheap, check: payloadOnly(CheckUDPTrackerDeep)},
+	{id: "http_bittorrent", reason: "HTTP BitTorrent Protocol (BEP 19)", transport: TransportTCP, cost: CostModerate, stream: 2,
+		check: payloadOnly(CheckHTTPBitTorrent)},
+	{id: "signatures", reason: "BitTorrent Signature", transport: TransportAny, cost: CostModerate, stream: 1, check: payloadOnly(CheckSignatures)},
+	{id: "dht_nodes", reason: "DHT Node List (BEP 5)", transport: TransportAny, cost: CostModerate, off: true, check: payloadOnly(CheckDHTNodes)},
+	{id: "mse", reason: "MSE/PE Encryption", transport: TransportTCP, cost: CostExpensive, stream: 3, check: payloadOnly(CheckMSEEncryption)},
+	{id: "socks", reason: "SOCKS Proxy Connection", transport: TransportTCP, cost: CostCheap, off: true, check: payloadOnly(CheckSOCKSConnection)},
+}
+
+// DetectorStatus is a built-in detector and its mode under a configuration
+type DetectorStatus struct {
+	Detector
+	Mode string // Detector* mode constant
+}
+
+// DetectorStatuses returns every built-in detector with its mode under config, in pipeline order
+// Config.Detectors overrides the defaults; BlockSOCKS turns on the socks detector.
+func DetectorStatuses(config Config) ([]DetectorStatus, error) {
+	modes, err := parseDetectorModes(config.Detectors)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]DetectorStatus, len(detectorRegistry))
+	for i, d := range detectorRegistry {
+		mode := DetectorOn
+		if d.off && !(d.id == "socks" && config.BlockSOCKS) {
+			mode = DetectorOff
+		}
+		if m, ok := modes[d.id]; ok {
+			mode = m
+		}
+		statuses[i] = DetectorStatus{Detector: d, Mode: mode}
+	}
+	return statuses, nil
+}
+
+// parseDetectorModes parses per-detector modes of the form "id=mode"
+func parseDetectorModes(entries []string) (map[string]string, error) {
+	modes := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		id, mode, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		id, mode = strings.TrimSpace(id), strings.TrimSpace(mode)
+		if !ok || lookupDetector(id) == nil {
+			return nil, fmt.Errorf("invalid detector mode %q (must be ID=MODE, detectors: %s)", entry, strings.Join(detectorIDs(), ", "))
+		}
+		switch mode {
+		case DetectorOn, DetectorOff, DetectorLogOnly:
+		default:
+			return nil, fmt.Errorf("invalid mode %q for detector %s (must be %s, %s or %s)",
+				mode, id, DetectorOn, DetectorOff, DetectorLogOnly)
+		}
+		modes[id] = mode
+	}
+	return modes, nil
+}
+
+// lookupDetector returns the built-in detector with the given ID, or nil
+func lookupDetector(id string) *builtinDetector {
+	for _, d := range detectorRegistry {
+		if d.id == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// detectorIDs returns the IDs of the built-in detectors
+func detectorIDs() []string {
+	ids := make([]string, len(detectorRegistry))
+	for i, d := range detectorRegistry {
+		ids[i] = d.id
+	}
+	return ids
+}
@@ -0,0 +1,171 @@
+package blocker
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	nfqueue "github.com/florianl/go-nfqueue/v2"
+)
+
+func TestDetectorRegistry(t *testing.T) {
+	seen := make(map[string]bool)
+	for i, d := range detectorRegistry {
+		if d.id == "" || d.reason == "" || d.check == nil || d.transport&TransportAny == 0 {
+			t.Errorf("Detector %d incomplete: %+v", i, d)
+		}
+		if seen[d.id] {
+			t.Errorf("Detector ID %q registered twice", d.id)
+		}
+		seen[d.id] = true
+		if d.stream > 0 && d.transport&TransportTCP == 0 {
+			t.Errorf("Stream detector %s does not inspect TCP", d.id)
+		}
+	}
+}
+
+func TestDetectorOrder(t *testing.T) {
+	ids := func(stages []stage) []string {
+		var ids []string
+		for _, s := range stages {
+			ids = append(ids, s.detector.ID())
+		}
+		return ids
+	}
+
+	// The order of the original hand-written fast paths; changing it changes
+	// which reason is reported when several detectors match
+	config := DefaultConfig()
+	config.Detectors = []string{"extended_message=on", "dht_nodes=on", "socks=on"}
+	a := NewAnalyzer(config)
+	for _, tc := range []struct {
+		name   string
+		stages []stage
+		want   []string
+	}{
+		{"tcp", a.tcp, []string{"fast_extension", "extended_message", "bittorrent_message", "dht_bencode",
+			"http_bittorrent", "signatures", "dht_nodes", "mse", "socks"}},
+		{"udp", a.udp, []string{"lsd", "utp", "dht_bencode", "udp_tracker", "signatures", "dht_nodes"}},
+		{"stream", a.stream, []string{"signatures", "http_bittorrent", "mse"}},
+	} {
+		if got := ids(tc.stages); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s pipeline = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseDetectorModes(t *testing.T) {
+	modes, err := parseDetectorModes([]string{"mse=log", " dht_nodes = on ", "utp=off"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modes["mse"] != DetectorLogOnly || modes["dht_nodes"] != DetectorOn || modes["utp"] != DetectorOff {
+		t.Errorf("parseDetectorModes() = %v", modes)
+	}
+	for _, entry := range []string{"mse", "nope=on", "mse=maybe", "=off"} {
+		if _, err := parseDetectorModes([]string{entry}); err == nil {
+			t.Errorf("parseDetectorModes(%q) should fail", entry)
+		}
+	}
+}
+
+func TestDetectorStatuses(t *testing.T) {
+	mode := func(statuses []DetectorStatus, id string) string {
+		for _, s := range statuses {
+			if s.ID() == id {
+				return s.Mode
+			}
+		}
+		return ""
+	}
+
+	statuses, err := DetectorStatuses(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]string{"utp": DetectorOn, "mse": DetectorOn, "socks": DetectorOff,
+		"extended_message": DetectorOff, "dht_nodes": DetectorOff} {
+		if got := mode(statuses, id); got != want {
+			t.Errorf("Default mode of %s = %q, want %q", id, got, want)
+		}
+	}
+
+	// BlockSOCKS turns socks on unless Detectors says otherwise
+	config := DefaultConfig()
+	config.BlockSOCKS = true
+	statuses, _ = DetectorStatuses(config)
+	if got := mode(statuses, "socks"); got != DetectorOn {
+		t.Errorf("socks with BlockSOCKS = %q, want on", got)
+	}
+	config.Detectors = []string{"socks=log"}
+	statuses, _ = DetectorStatuses(config)
+	if got := mode(statuses, "socks"); got != DetectorLogOnly {
+		t.Errorf("socks with BlockSOCKS and socks=log = %q, want log", got)
+	}
+}
+
+func TestAnalyzer_DetectorModes(t *testing.T) {
+	handshake := []byte("\x13BitTorrent protocol")
+	extended := []byte{0x00, 0x00, 0x00, 0x03, 0x14, 0x00, 'd'}
+
+	config := DefaultConfig()
+	config.Detectors = []string{"signatures=off"}
+	if result := NewAnalyzer(config).AnalyzePacket(handshake, false); result.ShouldBlock || result.LogOnly {
+		t.Errorf("Handshake with signatures off = %+v, want no match", result)
+	}
+
+	config.Detectors = []string{"signatures=log"}
+	result := NewAnalyzer(config).AnalyzePacket(handshake, false)
+	if result.ShouldBlock || !result.LogOnly || result.Reason != "BitTorrent Signature" {
+		t.Errorf("Handshake with signatures log-only = %+v, want a log-only signature match", result)
+	}
+
+	// A log-only match does not hide a blocking detector later in the pipeline
+	config.Detectors = []string{"extended_message=log"}
+	a := NewAnalyzer(config)
+	var ran []string
+	a.SetDetectorObserver(func(detector string, _ time.Duration) { ran = append(ran, detector) })
+	result = a.AnalyzePacket(extended, false)
+	if !result.ShouldBlock || result.LogOnly || result.Reason != "BitTorrent Message Structure" {
+		t.Errorf("Extended message with extended_message log-only = %+v, want blocked by bittorrent_message", result)
+	}
+	if len(ran) < 2 || ran[0] != "fast_extension" || ran[1] != "extended_message" {
+		t.Errorf("Detectors run = %v, want the enabled extended_message in pipeline order", ran)
+	}
+
+	config.Detectors = []string{"extended_message=on"}
+	if result := NewAnalyzer(config).AnalyzePacket(extended, false); result.Reason != "Extension Protocol Message (BEP 10)" {
+		t.Errorf("Extended message with extended_message on = %+v", result)
+	}
+}
+
+func TestProcessNFQPacket_LogOnlyDetector(t *testing.T) {
+	config := DefaultConfig()
+	config.FlowTableSize = 0
+	config.Detectors = []string{"signatures=log"}
+	b := newTestBlocker(t, config)
+	backend := &fakeBackend{banned: make(map[string]time.Duration)}
+	b.enforcer = backend
+	handshake := []byte("\x13BitTorrent protocol")
+
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, handshake), 0); v != nfqueue.NfAccept {
+		t.Errorf("Verdict of a log-only match = %d, want NfAccept", v)
+	}
+	if backend.IsBanned(net.ParseIP("10.0.0.3")) {
+		t.Error("Log-only match banned the source")
+	}
+
+	// Switching the detector on takes effect on reload
+	next := b.Config()
+	next.Detectors = nil
+	if _, err := b.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+	if v := b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40001, handshake), 0); v != nfqueue.NfDrop {
+		t.Errorf("Verdict after reload = %d, want NfDrop", v)
+	}
+	if !backend.IsBanned(net.ParseIP("10.0.0.3")) {
+		t.Error("Not banned after the detector was switched on")
+	}
+}
@@ -0,0 +1,139 @@
+package blocker
+
+import (
+	"sync"
+	"time"
+)
+
+// escalation maps the strike count of an address to its ban duration
+// Each detection ban is a strike; strikes count towards the next ban until
+// window has passed since the latest one, and one strike is forgiven per decay
+// period without a new one.
+type escalation struct {
+	ladder []time.Duration // Ban duration of the 1st, 2nd, ... strike; the last step repeats
+	window time.Duration   // Strikes older than this no longer count
+	decay  time.Duration   // One strike is forgiven per period without a new one (0 = no decay)
+}
+
+// newEscalation returns the ban ladder of config (disabled if BanLadder is empty)
+func newEscalation(config Config) escalation {
+	e := escalation{
+		window: time.Duration(config.BanStrikeWindow) * time.Second,
+		decay:  time.Duration(config.BanStrikeDecay) * time.Second,
+	}
+	for _, seconds := range config.BanLadder {
+		e.ladder = append(e.ladder, time.Duration(seconds)*time.Second)
+	}
+	return e
+}
+
+// enabled reports whether bans escalate
+func (e escalation) enabled() bool {
+	return len(e.ladder) > 0
+}
+
+// current returns how many of count strikes, the latest at last, still count at now
+func (e escalation) current(count int, last, now time.Time) int {
+	elapsed := now.Sub(last)
+	if count <= 0 || elapsed >= e.window {
+		return 0
+	}
+	if e.decay > 0 {
+		count -= int(elapsed / e.decay)
+	}
+	return max(count, 0)
+}
+
+// tier returns the ladder step (1-based) applied at the given strike count
+func (e escalation) tier(strikes int) int {
+	return min(max(strikes, 1), len(e.ladder))
+}
+
+// duration returns the ban duration at the given strike count
+func (e escalation) duration(strikes int) time.Duration {
+	return e.ladder[e.tier(strikes)-1]
+}
+
+// Strike is the offense history of one address
+type Strike struct {
+	Count int       // Strikes as of Last
+	Last  time.Time // Time of the latest strike
+}
+
+// strikeTable remembers strikes per address beyond the expiry of their bans
+// All methods are safe for concurrent use.
+type strikeTable struct {
+	mu      sync.Mutex
+	strikes map[string]Strike // IP -> history
+}
+
+func newStrikeTable() *strikeTable {
+	return &strikeTable{strikes: make(map[string]Strike)}
+}
+
+// add records an offense of ip and returns its history including it
+// An offense during the ban of the previous strike does not escalate, so packets
+// that reach the queue before the kernel ban takes effect count only once.
+func (t *strikeTable) add(ip string, now time.Time, e escalation) Strike {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev := t.strikes[ip]
+	strikes := e.current(prev.Count, prev.Last, now)
+	if strikes > 0 && now.Before(prev.Last.Add(e.duration(strikes))) {
+		return Strike{Count: strikes, Last: prev.Last}
+	}
+	s := Strike{Count: strikes + 1, Last: now}
+	t.strikes[ip] = s
+	return s
+}
+
+// get returns the strikes of ip that still count at now
+func (t *strikeTable) get(ip string, now time.Time, e escalation) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.strikes[ip]
+	return e.current(s.Count, s.Last, now)
+}
+
+// restore sets the history of ip, e.g. from the ban journal on startup
+func (t *strikeTable) restore(ip string, s Strike) {
+	t.mu.Lock()
+	t.strikes[ip] = s
+	t.mu.Unlock()
+}
+
+// forget clears the history of ip (a lifted ban was a mistake, or ip is allowlisted)
+func (t *strikeTable) forget(ip string) {
+	t.mu.Lock()
+	delete(t.strikes, ip)
+	t.mu.Unlock()
+}
+
+// forgetAll clears every history
+func (t *strikeTable) forgetAll() {
+	t.mu.Lock()
+	t.strikes = make(map[string]Strike)
+	t.mu.Unlock()
+}
+
+// expire drops the histories that no longer count and returns how many were dropped
+func (t *strikeTable) expire(now time.Time, e escalation) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed := 0
+	for ip, s := range t.strikes {
+		if e.current(s.Count, s.Last, now) == 0 {
+			delete(t.strikes, ip)
+			removed++
+		}
+	}
+	return removed
+}
+
+// len returns the number of addresses with a history
+func (t *strikeTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.strikes)
+}
@@ -0,0 +1,157 @@
+package blocker
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testEscalation() escalation {
+	config := DefaultConfig()
+	config.BanLadder = []int{600, 3600, 86400, 604800} // 10m, 1h, 24h, 7d
+	config.BanStrikeWindow = 30 * 86400
+	config.BanStrikeDecay = 7 * 86400
+	return newEscalation(config)
+}
+
+func TestStrikeTable_Escalates(t *testing.T) {
+	e := testEscalation()
+	e.decay = 0 // The 7d ban would otherwise decay a strike before the next offense
+	tbl := newStrikeTable()
+	now := time.Now()
+
+	want := []time.Duration{10 * time.Minute, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour, 7 * 24 * time.Hour}
+	for i, d := range want {
+		s := tbl.add("10.0.0.1", now, e)
+		if s.Count != i+1 || e.duration(s.Count) != d {
+			t.Errorf("Offense %d: strikes %d, ban %v, want %d, %v", i+1, s.Count, e.duration(s.Count), i+1, d)
+		}
+		now = now.Add(e.duration(s.Count) + time.Minute) // Next offense after the ban ran out
+	}
+}
+
+func TestStrikeTable_NoEscalationDuringBan(t *testing.T) {
+	e := testEscalation()
+	tbl := newStrikeTable()
+	now := time.Now()
+
+	tbl.add("10.0.0.1", now, e)
+	if s := tbl.add("10.0.0.1", now.Add(time.Second), e); s.Count != 1 || !s.Last.Equal(now) {
+		t.Errorf("Offense during the ban = %+v, want the first strike unchanged", s)
+	}
+}
+
+func TestStrikeTable_DecayAndWindow(t *testing.T) {
+	e := testEscalation()
+	tbl := newStrikeTable()
+	start := time.Now()
+	tbl.restore("10.0.0.1", Strike{Count: 3, Last: start})
+
+	for _, tt := range []struct {
+		after time.Duration
+		want  int
+	}{
+		{time.Hour, 3},
+		{8 * 24 * time.Hour, 2},  // One decay period
+		{15 * 24 * time.Hour, 1}, // Two decay periods
+		{29 * 24 * time.Hour, 0}, // Fully decayed
+	} {
+		if got := tbl.get("10.0.0.1", start.Add(tt.after), e); got != tt.want {
+			t.Errorf("Strikes after %v = %d, want %d", tt.after, got, tt.want)
+		}
+	}
+
+	// Without decay, strikes count for the whole window
+	e.decay = 0
+	if got := tbl.get("10.0.0.1", start.Add(29*24*time.Hour), e); got != 3 {
+		t.Errorf("Strikes inside the window without decay = %d, want 3", got)
+	}
+	if got := tbl.get("10.0.0.1", start.Add(31*24*time.Hour), e); got != 0 {
+		t.Errorf("Strikes after the window = %d, want 0", got)
+	}
+	if removed := tbl.expire(start.Add(31*24*time.Hour), e); removed != 1 || tbl.len() != 0 {
+		t.Errorf("expire() removed %d, %d left, want 1, 0", removed, tbl.len())
+	}
+}
+
+func TestProcessNFQPacket_EscalatingBans(t *testing.T) {
+	config := DefaultConfig()
+	config.FlowTableSize = 0
+	config.BanDBPath = filepath.Join(t.TempDir(), "bans.jsonl")
+	config.BanLadder = []int{600, 3600, 86400}
+	b := newTestBlocker(t, config)
+	backend := &fakeBackend{banned: make(map[string]time.Duration)}
+	b.enforcer = backend
+	handshake := []byte("\x13BitTorrent protocol")
+
+	b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40000, handshake), 0)
+	if d := backend.banned["10.0.0.3"]; d != 10*time.Minute {
+		t.Errorf("First ban = %v, want 10m", d)
+	}
+
+	// The ban runs out; the next offense climbs the ladder
+	b.strikes.restore("10.0.0.3", Strike{Count: 1, Last: time.Now().Add(-20 * time.Minute)})
+	_ = backend.Unban(net.ParseIP("10.0.0.3"))
+	b.processNFQPacket(tcpPacket(t, "10.0.0.3", 40001, handshake), 0)
+	if d := backend.banned["10.0.0.3"]; d != time.Hour {
+		t.Errorf("Second ban = %v, want 1h", d)
+	}
+
+	info, err := b.BanInfo(net.ParseIP("10.0.0.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Strikes != 2 || info.NextTier != 3 || info.NextBan != 86400 {
+		t.Errorf("BanInfo strikes %d, next tier %d, next ban %ds, want 2, 3, 86400s", info.Strikes, info.NextTier, info.NextBan)
+	}
+
+	// The strike history is journaled with the ban and restored on startup
+	rec, ok := b.bans.Get(net.ParseIP("10.0.0.3"))
+	if !ok || rec.Strikes != 2 || rec.StrikesUntil.IsZero() {
+		t.Fatalf("Journaled record = %+v, want 2 strikes", rec)
+	}
+	_ = b.Close()
+	b = newTestBlocker(t, config)
+	if got := b.strikes.get("10.0.0.3", time.Now(), b.live.Load().escalation); got != 2 {
+		t.Errorf("Restored strikes = %d, want 2", got)
+	}
+
+	// A manual unban forgets them
+	b.enforcer = &fakeBackend{banned: map[string]time.Duration{"10.0.0.3": time.Hour}}
+	if err := b.Unban(net.ParseIP("10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.strikes.get("10.0.0.3", time.Now(), b.live.Load().escalation); got != 0 {
+		t.Errorf("Strikes after unban = %d, want 0", got)
+	}
+}
+
+func TestBanStore_KeepsStrikesAfterExpiry(t *testing.T) {
+	s, err := OpenBanStore(filepath.Join(t.TempDir(), "bans.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Now()
+	ip := net.ParseIP("10.0.0.1")
+	_, _ = s.RecordStrike(ip, "test", now, now.Add(time.Minute), Strike{Count: 1, Last: now}, now.Add(time.Hour))
+	_, _ = s.Record(net.ParseIP("10.0.0.2"), "test", now, now.Add(time.Minute))
+
+	if removed, _ := s.Compact(now.Add(10 * time.Minute)); removed != 1 {
+		t.Errorf("Compact() removed %d, want only the ban without strikes", removed)
+	}
+	if s.IsBanned(ip, now.Add(10*time.Minute)) || len(s.Active(now.Add(10*time.Minute))) != 0 {
+		t.Error("Expired ban kept for its strikes must not count as active")
+	}
+
+	// A new ban starts a fresh record but keeps the strikes
+	rec, _ := s.Record(ip, "manual", now.Add(20*time.Minute), now.Add(time.Hour))
+	if rec.Hits != 1 || rec.Strikes != 1 {
+		t.Errorf("Record after expiry = %+v, want hits 1, strikes 1", rec)
+	}
+	if removed, _ := s.Compact(now.Add(2 * time.Hour)); removed != 1 {
+		t.Errorf("Compact() after the strike window removed %d, want 1", removed)
+	}
+}
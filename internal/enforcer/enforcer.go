@@ -0,0 +1,129 @@
+// Package enforcer applies IP bans decided by the blocker.
+//
+// A Backend keeps banned IPs out of the host until their ban expires. The XDP
+// blocklist is the fastest backend; nftables and ipset sets give hosts where
+// XDP cannot be loaded the same kernel-level bans.
+package enforcer
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Backend names accepted by ValidateBackend
+const (
+	BackendXDP      = "xdp"      // XDP blocklist map (default)
+	BackendNFTables = "nftables" // nftables named sets with per-element timeouts
+	BackendIPSet    = "ipset"    // ipset hash:ip sets matched by iptables rules
+	BackendNone     = "none"     // No kernel enforcement, detected packets are only dropped inline
+)
+
+// Ban is one banned IP as reported by a backend
+type Ban struct {
+	IP        net.IP
+	ExpiresAt time.Time
+}
+
+// Backend enforces IP bans in the kernel
+// Implementations must be safe for concurrent use; IsBanned is called for
+// every queued packet and must not block on the kernel.
+type Backend interface {
+	// Name returns the backend name (one of the Backend* constants)
+	Name() string
+	// Ban blocks ip for duration, extending an existing ban
+	Ban(ip net.IP, duration time.Duration) error
+	// Unban lifts a ban early
+	Unban(ip net.IP) error
+	// IsBanned reports whether ip is currently banned
+	IsBanned(ip net.IP) bool
+	// List returns all active bans
+	List() ([]Ban, error)
+	// Expire removes expired bans and returns how many were removed
+	Expire() (int, error)
+	// Close releases the backend; bans already in the kernel stay in place
+	Close() error
+}
+
+// Persistent is a backend whose kernel state (sets, rules, tables) outlives Close
+// so bans survive a restart. Teardown removes that state, lifting all bans, and
+// releases the backend; it replaces Close.
+type Persistent interface {
+	Backend
+	Teardown() error
+}
+
+// ValidateBackend checks that name is a known backend
+func ValidateBackend(name string) error {
+	switch name {
+	case BackendXDP, BackendNFTables, BackendIPSet, BackendNone:
+		return nil
+	default:
+		return fmt.Errorf("unknown enforcement backend %q (want %s, %s, %s or %s)",
+			name, BackendXDP, BackendNFTables, BackendIPSet, BackendNone)
+	}
+}
+
+// banCache mirrors the bans held in the kernel so IsBanned never needs a syscall
+// The kernel expires its own entries; the cache only has to agree with it.
+type banCache struct {
+	mu   sync.RWMutex
+	bans map[string]time.Time // IP string -> expiry
+}
+
+func newBanCache() *banCache {
+	return &banCache{bans: make(map[string]time.Time)}
+}
+
+// set records a ban of ip until expiresAt
+func (c *banCache) set(ip net.IP, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bans[ip.String()] = expiresAt
+}
+
+// remove forgets a ban
+func (c *banCache) remove(ip net.IP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.bans, ip.String())
+}
+
+// active reports whether ip has an unexpired ban at now
+func (c *banCache) active(ip net.IP, now time.Time) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	expiresAt, ok := c.bans[ip.String()]
+	return ok && expiresAt.After(now)
+}
+
+// expire removes bans that expired before now
+func (c *banCache) expire(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for ip, expiresAt := range c.bans {
+		if !expiresAt.After(now) {
+			delete(c.bans, ip)
+			removed++
+		}
+	}
+	return removed
+}
+
+// replace swaps the cache contents for bans read back from the kernel
+func (c *banCache) replace(bans []Ban) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bans = make(map[string]time.Time, len(bans))
+	for _, b := range bans {
+		c.bans[b.IP.String()] = b.ExpiresAt
+	}
+}
+
+// sortBans orders bans by expiry so listings are stable
+func sortBans(bans []Ban) {
+	sort.Slice(bans, func(i, j int) bool { return bans[i].ExpiresAt.Before(bans[j].ExpiresAt) })
+}
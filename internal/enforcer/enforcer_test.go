@@ -0,0 +1,48 @@
+package enforcer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestValidateBackend(t *testing.T) {
+	for _, name := range []string{BackendXDP, BackendNFTables, BackendIPSet, BackendNone} {
+		if err := ValidateBackend(name); err != nil {
+			t.Errorf("ValidateBackend(%q) = %v, want nil", name, err)
+		}
+	}
+	for _, name := range []string{"", "iptables", "XDP"} {
+		if err := ValidateBackend(name); err == nil {
+			t.Errorf("ValidateBackend(%q) should fail", name)
+		}
+	}
+}
+
+func TestBanCache(t *testing.T) {
+	c := newBanCache()
+	now := time.Now()
+	ip := net.ParseIP("10.0.0.1")
+
+	c.set(ip, now.Add(time.Minute))
+	c.set(net.ParseIP("10.0.0.2"), now.Add(-time.Second))
+	if !c.active(ip, now) {
+		t.Error("Unexpired ban should be active")
+	}
+	if c.active(ip, now.Add(2*time.Minute)) {
+		t.Error("Ban should not be active after its expiry")
+	}
+	if removed := c.expire(now); removed != 1 {
+		t.Errorf("expire() = %d, want 1", removed)
+	}
+
+	c.remove(ip)
+	if c.active(ip, now) {
+		t.Error("Removed ban should not be active")
+	}
+
+	c.replace([]Ban{{IP: net.ParseIP("2001:db8::1"), ExpiresAt: now.Add(time.Hour)}})
+	if !c.active(net.ParseIP("2001:db8::1"), now) || len(c.bans) != 1 {
+		t.Errorf("replace() should swap the cache contents, got %v", c.bans)
+	}
+}
@@ -0,0 +1,235 @@
+package enforcer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default ipset names, one per address family (hash:ip sets are single-family)
+const (
+	IPSetName4 = "btblocker4"
+	IPSetName6 = "btblocker6"
+)
+
+// ipsetMaxTimeout is the largest per-element timeout ipset accepts, in seconds
+const ipsetMaxTimeout = 2147483
+
+// commandRunner runs an external command and returns its combined output
+type commandRunner func(name string, args ...string) ([]byte, error)
+
+// runCommand is the default commandRunner
+func runCommand(name string, args ...string) ([]byte, error) {
+	out, err := exec.Command(name, args...).CombinedOutput() // #nosec G204 - fixed binaries, arguments built from parsed IPs
+	if err != nil {
+		return out, fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// ipsetRule is an iptables rule matching one set
+type ipsetRule struct {
+	iptables string // iptables or ip6tables
+	set      string
+}
+
+// args returns the raw PREROUTING rule dropping sources in the set
+func (r ipsetRule) args(action string) []string {
+	return []string{"-t", "raw", action, "PREROUTING", "-m", "set", "--match-set", r.set, "src", "-j", "DROP"}
+}
+
+// IPSet enforces bans through ipset hash:ip sets with per-element timeouts
+// The sets are matched by rules in the iptables raw PREROUTING chain, ahead of
+// conntrack and the NFQUEUE rules. Requires the ipset and iptables tools.
+type IPSet struct {
+	mu    sync.Mutex // Serializes ipset commands
+	run   commandRunner
+	rules []ipsetRule // Rules matching the sets, removed by Teardown
+	cache *banCache
+}
+
+// NewIPSet creates (or takes over) the btblocker ipsets and their drop rules
+// Bans left in the sets by a previous run are kept. Sets and rules are never
+// removed implicitly, not even when setup fails half-way (see Teardown).
+func NewIPSet() (*IPSet, error) {
+	return newIPSet(runCommand)
+}
+
+func newIPSet(run commandRunner) (*IPSet, error) {
+	s := &IPSet{run: run, cache: newBanCache()}
+
+	for _, set := range []struct{ name, family, iptables string }{
+		{IPSetName4, "inet", "iptables"},
+		{IPSetName6, "inet6", "ip6tables"},
+	} {
+		// timeout 0 enables per-element timeouts without a default
+		if _, err := s.run("ipset", "create", set.name, "hash:ip", "family", set.family, "timeout", "0", "-exist"); err != nil {
+			return nil, fmt.Errorf("failed to create ipset %s: %w", set.name, err)
+		}
+
+		rule := ipsetRule{iptables: set.iptables, set: set.name}
+		if _, err := s.run(rule.iptables, rule.args("-C")...); err != nil {
+			if _, err := s.run(rule.iptables, rule.args("-I")...); err != nil {
+				return nil, fmt.Errorf("failed to add %s rule for ipset %s: %w", rule.iptables, set.name, err)
+			}
+		}
+		s.rules = append(s.rules, rule)
+	}
+
+	bans, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	s.cache.replace(bans)
+	return s, nil
+}
+
+// Name returns BackendIPSet
+func (s *IPSet) Name() string {
+	return BackendIPSet
+}
+
+// Ban adds ip to its set, replacing the timeout of an existing entry
+func (s *IPSet) Ban(ip net.IP, duration time.Duration) error {
+	if duration <= 0 {
+		return fmt.Errorf("invalid ban duration %v", duration)
+	}
+	set, err := ipsetFor(ip)
+	if err != nil {
+		return err
+	}
+
+	timeout := int(duration.Round(time.Second) / time.Second)
+	if timeout < 1 {
+		timeout = 1
+	}
+	if timeout > ipsetMaxTimeout {
+		timeout = ipsetMaxTimeout
+	}
+
+	s.mu.Lock()
+	_, err = s.run("ipset", "add", set, ip.String(), "timeout", strconv.Itoa(timeout), "-exist")
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to add %s to ipset %s: %w", ip, set, err)
+	}
+
+	s.cache.set(ip, time.Now().Add(time.Duration(timeout)*time.Second))
+	return nil
+}
+
+// Unban removes ip from its set
+func (s *IPSet) Unban(ip net.IP) error {
+	set, err := ipsetFor(ip)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	_, err = s.run("ipset", "del", set, ip.String(), "-exist")
+	s.mu.Unlock()
+	s.cache.remove(ip)
+	if err != nil {
+		return fmt.Errorf("failed to remove %s from ipset %s: %w", ip, set, err)
+	}
+	return nil
+}
+
+// IsBanned reports whether ip is banned (answered from the local cache)
+func (s *IPSet) IsBanned(ip net.IP) bool {
+	return s.cache.active(ip, time.Now())
+}
+
+// List reads all bans back from the kernel sets
+func (s *IPSet) List() ([]Ban, error) {
+	var bans []Ban
+	for _, set := range []string{IPSetName4, IPSetName6} {
+		s.mu.Lock()
+		out, err := s.run("ipset", "save", set)
+		s.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list ipset %s: %w", set, err)
+		}
+		bans = append(bans, parseIPSetSave(out, time.Now())...)
+	}
+	sortBans(bans)
+	return bans, nil
+}
+
+// Expire prunes the local cache; the kernel removes timed-out entries itself
+func (s *IPSet) Expire() (int, error) {
+	return s.cache.expire(time.Now()), nil
+}
+
+// Close releases the backend, leaving the sets and drop rules in place
+// The next NewIPSet takes them over with their bans.
+func (s *IPSet) Close() error {
+	return nil
+}
+
+// Teardown removes the drop rules and destroys the sets, lifting all bans
+func (s *IPSet) Teardown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, rule := range s.rules {
+		if _, err := s.run(rule.iptables, rule.args("-D")...); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// The set can only be destroyed once no rule references it
+		if _, err := s.run("ipset", "destroy", rule.set); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.rules = nil
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove ipset backend: %v", errs)
+	}
+	return nil
+}
+
+// ipsetFor returns the set holding ip
+func ipsetFor(ip net.IP) (string, error) {
+	if ip.To4() != nil {
+		return IPSetName4, nil
+	}
+	if ip.To16() != nil {
+		return IPSetName6, nil
+	}
+	return "", fmt.Errorf("invalid IP address: %v", ip)
+}
+
+// parseIPSetSave parses "ipset save" output ("add <set> <ip> timeout <seconds>" lines)
+func parseIPSetSave(out []byte, now time.Time) []Ban {
+	var bans []Ban
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != "add" {
+			continue
+		}
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			continue
+		}
+		ban := Ban{IP: ip}
+		for i := 3; i+1 < len(fields); i++ {
+			if fields[i] == "timeout" {
+				if seconds, err := strconv.Atoi(fields[i+1]); err == nil {
+					ban.ExpiresAt = now.Add(time.Duration(seconds) * time.Second)
+				}
+			}
+		}
+		bans = append(bans, ban)
+	}
+	return bans
+}
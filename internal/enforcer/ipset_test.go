@@ -0,0 +1,136 @@
+package enforcer
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRunner records commands and answers "ipset save" with canned output
+type fakeRunner struct {
+	commands []string
+	saved    map[string]string // Set name -> "ipset save" output
+	fail     map[string]bool   // Command prefixes that fail
+}
+
+func (f *fakeRunner) run(name string, args ...string) ([]byte, error) {
+	cmd := name + " " + strings.Join(args, " ")
+	f.commands = append(f.commands, cmd)
+	for prefix := range f.fail {
+		if strings.HasPrefix(cmd, prefix) {
+			return nil, errors.New("exit status 1")
+		}
+	}
+	if name == "ipset" && args[0] == "save" {
+		return []byte(f.saved[args[1]]), nil
+	}
+	return nil, nil
+}
+
+func TestIPSet_Lifecycle(t *testing.T) {
+	f := &fakeRunner{
+		saved: map[string]string{
+			IPSetName4: "create btblocker4 hash:ip family inet hashsize 1024 maxelem 65536 timeout 0\nadd btblocker4 10.0.0.9 timeout 600\n",
+		},
+		// Rules are not installed yet
+		fail: map[string]bool{"iptables -t raw -C": true, "ip6tables -t raw -C": true},
+	}
+
+	s, err := newIPSet(f.run)
+	if err != nil {
+		t.Fatalf("newIPSet() failed: %v", err)
+	}
+	if !s.IsBanned(net.ParseIP("10.0.0.9")) {
+		t.Error("Ban left by a previous run should be picked up")
+	}
+
+	if err := s.Ban(net.ParseIP("10.0.0.1"), 5*time.Hour); err != nil {
+		t.Fatalf("Ban() failed: %v", err)
+	}
+	if err := s.Ban(net.ParseIP("2001:db8::1"), 60*24*time.Hour); err != nil {
+		t.Fatalf("Ban() failed: %v", err)
+	}
+	if err := s.Unban(net.ParseIP("10.0.0.9")); err != nil {
+		t.Fatalf("Unban() failed: %v", err)
+	}
+	if err := s.Teardown(); err != nil {
+		t.Fatalf("Teardown() failed: %v", err)
+	}
+
+	want := []string{
+		"ipset create btblocker4 hash:ip family inet timeout 0 -exist",
+		"iptables -t raw -I PREROUTING -m set --match-set btblocker4 src -j DROP",
+		"ipset create btblocker6 hash:ip family inet6 timeout 0 -exist",
+		"ip6tables -t raw -I PREROUTING -m set --match-set btblocker6 src -j DROP",
+		"ipset add btblocker4 10.0.0.1 timeout 18000 -exist",
+		"ipset add btblocker6 2001:db8::1 timeout 2147483 -exist", // Capped at the ipset maximum
+		"ipset del btblocker4 10.0.0.9 -exist",
+		"iptables -t raw -D PREROUTING -m set --match-set btblocker4 src -j DROP",
+		"ipset destroy btblocker4",
+		"ip6tables -t raw -D PREROUTING -m set --match-set btblocker6 src -j DROP",
+		"ipset destroy btblocker6",
+	}
+	got := strings.Join(f.commands, "\n")
+	for _, cmd := range want {
+		if !strings.Contains(got, cmd) {
+			t.Errorf("missing command %q in:\n%s", cmd, got)
+		}
+	}
+	if s.IsBanned(net.ParseIP("10.0.0.9")) {
+		t.Error("Unbanned IP should not be banned")
+	}
+}
+
+func TestIPSet_CloseKeepsBans(t *testing.T) {
+	f := &fakeRunner{}
+	s, err := newIPSet(f.run)
+	if err != nil {
+		t.Fatalf("newIPSet() failed: %v", err)
+	}
+	setup := len(f.commands)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if extra := f.commands[setup:]; len(extra) > 0 {
+		t.Errorf("Close() should leave the sets and rules in place, ran %q", extra)
+	}
+}
+
+func TestIPSet_ExistingRuleNotDuplicated(t *testing.T) {
+	f := &fakeRunner{}
+	s, err := newIPSet(f.run)
+	if err != nil {
+		t.Fatalf("newIPSet() failed: %v", err)
+	}
+	defer s.Close()
+
+	for _, cmd := range f.commands {
+		if strings.Contains(cmd, " -I PREROUTING") {
+			t.Errorf("Rule should not be inserted twice: %q", cmd)
+		}
+	}
+}
+
+func TestIPSet_CreateFails(t *testing.T) {
+	f := &fakeRunner{fail: map[string]bool{"ipset create": true}}
+	if _, err := newIPSet(f.run); err == nil {
+		t.Fatal("newIPSet() should fail when the set cannot be created")
+	}
+}
+
+func TestParseIPSetSave(t *testing.T) {
+	now := time.Now()
+	out := []byte(`create btblocker6 hash:ip family inet6 hashsize 1024 maxelem 65536 timeout 0
+add btblocker6 2001:db8::1 timeout 42
+add btblocker6 not-an-ip timeout 5
+`)
+	bans := parseIPSetSave(out, now)
+	if len(bans) != 1 {
+		t.Fatalf("parseIPSetSave() = %v, want 1 ban", bans)
+	}
+	if !bans[0].IP.Equal(net.ParseIP("2001:db8::1")) || !bans[0].ExpiresAt.Equal(now.Add(42*time.Second)) {
+		t.Errorf("parseIPSetSave() = %+v", bans[0])
+	}
+}
@@ -0,0 +1,507 @@
+//go:build linux
+
+package enforcer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Default nftables object names
+const (
+	NFTablesTable = "btblocker"
+	nftChain      = "prerouting"
+	nftSet4       = "banned4"
+	nftSet6       = "banned6"
+
+	// Ahead of conntrack and every filter chain, so banned peers never reach NFQUEUE
+	nftPriority = -300
+)
+
+// nf_tables netlink protocol constants (linux/netfilter/nf_tables.h)
+const (
+	nftMsgNewTable   = 0
+	nftMsgDelTable   = 2
+	nftMsgNewChain   = 3
+	nftMsgNewRule    = 6
+	nftMsgDelRule    = 8
+	nftMsgNewSet     = 9
+	nftMsgNewSetElem = 12
+	nftMsgGetSetElem = 13
+	nftMsgDelSetElem = 14
+
+	nftaTableName = 1
+
+	nftaChainTable  = 1
+	nftaChainName   = 3
+	nftaChainHook   = 4
+	nftaChainPolicy = 5
+	nftaChainType   = 7
+	nftaHookHooknum = 1
+	nftaHookPrio    = 2
+
+	nftaRuleTable       = 1
+	nftaRuleChain       = 2
+	nftaRuleExpressions = 4
+	nftaListElem        = 1
+	nftaExprName        = 1
+	nftaExprData        = 2
+
+	nftaSetTable   = 1
+	nftaSetName    = 2
+	nftaSetFlags   = 3
+	nftaSetKeyType = 4
+	nftaSetKeyLen  = 5
+	nftaSetID      = 10
+	nftSetTimeout  = 0x10
+
+	nftaSetElemListTable    = 1
+	nftaSetElemListSet      = 2
+	nftaSetElemListElements = 3
+	nftaSetElemKey          = 1
+	nftaSetElemTimeout      = 4
+	nftaSetElemExpiration   = 5
+
+	nftaDataValue   = 1
+	nftaDataVerdict = 2
+	nftaVerdictCode = 1
+
+	nftaMetaDreg      = 1
+	nftaMetaKey       = 2
+	nftMetaNFProto    = 15
+	nftaCmpSreg       = 1
+	nftaCmpOp         = 2
+	nftaCmpData       = 3
+	nftCmpEq          = 0
+	nftaPayloadDreg   = 1
+	nftaPayloadBase   = 2
+	nftaPayloadOffset = 3
+	nftaPayloadLen    = 4
+	nftPayloadNetwork = 1
+	nftaLookupSet     = 1
+	nftaLookupSreg    = 2
+	nftaLookupSetID   = 4
+	nftaImmDreg       = 1
+	nftaImmData       = 2
+
+	nftRegVerdict = 0
+	nftReg1       = 1
+
+	// Netfilter verdicts (linux/netfilter.h)
+	nfDrop   = 0
+	nfAccept = 1
+
+	// nft datatype identifiers for set keys
+	nftTypeIPAddr  = 7
+	nftTypeIP6Addr = 8
+
+	nfnlBatchBegin = 0x10
+	nfnlBatchEnd   = 0x11
+)
+
+// NFTables enforces bans through timed elements in nftables named sets
+// It owns an inet table with one set per address family and a prerouting
+// chain dropping packets whose source address is in either set.
+type NFTables struct {
+	mu    sync.Mutex // Serializes netlink requests
+	conn  *netlink.Conn
+	table string
+	cache *banCache
+}
+
+// NewNFTables creates (or takes over) the btblocker table and its sets
+// Bans left in the sets by a previous run are kept.
+func NewNFTables() (*NFTables, error) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open nftables netlink socket: %w", err)
+	}
+
+	n := &NFTables{conn: conn, table: NFTablesTable, cache: newBanCache()}
+	if err := n.setup(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create nftables table %s: %w", n.table, err)
+	}
+
+	bans, err := n.List()
+	if err != nil {
+		n.Close()
+		return nil, err
+	}
+	n.cache.replace(bans)
+	return n, nil
+}
+
+// Name returns BackendNFTables
+func (n *NFTables) Name() string {
+	return BackendNFTables
+}
+
+// setup creates the table, sets and chain and (re)installs the drop rules
+// Everything is sent in one transaction, so a failure leaves no partial state.
+func (n *NFTables) setup() error {
+	msgs := []netlink.Message{
+		n.message(nftMsgNewTable, netlink.Create, func(ae *netlink.AttributeEncoder) {
+			ae.String(nftaTableName, n.table)
+		}),
+	}
+
+	for i, set := range []struct {
+		name    string
+		keyType uint32
+		keyLen  uint32
+	}{{nftSet4, nftTypeIPAddr, net.IPv4len}, {nftSet6, nftTypeIP6Addr, net.IPv6len}} {
+		msgs = append(msgs, n.message(nftMsgNewSet, netlink.Create, func(ae *netlink.AttributeEncoder) {
+			ae.String(nftaSetTable, n.table)
+			ae.String(nftaSetName, set.name)
+			ae.Uint32(nftaSetFlags, nftSetTimeout)
+			ae.Uint32(nftaSetKeyType, set.keyType)
+			ae.Uint32(nftaSetKeyLen, set.keyLen)
+			ae.Uint32(nftaSetID, uint32(i+1)) // #nosec G115 - two sets
+		}))
+	}
+
+	msgs = append(msgs,
+		n.message(nftMsgNewChain, netlink.Create, func(ae *netlink.AttributeEncoder) {
+			ae.String(nftaChainTable, n.table)
+			ae.String(nftaChainName, nftChain)
+			ae.Nested(nftaChainHook, func(nae *netlink.AttributeEncoder) error {
+				nae.Uint32(nftaHookHooknum, unix.NF_INET_PRE_ROUTING)
+				nae.Int32(nftaHookPrio, nftPriority)
+				return nil
+			})
+			ae.Uint32(nftaChainPolicy, nfAccept)
+			ae.String(nftaChainType, "filter")
+		}),
+		// Flush the chain so restarts do not stack duplicate rules
+		n.message(nftMsgDelRule, 0, func(ae *netlink.AttributeEncoder) {
+			ae.String(nftaRuleTable, n.table)
+			ae.String(nftaRuleChain, nftChain)
+		}),
+		n.dropRule(unix.NFPROTO_IPV4, 12, net.IPv4len, nftSet4, 1), // ip saddr @banned4 drop
+		n.dropRule(unix.NFPROTO_IPV6, 8, net.IPv6len, nftSet6, 2),  // ip6 saddr @banned6 drop
+	)
+
+	return n.batch(msgs)
+}
+
+// dropRule builds "meta nfproto <proto> <network header field> @set drop"
+func (n *NFTables) dropRule(proto uint8, offset, length uint32, set string, setID uint32) netlink.Message {
+	return n.message(nftMsgNewRule, netlink.Create|netlink.Append, func(ae *netlink.AttributeEncoder) {
+		ae.String(nftaRuleTable, n.table)
+		ae.String(nftaRuleChain, nftChain)
+		ae.Nested(nftaRuleExpressions, func(exprs *netlink.AttributeEncoder) error {
+			nftExpr(exprs, "meta", func(e *netlink.AttributeEncoder) {
+				e.Uint32(nftaMetaKey, nftMetaNFProto)
+				e.Uint32(nftaMetaDreg, nftReg1)
+			})
+			nftExpr(exprs, "cmp", func(e *netlink.AttributeEncoder) {
+				e.Uint32(nftaCmpSreg, nftReg1)
+				e.Uint32(nftaCmpOp, nftCmpEq)
+				e.Nested(nftaCmpData, func(d *netlink.AttributeEncoder) error {
+					d.Bytes(nftaDataValue, []byte{proto})
+					return nil
+				})
+			})
+			nftExpr(exprs, "payload", func(e *netlink.AttributeEncoder) {
+				e.Uint32(nftaPayloadDreg, nftReg1)
+				e.Uint32(nftaPayloadBase, nftPayloadNetwork)
+				e.Uint32(nftaPayloadOffset, offset)
+				e.Uint32(nftaPayloadLen, length)
+			})
+			nftExpr(exprs, "lookup", func(e *netlink.AttributeEncoder) {
+				e.String(nftaLookupSet, set)
+				e.Uint32(nftaLookupSetID, setID)
+				e.Uint32(nftaLookupSreg, nftReg1)
+			})
+			nftExpr(exprs, "immediate", func(e *netlink.AttributeEncoder) {
+				e.Uint32(nftaImmDreg, nftRegVerdict)
+				e.Nested(nftaImmData, func(d *netlink.AttributeEncoder) error {
+					d.Nested(nftaDataVerdict, func(v *netlink.AttributeEncoder) error {
+						v.Int32(nftaVerdictCode, nfDrop)
+						return nil
+					})
+					return nil
+				})
+			})
+			return nil
+		})
+	})
+}
+
+// nftExpr appends one rule expression to a list of expressions
+func nftExpr(exprs *netlink.AttributeEncoder, name string, data func(*netlink.AttributeEncoder)) {
+	exprs.Nested(nftaListElem, func(ae *netlink.AttributeEncoder) error {
+		ae.String(nftaExprName, name)
+		ae.Nested(nftaExprData, func(nae *netlink.AttributeEncoder) error {
+			data(nae)
+			return nil
+		})
+		return nil
+	})
+}
+
+// Ban adds ip to its set with a timeout of duration
+func (n *NFTables) Ban(ip net.IP, duration time.Duration) error {
+	if duration <= 0 {
+		return fmt.Errorf("invalid ban duration %v", duration)
+	}
+	set, key, err := nftSetKey(ip)
+	if err != nil {
+		return err
+	}
+
+	// Adding an existing element does not refresh its timeout, so replace it;
+	// NLM_F_EXCL makes the kernel report an element the cache missed as EEXIST
+	add := n.setElemMessage(nftMsgNewSetElem, netlink.Create|netlink.Excl, set, key, duration)
+	del := n.setElemMessage(nftMsgDelSetElem, 0, set, key, 0)
+	now := time.Now()
+	if n.cache.active(ip, now) {
+		err = n.batch([]netlink.Message{del, add})
+		if errors.Is(err, unix.ENOENT) {
+			err = n.batch([]netlink.Message{add}) // Expired in the kernel meanwhile
+		}
+	} else {
+		err = n.batch([]netlink.Message{add})
+		if errors.Is(err, unix.EEXIST) {
+			err = n.batch([]netlink.Message{del, add})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add %s to nftables set %s: %w", ip, set, err)
+	}
+
+	n.cache.set(ip, now.Add(duration))
+	return nil
+}
+
+// Unban removes ip from its set
+func (n *NFTables) Unban(ip net.IP) error {
+	set, key, err := nftSetKey(ip)
+	if err != nil {
+		return err
+	}
+	err = n.batch([]netlink.Message{n.setElemMessage(nftMsgDelSetElem, 0, set, key, 0)})
+	n.cache.remove(ip)
+	if err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to remove %s from nftables set %s: %w", ip, set, err)
+	}
+	return nil
+}
+
+// IsBanned reports whether ip is banned (answered from the local cache)
+func (n *NFTables) IsBanned(ip net.IP) bool {
+	return n.cache.active(ip, time.Now())
+}
+
+// List reads all bans back from the kernel sets
+func (n *NFTables) List() ([]Ban, error) {
+	var bans []Ban
+	for _, set := range []string{nftSet4, nftSet6} {
+		setBans, err := n.listSet(set)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list nftables set %s: %w", set, err)
+		}
+		bans = append(bans, setBans...)
+	}
+	sortBans(bans)
+	return bans, nil
+}
+
+// listSet dumps the elements of one set
+func (n *NFTables) listSet(set string) ([]Ban, error) {
+	req := n.message(nftMsgGetSetElem, netlink.Dump, func(ae *netlink.AttributeEncoder) {
+		ae.String(nftaSetElemListTable, n.table)
+		ae.String(nftaSetElemListSet, set)
+	})
+
+	n.mu.Lock()
+	msgs, err := n.conn.Execute(req)
+	n.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var bans []Ban
+	for _, msg := range msgs {
+		if len(msg.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(msg.Data[4:]) // Skip nfgenmsg
+		if err != nil {
+			return nil, err
+		}
+		ad.ByteOrder = binary.BigEndian
+		for ad.Next() {
+			if ad.Type() != nftaSetElemListElements {
+				continue
+			}
+			ad.Nested(func(elems *netlink.AttributeDecoder) error {
+				for elems.Next() {
+					elems.Nested(func(elem *netlink.AttributeDecoder) error {
+						var b Ban
+						for elem.Next() {
+							switch elem.Type() {
+							case nftaSetElemKey:
+								elem.Nested(func(key *netlink.AttributeDecoder) error {
+									for key.Next() {
+										if key.Type() == nftaDataValue {
+											b.IP = net.IP(key.Bytes())
+										}
+									}
+									return nil
+								})
+							case nftaSetElemExpiration:
+								b.ExpiresAt = now.Add(time.Duration(elem.Uint64()) * time.Millisecond) // #nosec G115 - kernel timeouts fit in int64
+							}
+						}
+						if b.IP != nil {
+							bans = append(bans, b)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		}
+		if err := ad.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return bans, nil
+}
+
+// Expire prunes the local cache; the kernel removes timed-out elements itself
+func (n *NFTables) Expire() (int, error) {
+	return n.cache.expire(time.Now()), nil
+}
+
+// Close releases the netlink socket, leaving the table and its bans in place
+// The next NewNFTables takes them over.
+func (n *NFTables) Close() error {
+	return n.conn.Close()
+}
+
+// Teardown deletes the btblocker table, lifting all bans, and releases the socket
+func (n *NFTables) Teardown() error {
+	err := n.batch([]netlink.Message{n.message(nftMsgDelTable, 0, func(ae *netlink.AttributeEncoder) {
+		ae.String(nftaTableName, n.table)
+	})})
+	if closeErr := n.conn.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to delete nftables table %s: %w", n.table, err)
+	}
+	return nil
+}
+
+// setElemMessage builds a NEWSETELEM/DELSETELEM request for one key
+func (n *NFTables) setElemMessage(msgType uint16, flags netlink.HeaderFlags, set string, key []byte, timeout time.Duration) netlink.Message {
+	return n.message(msgType, flags, func(ae *netlink.AttributeEncoder) {
+		ae.String(nftaSetElemListTable, n.table)
+		ae.String(nftaSetElemListSet, set)
+		ae.Nested(nftaSetElemListElements, func(elems *netlink.AttributeEncoder) error {
+			elems.Nested(nftaListElem, func(elem *netlink.AttributeEncoder) error {
+				elem.Nested(nftaSetElemKey, func(k *netlink.AttributeEncoder) error {
+					k.Bytes(nftaDataValue, key)
+					return nil
+				})
+				if timeout > 0 {
+					elem.Uint64(nftaSetElemTimeout, uint64(timeout.Milliseconds())) // #nosec G115 - checked positive
+				}
+				return nil
+			})
+			return nil
+		})
+	})
+}
+
+// message builds an nf_tables request for the inet family
+func (n *NFTables) message(msgType uint16, flags netlink.HeaderFlags, attrs func(*netlink.AttributeEncoder)) netlink.Message {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	attrs(ae)
+	data, err := ae.Encode()
+	if err != nil {
+		panic(fmt.Sprintf("enforcer: encoding nftables attributes: %v", err)) // Only fails on programming errors
+	}
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | msgType),
+			Flags: netlink.Request | flags,
+		},
+		Data: append(nfgenmsg(unix.NFPROTO_INET, 0), data...),
+	}
+}
+
+// batch sends msgs as one nf_tables transaction and waits for it to be applied
+func (n *NFTables) batch(msgs []netlink.Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	batch := make([]netlink.Message, 0, len(msgs)+2)
+	batch = append(batch, netlink.Message{
+		Header: netlink.Header{Type: nfnlBatchBegin, Flags: netlink.Request},
+		Data:   nfgenmsg(unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES),
+	})
+	for _, msg := range msgs {
+		msg.Header.Flags |= netlink.Acknowledge
+		batch = append(batch, msg)
+	}
+	batch = append(batch, netlink.Message{
+		Header: netlink.Header{Type: nfnlBatchEnd, Flags: netlink.Request},
+		Data:   nfgenmsg(unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES),
+	})
+
+	if _, err := n.conn.SendMessages(batch); err != nil {
+		return err
+	}
+
+	// One ack or error per message; the first failure aborts the whole transaction
+	// but every reply must still be read so the next request starts clean
+	var firstErr error
+	for replied := 0; replied < len(msgs); {
+		replies, err := n.conn.Receive()
+		if err != nil {
+			var opErr *netlink.OpError
+			if !errors.As(err, &opErr) {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			replied++
+			continue
+		}
+		replied += len(replies)
+	}
+	return firstErr
+}
+
+// nfgenmsg encodes the nfnetlink message header
+func nfgenmsg(family uint8, resID uint16) []byte {
+	b := []byte{family, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], resID)
+	return b
+}
+
+// nftSetKey returns the set and key bytes for ip
+func nftSetKey(ip net.IP) (string, []byte, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return nftSet4, []byte(ip4), nil
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return nftSet6, []byte(ip16), nil
+	}
+	return "", nil, fmt.Errorf("invalid IP address: %v", ip)
+}
@@ -0,0 +1,51 @@
+//go:build !linux
+
+package enforcer
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"time"
+)
+
+// NFTablesTable is the nftables table owned by the backend
+const NFTablesTable = "btblocker"
+
+// NFTables is the nftables backend (stub for non-Linux)
+type NFTables struct{}
+
+// NewNFTables returns an error on non-Linux platforms
+func NewNFTables() (*NFTables, error) {
+	return nil, fmt.Errorf("nftables is only supported on Linux (current platform: %s/%s)", runtime.GOOS, runtime.GOARCH)
+}
+
+// Name returns BackendNFTables
+func (n *NFTables) Name() string { return BackendNFTables }
+
+// Ban returns an error on stub
+func (n *NFTables) Ban(ip net.IP, duration time.Duration) error {
+	return fmt.Errorf("nftables not supported on %s", runtime.GOOS)
+}
+
+// Unban returns an error on stub
+func (n *NFTables) Unban(ip net.IP) error {
+	return fmt.Errorf("nftables not supported on %s", runtime.GOOS)
+}
+
+// IsBanned returns false on stub
+func (n *NFTables) IsBanned(ip net.IP) bool { return false }
+
+// List returns an error on stub
+func (n *NFTables) List() ([]Ban, error) {
+	return nil, fmt.Errorf("nftables not supported on %s", runtime.GOOS)
+}
+
+// Expire is a no-op on stub
+func (n *NFTables) Expire() (int, error) { return 0, nil }
+
+// Close is a no-op on stub
+func (n *NFTables) Close() error { return nil }
+
+// Teardown is a no-op on stub
+func (n *NFTables) Teardown() error { return nil }
@@ -0,0 +1,66 @@
+package enforcer
+
+import (
+	"net"
+	"time"
+
+	"github.com/example/BitTorrentBlocker/internal/xdp"
+)
+
+// XDP enforces bans through the XDP blocklist maps
+type XDP struct {
+	filter *xdp.Filter
+	mapMgr *xdp.IPMapManager
+}
+
+// NewXDP wraps a loaded XDP filter; closing the backend closes the filter
+func NewXDP(filter *xdp.Filter) *XDP {
+	return &XDP{filter: filter, mapMgr: filter.GetMapManager()}
+}
+
+// Name returns BackendXDP
+func (x *XDP) Name() string {
+	return BackendXDP
+}
+
+// Ban adds ip to the XDP blocklist
+func (x *XDP) Ban(ip net.IP, duration time.Duration) error {
+	return x.mapMgr.AddIP(ip, duration)
+}
+
+// Unban removes ip from the XDP blocklist
+func (x *XDP) Unban(ip net.IP) error {
+	return x.mapMgr.RemoveIP(ip)
+}
+
+// IsBanned reports whether ip is in the XDP blocklist
+func (x *XDP) IsBanned(ip net.IP) bool {
+	blocked, _ := x.mapMgr.IsBlocked(ip)
+	return blocked
+}
+
+// List returns all IPs in the XDP blocklist
+func (x *XDP) List() ([]Ban, error) {
+	blocked := x.mapMgr.GetAllBlockedIPs()
+	bans := make([]Ban, 0, len(blocked))
+	for _, b := range blocked {
+		bans = append(bans, Ban{IP: b.IP, ExpiresAt: b.ExpiresAt})
+	}
+	sortBans(bans)
+	return bans, nil
+}
+
+// Expire removes expired IPs from the XDP maps
+func (x *XDP) Expire() (int, error) {
+	return x.mapMgr.CleanupExpired()
+}
+
+// Close detaches the XDP program (unless it is kept attached) and closes its maps
+func (x *XDP) Close() error {
+	return x.filter.Close()
+}
+
+// Filter returns the underlying XDP filter (for statistics)
+func (x *XDP) Filter() *xdp.Filter {
+	return x.filter
+}
@@ -0,0 +1,313 @@
+// Package metrics implements the small subset of the Prometheus data model the
+// blocker needs (counters, labeled counters, histograms and gauges) and exposes
+// it in the Prometheus text exposition format.
+//
+// All metric types are safe for concurrent use; updates on the packet path are
+// lock-free once a label value has been seen.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// collector is anything that can render itself in the text exposition format
+type collector interface {
+	write(w io.Writer) error
+}
+
+// Registry holds a set of metrics and renders them for scraping
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+	names      map[string]bool
+}
+
+// NewRegistry creates an empty metrics registry
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register adds a collector, panicking on duplicate names (a programming error)
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: duplicate metric %q", name))
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes all registered metrics in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler returns an HTTP handler serving the registry in the Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WriteText(w)
+	})
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+// Value returns the current counter value
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// namedCounter is a registered unlabeled counter
+type namedCounter struct {
+	Counter
+	name, help string
+}
+
+func (c *namedCounter) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+		c.name, escapeHelp(c.help), c.name, c.name, c.Value())
+	return err
+}
+
+// NewCounter registers and returns an unlabeled counter
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &namedCounter{name: name, help: help}
+	r.register(name, c)
+	return &c.Counter
+}
+
+// CounterVec is a family of counters partitioned by a single label
+type CounterVec struct {
+	name, help, label string
+	mu                sync.RWMutex
+	counters          map[string]*Counter
+}
+
+// NewCounterVec registers and returns a counter family with one label
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{name: name, help: help, label: label, counters: make(map[string]*Counter)}
+	r.register(name, v)
+	return v
+}
+
+// WithLabel returns the counter for the given label value, creating it if needed
+func (v *CounterVec) WithLabel(value string) *Counter {
+	v.mu.RLock()
+	c, ok := v.counters[value]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.counters[value]; !ok {
+		c = &Counter{}
+		v.counters[value] = c
+	}
+	return c
+}
+
+func (v *CounterVec) write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, escapeHelp(v.help), v.name); err != nil {
+		return err
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for _, value := range sortedKeys(v.counters) {
+		if _, err := fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", v.name, v.label, escapeLabel(value), v.counters[value].Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// valueFunc is a gauge or counter whose value is read on every scrape
+type valueFunc struct {
+	name, help, typ string
+	labels          string // Rendered constant labels including braces, or empty
+	fn              func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by fn at scrape time
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &valueFunc{name: name, help: help, typ: "gauge", fn: fn})
+}
+
+// NewLabeledGaugeFunc registers a gauge computed by fn at scrape time, with
+// one label fixed to value (e.g. the backend the gauge describes)
+func (r *Registry) NewLabeledGaugeFunc(name, help, label, value string, fn func() float64) {
+	labels := fmt.Sprintf("{%s=\"%s\"}", label, escapeLabel(value))
+	r.register(name, &valueFunc{name: name, help: help, typ: "gauge", labels: labels, fn: fn})
+}
+
+// NewCounterFunc registers a counter maintained elsewhere (e.g. in the kernel)
+// whose value is read by fn at scrape time; fn must never decrease
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(name, &valueFunc{name: name, help: help, typ: "counter", fn: fn})
+}
+
+func (v *valueFunc) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s%s %s\n",
+		v.name, escapeHelp(v.help), v.name, v.typ, v.name, v.labels, formatFloat(v.fn()))
+	return err
+}
+
+// Histogram counts observed durations into cumulative buckets (in seconds)
+type Histogram struct {
+	bounds []float64       // Upper bounds in seconds, ascending
+	counts []atomic.Uint64 // Non-cumulative per-bucket counts, last entry is +Inf
+	count  atomic.Uint64
+	sumNs  atomic.Uint64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+// Observe records one duration
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(h.bounds, seconds)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	if d > 0 {
+		h.sumNs.Add(uint64(d)) // #nosec G115 - checked positive
+	}
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// HistogramVec is a family of histograms partitioned by a single label
+type HistogramVec struct {
+	name, help, label string
+	bounds            []float64
+	mu                sync.RWMutex
+	histograms        map[string]*Histogram
+}
+
+// NewHistogramVec registers and returns a histogram family with one label
+// bounds are the bucket upper bounds in seconds and must be sorted ascending
+func (r *Registry) NewHistogramVec(name, help, label string, bounds []float64) *HistogramVec {
+	v := &HistogramVec{name: name, help: help, label: label, bounds: bounds, histograms: make(map[string]*Histogram)}
+	r.register(name, v)
+	return v
+}
+
+// WithLabel returns the histogram for the given label value, creating it if needed
+func (v *HistogramVec) WithLabel(value string) *Histogram {
+	v.mu.RLock()
+	h, ok := v.histograms[value]
+	v.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h, ok = v.histograms[value]; !ok {
+		h = newHistogram(v.bounds)
+		v.histograms[value] = h
+	}
+	return h
+}
+
+func (v *HistogramVec) write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, escapeHelp(v.help), v.name); err != nil {
+		return err
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for _, value := range sortedKeys(v.histograms) {
+		h := v.histograms[value]
+		label := fmt.Sprintf("%s=\"%s\"", v.label, escapeLabel(value))
+
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i].Load()
+			if _, err := fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", v.name, label, formatFloat(bound), cumulative); err != nil {
+				return err
+			}
+		}
+		cumulative += h.counts[len(h.bounds)].Load()
+		sum := time.Duration(h.sumNs.Load()).Seconds() // #nosec G115 - sum of positive durations
+		if _, err := fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n%s_sum{%s} %s\n%s_count{%s} %d\n",
+			v.name, label, cumulative, v.name, label, formatFloat(sum), v.name, label, cumulative); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns map keys in a stable order so scrapes are deterministic
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatFloat formats a sample value the way Prometheus expects
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// escapeHelp escapes a HELP string
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// escapeLabel escapes a label value
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText() failed: %v", err)
+	}
+	return buf.String()
+}
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_packets_total", "Packets seen")
+	c.Inc()
+	c.Add(4)
+
+	want := "# HELP test_packets_total Packets seen\n# TYPE test_packets_total counter\ntest_packets_total 5\n"
+	if got := scrape(t, r); got != want {
+		t.Errorf("scrape =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewCounterVec("test_detections_total", "Detections", "reason")
+	v.WithLabel("uTP Protocol (BEP 29)").Inc()
+	v.WithLabel("BitTorrent Signature").Add(2)
+	v.WithLabel(`quote " and \ backslash`).Inc()
+
+	got := scrape(t, r)
+	for _, line := range []string{
+		`test_detections_total{reason="BitTorrent Signature"} 2`,
+		`test_detections_total{reason="uTP Protocol (BEP 29)"} 1`,
+		`test_detections_total{reason="quote \" and \\ backslash"} 1`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("scrape missing %q:\n%s", line, got)
+		}
+	}
+
+	// Label values are sorted so scrapes are stable
+	if strings.Index(got, "BitTorrent Signature") > strings.Index(got, "uTP Protocol") {
+		t.Errorf("label values not sorted:\n%s", got)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	r := NewRegistry()
+	value := 3.0
+	r.NewGaugeFunc("test_blocked_ips", "Blocked IPs", func() float64 { return value })
+
+	if got := scrape(t, r); !strings.Contains(got, "# TYPE test_blocked_ips gauge\ntest_blocked_ips 3\n") {
+		t.Errorf("scrape =\n%s", got)
+	}
+	value = 7
+	if got := scrape(t, r); !strings.Contains(got, "test_blocked_ips 7\n") {
+		t.Errorf("gauge should be read at scrape time, got:\n%s", got)
+	}
+}
+
+func TestLabeledGaugeFunc(t *testing.T) {
+	r := NewRegistry()
+	r.NewLabeledGaugeFunc("test_blocked_ips", "Blocked IPs", "backend", "nftables", func() float64 { return 5 })
+
+	if got := scrape(t, r); !strings.Contains(got, "# TYPE test_blocked_ips gauge\ntest_blocked_ips{backend=\"nftables\"} 5\n") {
+		t.Errorf("scrape =\n%s", got)
+	}
+}
+
+func TestCounterFunc(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterFunc("test_kernel_drops_total", "Drops counted in the kernel", func() float64 { return 42 })
+
+	if got := scrape(t, r); !strings.Contains(got, "# TYPE test_kernel_drops_total counter\ntest_kernel_drops_total 42\n") {
+		t.Errorf("scrape =\n%s", got)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewHistogramVec("test_duration_seconds", "Durations", "detector", []float64{1e-6, 1e-3})
+	h := v.WithLabel("mse")
+	h.Observe(500 * time.Nanosecond) // <= 1µs
+	h.Observe(time.Microsecond)      // exactly on the bound counts in that bucket
+	h.Observe(100 * time.Microsecond)
+	h.Observe(time.Second) // +Inf only
+
+	got := scrape(t, r)
+	for _, line := range []string{
+		`test_duration_seconds_bucket{detector="mse",le="1e-06"} 2`,
+		`test_duration_seconds_bucket{detector="mse",le="0.001"} 3`,
+		`test_duration_seconds_bucket{detector="mse",le="+Inf"} 4`,
+		`test_duration_seconds_sum{detector="mse"} 1.0001015`,
+		`test_duration_seconds_count{detector="mse"} 4`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("scrape missing %q:\n%s", line, got)
+		}
+	}
+	if h.Count() != 4 {
+		t.Errorf("Count() = %d, want 4", h.Count())
+	}
+}
+
+func TestRegistry_DuplicateName(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "")
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering a duplicate metric name should panic")
+		}
+	}()
+	r.NewCounterVec("test_total", "", "label")
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want Prometheus text format", ct)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if !strings.Contains(string(body), "test_total 1\n") {
+		t.Errorf("body =\n%s", body)
+	}
+}
+
+func TestCounterVec_Concurrent(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewCounterVec("test_total", "", "worker")
+	h := r.NewHistogramVec("test_seconds", "", "worker", []float64{1e-6})
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				v.WithLabel("shared").Inc()
+				h.WithLabel("shared").Observe(time.Nanosecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := v.WithLabel("shared").Value(); got != 8000 {
+		t.Errorf("counter = %d, want 8000", got)
+	}
+	if got := h.WithLabel("shared").Count(); got != 8000 {
+		t.Errorf("histogram count = %d, want 8000", got)
+	}
+}
@@ -0,0 +1,194 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compactThreshold is how many delivered bytes a queue file may keep before it is rewritten
+const compactThreshold = 1 << 20
+
+// queue holds the events of one endpoint until they are delivered, oldest first
+// With a path, events are appended to a JSON-lines file and the offset of the
+// first undelivered byte is kept in <path>.head, so undelivered events survive
+// restarts and endpoint outages. The queue holds at most max events; when it
+// is full the oldest are dropped. All methods are safe for concurrent use.
+type queue struct {
+	mu      sync.Mutex
+	events  [][]byte // Undelivered events, oldest first
+	max     int
+	dropped int // Events dropped because the queue was full
+
+	path string   // Queue file (empty = memory only)
+	file *os.File // Open for appending
+	head int64    // Offset of the first undelivered event in the file
+	size int64    // Size of the file
+}
+
+// openQueue opens the queue file at path and loads its undelivered events
+// An empty path creates a memory-only queue.
+func openQueue(path string, max int) (*queue, error) {
+	q := &queue{max: max, path: path}
+	if path == "" {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(path) // #nosec G304 - configured queue directory
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// A line torn by a crash is discarded
+	if end := bytes.LastIndexByte(data, '\n'); end+1 < len(data) {
+		data = data[:end+1]
+		if err := os.Truncate(path, int64(len(data))); err != nil {
+			return nil, err
+		}
+	}
+	q.size = int64(len(data))
+	if head, err := os.ReadFile(path + ".head"); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(head)), 10, 64); err == nil && n >= 0 && n <= q.size {
+			q.head = n
+		}
+	}
+	for _, line := range bytes.Split(data[q.head:], []byte("\n")) {
+		if len(line) > 0 {
+			q.events = append(q.events, line)
+		}
+	}
+
+	q.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if over := len(q.events) - q.max; over > 0 {
+		q.dropped += over
+		if err := q.ackLocked(over); err != nil {
+			_ = q.file.Close()
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// push appends an event, dropping the oldest one if the queue is full
+func (q *queue) push(event []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file != nil {
+		n, err := q.file.Write(append(event[:len(event):len(event)], '\n'))
+		q.size += int64(n)
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", q.path, err)
+		}
+	}
+	q.events = append(q.events, event)
+	if len(q.events) > q.max {
+		q.dropped++
+		return q.ackLocked(1)
+	}
+	return nil
+}
+
+// peek returns up to n of the oldest events without removing them
+func (q *queue) peek(n int) [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n > len(q.events) {
+		n = len(q.events)
+	}
+	return append([][]byte(nil), q.events[:n]...)
+}
+
+// ack removes the n oldest events once they are delivered (or given up on)
+func (q *queue) ack(n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.ackLocked(n)
+}
+
+func (q *queue) ackLocked(n int) error {
+	if n > len(q.events) {
+		n = len(q.events)
+	}
+	for _, event := range q.events[:n] {
+		q.head += int64(len(event)) + 1
+	}
+	q.events = q.events[n:]
+	if q.file == nil {
+		return nil
+	}
+
+	switch {
+	case len(q.events) == 0:
+		// Everything delivered: start the file over
+		if err := q.file.Truncate(0); err != nil {
+			return err
+		}
+		q.head, q.size = 0, 0
+	case q.head > compactThreshold && q.head > q.size/2:
+		if err := q.compact(); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(q.path+".head", []byte(strconv.FormatInt(q.head, 10)+"\n"), 0600)
+}
+
+// compact rewrites the queue file with only the undelivered events
+func (q *queue) compact() error {
+	var buf bytes.Buffer
+	for _, event := range q.events {
+		buf.Write(event)
+		buf.WriteByte('\n')
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	// Reset the head first: a crash in between re-sends events instead of losing them
+	if err := os.WriteFile(q.path+".head", []byte("0\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_ = q.file.Close()
+	q.file, q.head, q.size = file, 0, int64(buf.Len())
+	return nil
+}
+
+// len returns the number of undelivered events
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events)
+}
+
+// takeDropped returns the number of events dropped since the last call
+func (q *queue) takeDropped() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := q.dropped
+	q.dropped = 0
+	return n
+}
+
+// close closes the queue file; undelivered events stay in it
+func (q *queue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
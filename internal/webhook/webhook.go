@@ -0,0 +1,385 @@
+// Package webhook delivers events as signed JSON batches to HTTP endpoints.
+//
+// Send never blocks: events are handed to a background goroutine that queues
+// them per endpoint (in memory, or in a file that survives restarts and
+// outages), and one goroutine per endpoint posts them in batches, retrying
+// failed deliveries with exponential backoff.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Request headers set on every delivery
+const (
+	HeaderTimestamp = "X-Btblocker-Timestamp" // Unix time of the delivery attempt
+	HeaderSignature = "X-Btblocker-Signature" // "sha256=" + hex HMAC-SHA256 of timestamp + "." + body
+)
+
+// Defaults applied by New to zero Options fields
+const (
+	DefaultBatchSize  = 100
+	DefaultTimeout    = 10 * time.Second
+	DefaultMaxBackoff = 5 * time.Minute
+	DefaultQueueSize  = 100000
+)
+
+// minBackoff is the delay before the first retry; it doubles up to Options.MaxBackoff
+const minBackoff = time.Second
+
+// inboxSize is the number of events Send can hand over before it starts dropping them
+const inboxSize = 4096
+
+// Options configures New
+type Options struct {
+	URLs       []string      // Endpoints; each receives every event
+	Secret     string        // HMAC-SHA256 key for HeaderSignature (empty = unsigned)
+	BatchSize  int           // Maximum events per request
+	BatchDelay time.Duration // How long to wait for a batch to fill before sending it (0 = send right away)
+	Timeout    time.Duration // Timeout of one request
+	MaxBackoff time.Duration // Upper bound of the delay between retries
+	QueueDir   string        // Directory for the per-endpoint queue files (empty = memory only)
+	QueueSize  int           // Undelivered events kept per endpoint; the oldest are dropped beyond it
+	Logger     *slog.Logger  // nil = slog.Default()
+}
+
+// Validate checks the endpoints and limits
+func (o Options) Validate() error {
+	for _, raw := range o.URLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook URL %q (must be http:// or https://)", raw)
+		}
+	}
+	if o.BatchSize < 0 || o.BatchDelay < 0 || o.Timeout < 0 || o.MaxBackoff < 0 || o.QueueSize < 0 {
+		return fmt.Errorf("invalid webhook limits (batch size %d, batch delay %v, timeout %v, max backoff %v, queue size %d): must not be negative",
+			o.BatchSize, o.BatchDelay, o.Timeout, o.MaxBackoff, o.QueueSize)
+	}
+	return nil
+}
+
+// Sender delivers events to the configured endpoints
+type Sender struct {
+	opts      Options
+	client    *http.Client
+	logger    *slog.Logger
+	endpoints []*endpoint
+	inbox     chan []byte
+
+	mu      sync.Mutex
+	dropped int // Events Send dropped because the inbox was full
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// endpoint is one URL with its own queue and delivery goroutine
+type endpoint struct {
+	url    string
+	queue  *queue
+	notify chan struct{} // Signaled when events are queued
+}
+
+// New opens the endpoint queues and starts delivering
+func New(opts Options) (*Sender, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.QueueSize == 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if opts.QueueDir != "" {
+		if err := os.MkdirAll(opts.QueueDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create webhook queue directory: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Sender{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		logger: logger,
+		inbox:  make(chan []byte, inboxSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for _, u := range opts.URLs {
+		path := ""
+		if opts.QueueDir != "" {
+			path = filepath.Join(opts.QueueDir, queueFileName(u))
+		}
+		q, err := openQueue(path, opts.QueueSize)
+		if err != nil {
+			s.closeQueues()
+			cancel()
+			return nil, fmt.Errorf("failed to open webhook queue for %s: %w", u, err)
+		}
+		if n := q.len(); n > 0 {
+			logger.Info("Resuming webhook delivery of queued events", "url", u, "queued", n)
+		}
+		s.endpoints = append(s.endpoints, &endpoint{url: u, queue: q, notify: make(chan struct{}, 1)})
+	}
+
+	s.wg.Add(1)
+	go s.dispatch()
+	for _, ep := range s.endpoints {
+		s.wg.Add(1)
+		go s.deliver(ep)
+	}
+	return s, nil
+}
+
+// queueFileName names the queue file of an endpoint after a hash of its URL
+func queueFileName(u string) string {
+	sum := sha256.Sum256([]byte(u))
+	return hex.EncodeToString(sum[:8]) + ".jsonl"
+}
+
+// Send queues an event (any value that marshals to a JSON object) for every endpoint
+// It never blocks; if the sender falls behind, the event is dropped and counted.
+func (s *Sender) Send(event any) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.inbox <- data:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// dispatch moves events from the inbox into the endpoint queues
+// Queue files are written here so a slow disk never holds up Send.
+func (s *Sender) dispatch() {
+	defer s.wg.Done()
+	for {
+		select {
+		case data := <-s.inbox:
+			for _, ep := range s.endpoints {
+				if err := ep.queue.push(data); err != nil {
+					s.logger.Error("Failed to queue webhook event", "url", ep.url, "error", err)
+				}
+				select {
+				case ep.notify <- struct{}{}:
+				default:
+				}
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver posts the queued events of one endpoint in batches until the sender is closed
+func (s *Sender) deliver(ep *endpoint) {
+	defer s.wg.Done()
+	var backoff time.Duration
+	for {
+		// Wait for events, then give the batch a chance to fill
+		for ep.queue.len() == 0 {
+			select {
+			case <-ep.notify:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+		if s.opts.BatchDelay > 0 && ep.queue.len() < s.opts.BatchSize && !s.waitForBatch(ep) {
+			return
+		}
+		s.logDropped(ep)
+
+		batch := ep.queue.peek(s.opts.BatchSize)
+		err := s.post(ep.url, batch)
+		var permanent *permanentError
+		switch {
+		case err == nil:
+			backoff = 0
+		case errors.As(err, &permanent):
+			// Retrying cannot help; drop the batch rather than block the queue
+			s.logger.Error("Webhook endpoint rejected events, dropping them", "url", ep.url, "events", len(batch), "error", err)
+			backoff = 0
+		case s.ctx.Err() != nil:
+			return // Closed during the request; the batch stays queued
+		default:
+			backoff = min(max(2*backoff, minBackoff), s.opts.MaxBackoff)
+			s.logger.Warn("Webhook delivery failed, retrying", "url", ep.url, "events", len(batch),
+				"queued", ep.queue.len(), "retry_in", backoff, "error", err)
+			if !s.sleep(backoff) {
+				return
+			}
+			continue
+		}
+		if err := ep.queue.ack(len(batch)); err != nil {
+			s.logger.Error("Failed to update webhook queue", "url", ep.url, "error", err)
+		}
+	}
+}
+
+// waitForBatch waits until a full batch is queued or BatchDelay has passed
+// It returns false if the sender was closed.
+func (s *Sender) waitForBatch(ep *endpoint) bool {
+	timer := time.NewTimer(s.opts.BatchDelay)
+	defer timer.Stop()
+	for ep.queue.len() < s.opts.BatchSize {
+		select {
+		case <-ep.notify:
+		case <-timer.C:
+			return true
+		case <-s.ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// sleep waits for d; it returns false if the sender was closed
+func (s *Sender) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// logDropped reports events lost to full queues since the last report
+func (s *Sender) logDropped(ep *endpoint) {
+	if n := ep.queue.takeDropped(); n > 0 {
+		s.logger.Warn("Webhook queue full, dropped oldest events", "url", ep.url, "dropped", n)
+	}
+	s.mu.Lock()
+	n := s.dropped
+	s.dropped = 0
+	s.mu.Unlock()
+	if n > 0 {
+		s.logger.Warn("Webhook sender falling behind, dropped events", "dropped", n)
+	}
+}
+
+// permanentError is a response that will not change on retry (4xx other than 408 and 429)
+type permanentError struct {
+	status string
+}
+
+func (e *permanentError) Error() string {
+	return "endpoint returned " + e.status
+}
+
+// post sends one batch as {"events": [...]}
+func (s *Sender) post(u string, batch [][]byte) error {
+	body := make([]byte, 0, 16+len(batch)*256)
+	body = append(body, `{"events":[`...)
+	for i, event := range batch {
+		if i > 0 {
+			body = append(body, ',')
+		}
+		body = append(body, event...)
+	}
+	body = append(body, "]}"...)
+
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "btblocker")
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if s.opts.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(s.opts.Secret, timestamp, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return &permanentError{status: resp.Status}
+	}
+	return fmt.Errorf("endpoint returned %s", resp.Status)
+}
+
+// Sign returns the HeaderSignature value for a request body sent at timestamp
+// Receivers recompute it with the shared secret and compare with hmac.Equal.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close stops delivery; undelivered events stay in the queue files
+// Events still in memory are lost, so their number is logged.
+func (s *Sender) Close() error {
+	s.cancel()
+	s.wg.Wait()
+
+	// Events Send handed over but dispatch did not get to
+	for pending := len(s.inbox); pending > 0; pending-- {
+		data := <-s.inbox
+		for _, ep := range s.endpoints {
+			_ = ep.queue.push(data)
+		}
+	}
+	for _, ep := range s.endpoints {
+		if n := ep.queue.len(); n > 0 && ep.queue.path == "" {
+			s.logger.Warn("Webhook events not delivered", "url", ep.url, "events", n)
+		}
+	}
+	return s.closeQueues()
+}
+
+// closeQueues closes every endpoint queue
+func (s *Sender) closeQueues() error {
+	var errs []error
+	for _, ep := range s.endpoints {
+		if err := ep.queue.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
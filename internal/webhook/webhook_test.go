@@ -0,0 +1,289 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	N int `json:"n"`
+}
+
+// recorder is an endpoint that records delivered batches and answers with status()
+type recorder struct {
+	mu      sync.Mutex
+	batches [][]testEvent
+	headers []http.Header
+	bodies  [][]byte
+	status  func(attempt int) int
+	calls   int
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	status := http.StatusOK
+	if r.status != nil {
+		status = r.status(r.calls)
+	}
+	if status == http.StatusOK {
+		var payload struct {
+			Events []testEvent `json:"events"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			status = http.StatusBadRequest
+		} else {
+			r.batches = append(r.batches, payload.Events)
+			r.headers = append(r.headers, req.Header.Clone())
+			r.bodies = append(r.bodies, body)
+		}
+	}
+	w.WriteHeader(status)
+}
+
+// delivered returns the event numbers received so far, in order
+func (r *recorder) delivered() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ns []int
+	for _, batch := range r.batches {
+		for _, ev := range batch {
+			ns = append(ns, ev.N)
+		}
+	}
+	return ns
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSender_BatchesAndSigns(t *testing.T) {
+	rec := &recorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	s, err := New(Options{URLs: []string{srv.URL}, Secret: "s3cret", BatchSize: 3, BatchDelay: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 1; i <= 7; i++ {
+		if err := s.Send(testEvent{N: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "7 events", func() bool { return len(rec.delivered()) == 7 })
+	if got := fmt.Sprint(rec.delivered()); got != "[1 2 3 4 5 6 7]" {
+		t.Errorf("Delivered %s, want events in order", got)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for i, batch := range rec.batches {
+		if len(batch) > 3 {
+			t.Errorf("Batch %d has %d events, want at most 3", i, len(batch))
+		}
+		h := rec.headers[i]
+		want := Sign("s3cret", h.Get(HeaderTimestamp), rec.bodies[i])
+		if got := h.Get(HeaderSignature); got != want {
+			t.Errorf("Batch %d signature = %q, want %q", i, got, want)
+		}
+		if h.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type = %q", h.Get("Content-Type"))
+		}
+	}
+}
+
+func TestSender_RetriesTransientFailures(t *testing.T) {
+	rec := &recorder{status: func(attempt int) int {
+		if attempt <= 2 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	s, err := New(Options{URLs: []string{srv.URL}, BatchSize: 1, BatchDelay: time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_ = s.Send(testEvent{N: 1})
+	waitFor(t, "delivery after retries", func() bool { return len(rec.delivered()) == 1 })
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.calls != 3 {
+		t.Errorf("Requests = %d, want 3 (two failures, one success)", rec.calls)
+	}
+}
+
+func TestSender_DropsRejectedBatches(t *testing.T) {
+	rec := &recorder{status: func(attempt int) int {
+		if attempt == 1 {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	}}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	s, err := New(Options{URLs: []string{srv.URL}, BatchSize: 1, BatchDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_ = s.Send(testEvent{N: 1})
+	_ = s.Send(testEvent{N: 2})
+	waitFor(t, "second event", func() bool { return len(rec.delivered()) == 1 })
+	if got := rec.delivered(); got[0] != 2 {
+		t.Errorf("Delivered %v, want only event 2 (event 1 was rejected)", got)
+	}
+}
+
+func TestSender_DiskQueueSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	url := down.URL
+
+	s, err := New(Options{URLs: []string{url}, BatchSize: 10, BatchDelay: time.Millisecond, MaxBackoff: time.Hour, QueueDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		_ = s.Send(testEvent{N: i})
+	}
+	waitFor(t, "events queued on disk", func() bool { return s.endpoints[0].queue.len() == 5 })
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	down.Close()
+
+	// The endpoint comes back at the same address
+	rec := &recorder{}
+	up := httptest.NewUnstartedServer(rec)
+	up.Listener.Close()
+	up.Listener = listen(t, url)
+	up.Start()
+	defer up.Close()
+
+	s, err = New(Options{URLs: []string{url}, BatchSize: 10, BatchDelay: time.Millisecond, QueueDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	waitFor(t, "queued events after restart", func() bool { return len(rec.delivered()) == 5 })
+
+	waitFor(t, "queue file emptied", func() bool {
+		fi, err := os.Stat(filepath.Join(dir, queueFileName(url)))
+		return err == nil && fi.Size() == 0
+	})
+}
+
+// listen listens on the address of an endpoint URL that was closed
+func listen(t *testing.T, url string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Skipf("Cannot listen on %s again: %v", url, err)
+	}
+	return ln
+}
+
+func TestSender_SendNeverBlocks(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	s, err := New(Options{URLs: []string{srv.URL}, BatchSize: 1, BatchDelay: time.Millisecond, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := time.Now()
+	for i := 0; i < 2*inboxSize; i++ {
+		_ = s.Send(testEvent{N: i})
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Send took %v with a stalled endpoint", elapsed)
+	}
+}
+
+func TestQueue_DropsOldest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "q.jsonl")
+	q, err := openQueue(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := q.push([]byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := fmt.Sprintf("%s", q.peek(10)); got != `[{"n":3} {"n":4} {"n":5}]` {
+		t.Errorf("Queue = %s, want the 3 newest events", got)
+	}
+	if n := q.takeDropped(); n != 2 {
+		t.Errorf("Dropped = %d, want 2", n)
+	}
+	_ = q.ack(1)
+	_ = q.close()
+
+	// Reopening resumes after the delivered events
+	q, err = openQueue(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+	if got := fmt.Sprintf("%s", q.peek(10)); got != `[{"n":4} {"n":5}]` {
+		t.Errorf("Reopened queue = %s, want the undelivered events", got)
+	}
+}
+
+func TestOptions_Validate(t *testing.T) {
+	for _, tt := range []struct {
+		opts    Options
+		wantErr bool
+	}{
+		{Options{URLs: []string{"https://tickets.example.com/hooks/btblocker"}}, false},
+		{Options{URLs: []string{"ftp://example.com"}}, true},
+		{Options{URLs: []string{"example.com/hook"}}, true},
+		{Options{URLs: []string{"http://example.com"}, BatchSize: -1}, true},
+	} {
+		if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%v) error = %v, wantErr %v", tt.opts.URLs, err, tt.wantErr)
+		}
+	}
+}
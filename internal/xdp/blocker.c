@@ -15,6 +15,8 @@ typedef unsigned short __u16;
 
 // BPF helper functions
 static void *(*bpf_map_lookup_elem)(void *map, const void *key) = (void *) 1;
+static long (*bpf_map_update_elem)(void *map, const void *key, const void *value, __u64 flags) = (void *) 2;
+static __u64 (*bpf_ktime_get_ns)(void) = (void *) 5;
 
 // XDP action codes
 #define XDP_ABORTED 0
@@ -23,11 +25,21 @@ static void *(*bpf_map_lookup_elem)(void *map, const void *key) = (void *) 1;
 #define XDP_TX 3
 #define XDP_REDIRECT 4
 
-// Ethernet protocol
+// Ethernet protocols
 #define ETH_P_IP 0x0800
+#define ETH_P_IPV6 0x86DD
 
-// BPF map type
+// BPF map types
 #define BPF_MAP_TYPE_HASH 1
+#define BPF_MAP_TYPE_PERCPU_HASH 5
+#define BPF_MAP_TYPE_PERCPU_ARRAY 6
+#define BPF_MAP_TYPE_LPM_TRIE 11
+
+// Map creation flags
+#define BPF_F_NO_PREALLOC 1  // Required for LPM tries
+
+// bpf_map_update_elem flags
+#define BPF_NOEXIST 1
 
 // Byte order conversion
 #define bpf_ntohs(x) __builtin_bswap16(x)
@@ -62,48 +74,258 @@ struct iphdr {
 	__u32 daddr;
 } __attribute__((packed));
 
-// Map to store blocked IPs (key: IPv4 address as __u32, value: expiration timestamp as __u64)
+struct ipv6hdr {
+	__u8 priority:4;
+	__u8 version:4;
+	__u8 flow_lbl[3];
+	__u16 payload_len;
+	__u8 nexthdr;
+	__u8 hop_limit;
+	__u8 saddr[16];
+	__u8 daddr[16];
+} __attribute__((packed));
+
+// 128-bit IPv6 address used as map key
+struct ip6_key {
+	__u8 addr[16];
+};
+
+// LPM trie keys: prefix length in bits followed by the address in network byte order
+struct lpm_key4 {
+	__u32 prefixlen;
+	__u32 addr;
+};
+
+struct lpm_key6 {
+	__u32 prefixlen;
+	__u8 addr[16];
+};
+
+// Allowlisted IPv4 prefixes, checked before the blocklist so they are never dropped
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, 10000);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct lpm_key4);
+	__type(value, __u8);
+} allow_ips SEC(".maps");
+
+// Allowlisted IPv6 prefixes
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, 10000);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct lpm_key6);
+	__type(value, __u8);
+} allow_ips6 SEC(".maps");
+
+// Banned IPv4 prefixes (subnet bans), value: expiration time as in blocked_ips
+// The longest matching prefix decides, so a nested prefix's expiry hides the outer one
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, 10000);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct lpm_key4);
+	__type(value, __u64);
+} blocked_prefixes SEC(".maps");
+
+// Banned IPv6 prefixes
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, 10000);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct lpm_key6);
+	__type(value, __u64);
+} blocked_prefixes6 SEC(".maps");
+
+// Map to store blocked IPs (key: IPv4 address as __u32, value: expiration time as __u64)
+// Expiry is in bpf_ktime_get_ns() nanoseconds (CLOCK_MONOTONIC), so the program can
+// enforce it on its own even if user space stops running cleanup
 struct {
 	__uint(type, BPF_MAP_TYPE_HASH);
 	__uint(max_entries, 100000);  // Support up to 100k blocked IPs
 	__type(key, __u32);           // IPv4 address
-	__type(value, __u64);         // Expiration timestamp (seconds since epoch)
+	__type(value, __u64);         // Expiration time (bpf_ktime_get_ns() nanoseconds)
 } blocked_ips SEC(".maps");
 
-// XDP program to filter blocked IPs
+// Map to store blocked IPv6 IPs (key: 128-bit IPv6 address, value: expiration time as __u64)
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 100000);  // Support up to 100k blocked IPv6 addresses
+	__type(key, struct ip6_key);  // IPv6 address
+	__type(value, __u64);         // Expiration time (bpf_ktime_get_ns() nanoseconds)
+} blocked_ips6 SEC(".maps");
+
+// Per-source drop counters (one copy per CPU, summed in user space)
+struct drop_stats {
+	__u64 packets;
+	__u64 bytes;
+	__u64 last_seen_ns;  // bpf_ktime_get_ns() of the last dropped packet
+};
+
+// Global packet/byte totals, indexed by XDP_STAT_*
+struct xdp_total {
+	__u64 packets;
+	__u64 bytes;
+};
+
+#define XDP_STAT_PASS 0
+#define XDP_STAT_DROP 1
+#define XDP_STAT_MAX 2
+
+// Drop counters per blocked IPv4 source (entries are removed together with the ban)
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+	__uint(max_entries, 100000);
+	__type(key, __u32);
+	__type(value, struct drop_stats);
+} ip_drop_stats SEC(".maps");
+
+// Drop counters per blocked IPv6 source
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+	__uint(max_entries, 100000);
+	__type(key, struct ip6_key);
+	__type(value, struct drop_stats);
+} ip_drop_stats6 SEC(".maps");
+
+// Global pass/drop totals
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, XDP_STAT_MAX);
+	__type(key, __u32);
+	__type(value, struct xdp_total);
+} xdp_totals SEC(".maps");
+
+// Add a packet to the global totals and return the XDP action unchanged
+static __attribute__((always_inline)) int count_total(__u32 action, __u64 bytes) {
+	__u32 idx = action == XDP_DROP ? XDP_STAT_DROP : XDP_STAT_PASS;
+	struct xdp_total *total = bpf_map_lookup_elem(&xdp_totals, &idx);
+	if (total) {
+		total->packets++;
+		total->bytes += bytes;
+	}
+	return action;
+}
+
+// Check whether a blocklist entry is still in force
+// Expired entries are passed (and left for user-space cleanup to delete)
+static __attribute__((always_inline)) int ban_active(const __u64 *expires_at, __u64 now) {
+	return expires_at != NULL && now < *expires_at;
+}
+
+// Account a dropped packet to its source address
+// Per-CPU values need no atomics; a lost NOEXIST race only drops one sample
+static __attribute__((always_inline)) int count_drop(void *stats_map, const void *key, __u64 bytes, __u64 now) {
+	struct drop_stats *stats = bpf_map_lookup_elem(stats_map, key);
+	if (stats) {
+		stats->packets++;
+		stats->bytes += bytes;
+		stats->last_seen_ns = now;
+	} else {
+		struct drop_stats init = { .packets = 1, .bytes = bytes, .last_seen_ns = now };
+		bpf_map_update_elem(stats_map, key, &init, BPF_NOEXIST);
+	}
+	return count_total(XDP_DROP, bytes);
+}
+
+// Check an IPv6 packet's source address against blocked_ips6
+static __attribute__((always_inline)) int handle_ipv6(void *data, void *data_end, __u64 bytes) {
+	struct ipv6hdr *ip6 = data;
+	if ((void *)(ip6 + 1) > data_end)
+		return count_total(XDP_PASS, bytes);  // Invalid packet, pass to network stack
+
+	// Allowlisted sources always pass, whatever the blocklist says
+	struct lpm_key6 lpm_key = { .prefixlen = 128 };
+	__builtin_memcpy(lpm_key.addr, ip6->saddr, sizeof(lpm_key.addr));
+	if (bpf_map_lookup_elem(&allow_ips6, &lpm_key))
+		return count_total(XDP_PASS, bytes);
+
+	// Copy source address to the stack (map keys must not point into packet memory)
+	struct ip6_key key;
+	__builtin_memcpy(key.addr, ip6->saddr, sizeof(key.addr));
+
+	__u64 now = bpf_ktime_get_ns();
+	if (ban_active(bpf_map_lookup_elem(&blocked_ips6, &key), now))
+		return count_drop(&ip_drop_stats6, &key, bytes, now);
+
+	// Subnet bans are only counted in the global totals
+	if (ban_active(bpf_map_lookup_elem(&blocked_prefixes6, &lpm_key), now))
+		return count_total(XDP_DROP, bytes);
+
+	return count_total(XDP_PASS, bytes);
+}
+
+// Check an IPv4 packet's source address against blocked_ips
+static __attribute__((always_inline)) int handle_ipv4(void *data, void *data_end, __u64 bytes) {
+	// Parse IP header
+	struct iphdr *ip = data;
+	if ((void *)(ip + 1) > data_end)
+		return count_total(XDP_PASS, bytes);  // Invalid packet, pass to network stack
+
+	// Extract source IP address (already in network byte order)
+	__u32 src_ip = ip->saddr;
+
+	// Allowlisted sources always pass, whatever the blocklist says
+	struct lpm_key4 lpm_key = { .prefixlen = 32, .addr = src_ip };
+	if (bpf_map_lookup_elem(&allow_ips, &lpm_key))
+		return count_total(XDP_PASS, bytes);
+
+	// Look up source IP in blocked_ips map
+	__u64 now = bpf_ktime_get_ns();
+	if (ban_active(bpf_map_lookup_elem(&blocked_ips, &src_ip), now)) {
+		// IP is in blocklist and the ban has not expired - DROP the packet
+		return count_drop(&ip_drop_stats, &src_ip, bytes, now);
+	}
+
+	// Source inside a banned prefix (subnet ban, only counted in the global totals)
+	if (ban_active(bpf_map_lookup_elem(&blocked_prefixes, &lpm_key), now))
+		return count_total(XDP_DROP, bytes);
+
+	// IP not in blocklist (or ban expired) - pass to network stack (will go to NFQUEUE for DPI)
+	return count_total(XDP_PASS, bytes);
+}
+
+// XDP program to filter blocked IPs on Ethernet devices
 SEC("xdp")
 int xdp_blocker(struct xdp_md *ctx) {
 	void *data_end = (void *)(long)ctx->data_end;
 	void *data = (void *)(long)ctx->data;
+	__u64 bytes = data_end - data;
 
 	// Parse Ethernet header
 	struct ethhdr *eth = data;
 	if ((void *)(eth + 1) > data_end)
-		return XDP_PASS;  // Invalid packet, pass to network stack
+		return count_total(XDP_PASS, bytes);  // Invalid packet, pass to network stack
 
-	// Only process IPv4 packets
-	if (eth->h_proto != bpf_htons(ETH_P_IP))
-		return XDP_PASS;
+	// IPv6 packets are checked against the separate 128-bit keyed map
+	if (eth->h_proto == bpf_htons(ETH_P_IPV6))
+		return handle_ipv6((void *)(eth + 1), data_end, bytes);
+	if (eth->h_proto == bpf_htons(ETH_P_IP))
+		return handle_ipv4((void *)(eth + 1), data_end, bytes);
 
-	// Parse IP header
-	struct iphdr *ip = (void *)(eth + 1);
-	if ((void *)(ip + 1) > data_end)
-		return XDP_PASS;  // Invalid packet, pass to network stack
+	return count_total(XDP_PASS, bytes);
+}
 
-	// Extract source IP address (already in network byte order)
-	__u32 src_ip = ip->saddr;
+// XDP program for devices without a link-layer header (WireGuard, tun, ...)
+// Packets start at the IP header, whose version nibble tells IPv4 from IPv6.
+SEC("xdp")
+int xdp_blocker_raw(struct xdp_md *ctx) {
+	void *data_end = (void *)(long)ctx->data_end;
+	void *data = (void *)(long)ctx->data;
+	__u64 bytes = data_end - data;
 
-	// Look up source IP in blocked_ips map
-	__u64 *expires_at = bpf_map_lookup_elem(&blocked_ips, &src_ip);
-	if (expires_at != NULL) {
-		// IP is in blocklist - DROP the packet
-		// Note: Expiration checking is handled by user-space periodic cleanup
-		// This keeps the kernel code simple and avoids division operations
-		return XDP_DROP;
-	}
+	__u8 *version = data;
+	if ((void *)(version + 1) > data_end)
+		return count_total(XDP_PASS, bytes);  // Invalid packet, pass to network stack
 
-	// IP not in blocklist - pass to network stack (will go to NFQUEUE for DPI)
-	return XDP_PASS;
+	switch (*version >> 4) {
+	case 4:
+		return handle_ipv4(data, data_end, bytes);
+	case 6:
+		return handle_ipv6(data, data_end, bytes);
+	}
+	return count_total(XDP_PASS, bytes);
 }
 
 char _license[] SEC("license") = "GPL";
@@ -8,10 +8,41 @@ import (
 	_ "embed"
 	"fmt"
 	"io"
+	"structs"
 
 	"github.com/cilium/ebpf"
 )
 
+type bpfDropStats struct {
+	_          structs.HostLayout
+	Packets    uint64
+	Bytes      uint64
+	LastSeenNs uint64
+}
+
+type bpfIp6Key struct {
+	_    structs.HostLayout
+	Addr [16]uint8
+}
+
+type bpfLpmKey4 struct {
+	_         structs.HostLayout
+	Prefixlen uint32
+	Addr      uint32
+}
+
+type bpfLpmKey6 struct {
+	_         structs.HostLayout
+	Prefixlen uint32
+	Addr      [16]uint8
+}
+
+type bpfXdpTotal struct {
+	_       structs.HostLayout
+	Packets uint64
+	Bytes   uint64
+}
+
 // loadBpf returns the embedded CollectionSpec for bpf.
 func loadBpf() (*ebpf.CollectionSpec, error) {
 	reader := bytes.NewReader(_BpfBytes)
@@ -54,14 +85,23 @@ type bpfSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfProgramSpecs struct {
-	XdpBlocker *ebpf.ProgramSpec `ebpf:"xdp_blocker"`
+	XdpBlocker    *ebpf.ProgramSpec `ebpf:"xdp_blocker"`
+	XdpBlockerRaw *ebpf.ProgramSpec `ebpf:"xdp_blocker_raw"`
 }
 
 // bpfMapSpecs contains maps before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfMapSpecs struct {
-	BlockedIps *ebpf.MapSpec `ebpf:"blocked_ips"`
+	AllowIps         *ebpf.MapSpec `ebpf:"allow_ips"`
+	AllowIps6        *ebpf.MapSpec `ebpf:"allow_ips6"`
+	BlockedIps       *ebpf.MapSpec `ebpf:"blocked_ips"`
+	BlockedIps6      *ebpf.MapSpec `ebpf:"blocked_ips6"`
+	BlockedPrefixes  *ebpf.MapSpec `ebpf:"blocked_prefixes"`
+	BlockedPrefixes6 *ebpf.MapSpec `ebpf:"blocked_prefixes6"`
+	IpDropStats      *ebpf.MapSpec `ebpf:"ip_drop_stats"`
+	IpDropStats6     *ebpf.MapSpec `ebpf:"ip_drop_stats6"`
+	XdpTotals        *ebpf.MapSpec `ebpf:"xdp_totals"`
 }
 
 // bpfVariableSpecs contains global variables before they are loaded into the kernel.
@@ -90,12 +130,28 @@ func (o *bpfObjects) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfMaps struct {
-	BlockedIps *ebpf.Map `ebpf:"blocked_ips"`
+	AllowIps         *ebpf.Map `ebpf:"allow_ips"`
+	AllowIps6        *ebpf.Map `ebpf:"allow_ips6"`
+	BlockedIps       *ebpf.Map `ebpf:"blocked_ips"`
+	BlockedIps6      *ebpf.Map `ebpf:"blocked_ips6"`
+	BlockedPrefixes  *ebpf.Map `ebpf:"blocked_prefixes"`
+	BlockedPrefixes6 *ebpf.Map `ebpf:"blocked_prefixes6"`
+	IpDropStats      *ebpf.Map `ebpf:"ip_drop_stats"`
+	IpDropStats6     *ebpf.Map `ebpf:"ip_drop_stats6"`
+	XdpTotals        *ebpf.Map `ebpf:"xdp_totals"`
 }
 
 func (m *bpfMaps) Close() error {
 	return _BpfClose(
+		m.AllowIps,
+		m.AllowIps6,
 		m.BlockedIps,
+		m.BlockedIps6,
+		m.BlockedPrefixes,
+		m.BlockedPrefixes6,
+		m.IpDropStats,
+		m.IpDropStats6,
+		m.XdpTotals,
 	)
 }
 
@@ -109,12 +165,14 @@ type bpfVariables struct {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfPrograms struct {
-	XdpBlocker *ebpf.Program `ebpf:"xdp_blocker"`
+	XdpBlocker    *ebpf.Program `ebpf:"xdp_blocker"`
+	XdpBlockerRaw *ebpf.Program `ebpf:"xdp_blocker_raw"`
 }
 
 func (p *bpfPrograms) Close() error {
 	return _BpfClose(
 		p.XdpBlocker,
+		p.XdpBlockerRaw,
 	)
 }
 
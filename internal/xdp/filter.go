@@ -0,0 +1,55 @@
+package xdp
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// XDP attach modes accepted by NewXDPFilter
+const (
+	ModeGeneric = "generic" // SKB mode, works with every driver (slowest)
+	ModeNative  = "native"  // Driver mode, requires XDP support in the NIC driver
+	ModeOffload = "offload" // Hardware offload, requires a SmartNIC that can run eBPF
+	ModeAuto    = "auto"    // Try native first, fall back to generic
+)
+
+// ValidateMode checks that mode is a supported XDP attach mode
+func ValidateMode(mode string) error {
+	switch mode {
+	case ModeGeneric, ModeNative, ModeOffload, ModeAuto:
+		return nil
+	default:
+		return fmt.Errorf("invalid XDP mode %q (must be %s, %s, %s or %s)", mode, ModeGeneric, ModeNative, ModeOffload, ModeAuto)
+	}
+}
+
+// DefaultPinPath is the bpffs directory where maps (and kept links) are pinned
+const DefaultPinPath = "/sys/fs/bpf/btblocker"
+
+// Options configures NewXDPFilterWithOptions
+type Options struct {
+	Interfaces []string // Interfaces to attach the program to
+	Mode       string   // Attach mode (empty = generic)
+
+	// PinPath is a bpffs directory for pinning the maps (empty = no pinning)
+	// Pinned maps survive restarts, so bans are restored on the next start.
+	PinPath string
+
+	// KeepAttached leaves the program attached when the filter is closed, so
+	// enforcement continues while the daemon restarts (requires PinPath)
+	KeepAttached bool
+
+	// Logger receives the filter's events, including map cleanup and
+	// aggregation (nil = slog.Default())
+	Logger *slog.Logger
+}
+
+// InterfaceStatus describes the XDP attachment on one interface
+type InterfaceStatus struct {
+	Name       string // Interface name
+	Attached   bool   // True if the XDP program is attached
+	AttachMode string // Mode that actually took effect (empty if not attached, configured mode if Reused)
+	Reused     bool   // True if a link kept from a previous run was updated in place
+	RawIP      bool   // True for devices without an Ethernet header (WireGuard, tun)
+	Error      string // Attach failure (empty if attached)
+}
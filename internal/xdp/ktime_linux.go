@@ -0,0 +1,28 @@
+//go:build linux
+
+package xdp
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ktimeNow returns the current CLOCK_MONOTONIC time in nanoseconds,
+// the clock used by bpf_ktime_get_ns() in the XDP program
+func ktimeNow() uint64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return uint64(ts.Nano()) // #nosec G115 - monotonic time is never negative
+}
+
+// ktimeToTime converts a bpf_ktime_get_ns() timestamp (past or future) to wall-clock time
+func ktimeToTime(ktime uint64) time.Time {
+	now := ktimeNow()
+	if ktime >= now {
+		return time.Now().Add(time.Duration(ktime - now)) // #nosec G115 - difference of two monotonic readings
+	}
+	return time.Now().Add(-time.Duration(now - ktime)) // #nosec G115 - difference of two monotonic readings
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package xdp
+
+import "time"
+
+// ktimeNow is not available without the Linux monotonic clock
+func ktimeNow() uint64 {
+	return 0
+}
+
+// ktimeToTime is not available without the Linux monotonic clock
+func ktimeToTime(ktime uint64) time.Time {
+	return time.Time{}
+}
@@ -3,58 +3,284 @@
 package xdp
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
+	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
 )
 
+// attachment is the XDP program attached to one interface
+type attachment struct {
+	ifaceName  string
+	attachMode string    // Mode that actually took effect (never "auto" unless reused)
+	link       link.Link // nil if the attach failed
+	pinned     bool      // Link is pinned in bpffs
+	reused     bool      // Link was kept attached by a previous run
+	rawIP      bool      // Device without a link-layer header, running xdp_blocker_raw
+	err        error
+}
+
 // Filter represents the XDP-based packet filter
+// One program is attached per interface; all attachments share the same maps,
+// so a single IPMapManager drives every interface.
 type Filter struct {
-	ifaceName string
-	objs      *bpfObjects
-	link      link.Link
-	mapMgr    *IPMapManager
+	attachments  []*attachment
+	objs         *bpfObjects
+	mapMgr       *IPMapManager
+	keepAttached bool
+	logger       *slog.Logger
 }
 
-// NewXDPFilter creates and loads a new XDP filter on the specified interface
-func NewXDPFilter(ifaceName string) (*Filter, error) {
+// NewXDPFilter creates and loads a new XDP filter on the specified interfaces
+// mode is one of ModeGeneric, ModeNative, ModeOffload or ModeAuto (empty = generic).
+// Maps are not pinned; use NewXDPFilterWithOptions to keep bans across restarts.
+func NewXDPFilter(ifaceNames []string, mode string) (*Filter, error) {
+	return NewXDPFilterWithOptions(Options{Interfaces: ifaceNames, Mode: mode})
+}
+
+// NewXDPFilterWithOptions creates and loads a new XDP filter
+// Per-interface attach failures are logged and reported by GetStats; an error is
+// returned only if the program could not be attached to any interface.
+// With a PinPath, maps pinned by a previous run are reused and their bans restored.
+func NewXDPFilterWithOptions(opts Options) (*Filter, error) {
+	ifaceNames, mode := opts.Interfaces, opts.Mode
+	if mode == "" {
+		mode = ModeGeneric
+	}
+	if err := ValidateMode(mode); err != nil {
+		return nil, err
+	}
+	if len(ifaceNames) == 0 {
+		return nil, fmt.Errorf("no interfaces specified")
+	}
+	if mode == ModeOffload && len(ifaceNames) > 1 {
+		// An offloaded program (and its maps) lives on a single NIC
+		return nil, fmt.Errorf("%s mode supports a single interface (got %d)", ModeOffload, len(ifaceNames))
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	pinPath := opts.PinPath
+	if pinPath != "" && mode == ModeOffload {
+		// Offloaded maps live on the NIC and cannot be shared through bpffs
+		logger.Warn("Map pinning is not supported in offload mode, bans will not survive restarts")
+		pinPath = ""
+	}
+	if pinPath != "" {
+		if err := os.MkdirAll(pinPath, 0o700); err != nil {
+			logger.Warn("Failed to create pin directory, continuing without pinning", "path", pinPath, "error", err)
+			pinPath = ""
+		}
+	}
+	if opts.KeepAttached && pinPath == "" {
+		logger.Warn("Keeping XDP attached across restarts requires map pinning, ignoring")
+	}
+
 	// Load pre-compiled eBPF objects
+	spec, err := loadBpf()
+	if err != nil {
+		return nil, fmt.Errorf("loading eBPF spec: %w", err)
+	}
+	if mode == ModeOffload {
+		// Offloaded programs must be bound to the target device at load time
+		iface, err := getInterface(ifaceNames[0])
+		if err != nil {
+			return nil, fmt.Errorf("getting interface %s: %w", ifaceNames[0], err)
+		}
+		for _, prog := range spec.Programs {
+			prog.Ifindex = uint32(iface.Index) // #nosec G115 - interface indexes are positive
+		}
+	}
+	objs, err := loadObjects(spec, pinPath, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Attach the program to every interface, keeping going on failures
+	f := &Filter{objs: objs, keepAttached: opts.KeepAttached && pinPath != "", logger: logger}
+	var errs []error
+	for _, name := range ifaceNames {
+		a := f.attachInterface(objs, name, mode, pinPath)
+		f.attachments = append(f.attachments, a)
+		if a.err != nil {
+			logger.Error("Failed to attach XDP filter", "interface", name, "error", a.err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, a.err))
+		}
+	}
+
+	if len(errs) == len(ifaceNames) {
+		_ = objs.Close()
+		return nil, fmt.Errorf("attaching XDP program: %w", errors.Join(errs...))
+	}
+
+	// Create IP map manager
+	f.mapMgr = NewIPMapManager(Maps{
+		Allow:      objs.AllowIps,
+		Allow6:     objs.AllowIps6,
+		Blocked:    objs.BlockedIps,
+		Blocked6:   objs.BlockedIps6,
+		Prefixes:   objs.BlockedPrefixes,
+		Prefixes6:  objs.BlockedPrefixes6,
+		DropStats:  objs.IpDropStats,
+		DropStats6: objs.IpDropStats6,
+		Totals:     objs.XdpTotals,
+	})
+	f.mapMgr.SetLogger(logger)
+
+	// Rebuild the user-space view of bans left in the pinned maps by a previous run
+	if pinPath != "" {
+		restored, err := f.mapMgr.Restore()
+		if err != nil {
+			logger.Error("Failed to restore bans from pinned maps", "error", err)
+		} else if restored > 0 {
+			logger.Info("Restored active bans from pinned maps", "restored", restored, "path", pinPath)
+		}
+	}
+
+	return f, nil
+}
+
+// loadObjects loads the eBPF objects, reusing maps pinned under pinPath if set
+// Pinned maps whose layout no longer matches the program (e.g. after an upgrade)
+// are discarded and recreated.
+func loadObjects(spec *ebpf.CollectionSpec, pinPath string, logger *slog.Logger) (*bpfObjects, error) {
+	var opts *ebpf.CollectionOptions
+	if pinPath != "" {
+		for _, m := range spec.Maps {
+			m.Pinning = ebpf.PinByName
+		}
+		opts = &ebpf.CollectionOptions{Maps: ebpf.MapOptions{PinPath: pinPath}}
+	}
+
 	objs := &bpfObjects{}
-	if err := loadBpfObjects(objs, nil); err != nil {
+	err := spec.LoadAndAssign(objs, opts)
+	if err != nil && pinPath != "" && errors.Is(err, ebpf.ErrMapIncompatible) {
+		logger.Warn("Pinned maps are incompatible with this version, recreating them (previous bans are lost)", "path", pinPath)
+		for name := range spec.Maps {
+			_ = os.Remove(filepath.Join(pinPath, name))
+		}
+		err = spec.LoadAndAssign(objs, opts)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("loading eBPF objects: %w", err)
 	}
+	return objs, nil
+}
+
+// linkPinPath returns where the link for an interface is pinned
+func linkPinPath(pinPath, ifaceName string) string {
+	return filepath.Join(pinPath, "link_"+ifaceName)
+}
+
+// attachInterface attaches the program to one interface by name
+// A link kept attached by a previous run is updated in place, so there is no
+// window in which the interface is unprotected.
+func (f *Filter) attachInterface(objs *bpfObjects, ifaceName, mode, pinPath string) *attachment {
+	a := &attachment{ifaceName: ifaceName}
 
-	// Get the network interface
 	iface, err := getInterface(ifaceName)
 	if err != nil {
-		_ = objs.Close()
-		return nil, fmt.Errorf("getting interface %s: %w", ifaceName, err)
+		a.err = err
+		return a
 	}
 
-	// Attach XDP program to the interface
-	l, err := link.AttachXDP(link.XDPOptions{
-		Program:   objs.XdpBlocker,
-		Interface: iface.Index,
-		Flags:     link.XDPGenericMode, // Use generic mode for compatibility
-	})
+	// Layer 3 devices hand XDP the bare IP packet
+	prog := objs.XdpBlocker
+	if !hasEthernetHeader(iface) {
+		prog, a.rawIP = objs.XdpBlockerRaw, true
+	}
+
+	if pinPath != "" {
+		if l, err := link.LoadPinnedLink(linkPinPath(pinPath, ifaceName), nil); err == nil {
+			if err := l.Update(prog); err == nil {
+				a.link, a.attachMode, a.pinned, a.reused = l, mode, true, true
+				f.logger.Info("XDP filter updated in place, kept from previous run", "interface", ifaceName, "index", iface.Index)
+				return a
+			}
+			// Stale pin (e.g. interface recreated): drop it and attach fresh
+			f.logger.Warn("Failed to reuse pinned XDP link, re-attaching", "interface", ifaceName, "error", err)
+			_ = l.Unpin()
+			_ = l.Close()
+		}
+	}
+
+	a.link, a.attachMode, a.err = f.attachXDP(prog, iface.Index, mode)
+	if a.err != nil {
+		a.attachMode = ""
+		return a
+	}
+
+	if f.keepAttached {
+		if err := a.link.Pin(linkPinPath(pinPath, ifaceName)); err != nil {
+			f.logger.Warn("Failed to pin XDP link, it will detach on exit", "interface", ifaceName, "error", err)
+		} else {
+			a.pinned = true
+		}
+	}
+
+	f.logger.Info("XDP filter loaded", "interface", ifaceName, "index", iface.Index, "mode", a.attachMode, "raw_ip", a.rawIP)
+	return a
+}
+
+// hasEthernetHeader reports whether packets of iface start with an Ethernet header
+// WireGuard, AmneziaWG and tun devices have the link type ARPHRD_NONE and
+// deliver raw IPv4/IPv6 packets; loopback has an all-zero (so empty) hardware
+// address but still carries an Ethernet header. Falls back to the hardware
+// address length if sysfs is unavailable.
+func hasEthernetHeader(iface *net.Interface) bool {
+	data, err := os.ReadFile(filepath.Join("/sys/class/net", iface.Name, "type"))
 	if err != nil {
-		_ = objs.Close()
-		return nil, fmt.Errorf("attaching XDP program to %s: %w", ifaceName, err)
+		return len(iface.HardwareAddr) == 6
 	}
+	switch strings.TrimSpace(string(data)) {
+	case strconv.Itoa(unix.ARPHRD_NONE), strconv.Itoa(unix.ARPHRD_RAWIP):
+		return false
+	}
+	return true
+}
 
-	log.Printf("XDP filter loaded on interface %s (index %d)", ifaceName, iface.Index)
+// attachXDP attaches the program in the requested mode
+// Returns the link and the mode that actually took effect
+func (f *Filter) attachXDP(prog *ebpf.Program, ifindex int, mode string) (link.Link, string, error) {
+	attach := func(flags link.XDPAttachFlags) (link.Link, error) {
+		return link.AttachXDP(link.XDPOptions{
+			Program:   prog,
+			Interface: ifindex,
+			Flags:     flags,
+		})
+	}
 
-	// Create IP map manager
-	mapMgr := NewIPMapManager(objs.BlockedIps)
-
-	return &Filter{
-		ifaceName: ifaceName,
-		objs:      objs,
-		link:      l,
-		mapMgr:    mapMgr,
-	}, nil
+	switch mode {
+	case ModeNative:
+		l, err := attach(link.XDPDriverMode)
+		return l, ModeNative, err
+	case ModeOffload:
+		l, err := attach(link.XDPOffloadMode)
+		return l, ModeOffload, err
+	case ModeAuto:
+		// Prefer native mode, fall back to generic if the driver lacks XDP support
+		l, err := attach(link.XDPDriverMode)
+		if err == nil {
+			return l, ModeNative, nil
+		}
+		f.logger.Warn("Native XDP attach failed, falling back to generic mode", "error", err)
+		l, err = attach(link.XDPGenericMode)
+		return l, ModeGeneric, err
+	default:
+		l, err := attach(link.XDPGenericMode)
+		return l, ModeGeneric, err
+	}
 }
 
 // GetMapManager returns the IP map manager for adding/removing blocked IPs
@@ -62,35 +288,61 @@ func (f *Filter) GetMapManager() *IPMapManager {
 	return f.mapMgr
 }
 
-// Close detaches the XDP program and releases all resources
+// Close detaches the XDP program from all interfaces and releases all resources
 func (f *Filter) Close() error {
-	log.Printf("Detaching XDP filter from interface %s", f.ifaceName)
-
 	// Stop periodic cleanup
 	if f.mapMgr != nil {
 		_ = f.mapMgr.Close()
 	}
 
-	// Detach XDP program
-	if f.link != nil {
-		if err := f.link.Close(); err != nil {
-			log.Printf("Warning: failed to detach XDP link: %v", err)
+	// Detach XDP program (or leave it running for the next start)
+	for _, a := range f.attachments {
+		if a.link == nil {
+			continue
+		}
+		if f.keepAttached && a.pinned {
+			// Closing the fd of a pinned link leaves the program attached
+			f.logger.Info("Leaving XDP filter attached", "interface", a.ifaceName)
+		} else {
+			f.logger.Info("Detaching XDP filter", "interface", a.ifaceName)
+			if a.pinned {
+				if err := a.link.Unpin(); err != nil {
+					f.logger.Warn("Failed to unpin XDP link", "interface", a.ifaceName, "error", err)
+				}
+			}
+		}
+		if err := a.link.Close(); err != nil {
+			f.logger.Warn("Failed to close XDP link", "interface", a.ifaceName, "error", err)
 		}
 	}
 
 	// Close eBPF objects (maps and programs)
 	if f.objs != nil {
 		if err := f.objs.Close(); err != nil {
-			log.Printf("Warning: failed to close eBPF objects: %v", err)
+			f.logger.Warn("Failed to close eBPF objects", "error", err)
 		}
 	}
 
 	return nil
 }
 
-// GetInterfaceName returns the name of the interface this filter is attached to
-func (f *Filter) GetInterfaceName() string {
-	return f.ifaceName
+// GetInterfaces returns the attach status of every configured interface
+func (f *Filter) GetInterfaces() []InterfaceStatus {
+	statuses := make([]InterfaceStatus, 0, len(f.attachments))
+	for _, a := range f.attachments {
+		status := InterfaceStatus{
+			Name:       a.ifaceName,
+			Attached:   a.err == nil,
+			AttachMode: a.attachMode,
+			Reused:     a.reused,
+			RawIP:      a.rawIP,
+		}
+		if a.err != nil {
+			status.Error = a.err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
 }
 
 // GetStats returns statistics about the XDP filter
@@ -99,9 +351,26 @@ func (f *Filter) GetStats() (map[string]interface{}, error) {
 
 	if f.mapMgr != nil {
 		stats["blocked_ips"] = f.mapMgr.GetBlockedCount()
+		if totals, err := f.mapMgr.GetTotals(); err == nil {
+			stats["passed_packets"] = totals.PassedPackets
+			stats["dropped_packets"] = totals.DroppedPackets
+			stats["dropped_bytes"] = totals.DroppedBytes
+		}
 	}
 
-	stats["interface"] = f.ifaceName
+	interfaces := make(map[string]interface{}, len(f.attachments))
+	for _, status := range f.GetInterfaces() {
+		iface := map[string]interface{}{
+			"attached": status.Attached,
+		}
+		if status.Attached {
+			iface["attach_mode"] = status.AttachMode
+		} else {
+			iface["error"] = status.Error
+		}
+		interfaces[status.Name] = iface
+	}
+	stats["interfaces"] = interfaces
 
 	return stats, nil
 }
@@ -13,7 +13,12 @@ type Filter struct {
 }
 
 // NewXDPFilter returns an error on non-Linux platforms
-func NewXDPFilter(ifaceName string) (*Filter, error) {
+func NewXDPFilter(ifaceNames []string, mode string) (*Filter, error) {
+	return NewXDPFilterWithOptions(Options{Interfaces: ifaceNames, Mode: mode})
+}
+
+// NewXDPFilterWithOptions returns an error on non-Linux platforms
+func NewXDPFilterWithOptions(opts Options) (*Filter, error) {
 	return nil, fmt.Errorf("XDP is only supported on Linux (current platform: %s/%s)", runtime.GOOS, runtime.GOARCH)
 }
 
@@ -27,9 +32,9 @@ func (f *Filter) Close() error {
 	return nil
 }
 
-// GetInterfaceName returns empty string on stub
-func (f *Filter) GetInterfaceName() string {
-	return ""
+// GetInterfaces returns nil on stub
+func (f *Filter) GetInterfaces() []InterfaceStatus {
+	return nil
 }
 
 // GetStats returns error on stub
@@ -2,7 +2,9 @@ package xdp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
@@ -10,88 +12,162 @@ import (
 	"github.com/cilium/ebpf"
 )
 
+// ErrAllowlisted is returned by AddIP for addresses covered by the allowlist
+var ErrAllowlisted = errors.New("address is allowlisted")
+
 // BlockedIP represents an IP address in the XDP blocklist with expiration time
 type BlockedIP struct {
 	IP        net.IP
 	ExpiresAt time.Time
+
+	// Drop statistics collected by the XDP program (zero if stats are unavailable)
+	DroppedPackets uint64
+	DroppedBytes   uint64
+	LastSeen       time.Time // Time of the last dropped packet (zero if none yet)
+}
+
+// Totals holds global packet counters from the XDP program
+type Totals struct {
+	PassedPackets  uint64
+	PassedBytes    uint64
+	DroppedPackets uint64
+	DroppedBytes   uint64
+}
+
+// dropStats mirrors struct drop_stats in blocker.c
+type dropStats struct {
+	Packets    uint64
+	Bytes      uint64
+	LastSeenNs uint64
+}
+
+// xdpTotal mirrors struct xdp_total in blocker.c
+type xdpTotal struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// lpmKey4 mirrors struct lpm_key4 in blocker.c
+type lpmKey4 struct {
+	PrefixLen uint32
+	Addr      [4]byte // Network byte order
 }
 
-// IPMapManager manages the XDP map for blocked IPs
+// lpmKey6 mirrors struct lpm_key6 in blocker.c
+type lpmKey6 struct {
+	PrefixLen uint32
+	Addr      [16]byte
+}
+
+// Indexes into the xdp_totals map (XDP_STAT_* in blocker.c)
+const (
+	statPass uint32 = 0
+	statDrop uint32 = 1
+)
+
+// Maps groups the BPF maps driven by an IPMapManager
+// Any map except Blocked may be nil, disabling the corresponding feature.
+type Maps struct {
+	Allow      *ebpf.Map // IPv4 allowlist (LPM trie), checked before the blocklist
+	Allow6     *ebpf.Map // IPv6 allowlist (LPM trie)
+	Blocked    *ebpf.Map // IPv4 blocklist (key: __u32)
+	Blocked6   *ebpf.Map // IPv6 blocklist (key: 128-bit address)
+	Prefixes   *ebpf.Map // IPv4 prefix blocklist (LPM trie, subnet bans)
+	Prefixes6  *ebpf.Map // IPv6 prefix blocklist (LPM trie)
+	DropStats  *ebpf.Map // Per-CPU drop counters per IPv4 source
+	DropStats6 *ebpf.Map // Per-CPU drop counters per IPv6 source
+	Totals     *ebpf.Map // Per-CPU global pass/drop totals
+}
+
+// IPMapManager manages the XDP maps for blocked IPs (IPv4 and IPv6)
 type IPMapManager struct {
-	bpfMap    *ebpf.Map
+	maps      Maps
 	mu        sync.RWMutex
 	localMap  map[string]time.Time // Track expiration times in user space
+	allow     []net.IPNet          // Prefixes AddIP refuses to ban (mirrors the allow maps)
+	prefixes  map[string]prefixBan // Prefix bans by CIDR (mirrors the prefix maps)
 	cleanupCh chan struct{}
+	logger    *slog.Logger
+
+	aggregation AggregationPolicy
+	recent      map[string]map[string]time.Time // Aggregation prefix -> recently banned addresses
 }
 
 // NewIPMapManager creates a new IP map manager
-func NewIPMapManager(bpfMap *ebpf.Map) *IPMapManager {
+// If maps.Blocked6 is nil, IPv6 addresses are rejected
+func NewIPMapManager(maps Maps) *IPMapManager {
 	return &IPMapManager{
-		bpfMap:    bpfMap,
+		maps:      maps,
 		localMap:  make(map[string]time.Time),
+		prefixes:  make(map[string]prefixBan),
 		cleanupCh: make(chan struct{}, 1),
+		logger:    slog.Default(),
+		recent:    make(map[string]map[string]time.Time),
 	}
 }
 
+// SetLogger sets the logger of periodic cleanup and aggregation events
+// It must be called before StartPeriodicCleanup and the first ban.
+func (m *IPMapManager) SetLogger(logger *slog.Logger) {
+	m.logger = logger
+}
+
 // AddIP adds an IP address to the XDP blocklist
+// Allowlisted addresses are refused with ErrAllowlisted.
 func (m *IPMapManager) AddIP(ip net.IP, duration time.Duration) error {
-	if ip == nil {
-		return fmt.Errorf("nil IP address")
-	}
-
-	// Convert to IPv4 if needed
-	ip = ip.To4()
-	if ip == nil {
-		return fmt.Errorf("invalid IPv4 address")
+	bpfMap, key, ip, err := m.lookupKey(ip)
+	if err != nil {
+		return err
 	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Convert IP to uint32 (big endian)
-	ipKey := binary.BigEndian.Uint32(ip)
+	if m.allowlisted(ip) {
+		return fmt.Errorf("refusing to ban %s: %w", ip, ErrAllowlisted)
+	}
 
-	// Calculate expiration time (seconds since epoch)
-	expiresAt := time.Now().Add(duration)
-	unixTime := expiresAt.Unix()
-	if unixTime < 0 {
-		return fmt.Errorf("invalid expiration time: %v", expiresAt)
+	// The XDP program compares against bpf_ktime_get_ns(), so convert the
+	// wall-clock duration to an absolute CLOCK_MONOTONIC deadline
+	if duration <= 0 {
+		return fmt.Errorf("invalid ban duration: %v", duration)
+	}
+	now := ktimeNow()
+	if now == 0 {
+		return fmt.Errorf("monotonic clock not available")
 	}
-	expiresAtSec := uint64(unixTime) // #nosec G115 - Unix timestamps are always positive after check
+	expiresAtNs := now + uint64(duration) // #nosec G115 - duration checked positive
+	expiresAt := time.Now().Add(duration)
 
 	// Update XDP map (kernel space)
-	if err := m.bpfMap.Put(&ipKey, &expiresAtSec); err != nil {
+	if err := bpfMap.Put(key, &expiresAtNs); err != nil {
 		return fmt.Errorf("failed to add IP to XDP map: %w", err)
 	}
 
 	// Update local tracking map (user space)
 	m.localMap[ip.String()] = expiresAt
 
+	// Ban the whole prefix once many of its addresses are banned, if a policy is set
+	m.aggregate(ip, expiresAt)
+
 	return nil
 }
 
 // RemoveIP removes an IP address from the XDP blocklist
 func (m *IPMapManager) RemoveIP(ip net.IP) error {
-	if ip == nil {
-		return fmt.Errorf("nil IP address")
-	}
-
-	// Convert to IPv4 if needed
-	ip = ip.To4()
-	if ip == nil {
-		return fmt.Errorf("invalid IPv4 address")
+	bpfMap, key, ip, err := m.lookupKey(ip)
+	if err != nil {
+		return err
 	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Convert IP to uint32 (big endian)
-	ipKey := binary.BigEndian.Uint32(ip)
-
 	// Remove from XDP map (kernel space)
-	if err := m.bpfMap.Delete(&ipKey); err != nil {
+	if err := bpfMap.Delete(key); err != nil {
 		return fmt.Errorf("failed to remove IP from XDP map: %w", err)
 	}
+	m.deleteStats(ip, key)
 
 	// Remove from local tracking map (user space)
 	delete(m.localMap, ip.String())
@@ -99,16 +175,11 @@ func (m *IPMapManager) RemoveIP(ip net.IP) error {
 	return nil
 }
 
-// IsBlocked checks if an IP is currently blocked
+// IsBlocked checks if an IP is currently blocked, on its own or by a prefix ban
 func (m *IPMapManager) IsBlocked(ip net.IP) (bool, error) {
-	if ip == nil {
-		return false, fmt.Errorf("nil IP address")
-	}
-
-	// Convert to IPv4 if needed
-	ip = ip.To4()
-	if ip == nil {
-		return false, fmt.Errorf("invalid IPv4 address")
+	_, _, ip, err := m.lookupKey(ip)
+	if err != nil {
+		return false, err
 	}
 
 	m.mu.RLock()
@@ -119,21 +190,187 @@ func (m *IPMapManager) IsBlocked(ip net.IP) (bool, error) {
 		if time.Now().Before(expiresAt) {
 			return true, nil
 		}
-		// Expired but not yet cleaned up
-		return false, nil
+		// Expired but not yet cleaned up (a prefix ban may still cover it)
+	}
+
+	return m.prefixBlocked(ip, time.Now()), nil
+}
+
+// SetAllowlist replaces the allowlisted prefixes
+// The XDP program passes packets from these prefixes even if they are banned,
+// and AddIP refuses to ban addresses inside them. Existing bans are kept.
+func (m *IPMapManager) SetAllowlist(prefixes []net.IPNet) error {
+	want4 := make(map[lpmKey4]bool)
+	want6 := make(map[lpmKey6]bool)
+	allow := make([]net.IPNet, 0, len(prefixes))
+	for _, p := range prefixes {
+		ones, bits := p.Mask.Size()
+		if ip4 := p.IP.To4(); ip4 != nil && bits == 8*net.IPv4len {
+			key := lpmKey4{PrefixLen: uint32(ones)} // #nosec G115 - mask size is 0-32
+			copy(key.Addr[:], ip4.Mask(p.Mask))
+			want4[key] = true
+		} else if ip6 := p.IP.To16(); ip6 != nil && bits == 8*net.IPv6len {
+			key := lpmKey6{PrefixLen: uint32(ones)} // #nosec G115 - mask size is 0-128
+			copy(key.Addr[:], ip6.Mask(p.Mask))
+			want6[key] = true
+		} else {
+			return fmt.Errorf("invalid allowlist prefix %v", p.String())
+		}
+		allow = append(allow, p)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	if m.maps.Allow != nil {
+		if err := syncLPM(m.maps.Allow, want4); err != nil {
+			errs = append(errs, fmt.Errorf("IPv4 allowlist: %w", err))
+		}
+	}
+	if m.maps.Allow6 != nil {
+		if err := syncLPM(m.maps.Allow6, want6); err != nil {
+			errs = append(errs, fmt.Errorf("IPv6 allowlist: %w", err))
+		}
+	}
+	m.allow = allow
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to update XDP allowlist: %v", errs)
+	}
+	return nil
+}
+
+// IsAllowlisted reports whether ip is covered by the allowlist
+func (m *IPMapManager) IsAllowlisted(ip net.IP) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.allowlisted(ip)
+}
+
+// allowlisted checks ip against the allowlist; the caller holds m.mu
+func (m *IPMapManager) allowlisted(ip net.IP) bool {
+	for i := range m.allow {
+		if m.allow[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncLPM makes the keys of an allowlist LPM trie exactly want
+func syncLPM[K comparable](lpm *ebpf.Map, want map[K]bool) error {
+	// Remove stale prefixes (e.g. left in a pinned map by a previous configuration)
+	var stale []K
+	var key K
+	var value uint8
+	iter := lpm.Iterate()
+	for iter.Next(&key, &value) {
+		if !want[key] {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for i := range stale {
+		if err := lpm.Delete(&stale[i]); err != nil {
+			return err
+		}
+	}
+
+	value = 1
+	for key := range want {
+		if err := lpm.Put(&key, &value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore rebuilds the user-space expiration map from the BPF maps
+// Used when the maps were pinned by a previous run; entries that expired
+// while the daemon was down are deleted. Returns the number of bans restored.
+func (m *IPMapManager) Restore() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := ktimeNow()
+	var expired []net.IP // Deleted after iterating, deleting mid-walk restarts the iteration
+	var errs []error
+
+	if m.maps.Blocked != nil {
+		var key uint32
+		var expiresAtNs uint64
+		iter := m.maps.Blocked.Iterate()
+		for iter.Next(&key, &expiresAtNs) {
+			ip := make(net.IP, net.IPv4len)
+			binary.NativeEndian.PutUint32(ip, key)
+			if expiresAtNs <= now {
+				expired = append(expired, ip)
+				continue
+			}
+			m.localMap[ip.String()] = ktimeToTime(expiresAtNs)
+		}
+		if err := iter.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("iterating IPv4 blocklist: %w", err))
+		}
+	}
+
+	if m.maps.Blocked6 != nil {
+		var key [16]byte
+		var expiresAtNs uint64
+		iter := m.maps.Blocked6.Iterate()
+		for iter.Next(&key, &expiresAtNs) {
+			ip := net.IP(append([]byte(nil), key[:]...))
+			if expiresAtNs <= now {
+				expired = append(expired, ip)
+				continue
+			}
+			m.localMap[ip.String()] = ktimeToTime(expiresAtNs)
+		}
+		if err := iter.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("iterating IPv6 blocklist: %w", err))
+		}
+	}
+
+	for _, ip := range expired {
+		bpfMap, key, ip, err := m.lookupKey(ip)
+		if err != nil {
+			continue
+		}
+		if err := bpfMap.Delete(key); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove expired %s: %w", ip, err))
+			continue
+		}
+		m.deleteStats(ip, key)
 	}
 
-	return false, nil
+	errs = append(errs, m.restorePrefixes(now)...)
+
+	restored := len(m.localMap) + len(m.prefixes)
+	if len(errs) > 0 {
+		return restored, fmt.Errorf("restore errors: %v", errs)
+	}
+	return restored, nil
 }
 
 // GetBlockedCount returns the number of currently blocked IPs
+// Expired bans still waiting for CleanupExpired are not counted.
 func (m *IPMapManager) GetBlockedCount() int {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return len(m.localMap)
+	now := time.Now()
+	count := 0
+	for _, expiresAt := range m.localMap {
+		if expiresAt.After(now) {
+			count++
+		}
+	}
+	return count
 }
 
-// CleanupExpired removes expired IP addresses from the XDP map
+// CleanupExpired removes expired IP addresses and prefixes from the XDP maps
 // This should be called periodically from user space
 func (m *IPMapManager) CleanupExpired() (int, error) {
 	m.mu.Lock()
@@ -146,24 +383,17 @@ func (m *IPMapManager) CleanupExpired() (int, error) {
 	// Iterate over local map to find expired entries
 	for ipStr, expiresAt := range m.localMap {
 		if now.After(expiresAt) {
-			ip := net.ParseIP(ipStr)
-			if ip == nil {
-				continue
-			}
-
-			ip = ip.To4()
-			if ip == nil {
+			bpfMap, key, ip, err := m.lookupKey(net.ParseIP(ipStr))
+			if err != nil {
 				continue
 			}
 
-			// Convert IP to uint32 (big endian)
-			ipKey := binary.BigEndian.Uint32(ip)
-
 			// Remove from XDP map
-			if err := m.bpfMap.Delete(&ipKey); err != nil {
+			if err := bpfMap.Delete(key); err != nil {
 				errs = append(errs, fmt.Errorf("failed to remove %s: %w", ipStr, err))
 				continue
 			}
+			m.deleteStats(ip, key)
 
 			// Remove from local map
 			delete(m.localMap, ipStr)
@@ -171,6 +401,22 @@ func (m *IPMapManager) CleanupExpired() (int, error) {
 		}
 	}
 
+	for cidr, p := range m.prefixes {
+		if now.After(p.expiresAt) {
+			bpfMap, key, _, err := m.prefixKey(p.prefix)
+			if err != nil {
+				continue
+			}
+			if err := bpfMap.Delete(key); err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove %s: %w", cidr, err))
+				continue
+			}
+			delete(m.prefixes, cidr)
+			removed++
+		}
+	}
+	m.pruneRecent(now)
+
 	if len(errs) > 0 {
 		return removed, fmt.Errorf("cleanup errors: %v", errs)
 	}
@@ -187,9 +433,9 @@ func (m *IPMapManager) StartPeriodicCleanup(interval time.Duration) {
 			case <-ticker.C:
 				if removed, err := m.CleanupExpired(); err != nil {
 					// Log error but continue
-					fmt.Printf("XDP cleanup error: %v\n", err)
+					m.logger.Error("XDP cleanup failed", "error", err)
 				} else if removed > 0 {
-					fmt.Printf("XDP cleanup: removed %d expired IPs\n", removed)
+					m.logger.Debug("XDP cleanup removed expired IPs", "removed", removed)
 				}
 			case <-m.cleanupCh:
 				ticker.Stop()
@@ -214,6 +460,7 @@ func (m *IPMapManager) Close() error {
 }
 
 // GetAllBlockedIPs returns all currently blocked IPs with their expiration times
+// and the drop statistics collected by the XDP program
 func (m *IPMapManager) GetAllBlockedIPs() []BlockedIP {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -221,13 +468,131 @@ func (m *IPMapManager) GetAllBlockedIPs() []BlockedIP {
 	result := make([]BlockedIP, 0, len(m.localMap))
 	for ipStr, expiresAt := range m.localMap {
 		ip := net.ParseIP(ipStr)
-		if ip != nil {
-			result = append(result, BlockedIP{
-				IP:        ip,
-				ExpiresAt: expiresAt,
-			})
+		if ip == nil {
+			continue
 		}
+		entry := BlockedIP{
+			IP:        ip,
+			ExpiresAt: expiresAt,
+		}
+		if stats, ok := m.lookupStats(ip); ok {
+			entry.DroppedPackets = stats.Packets
+			entry.DroppedBytes = stats.Bytes
+			if stats.LastSeenNs != 0 {
+				entry.LastSeen = ktimeToTime(stats.LastSeenNs)
+			}
+		}
+		result = append(result, entry)
 	}
 
 	return result
 }
+
+// GetTotals returns the global pass/drop counters summed over all CPUs
+func (m *IPMapManager) GetTotals() (Totals, error) {
+	if m.maps.Totals == nil {
+		return Totals{}, fmt.Errorf("XDP totals not available")
+	}
+
+	var totals Totals
+	for _, idx := range []uint32{statPass, statDrop} {
+		var perCPU []xdpTotal
+		if err := m.maps.Totals.Lookup(&idx, &perCPU); err != nil {
+			return Totals{}, fmt.Errorf("failed to read XDP totals: %w", err)
+		}
+		sum := sumTotals(perCPU)
+		if idx == statDrop {
+			totals.DroppedPackets, totals.DroppedBytes = sum.Packets, sum.Bytes
+		} else {
+			totals.PassedPackets, totals.PassedBytes = sum.Packets, sum.Bytes
+		}
+	}
+	return totals, nil
+}
+
+// lookupStats reads and aggregates the per-CPU drop counters for ip
+func (m *IPMapManager) lookupStats(ip net.IP) (dropStats, bool) {
+	statsMap, key := m.statsKey(ip)
+	if statsMap == nil {
+		return dropStats{}, false
+	}
+	var perCPU []dropStats
+	if err := statsMap.Lookup(key, &perCPU); err != nil {
+		return dropStats{}, false // No packet dropped yet
+	}
+	return sumDropStats(perCPU), true
+}
+
+// deleteStats removes the drop counters of an unbanned IP so a later ban starts from zero
+func (m *IPMapManager) deleteStats(ip net.IP, key interface{}) {
+	statsMap := m.maps.DropStats6
+	if ip.To4() != nil {
+		statsMap = m.maps.DropStats
+	}
+	if statsMap != nil {
+		_ = statsMap.Delete(key) // Missing entry just means nothing was dropped
+	}
+}
+
+// statsKey returns the drop stats map and key for ip (nil map if stats are unavailable)
+func (m *IPMapManager) statsKey(ip net.IP) (*ebpf.Map, interface{}) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ipKey := binary.NativeEndian.Uint32(ip4)
+		return m.maps.DropStats, &ipKey
+	}
+	var ipKey [16]byte
+	copy(ipKey[:], ip.To16())
+	return m.maps.DropStats6, &ipKey
+}
+
+// sumDropStats aggregates per-CPU drop counters
+func sumDropStats(perCPU []dropStats) dropStats {
+	var sum dropStats
+	for _, s := range perCPU {
+		sum.Packets += s.Packets
+		sum.Bytes += s.Bytes
+		if s.LastSeenNs > sum.LastSeenNs {
+			sum.LastSeenNs = s.LastSeenNs
+		}
+	}
+	return sum
+}
+
+// sumTotals aggregates per-CPU global totals
+func sumTotals(perCPU []xdpTotal) xdpTotal {
+	var sum xdpTotal
+	for _, t := range perCPU {
+		sum.Packets += t.Packets
+		sum.Bytes += t.Bytes
+	}
+	return sum
+}
+
+// lookupKey returns the BPF map and key to use for the given IP address along
+// with its normalized form (4 bytes for IPv4, 16 bytes for IPv6)
+func (m *IPMapManager) lookupKey(ip net.IP) (*ebpf.Map, interface{}, net.IP, error) {
+	if ip == nil {
+		return nil, nil, nil, fmt.Errorf("nil IP address")
+	}
+
+	// IPv4 (including IPv4-mapped IPv6): key is the __u32 ip->saddr, which holds the
+	// address bytes in network order; the map marshals it in host order, so read the
+	// bytes natively to keep them in place
+	if ip4 := ip.To4(); ip4 != nil {
+		ipKey := binary.NativeEndian.Uint32(ip4)
+		return m.maps.Blocked, &ipKey, ip4, nil
+	}
+
+	ip6 := ip.To16()
+	if ip6 == nil {
+		return nil, nil, nil, fmt.Errorf("invalid IP address: %v", ip)
+	}
+	if m.maps.Blocked6 == nil {
+		return nil, nil, nil, fmt.Errorf("IPv6 blocklist not available")
+	}
+
+	// IPv6: key is the raw 128-bit address
+	var ipKey [16]byte
+	copy(ipKey[:], ip6)
+	return m.maps.Blocked6, &ipKey, ip6, nil
+}
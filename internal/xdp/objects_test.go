@@ -0,0 +1,84 @@
+package xdp
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+)
+
+// The embedded objects are built from blocker.c by "go generate" and committed
+// with it. These tests catch objects that are older than the source or the
+// bindings, without loading anything into the kernel.
+
+// embeddedMaps lists the maps the Go side relies on, with their layout
+var embeddedMaps = []struct {
+	name       string
+	typ        ebpf.MapType
+	key, value uint32
+}{
+	{"blocked_ips", ebpf.Hash, 4, 8},            // IPv4 address in network byte order -> expiry
+	{"blocked_ips6", ebpf.Hash, 16, 8},          // IPv6 address -> expiry
+	{"ip_drop_stats", ebpf.PerCPUHash, 4, 24},   // Banned IPv4 address -> packets, bytes, last seen
+	{"ip_drop_stats6", ebpf.PerCPUHash, 16, 24}, // Banned IPv6 address -> packets, bytes, last seen
+	{"xdp_totals", ebpf.PerCPUArray, 4, 16},     // XDP action -> packets, bytes
+	{"allow_ips", ebpf.LPMTrie, 8, 1},           // Allowlisted IPv4 prefix -> 1
+	{"allow_ips6", ebpf.LPMTrie, 20, 1},         // Allowlisted IPv6 prefix -> 1
+	{"blocked_prefixes", ebpf.LPMTrie, 8, 8},    // Banned IPv4 prefix -> expiry
+	{"blocked_prefixes6", ebpf.LPMTrie, 20, 8},  // Banned IPv6 prefix -> expiry
+}
+
+func TestEmbeddedObject_MatchesBindings(t *testing.T) {
+	spec, err := loadBpf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var specs bpfSpecs
+	if err := spec.Assign(&specs); err != nil {
+		t.Fatalf("Embedded object does not provide the generated bindings (run go generate): %v", err)
+	}
+}
+
+func TestEmbeddedObject_Maps(t *testing.T) {
+	spec, err := loadBpf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range embeddedMaps {
+		m, ok := spec.Maps[want.name]
+		if !ok {
+			t.Errorf("Map %s missing from the embedded object", want.name)
+			continue
+		}
+		if m.Type != want.typ || m.KeySize != want.key || m.ValueSize != want.value {
+			t.Errorf("Map %s: %v with %d-byte keys and %d-byte values, want %v, %d, %d",
+				want.name, m.Type, m.KeySize, m.ValueSize, want.typ, want.key, want.value)
+		}
+	}
+}
+
+// Bans expire in the kernel: both programs compare the stored deadline with
+// bpf_ktime_get_ns, so an expired entry stops dropping before userspace cleans it up
+func TestEmbeddedObject_KernelExpiry(t *testing.T) {
+	spec, err := loadBpf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"xdp_blocker", "xdp_blocker_raw"} {
+		prog, ok := spec.Programs[name]
+		if !ok {
+			t.Errorf("Program %s missing from the embedded object", name)
+			continue
+		}
+		found := false
+		for _, ins := range prog.Instructions {
+			if ins.IsBuiltinCall() && ins.Constant == int64(asm.FnKtimeGetNs) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Program %s never calls bpf_ktime_get_ns, so bans cannot expire in the kernel", name)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package xdp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// BlockedPrefix is a subnet ban in the XDP prefix blocklist
+type BlockedPrefix struct {
+	Prefix    net.IPNet
+	ExpiresAt time.Time
+}
+
+// AggregationPolicy promotes many bans inside one prefix to a single prefix ban
+// When more than Threshold distinct addresses inside the same /PrefixLen4 (IPv4)
+// or /PrefixLen6 (IPv6) are banned within Window, the prefix is banned as well.
+// The individual bans stay until they expire or are lifted, so every member ban
+// keeps its own expiry and is still listed, unbanned and expired on its own.
+type AggregationPolicy struct {
+	Threshold  int // 0 = aggregation disabled
+	Window     time.Duration
+	PrefixLen4 int
+	PrefixLen6 int
+}
+
+// prefixBan tracks one prefix ban in user space
+type prefixBan struct {
+	prefix    net.IPNet
+	expiresAt time.Time
+}
+
+// SetAggregation installs the aggregation policy used by AddIP
+func (m *IPMapManager) SetAggregation(policy AggregationPolicy) error {
+	if policy.Threshold < 0 {
+		return fmt.Errorf("invalid aggregation threshold %d", policy.Threshold)
+	}
+	if policy.Threshold > 0 {
+		if policy.Window <= 0 {
+			return fmt.Errorf("invalid aggregation window %v", policy.Window)
+		}
+		if policy.PrefixLen4 < 1 || policy.PrefixLen4 > 32 {
+			return fmt.Errorf("invalid IPv4 aggregation prefix length %d (must be 1-32)", policy.PrefixLen4)
+		}
+		if policy.PrefixLen6 < 1 || policy.PrefixLen6 > 128 {
+			return fmt.Errorf("invalid IPv6 aggregation prefix length %d (must be 1-128)", policy.PrefixLen6)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.aggregation = policy
+	m.recent = make(map[string]map[string]time.Time)
+	return nil
+}
+
+// AddPrefix bans every address in prefix for duration
+// An existing ban of the same prefix is replaced. Prefixes that lie entirely
+// inside the allowlist are refused with ErrAllowlisted.
+func (m *IPMapManager) AddPrefix(prefix net.IPNet, duration time.Duration) error {
+	if duration <= 0 {
+		return fmt.Errorf("invalid ban duration: %v", duration)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addPrefix(prefix, time.Now().Add(duration))
+}
+
+// addPrefix bans prefix until expiresAt; the caller holds m.mu
+func (m *IPMapManager) addPrefix(prefix net.IPNet, expiresAt time.Time) error {
+	bpfMap, key, prefix, err := m.prefixKey(prefix)
+	if err != nil {
+		return err
+	}
+	for i := range m.allow {
+		if allowCovers(m.allow[i], prefix) {
+			return fmt.Errorf("refusing to ban %s: %w", prefix.String(), ErrAllowlisted)
+		}
+	}
+
+	remaining := time.Until(expiresAt)
+	if remaining <= 0 {
+		return fmt.Errorf("invalid ban expiry: %v", expiresAt)
+	}
+	now := ktimeNow()
+	if now == 0 {
+		return fmt.Errorf("monotonic clock not available")
+	}
+	expiresAtNs := now + uint64(remaining) // #nosec G115 - remaining checked positive
+	if err := bpfMap.Put(key, &expiresAtNs); err != nil {
+		return fmt.Errorf("failed to add prefix to XDP map: %w", err)
+	}
+	m.prefixes[prefix.String()] = prefixBan{prefix: prefix, expiresAt: expiresAt}
+	return nil
+}
+
+// RemovePrefix lifts a prefix ban
+func (m *IPMapManager) RemovePrefix(prefix net.IPNet) error {
+	bpfMap, key, prefix, err := m.prefixKey(prefix)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := bpfMap.Delete(key); err != nil {
+		return fmt.Errorf("failed to remove prefix from XDP map: %w", err)
+	}
+	delete(m.prefixes, prefix.String())
+	return nil
+}
+
+// GetAllBlockedPrefixes returns all prefix bans, sorted by prefix
+func (m *IPMapManager) GetAllBlockedPrefixes() []BlockedPrefix {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]BlockedPrefix, 0, len(m.prefixes))
+	for _, p := range m.prefixes {
+		result = append(result, BlockedPrefix{Prefix: p.prefix, ExpiresAt: p.expiresAt})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Prefix.String() < result[j].Prefix.String()
+	})
+	return result
+}
+
+// prefixBlocked reports whether ip is inside an active prefix ban; the caller holds m.mu
+func (m *IPMapManager) prefixBlocked(ip net.IP, now time.Time) bool {
+	for _, p := range m.prefixes {
+		if p.prefix.Contains(ip) && now.Before(p.expiresAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregate records a new ban of ip and promotes its prefix once the policy's
+// threshold is exceeded; the caller holds m.mu
+func (m *IPMapManager) aggregate(ip net.IP, expiresAt time.Time) {
+	policy := m.aggregation
+	if policy.Threshold <= 0 {
+		return
+	}
+
+	bits, prefixLen := 32, policy.PrefixLen4
+	if ip.To4() == nil {
+		bits, prefixLen = 128, policy.PrefixLen6
+	}
+	prefix := net.IPNet{IP: ip.Mask(net.CIDRMask(prefixLen, bits)), Mask: net.CIDRMask(prefixLen, bits)}
+	bucket := prefix.String()
+
+	now := time.Now()
+	if ban, ok := m.prefixes[bucket]; ok && now.Before(ban.expiresAt) {
+		return // Already banned as a whole
+	}
+
+	members := m.recent[bucket]
+	if members == nil {
+		members = make(map[string]time.Time)
+		m.recent[bucket] = members
+	}
+	members[ip.String()] = now
+	for member, bannedAt := range members {
+		if now.Sub(bannedAt) > policy.Window {
+			delete(members, member)
+		}
+	}
+	if len(members) <= policy.Threshold {
+		return
+	}
+
+	// The prefix ban lasts as long as the longest member ban
+	for member := range members {
+		if memberExpiry, ok := m.localMap[member]; ok && memberExpiry.After(expiresAt) {
+			expiresAt = memberExpiry
+		}
+	}
+	if err := m.addPrefix(prefix, expiresAt); err != nil {
+		m.logger.Error("XDP aggregation failed to ban prefix", "prefix", bucket, "error", err)
+		return
+	}
+	delete(m.recent, bucket)
+	m.logger.Info("XDP aggregation promoted bans to a prefix ban", "prefix", bucket, "bans", len(members), "window", policy.Window)
+}
+
+// pruneRecent forgets aggregation candidates older than the window; the caller holds m.mu
+func (m *IPMapManager) pruneRecent(now time.Time) {
+	for bucket, members := range m.recent {
+		for member, bannedAt := range members {
+			if now.Sub(bannedAt) > m.aggregation.Window {
+				delete(members, member)
+			}
+		}
+		if len(members) == 0 {
+			delete(m.recent, bucket)
+		}
+	}
+}
+
+// restorePrefixes rebuilds the user-space prefix bans from pinned prefix maps,
+// deleting the ones that expired; the caller holds m.mu
+func (m *IPMapManager) restorePrefixes(now uint64) []error {
+	var errs []error
+	found := func(prefix net.IPNet, expiresAt time.Time) {
+		m.prefixes[prefix.String()] = prefixBan{prefix: prefix, expiresAt: expiresAt}
+	}
+	if m.maps.Prefixes != nil {
+		if err := restoreLPM[lpmKey4](m.maps.Prefixes, now, found); err != nil {
+			errs = append(errs, fmt.Errorf("restoring IPv4 prefix blocklist: %w", err))
+		}
+	}
+	if m.maps.Prefixes6 != nil {
+		if err := restoreLPM[lpmKey6](m.maps.Prefixes6, now, found); err != nil {
+			errs = append(errs, fmt.Errorf("restoring IPv6 prefix blocklist: %w", err))
+		}
+	}
+	return errs
+}
+
+// restoreLPM reports the active entries of a prefix blocklist and deletes expired ones
+func restoreLPM[K interface{ prefix() net.IPNet }](lpm *ebpf.Map, now uint64, found func(net.IPNet, time.Time)) error {
+	var key K
+	var expiresAtNs uint64
+	var expired []K // Deleted after iterating, deleting mid-walk restarts the iteration
+	iter := lpm.Iterate()
+	for iter.Next(&key, &expiresAtNs) {
+		if expiresAtNs <= now {
+			expired = append(expired, key)
+			continue
+		}
+		found(key.prefix(), ktimeToTime(expiresAtNs))
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for i := range expired {
+		if err := lpm.Delete(&expired[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefix converts an IPv4 LPM key back to a prefix
+func (k lpmKey4) prefix() net.IPNet {
+	ip := net.IP(append([]byte(nil), k.Addr[:]...))
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(int(k.PrefixLen), 32)}
+}
+
+// prefix converts an IPv6 LPM key back to a prefix
+func (k lpmKey6) prefix() net.IPNet {
+	ip := net.IP(append([]byte(nil), k.Addr[:]...))
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(int(k.PrefixLen), 128)}
+}
+
+// prefixKey returns the prefix map and LPM key for prefix along with its
+// normalized form (host bits cleared, 4-byte IPv4 address)
+func (m *IPMapManager) prefixKey(prefix net.IPNet) (*ebpf.Map, interface{}, net.IPNet, error) {
+	ones, bits := prefix.Mask.Size()
+	if ip4 := prefix.IP.To4(); ip4 != nil && bits == 32 {
+		if m.maps.Prefixes == nil {
+			return nil, nil, net.IPNet{}, fmt.Errorf("IPv4 prefix blocklist not available")
+		}
+		normalized := net.IPNet{IP: ip4.Mask(prefix.Mask), Mask: prefix.Mask}
+		key := lpmKey4{PrefixLen: uint32(ones)} // #nosec G115 - mask size is 0-32
+		copy(key.Addr[:], normalized.IP)
+		return m.maps.Prefixes, &key, normalized, nil
+	}
+	if ip6 := prefix.IP.To16(); ip6 != nil && bits == 128 {
+		if m.maps.Prefixes6 == nil {
+			return nil, nil, net.IPNet{}, fmt.Errorf("IPv6 prefix blocklist not available")
+		}
+		normalized := net.IPNet{IP: ip6.Mask(prefix.Mask), Mask: prefix.Mask}
+		key := lpmKey6{PrefixLen: uint32(ones)} // #nosec G115 - mask size is 0-128
+		copy(key.Addr[:], normalized.IP)
+		return m.maps.Prefixes6, &key, normalized, nil
+	}
+	return nil, nil, net.IPNet{}, fmt.Errorf("invalid prefix: %v", prefix.String())
+}
+
+// allowCovers reports whether the allowlisted prefix allow contains all of prefix
+func allowCovers(allow, prefix net.IPNet) bool {
+	allowOnes, allowBits := allow.Mask.Size()
+	ones, bits := prefix.Mask.Size()
+	return allowBits == bits && allowOnes <= ones && allow.Contains(prefix.IP)
+}
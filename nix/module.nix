@@ -8,6 +8,76 @@ with lib;
 let
   cfg = config.services.btblocker;
 
+  lastQueue = cfg.queueNum + cfg.queueCount - 1;
+
+  # iptables NFQUEUE target arguments for the configured queue range
+  queueTarget = (if cfg.queueCount > 1
+    then "--queue-balance ${toString cfg.queueNum}:${toString lastQueue}"
+    else "--queue-num ${toString cfg.queueNum}")
+    + optionalString cfg.queueBypass " --queue-bypass";
+
+  # Contents of /etc/btblocker/config.json (keys as in `btblocker config dump`)
+  settings = {
+    interfaces = filter (i: i != "") (splitString "," (replaceStrings [ " " ] [ "" ] cfg.interface));
+    queueNum = cfg.queueNum;
+    queueCount = cfg.queueCount;
+    queueMaxLen = cfg.queueMaxLen;
+    queueBypass = cfg.queueBypass;
+    banDuration = cfg.banDuration;
+    banLadder = cfg.banLadder;
+    banStrikeWindow = cfg.banStrikeWindow;
+    banStrikeDecay = cfg.banStrikeDecay;
+    banEvidence = cfg.banEvidence;
+    banEvidenceWindow = cfg.banEvidenceWindow;
+    banEvidenceCount = cfg.banEvidenceCount;
+    banEvidenceReasons = cfg.banEvidenceReasons;
+    logLevel = cfg.logLevel;
+    logFormat = cfg.logFormat;
+    logComponentLevels = cfg.logComponentLevels;
+    detectionLogPath = cfg.detectionLogPath;
+    detectionPcapPath = cfg.detectionPcapPath;
+    detectionLogFormat = cfg.detectionLogFormat;
+    detectionLogPayloadBytes = cfg.detectionLogPayloadBytes;
+    detectionLogMaxSize = cfg.detectionLogMaxSize;
+    detectionLogMaxAge = cfg.detectionLogMaxAge;
+    detectionLogMaxFiles = cfg.detectionLogMaxFiles;
+    detectionLogCompress = cfg.detectionLogCompress;
+    detectionLogQuota = cfg.detectionLogQuota;
+    banDbPath = cfg.banDatabase;
+    monitorOnly = cfg.monitorOnly;
+    detectors = cfg.detectors;
+    metricsAddr = cfg.metricsAddress;
+    webhookUrls = cfg.webhook.urls;
+    webhookBatchSize = cfg.webhook.batchSize;
+    webhookBatchDelay = cfg.webhook.batchDelay;
+    webhookTimeout = cfg.webhook.timeout;
+    webhookMaxBackoff = cfg.webhook.maxBackoff;
+    webhookQueueDir = "/var/lib/btblocker/webhook";
+    webhookQueueSize = cfg.webhook.queueSize;
+    controlSocket = "/run/btblocker/control.sock";
+    controlSocketGroup = cfg.controlSocketGroup;
+    allowlist = cfg.allowlist;
+    allowPorts = cfg.allowPorts;
+    enforcementBackend = cfg.enforcementBackend;
+    enforcementTeardown = cfg.enforcementTeardown;
+    xdpMode = cfg.xdpMode;
+    xdpPinPath = cfg.xdpPinPath;
+    xdpKeepAttached = cfg.xdpKeepAttached;
+    subnetBanThreshold = cfg.subnetBan.threshold;
+    subnetBanWindow = cfg.subnetBan.window;
+    subnetBanPrefix4 = cfg.subnetBan.prefixLength4;
+    subnetBanPrefix6 = cfg.subnetBan.prefixLength6;
+    cleanupInterval = cfg.cleanupInterval;
+  };
+
+  # Settings the daemon applies on reload (SIGHUP); changing any other one restarts it
+  liveSettings = [
+    "logLevel" "logComponentLevels" "banDuration" "banLadder" "banStrikeWindow" "banStrikeDecay"
+    "banEvidence" "banEvidenceWindow" "banEvidenceCount" "banEvidenceReasons"
+    "monitorOnly" "detectors" "allowlist" "allowPorts"
+    "subnetBanThreshold" "subnetBanWindow" "subnetBanPrefix4" "subnetBanPrefix6"
+  ];
+
 in {
   options.services.btblocker = {
     enable = mkEnableOption "BitTorrent blocker service (NFQUEUE + XDP inline packet filtering)";
@@ -18,6 +88,32 @@ in {
       description = ''
         NFQUEUE number for packet processing (0-65535).
         Must match the iptables --queue-num parameter.
+        With queueCount > 1 this is the first queue of the --queue-balance range.
+      '';
+    };
+
+    queueCount = mkOption {
+      type = types.int;
+      default = 1;
+      description = ''
+        Number of consecutive NFQUEUEs starting at queueNum. Values above 1 spread
+        flows across queues with iptables --queue-balance, each processed by its own
+        reader goroutine (use one queue per CPU core on busy routers).
+      '';
+    };
+
+    queueMaxLen = mkOption {
+      type = types.int;
+      default = 1024;
+      description = "Maximum number of packets held by the kernel per queue";
+    };
+
+    queueBypass = mkOption {
+      type = types.bool;
+      default = false;
+      description = ''
+        If true, accept packets when a queue is full (or btblocker is not running)
+        instead of dropping them (iptables --queue-bypass semantics).
       '';
     };
 
@@ -53,7 +149,8 @@ in {
         Network interface(s) to monitor. Can be a single interface or comma-separated
         list (e.g., "eth0" or "eth0,wg0,awg0").
 
-        Note: XDP filter will be attached to the first interface in the list.
+        The XDP filter is attached to every interface in the list; all of them
+        share a single blocklist.
       '';
     };
 
@@ -63,12 +160,108 @@ in {
       description = "Ban duration in seconds (default: 5 hours)";
     };
 
+    banLadder = mkOption {
+      type = types.listOf types.ints.positive;
+      default = [ ];
+      example = [ 600 3600 86400 604800 ];
+      description = ''
+        Escalating ban durations in seconds for the 1st, 2nd, ... strike of an
+        address; offenses beyond the ladder get the last step. Empty = every ban
+        lasts banDuration.
+      '';
+    };
+
+    banStrikeWindow = mkOption {
+      type = types.ints.positive;
+      default = 2592000;
+      description = "Seconds after the latest strike until all strikes are forgotten (default: 30 days).";
+    };
+
+    banStrikeDecay = mkOption {
+      type = types.ints.unsigned;
+      default = 604800;
+      description = "Seconds without a new strike after which one strike is forgiven (0 = no decay).";
+    };
+
+    banEvidence = mkOption {
+      type = types.ints.positive;
+      default = 1;
+      description = ''
+        Detections of a source within banEvidenceWindow needed before it is banned
+        (1 = ban on the first). Detections below the threshold are still dropped.
+      '';
+    };
+
+    banEvidenceWindow = mkOption {
+      type = types.ints.positive;
+      default = 600;
+      description = "Seconds a detection counts towards banEvidence.";
+    };
+
+    banEvidenceCount = mkOption {
+      type = types.enum [ "detections" "detectors" "flows" ];
+      default = "detections";
+      description = ''
+        What counts towards banEvidence: every detection, detections with distinct
+        reasons ("detectors") or detections in distinct flows ("flows").
+      '';
+    };
+
+    banEvidenceReasons = mkOption {
+      type = types.listOf types.str;
+      default = [ ];
+      example = [ "BitTorrent Signature=1" ];
+      description = ''
+        Per-reason thresholds "reason=N" overriding banEvidence; reasons are the
+        reason values of the detection log.
+      '';
+    };
+
+    enforcementBackend = mkOption {
+      type = types.enum [ "xdp" "nftables" "ipset" "none" ];
+      default = "xdp";
+      description = ''
+        How bans are enforced in the kernel: "xdp" (blocklist maps on every interface),
+        "nftables" (timed set elements in table inet btblocker), "ipset" (ipset sets
+        matched by iptables rules) or "none". Use "nftables" where XDP cannot be loaded.
+      '';
+    };
+
+    enforcementTeardown = mkOption {
+      type = types.bool;
+      default = false;
+      description = ''
+        If true, remove the nftables table or the ipsets and their rules when the
+        service stops, lifting their bans. By default they stay in place so bans
+        are enforced across restarts.
+      '';
+    };
+
     xdpMode = mkOption {
-      type = types.enum [ "generic" "native" ];
+      type = types.enum [ "generic" "native" "offload" "auto" ];
       default = "generic";
       description = ''
-        XDP mode: "generic" (compatible with all drivers) or "native" (faster, requires driver support).
-        Use "generic" for maximum compatibility. Use "native" if your network driver supports XDP natively.
+        XDP mode: "generic" (compatible with all drivers), "native" (faster, requires driver support),
+        "offload" (SmartNIC hardware) or "auto" (try native, fall back to generic).
+        Use "generic" for maximum compatibility. Use "native" or "auto" if your network driver supports XDP natively.
+      '';
+    };
+
+    xdpPinPath = mkOption {
+      type = types.str;
+      default = "/sys/fs/bpf/btblocker";
+      description = ''
+        bpffs directory where the XDP maps are pinned so bans survive service
+        restarts (empty = no pinning).
+      '';
+    };
+
+    xdpKeepAttached = mkOption {
+      type = types.bool;
+      default = false;
+      description = ''
+        If true, leave the XDP program attached when the service stops so banned
+        IPs stay blocked across restarts. Requires xdpPinPath.
       '';
     };
 
@@ -84,6 +277,23 @@ in {
       description = "Logging level (error, warn, info, debug)";
     };
 
+    logFormat = mkOption {
+      type = types.enum [ "text" "json" "journald" "syslog" ];
+      default = "text";
+      description = ''
+        Log output: key=value text or JSON lines on stderr (collected by the journal),
+        or the native journald protocol, where every attribute (src_ip, dst_port,
+        reason, action, ...) becomes a journal field, or the local syslog socket
+      '';
+    };
+
+    logComponentLevels = mkOption {
+      type = types.listOf types.str;
+      default = [ ];
+      example = [ "xdp=debug" "blocker=info" ];
+      description = "Per-component log levels overriding logLevel (components: blocker, xdp, enforcer)";
+    };
+
     detectionLogPath = mkOption {
       type = types.str;
       default = "";
@@ -94,6 +304,141 @@ in {
       '';
     };
 
+    detectionPcapPath = mkOption {
+      type = types.str;
+      default = "";
+      description = ''
+        Path to a pcapng file receiving every detected packet (empty = disabled).
+        Each packet carries the detection reason, queue and verdict as comments and
+        can be opened in Wireshark or analyzed with `btblocker analyze`.
+        Rotated like the detection log.
+      '';
+    };
+
+    detectionLogFormat = mkOption {
+      type = types.enum [ "text" "json" ];
+      default = "text";
+      description = ''
+        Detection log format: "text" writes a human-readable block with hex and ASCII
+        dumps per detection, "json" writes one JSON object per line for log pipelines.
+      '';
+    };
+
+    detectionLogPayloadBytes = mkOption {
+      type = types.ints.between 0 65535;
+      default = 512;
+      description = "Payload bytes logged per detection (0 = payload not logged)";
+    };
+
+    detectionLogMaxSize = mkOption {
+      type = types.ints.unsigned;
+      default = 100;
+      description = "Rotate the detection log once it reaches this size in MB (0 = no size limit)";
+    };
+
+    detectionLogMaxAge = mkOption {
+      type = types.ints.unsigned;
+      default = 0;
+      description = "Rotate the detection log once it is this many seconds old (0 = no age limit)";
+    };
+
+    detectionLogMaxFiles = mkOption {
+      type = types.ints.unsigned;
+      default = 5;
+      description = "Rotated detection logs kept, oldest are deleted first (0 = keep all)";
+    };
+
+    detectionLogCompress = mkOption {
+      type = types.bool;
+      default = true;
+      description = "gzip rotated detection logs";
+    };
+
+    detectionLogQuota = mkOption {
+      type = types.ints.unsigned;
+      default = 0;
+      description = ''
+        Disk quota in MB for the active and rotated detection logs (0 = no quota).
+        Once exceeded, detections are logged without payload.
+      '';
+    };
+
+    banDatabase = mkOption {
+      type = types.str;
+      default = "/var/lib/btblocker/bans.jsonl";
+      description = ''
+        Path to the persistent ban journal (empty = bans are kept in memory only).
+        Active bans are re-applied when the service restarts.
+      '';
+    };
+
+    allowlist = mkOption {
+      type = types.listOf types.str;
+      default = [ ];
+      example = [ "203.0.113.0/24" "2001:db8:100::/48" ];
+      description = ''
+        IPv4/IPv6 addresses or CIDRs that are never inspected, dropped or banned
+        (partner ranges, monitoring hosts). Also enforced by the XDP program, so
+        these sources pass even if they were banned before being allowlisted.
+      '';
+    };
+
+    allowPorts = mkOption {
+      type = types.listOf types.port;
+      default = [ ];
+      description = "Ports that are never inspected, in addition to the built-in port whitelist.";
+    };
+
+    subnetBan = {
+      threshold = mkOption {
+        type = types.ints.unsigned;
+        default = 0;
+        description = ''
+          Ban a whole prefix once more than this many of its addresses are banned
+          within the window (0 = disabled). Requires the XDP enforcement backend.
+        '';
+      };
+
+      window = mkOption {
+        type = types.ints.positive;
+        default = 3600;
+        description = "Aggregation window in seconds.";
+      };
+
+      prefixLength4 = mkOption {
+        type = types.ints.between 1 32;
+        default = 24;
+        description = "IPv4 prefix length bans are grouped by.";
+      };
+
+      prefixLength6 = mkOption {
+        type = types.ints.between 1 128;
+        default = 48;
+        description = "IPv6 prefix length bans are grouped by.";
+      };
+    };
+
+    controlSocketGroup = mkOption {
+      type = types.str;
+      default = "";
+      example = "helpdesk";
+      description = ''
+        Group allowed to use the control socket (/run/btblocker/control.sock)
+        with `btblocker ctl` to list, ban and unban IPs. Empty = root only.
+      '';
+    };
+
+    metricsAddress = mkOption {
+      type = types.str;
+      default = "";
+      example = "127.0.0.1:9100";
+      description = ''
+        Listen address for the Prometheus /metrics endpoint (empty = disabled).
+        Exposes packet, verdict and detection counters, per-detector latency and
+        the number of IPs in the XDP blocklist.
+      '';
+    };
+
     monitorOnly = mkOption {
       type = types.bool;
       default = false;
@@ -102,6 +447,69 @@ in {
         Perfect for testing and validation before enabling blocking.
       '';
     };
+
+    detectors = mkOption {
+      type = types.listOf types.str;
+      default = [ ];
+      example = [ "mse=log" "dht_nodes=on" ];
+      description = ''
+        Per-detector modes "id=mode" overriding the built-in defaults: "on", "off"
+        or "log" (matches are logged, never dropped or banned). Run
+        `btblocker config detectors` for the IDs.
+      '';
+    };
+
+    webhook = {
+      urls = mkOption {
+        type = types.listOf types.str;
+        default = [ ];
+        example = [ "https://tickets.example.com/hooks/btblocker" ];
+        description = ''
+          URLs receiving ban, unban and expire events as JSON batches (empty = disabled).
+          Undelivered events are queued in /var/lib/btblocker/webhook and retried.
+        '';
+      };
+
+      secretFile = mkOption {
+        type = types.nullOr types.path;
+        default = null;
+        example = "/run/secrets/btblocker-webhook";
+        description = ''
+          Environment file containing `WEBHOOK_SECRET=...`, the HMAC-SHA256 key
+          signing each request. Kept out of the world-readable config.json.
+        '';
+      };
+
+      batchSize = mkOption {
+        type = types.ints.positive;
+        default = 100;
+        description = "Maximum events per request.";
+      };
+
+      batchDelay = mkOption {
+        type = types.ints.unsigned;
+        default = 5;
+        description = "Seconds to wait for a batch to fill before sending it (0 = send right away).";
+      };
+
+      timeout = mkOption {
+        type = types.ints.positive;
+        default = 10;
+        description = "Request timeout in seconds.";
+      };
+
+      maxBackoff = mkOption {
+        type = types.ints.positive;
+        default = 300;
+        description = "Maximum delay between retries in seconds.";
+      };
+
+      queueSize = mkOption {
+        type = types.ints.positive;
+        default = 100000;
+        description = "Undelivered events kept per endpoint; the oldest are dropped beyond it.";
+      };
+    };
   };
 
   config = mkIf cfg.enable {
@@ -115,6 +523,14 @@ in {
         assertion = cfg.queueNum >= 0 && cfg.queueNum <= 65535;
         message = "NFQUEUE number must be between 0 and 65535. Got: ${toString cfg.queueNum}";
       }
+      {
+        assertion = !cfg.xdpKeepAttached || cfg.xdpPinPath != "";
+        message = "services.btblocker.xdpKeepAttached requires xdpPinPath to be set";
+      }
+      {
+        assertion = cfg.queueCount >= 1 && cfg.queueNum + cfg.queueCount - 1 <= 65535;
+        message = "NFQUEUE range ${toString cfg.queueNum}+${toString cfg.queueCount} must stay within 0-65535";
+      }
     ];
 
     # Kernel tuning for NFQUEUE and netlink performance
@@ -134,16 +550,16 @@ in {
     networking.firewall.extraCommands = mkIf (config.networking.firewall.enable) ''
       # BitTorrent Blocker: Redirect packets to NFQUEUE for DPI
       ${concatMapStringsSep "\n" (chain: ''
-        iptables -I ${chain} -p tcp -j NFQUEUE --queue-num ${toString cfg.queueNum}
-        iptables -I ${chain} -p udp -j NFQUEUE --queue-num ${toString cfg.queueNum}
+        iptables -I ${chain} -p tcp -j NFQUEUE ${queueTarget}
+        iptables -I ${chain} -p udp -j NFQUEUE ${queueTarget}
       '') cfg.chains}
     '';
 
     networking.firewall.extraStopCommands = mkIf (config.networking.firewall.enable) ''
       # BitTorrent Blocker: Remove NFQUEUE rules on stop
       ${concatMapStringsSep "\n" (chain: ''
-        iptables -D ${chain} -p tcp -j NFQUEUE --queue-num ${toString cfg.queueNum} 2>/dev/null || true
-        iptables -D ${chain} -p udp -j NFQUEUE --queue-num ${toString cfg.queueNum} 2>/dev/null || true
+        iptables -D ${chain} -p tcp -j NFQUEUE ${queueTarget} 2>/dev/null || true
+        iptables -D ${chain} -p udp -j NFQUEUE ${queueTarget} 2>/dev/null || true
       '') cfg.chains}
     '';
 
@@ -152,33 +568,29 @@ in {
       description = "BitTorrent Traffic Blocker (XDP + DPI)";
       after = [ "network.target" ];
       wantedBy = [ "multi-user.target" ];
+      path = optionals (cfg.enforcementBackend == "ipset") [ pkgs.ipset pkgs.iptables ];
+      reloadTriggers = [ (builtins.toJSON settings) ];
+      restartTriggers = [ (builtins.toJSON (removeAttrs settings liveSettings)) ];
 
       serviceConfig = {
         Type = "simple";
-        ExecStart = "${cfg.package}/bin/btblocker";
+        ExecStart = "${cfg.package}/bin/btblocker --config /etc/btblocker/config.json";
+        ExecReload = "${pkgs.coreutils}/bin/kill -HUP $MAINPID"; # Re-reads config.json, queues stay bound
         Restart = "on-failure";
         RestartSec = "5s";
 
-        # Environment variables
-        Environment = [
-          "LOG_LEVEL=${cfg.logLevel}"
-          "INTERFACE=${cfg.interface}"
-          "QUEUE_NUM=${toString cfg.queueNum}"
-          "BAN_DURATION=${toString cfg.banDuration}"
-          "XDP_MODE=${cfg.xdpMode}"
-          "XDP_CLEANUP_INTERVAL=${toString cfg.cleanupInterval}"
-        ] ++ (if cfg.detectionLogPath != "" then [ "DETECTION_LOG=${cfg.detectionLogPath}" ] else [])
-          ++ (if cfg.monitorOnly then [ "MONITOR_ONLY=true" ] else []);
-
         # Security hardening
         NoNewPrivileges = false; # Required for CAP_NET_ADMIN
         PrivateTmp = true;
         ProtectSystem = "strict"; # Strict is safe: eBPF only needs /sys/fs/bpf access (via CAP_BPF/CAP_SYS_ADMIN)
         ProtectHome = true;
         ProtectKernelModules = false; # Required for eBPF program loading
-        ReadWritePaths = mkIf (cfg.detectionLogPath != "") [
-          (dirOf cfg.detectionLogPath)
-        ];
+        StateDirectory = "btblocker";
+        RuntimeDirectory = "btblocker"; # Control socket
+        EnvironmentFile = optional (cfg.webhook.secretFile != null) cfg.webhook.secretFile;
+        ReadWritePaths = optional (cfg.detectionLogPath != "") (dirOf cfg.detectionLogPath)
+          ++ optional (cfg.detectionPcapPath != "") (dirOf cfg.detectionPcapPath)
+          ++ optional (cfg.banDatabase != "") (dirOf cfg.banDatabase);
 
         # Capabilities for XDP (eBPF program loading and attachment)
         # CAP_NET_ADMIN: Required for XDP attachment and network configuration
@@ -193,15 +605,12 @@ in {
       };
     };
 
-    # Create configuration file
+    # btblocker ctl for ban management
+    environment.systemPackages = [ cfg.package ];
+
+    # Configuration file read by the service (--config); unknown keys are rejected at startup
     environment.etc."btblocker/config.json" = {
-      text = builtins.toJSON {
-        interface = cfg.interface;
-        queueNum = cfg.queueNum;
-        banDuration = cfg.banDuration;
-        xdpMode = cfg.xdpMode;
-        cleanupInterval = cfg.cleanupInterval;
-      };
+      text = builtins.toJSON settings;
       mode = "0644";
     };
   };
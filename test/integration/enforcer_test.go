@@ -0,0 +1,195 @@
+//go:build linux && integration
+
+package integration
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/example/BitTorrentBlocker/internal/enforcer"
+)
+
+// TestNFTablesBackend tests bans in the nftables sets, read back from the kernel
+func TestNFTablesBackend(t *testing.T) {
+	backend, err := enforcer.NewNFTables()
+	if err != nil {
+		t.Skipf("nftables not available: %v", err)
+	}
+	defer backend.Teardown()
+
+	ip4 := net.ParseIP("198.51.100.10")
+	ip6 := net.ParseIP("2001:db8::10")
+	for _, ip := range []net.IP{ip4, ip6} {
+		if err := backend.Ban(ip, time.Hour); err != nil {
+			t.Fatalf("Ban(%s) failed: %v", ip, err)
+		}
+		if !backend.IsBanned(ip) {
+			t.Errorf("%s should be banned", ip)
+		}
+	}
+
+	// Re-banning an existing element refreshes its timeout
+	if err := backend.Ban(ip4, 2*time.Hour); err != nil {
+		t.Fatalf("Re-ban failed: %v", err)
+	}
+
+	bans, err := backend.List()
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	if len(bans) != 2 {
+		t.Fatalf("List() = %v, want 2 bans", bans)
+	}
+	for _, b := range bans {
+		want := time.Hour
+		if b.IP.Equal(ip4) {
+			want = 2 * time.Hour
+		}
+		if remaining := time.Until(b.ExpiresAt); remaining < want-time.Minute || remaining > want {
+			t.Errorf("%s expires in %v, want about %v", b.IP, remaining, want)
+		}
+	}
+
+	if err := backend.Unban(ip4); err != nil {
+		t.Fatalf("Unban() failed: %v", err)
+	}
+	if backend.IsBanned(ip4) {
+		t.Error("Unbanned IP should not be banned")
+	}
+	if err := backend.Unban(ip4); err != nil {
+		t.Errorf("Unban() of an absent IP should succeed, got %v", err)
+	}
+}
+
+// TestNFTablesBackendRebanColdCache tests that re-banning an element the local
+// cache does not know about (e.g. added by another instance) refreshes its timeout
+func TestNFTablesBackendRebanColdCache(t *testing.T) {
+	first, err := enforcer.NewNFTables()
+	if err != nil {
+		t.Skipf("nftables not available: %v", err)
+	}
+	defer first.Teardown()
+	second, err := enforcer.NewNFTables()
+	if err != nil {
+		t.Fatalf("Second NewNFTables() failed: %v", err)
+	}
+	defer second.Close()
+
+	ip := net.ParseIP("198.51.100.30")
+	if err := first.Ban(ip, time.Hour); err != nil {
+		t.Fatalf("Ban() failed: %v", err)
+	}
+	if err := second.Ban(ip, 3*time.Hour); err != nil {
+		t.Fatalf("Re-ban failed: %v", err)
+	}
+
+	bans, err := second.List()
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	found := false
+	for _, b := range bans {
+		if !b.IP.Equal(ip) {
+			continue
+		}
+		found = true
+		if remaining := time.Until(b.ExpiresAt); remaining < 3*time.Hour-time.Minute || remaining > 3*time.Hour {
+			t.Errorf("%s expires in %v after the re-ban, want about 3h", ip, remaining)
+		}
+	}
+	if !found {
+		t.Errorf("%s missing from List() = %v", ip, bans)
+	}
+}
+
+// TestNFTablesBackendRestart tests that a second instance takes over existing bans
+func TestNFTablesBackendRestart(t *testing.T) {
+	backend, err := enforcer.NewNFTables()
+	if err != nil {
+		t.Skipf("nftables not available: %v", err)
+	}
+
+	ip := net.ParseIP("198.51.100.20")
+	if err := backend.Ban(ip, time.Hour); err != nil {
+		t.Fatalf("Ban() failed: %v", err)
+	}
+	if err := backend.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// Setting up again over the table left by Close keeps its sets and bans
+	second, err := enforcer.NewNFTables()
+	if err != nil {
+		t.Fatalf("Second NewNFTables() failed: %v", err)
+	}
+	defer second.Teardown()
+	if !second.IsBanned(ip) {
+		t.Error("Ban should be picked up from the existing set")
+	}
+
+	// The kernel expires elements on its own
+	short := net.ParseIP("198.51.100.21")
+	if err := second.Ban(short, time.Second); err != nil {
+		t.Fatalf("Ban() failed: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	bans, err := second.List()
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	for _, b := range bans {
+		if b.IP.Equal(short) {
+			t.Errorf("%s should have been expired by the kernel", short)
+		}
+	}
+	if removed, _ := second.Expire(); removed != 1 {
+		t.Errorf("Expire() = %d, want 1", removed)
+	}
+}
+
+// TestNFTablesBackendDrops tests that the installed rule drops traffic from a banned source
+func TestNFTablesBackendDrops(t *testing.T) {
+	backend, err := enforcer.NewNFTables()
+	if err != nil {
+		t.Skipf("nftables not available: %v", err)
+	}
+	defer backend.Teardown()
+
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer server.Close()
+	client, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	received := func() bool {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		_ = server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 16)
+		_, _, err := server.ReadFromUDP(buf)
+		return err == nil
+	}
+
+	if !received() {
+		t.Fatal("Datagram should arrive before the ban")
+	}
+	if err := backend.Ban(net.ParseIP("127.0.0.1"), time.Minute); err != nil {
+		t.Fatalf("Ban() failed: %v", err)
+	}
+	if received() {
+		t.Error("Datagram from a banned source should be dropped")
+	}
+	if err := backend.Unban(net.ParseIP("127.0.0.1")); err != nil {
+		t.Fatalf("Unban() failed: %v", err)
+	}
+	if !received() {
+		t.Error("Datagram should arrive again after the ban is lifted")
+	}
+}
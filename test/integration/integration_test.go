@@ -446,17 +446,17 @@ func TestDetectionLogging(t *testing.T) {
 					proto = "UDP"
 				}
 
-				detectionLogger.LogDetection(
-					getCurrentTime(),
-					"lo",
-					proto,
-					"127.0.0.1",
-					12345,
-					"8.8.8.8",
-					6881,
-					result.Reason,
-					tc.payload,
-				)
+				detectionLogger.LogDetection(blocker.Detection{
+					Timestamp: getCurrentTime(),
+					Interface: "lo",
+					Protocol:  proto,
+					SrcIP:     "127.0.0.1",
+					SrcPort:   12345,
+					DstIP:     "8.8.8.8",
+					DstPort:   6881,
+					Reason:    result.Reason,
+					Payload:   tc.payload,
+				})
 			}
 		})
 	}
@@ -605,17 +605,17 @@ func TestCombinedMonitorAndLogging(t *testing.T) {
 				proto = "UDP"
 			}
 
-			detectionLogger.LogDetection(
-				getCurrentTime(),
-				"lo",
-				proto,
-				"192.168.1.100",
-				uint16(10000+detectionCount),
-				"8.8.8.8",
-				6881,
-				result.Reason,
-				p.data,
-			)
+			detectionLogger.LogDetection(blocker.Detection{
+				Timestamp: getCurrentTime(),
+				Interface: "lo",
+				Protocol:  proto,
+				SrcIP:     "192.168.1.100",
+				SrcPort:   uint16(10000 + detectionCount),
+				DstIP:     "8.8.8.8",
+				DstPort:   6881,
+				Reason:    result.Reason,
+				Payload:   p.data,
+			})
 
 			t.Logf("Detected: %s - %s", p.name, result.Reason)
 		}
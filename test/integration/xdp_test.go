@@ -3,11 +3,18 @@
 package integration
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/example/BitTorrentBlocker/internal/xdp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
 )
 
 // TestXDPFilterLifecycle tests the basic lifecycle of XDP filter
@@ -16,7 +23,7 @@ func TestXDPFilterLifecycle(t *testing.T) {
 	iface := "lo"
 
 	// Create XDP filter
-	filter, err := xdp.NewXDPFilter(iface)
+	filter, err := xdp.NewXDPFilter([]string{iface}, xdp.ModeGeneric)
 	if err != nil {
 		t.Fatalf("Failed to create XDP filter: %v", err)
 	}
@@ -37,7 +44,7 @@ func TestXDPFilterLifecycle(t *testing.T) {
 func TestXDPMapOperations(t *testing.T) {
 	iface := "lo"
 
-	filter, err := xdp.NewXDPFilter(iface)
+	filter, err := xdp.NewXDPFilter([]string{iface}, xdp.ModeGeneric)
 	if err != nil {
 		t.Fatalf("Failed to create XDP filter: %v", err)
 	}
@@ -87,7 +94,7 @@ func TestXDPMapOperations(t *testing.T) {
 func TestXDPMultipleIPs(t *testing.T) {
 	iface := "lo"
 
-	filter, err := xdp.NewXDPFilter(iface)
+	filter, err := xdp.NewXDPFilter([]string{iface}, xdp.ModeGeneric)
 	if err != nil {
 		t.Fatalf("Failed to create XDP filter: %v", err)
 	}
@@ -154,7 +161,7 @@ func TestXDPMultipleIPs(t *testing.T) {
 func TestXDPExpiration(t *testing.T) {
 	iface := "lo"
 
-	filter, err := xdp.NewXDPFilter(iface)
+	filter, err := xdp.NewXDPFilter([]string{iface}, xdp.ModeGeneric)
 	if err != nil {
 		t.Fatalf("Failed to create XDP filter: %v", err)
 	}
@@ -202,11 +209,70 @@ func TestXDPExpiration(t *testing.T) {
 	}
 }
 
+// TestXDPKernelExpiration tests that the XDP program stops dropping once a ban
+// expires, without any user-space cleanup running
+func TestXDPKernelExpiration(t *testing.T) {
+	iface := "lo"
+
+	filter, err := xdp.NewXDPFilter([]string{iface}, xdp.ModeGeneric)
+	if err != nil {
+		t.Fatalf("Failed to create XDP filter: %v", err)
+	}
+	defer filter.Close()
+
+	mapMgr := filter.GetMapManager()
+	loopback := net.ParseIP("127.0.0.1")
+
+	send := func() {
+		conn, err := net.Dial("udp4", "127.0.0.1:9")
+		if err != nil {
+			t.Fatalf("Failed to open UDP socket: %v", err)
+		}
+		defer conn.Close()
+		for i := 0; i < 3; i++ {
+			_, _ = conn.Write([]byte("probe"))
+		}
+	}
+	dropped := func() uint64 {
+		for _, b := range mapMgr.GetAllBlockedIPs() {
+			if b.IP.Equal(loopback) {
+				return b.DroppedPackets
+			}
+		}
+		return 0
+	}
+
+	if err := mapMgr.AddIP(loopback, 1*time.Second); err != nil {
+		t.Fatalf("Failed to add IP: %v", err)
+	}
+	send()
+	if dropped() == 0 {
+		t.Fatal("Packets should be dropped while the ban is active")
+	}
+
+	// Let the ban expire; CleanupExpired is deliberately not called
+	time.Sleep(1500 * time.Millisecond)
+	before := dropped()
+	send()
+	if after := dropped(); after != before {
+		t.Errorf("Expired ban still dropped %d packets", after-before)
+	}
+
+	// The stale entry is still present until user-space cleanup runs, but no
+	// longer counts as blocked
+	if n := len(mapMgr.GetAllBlockedIPs()); n != 1 {
+		t.Errorf("GetAllBlockedIPs() has %d entries, want 1 (entry left for cleanup)", n)
+	}
+	if mapMgr.GetBlockedCount() != 0 {
+		t.Errorf("GetBlockedCount() = %d, want 0 for an expired ban", mapMgr.GetBlockedCount())
+	}
+}
+
 // TestXDPPeriodicCleanup tests automatic periodic cleanup
 func TestXDPPeriodicCleanup(t *testing.T) {
 	iface := "lo"
 
-	filter, err := xdp.NewXDPFilter(iface)
+	filter, err := xdp.NewXDPFilter([]string{iface}, xdp.ModeGeneric)
 	if err != nil {
 		t.Fatalf("Failed to create XDP filter: %v", err)
 	}
@@ -249,11 +315,11 @@ func TestXDPPeriodicCleanup(t *testing.T) {
 	}
 }
 
-// TestXDPIPv4Only tests that only IPv4 addresses are accepted
-func TestXDPIPv4Only(t *testing.T) {
+// TestXDPIPv6 tests that IPv6 addresses are stored in the separate IPv6 map
+func TestXDPIPv6(t *testing.T) {
 	iface := "lo"
 
-	filter, err := xdp.NewXDPFilter(iface)
+	filter, err := xdp.NewXDPFilter([]string{iface}, xdp.ModeGeneric)
 	if err != nil {
 		t.Fatalf("Failed to create XDP filter: %v", err)
 	}
@@ -261,16 +327,517 @@ func TestXDPIPv4Only(t *testing.T) {
 
 	mapMgr := filter.GetMapManager()
 
-	// Try to add IPv6 address (should fail or be rejected)
 	ipv6 := net.ParseIP("2001:db8::1")
 	if ipv6 == nil {
 		t.Fatal("Failed to parse IPv6 address")
 	}
 
-	err = mapMgr.AddIP(ipv6, 1*time.Hour)
-	// Expect error since XDP only supports IPv4
-	if err == nil {
-		t.Error("Adding IPv6 address should fail, but no error was returned")
+	if err := mapMgr.AddIP(ipv6, 1*time.Hour); err != nil {
+		t.Fatalf("Failed to add IPv6 address: %v", err)
+	}
+
+	blocked, err := mapMgr.IsBlocked(ipv6)
+	if err != nil {
+		t.Fatalf("Failed to check IPv6 address: %v", err)
+	}
+	if !blocked {
+		t.Error("IPv6 address should be blocked but IsBlocked returned false")
+	}
+
+	// IPv4-mapped IPv6 addresses must land in the IPv4 map
+	mapped := net.ParseIP("::ffff:192.0.2.7")
+	if err := mapMgr.AddIP(mapped, 1*time.Hour); err != nil {
+		t.Fatalf("Failed to add IPv4-mapped address: %v", err)
+	}
+	if blocked, _ := mapMgr.IsBlocked(net.ParseIP("192.0.2.7")); !blocked {
+		t.Error("IPv4-mapped address should block the plain IPv4 address")
+	}
+
+	if err := mapMgr.RemoveIP(ipv6); err != nil {
+		t.Fatalf("Failed to remove IPv6 address: %v", err)
+	}
+	if blocked, _ := mapMgr.IsBlocked(ipv6); blocked {
+		t.Error("IPv6 address should not be blocked after removal")
+	}
+}
+
+// TestXDPDropStats tests the per-IP and global drop counters kept by the XDP program
+func TestXDPDropStats(t *testing.T) {
+	iface := "lo"
+
+	filter, err := xdp.NewXDPFilter([]string{iface}, xdp.ModeGeneric)
+	if err != nil {
+		t.Fatalf("Failed to create XDP filter: %v", err)
+	}
+	defer filter.Close()
+
+	mapMgr := filter.GetMapManager()
+
+	// Ban loopback so our own datagrams are dropped on lo ingress
+	loopback := net.ParseIP("127.0.0.1")
+	if err := mapMgr.AddIP(loopback, 1*time.Hour); err != nil {
+		t.Fatalf("Failed to add IP: %v", err)
+	}
+
+	before, err := mapMgr.GetTotals()
+	if err != nil {
+		t.Fatalf("GetTotals failed: %v", err)
+	}
+
+	conn, err := net.Dial("udp4", "127.0.0.1:9")
+	if err != nil {
+		t.Fatalf("Failed to open UDP socket: %v", err)
+	}
+	const sent = 5
+	for i := 0; i < sent; i++ {
+		_, _ = conn.Write([]byte("drop me"))
+	}
+	conn.Close()
+
+	var entry xdp.BlockedIP
+	for _, b := range mapMgr.GetAllBlockedIPs() {
+		if b.IP.Equal(loopback) {
+			entry = b
+		}
+	}
+	if entry.DroppedPackets < sent {
+		t.Errorf("DroppedPackets = %d, want at least %d", entry.DroppedPackets, sent)
+	}
+	if entry.DroppedBytes == 0 {
+		t.Error("DroppedBytes should be non-zero")
+	}
+	if entry.LastSeen.IsZero() || time.Since(entry.LastSeen) > time.Minute {
+		t.Errorf("LastSeen = %v, want a recent time", entry.LastSeen)
+	}
+
+	after, err := mapMgr.GetTotals()
+	if err != nil {
+		t.Fatalf("GetTotals failed: %v", err)
+	}
+	if after.DroppedPackets-before.DroppedPackets < sent {
+		t.Errorf("Global drops increased by %d, want at least %d", after.DroppedPackets-before.DroppedPackets, sent)
+	}
+
+	// Unbanning clears the per-IP counters
+	if err := mapMgr.RemoveIP(loopback); err != nil {
+		t.Fatalf("Failed to remove IP: %v", err)
+	}
+	if err := mapMgr.AddIP(loopback, 1*time.Hour); err != nil {
+		t.Fatalf("Failed to re-add IP: %v", err)
+	}
+	for _, b := range mapMgr.GetAllBlockedIPs() {
+		if b.IP.Equal(loopback) && b.DroppedPackets != 0 {
+			t.Errorf("DroppedPackets after re-ban = %d, want 0", b.DroppedPackets)
+		}
+	}
+}
+
+// TestXDPAllowlist tests that allowlisted prefixes cannot be banned and pass XDP even when banned
+func TestXDPAllowlist(t *testing.T) {
+	filter, err := xdp.NewXDPFilter([]string{"lo"}, xdp.ModeGeneric)
+	if err != nil {
+		t.Fatalf("Failed to create XDP filter: %v", err)
+	}
+	defer filter.Close()
+
+	mapMgr := filter.GetMapManager()
+	loopback := net.ParseIP("127.0.0.1")
+
+	// Ban loopback first, then allowlist it: the allowlist must win in the kernel
+	if err := mapMgr.AddIP(loopback, 1*time.Hour); err != nil {
+		t.Fatalf("Failed to add IP: %v", err)
+	}
+	_, loopbackNet, _ := net.ParseCIDR("127.0.0.0/8")
+	_, docNet, _ := net.ParseCIDR("2001:db8::/32")
+	if err := mapMgr.SetAllowlist([]net.IPNet{*loopbackNet, *docNet}); err != nil {
+		t.Fatalf("SetAllowlist failed: %v", err)
+	}
+
+	if err := mapMgr.AddIP(net.ParseIP("127.0.0.2"), 1*time.Hour); !errors.Is(err, xdp.ErrAllowlisted) {
+		t.Errorf("AddIP of an allowlisted IPv4 address: error = %v, want ErrAllowlisted", err)
+	}
+	if err := mapMgr.AddIP(net.ParseIP("2001:db8::1"), 1*time.Hour); !errors.Is(err, xdp.ErrAllowlisted) {
+		t.Errorf("AddIP of an allowlisted IPv6 address: error = %v, want ErrAllowlisted", err)
+	}
+	if !mapMgr.IsAllowlisted(net.ParseIP("127.1.2.3")) || mapMgr.IsAllowlisted(net.ParseIP("192.0.2.1")) {
+		t.Error("IsAllowlisted mismatch")
+	}
+
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer server.Close()
+	client, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	received := func() bool {
+		if _, err := client.Write([]byte("allowed")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		_ = server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err := server.ReadFromUDP(make([]byte, 16))
+		return err == nil
+	}
+	if !received() {
+		t.Error("Datagram from an allowlisted (and banned) source should pass")
+	}
+
+	// Replacing the allowlist removes the old prefixes, so the ban applies again
+	if err := mapMgr.SetAllowlist(nil); err != nil {
+		t.Fatalf("SetAllowlist failed: %v", err)
+	}
+	if err := mapMgr.AddIP(net.ParseIP("127.0.0.2"), 1*time.Hour); err != nil {
+		t.Errorf("AddIP after clearing the allowlist failed: %v", err)
+	}
+	if received() {
+		t.Error("Datagram from a banned source should be dropped once it is no longer allowlisted")
+	}
+}
+
+// TestXDPPrefixBans tests banning and unbanning whole prefixes through the LPM tries
+func TestXDPPrefixBans(t *testing.T) {
+	filter, err := xdp.NewXDPFilter([]string{"lo"}, xdp.ModeGeneric)
+	if err != nil {
+		t.Fatalf("Failed to create XDP filter: %v", err)
+	}
+	defer filter.Close()
+
+	mapMgr := filter.GetMapManager()
+	_, loopbackNet, _ := net.ParseCIDR("127.0.0.0/24")
+	_, docNet, _ := net.ParseCIDR("2001:db8:1::/48")
+
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer server.Close()
+	client, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	received := func() bool {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		_ = server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err := server.ReadFromUDP(make([]byte, 16))
+		return err == nil
+	}
+
+	for _, prefix := range []net.IPNet{*loopbackNet, *docNet} {
+		if err := mapMgr.AddPrefix(prefix, 1*time.Hour); err != nil {
+			t.Fatalf("AddPrefix(%s) failed: %v", prefix.String(), err)
+		}
+	}
+	for ip, want := range map[string]bool{"127.0.0.9": true, "127.0.1.1": false, "2001:db8:1:2::1": true, "2001:db8:2::1": false} {
+		if blocked, _ := mapMgr.IsBlocked(net.ParseIP(ip)); blocked != want {
+			t.Errorf("IsBlocked(%s) = %v, want %v", ip, blocked, want)
+		}
+	}
+	if prefixes := mapMgr.GetAllBlockedPrefixes(); len(prefixes) != 2 {
+		t.Errorf("GetAllBlockedPrefixes() = %v, want 2 prefixes", prefixes)
+	}
+	if received() {
+		t.Error("Datagram from a banned prefix should be dropped")
+	}
+
+	if err := mapMgr.RemovePrefix(*loopbackNet); err != nil {
+		t.Fatalf("RemovePrefix failed: %v", err)
+	}
+	if !received() {
+		t.Error("Datagram should arrive again after the prefix ban is lifted")
+	}
+
+	// Prefixes entirely inside the allowlist are refused
+	_, allowNet, _ := net.ParseCIDR("127.0.0.0/8")
+	if err := mapMgr.SetAllowlist([]net.IPNet{*allowNet}); err != nil {
+		t.Fatalf("SetAllowlist failed: %v", err)
+	}
+	if err := mapMgr.AddPrefix(*loopbackNet, 1*time.Hour); !errors.Is(err, xdp.ErrAllowlisted) {
+		t.Errorf("AddPrefix inside the allowlist: error = %v, want ErrAllowlisted", err)
+	}
+}
+
+// TestXDPAggregation tests that enough bans inside one prefix are promoted to a prefix ban
+func TestXDPAggregation(t *testing.T) {
+	filter, err := xdp.NewXDPFilter([]string{"lo"}, xdp.ModeGeneric)
+	if err != nil {
+		t.Fatalf("Failed to create XDP filter: %v", err)
+	}
+	defer filter.Close()
+
+	mapMgr := filter.GetMapManager()
+	policy := xdp.AggregationPolicy{Threshold: 2, Window: time.Minute, PrefixLen4: 24, PrefixLen6: 48}
+	if err := mapMgr.SetAggregation(policy); err != nil {
+		t.Fatalf("SetAggregation failed: %v", err)
+	}
+
+	// Two bans stay individual, the third exceeds the threshold
+	for i, ip := range []string{"198.51.100.1", "198.51.100.2"} {
+		if err := mapMgr.AddIP(net.ParseIP(ip), time.Duration(i+1)*time.Hour); err != nil {
+			t.Fatalf("Failed to add %s: %v", ip, err)
+		}
+	}
+	if len(mapMgr.GetAllBlockedPrefixes()) != 0 {
+		t.Fatal("Threshold not exceeded yet, no prefix should be banned")
+	}
+	if err := mapMgr.AddIP(net.ParseIP("198.51.100.3"), 1*time.Hour); err != nil {
+		t.Fatalf("Failed to add IP: %v", err)
+	}
+
+	prefixes := mapMgr.GetAllBlockedPrefixes()
+	if len(prefixes) != 1 || prefixes[0].Prefix.String() != "198.51.100.0/24" {
+		t.Fatalf("GetAllBlockedPrefixes() = %v, want 198.51.100.0/24", prefixes)
+	}
+	// The prefix ban lasts as long as the longest member ban
+	if remaining := time.Until(prefixes[0].ExpiresAt); remaining < 2*time.Hour-time.Minute || remaining > 2*time.Hour {
+		t.Errorf("Prefix ban expires in %v, want about 2h", remaining)
+	}
+	// Member bans keep their own expiry, so their unban and expire events are not lost
+	if count := mapMgr.GetBlockedCount(); count != 3 {
+		t.Errorf("Member bans should stay until they expire, %d left, want 3", count)
+	}
+	if err := mapMgr.RemoveIP(net.ParseIP("198.51.100.1")); err != nil {
+		t.Errorf("Unbanning a member failed: %v", err)
+	}
+	if blocked, _ := mapMgr.IsBlocked(net.ParseIP("198.51.100.1")); !blocked {
+		t.Error("An unbanned member is still covered by the prefix ban")
+	}
+	if blocked, _ := mapMgr.IsBlocked(net.ParseIP("198.51.100.200")); !blocked {
+		t.Error("Other addresses in the prefix should be blocked")
+	}
+
+	// A different prefix starts its own count
+	if err := mapMgr.AddIP(net.ParseIP("203.0.113.1"), 1*time.Hour); err != nil {
+		t.Fatalf("Failed to add IP: %v", err)
+	}
+	if len(mapMgr.GetAllBlockedPrefixes()) != 1 {
+		t.Error("A single ban in another prefix should not be aggregated")
+	}
+
+	// Disabling the policy stops promotion
+	if err := mapMgr.SetAggregation(xdp.AggregationPolicy{}); err != nil {
+		t.Fatalf("SetAggregation failed: %v", err)
+	}
+	for _, ip := range []string{"203.0.113.2", "203.0.113.3", "203.0.113.4"} {
+		if err := mapMgr.AddIP(net.ParseIP(ip), 1*time.Hour); err != nil {
+			t.Fatalf("Failed to add %s: %v", ip, err)
+		}
+	}
+	if len(mapMgr.GetAllBlockedPrefixes()) != 1 {
+		t.Error("Disabled aggregation should not ban prefixes")
+	}
+}
+
+// openTun creates a tun device (no Ethernet header, like WireGuard) that is up
+// Packets written to the returned file are received on the device.
+func openTun(t *testing.T, name string) *os.File {
+	t.Helper()
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skipf("tun not available: %v", err)
+	}
+	tun := os.NewFile(uintptr(fd), "tun")
+	t.Cleanup(func() { _ = tun.Close() })
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		t.Skipf("Creating tun device failed: %v", err)
+	}
+
+	sock, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(sock)
+	ifr.SetUint16(unix.IFF_UP)
+	if err := unix.IoctlIfreq(sock, unix.SIOCSIFFLAGS, ifr); err != nil {
+		t.Fatalf("Bringing %s up failed: %v", name, err)
+	}
+	return tun
+}
+
+// rawUDP returns an IPv4 or IPv6 UDP packet without a link-layer header
+func rawUDP(t *testing.T, src, dst string) []byte {
+	t.Helper()
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 9}
+	var ip gopacket.SerializableLayer
+	if s := net.ParseIP(src); s.To4() != nil {
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: s.To4(), DstIP: net.ParseIP(dst).To4()}
+		_ = udp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	} else {
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: s, DstIP: net.ParseIP(dst)}
+		_ = udp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload("probe")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestXDPRawIPDevice tests that bans apply on devices without an Ethernet header,
+// such as WireGuard (wg0) and AmneziaWG (awg0) interfaces
+func TestXDPRawIPDevice(t *testing.T) {
+	const name = "btbtest0"
+	tun := openTun(t, name)
+
+	filter, err := xdp.NewXDPFilter([]string{name}, xdp.ModeGeneric)
+	if err != nil {
+		t.Fatalf("Failed to create XDP filter: %v", err)
+	}
+	defer filter.Close()
+	if status := filter.GetInterfaces(); len(status) != 1 || !status[0].RawIP {
+		t.Fatalf("GetInterfaces() = %+v, want a raw IP attachment", status)
+	}
+
+	// Loopback has no hardware address but does carry an Ethernet header
+	lo, err := xdp.NewXDPFilter([]string{"lo"}, xdp.ModeGeneric)
+	if err != nil {
+		t.Fatalf("Failed to create XDP filter on lo: %v", err)
+	}
+	if status := lo.GetInterfaces(); len(status) != 1 || status[0].RawIP {
+		t.Errorf("GetInterfaces() on lo = %+v, want an Ethernet attachment", status)
+	}
+	lo.Close()
+
+	mapMgr := filter.GetMapManager()
+	for _, cidr := range []string{"192.0.2.0/24", "2001:db8:5::/48"} {
+		_, prefix, _ := net.ParseCIDR(cidr)
+		if err := mapMgr.AddPrefix(*prefix, time.Hour); err != nil {
+			t.Fatalf("AddPrefix(%s) failed: %v", cidr, err)
+		}
+	}
+
+	before, err := mapMgr.GetTotals()
+	if err != nil {
+		t.Fatalf("GetTotals failed: %v", err)
+	}
+	for _, p := range [][2]string{
+		{"192.0.2.1", "10.9.9.9"},          // Banned IPv4 source
+		{"2001:db8:5::1", "2001:db8:9::9"}, // Banned IPv6 source
+		{"198.51.100.1", "10.9.9.9"},       // Not banned
+	} {
+		if _, err := tun.Write(rawUDP(t, p[0], p[1])); err != nil {
+			t.Fatalf("Writing to %s failed: %v", name, err)
+		}
+	}
+	after, err := mapMgr.GetTotals()
+	if err != nil {
+		t.Fatalf("GetTotals failed: %v", err)
+	}
+	if dropped := after.DroppedPackets - before.DroppedPackets; dropped != 2 {
+		t.Errorf("Dropped %d packets on %s, want the 2 from banned sources", dropped, name)
+	}
+	if passed := after.PassedPackets - before.PassedPackets; passed < 1 {
+		t.Errorf("Passed %d packets on %s, want the one from an unbanned source", passed, name)
+	}
+}
+
+// testPinPath returns a fresh bpffs directory for pinning and removes it afterwards
+func testPinPath(t *testing.T) string {
+	t.Helper()
+	pinPath := fmt.Sprintf("/sys/fs/bpf/btblocker-test-%d", time.Now().UnixNano())
+	t.Cleanup(func() { _ = os.RemoveAll(pinPath) })
+	return pinPath
+}
+
+// TestXDPPinnedMapsRestore tests that bans survive a restart when maps are pinned
+func TestXDPPinnedMapsRestore(t *testing.T) {
+	opts := xdp.Options{Interfaces: []string{"lo"}, Mode: xdp.ModeGeneric, PinPath: testPinPath(t)}
+
+	filter, err := xdp.NewXDPFilterWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to create XDP filter: %v", err)
+	}
+	active := net.ParseIP("198.51.100.1")
+	short := net.ParseIP("198.51.100.2")
+	active6 := net.ParseIP("2001:db8::42")
+	for ip, d := range map[string]time.Duration{active.String(): time.Hour, short.String(): time.Second, active6.String(): time.Hour} {
+		if err := filter.GetMapManager().AddIP(net.ParseIP(ip), d); err != nil {
+			t.Fatalf("Failed to add %s: %v", ip, err)
+		}
+	}
+	filter.Close()
+
+	// Let the short ban expire while "the daemon is down"
+	time.Sleep(1500 * time.Millisecond)
+
+	filter, err = xdp.NewXDPFilterWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to re-create XDP filter: %v", err)
+	}
+	defer filter.Close()
+	mapMgr := filter.GetMapManager()
+
+	for _, ip := range []net.IP{active, active6} {
+		if blocked, _ := mapMgr.IsBlocked(ip); !blocked {
+			t.Errorf("%s should still be blocked after restart", ip)
+		}
+	}
+	if blocked, _ := mapMgr.IsBlocked(short); blocked {
+		t.Errorf("%s expired while down and should not be restored", short)
+	}
+	if mapMgr.GetBlockedCount() != 2 {
+		t.Errorf("GetBlockedCount() = %d, want 2", mapMgr.GetBlockedCount())
+	}
+	for _, b := range mapMgr.GetAllBlockedIPs() {
+		if remaining := time.Until(b.ExpiresAt); remaining < 58*time.Minute || remaining > time.Hour {
+			t.Errorf("%s restored with expiry in %v, want about 1h", b.IP, remaining)
+		}
+	}
+}
+
+// TestXDPKeepAttached tests leaving the program attached across a restart
+func TestXDPKeepAttached(t *testing.T) {
+	pinPath := testPinPath(t)
+	opts := xdp.Options{Interfaces: []string{"lo"}, Mode: xdp.ModeGeneric, PinPath: pinPath, KeepAttached: true}
+
+	filter, err := xdp.NewXDPFilterWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to create XDP filter: %v", err)
+	}
+	if filter.GetInterfaces()[0].Reused {
+		t.Error("First start should attach a new link")
+	}
+	filter.Close()
+
+	if _, err := os.Stat(filepath.Join(pinPath, "link_lo")); err != nil {
+		t.Fatalf("Link should stay pinned after Close: %v", err)
+	}
+
+	// Second start updates the kept link in place
+	filter, err = xdp.NewXDPFilterWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to re-create XDP filter: %v", err)
+	}
+	if iface := filter.GetInterfaces()[0]; !iface.Attached || !iface.Reused {
+		t.Errorf("GetInterfaces()[0] = %+v, want attached and reused", iface)
+	}
+	filter.Close()
+
+	// Without KeepAttached the kept link is detached and unpinned on Close
+	opts.KeepAttached = false
+	filter, err = xdp.NewXDPFilterWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to re-create XDP filter: %v", err)
+	}
+	filter.Close()
+	if _, err := os.Stat(filepath.Join(pinPath, "link_lo")); !os.IsNotExist(err) {
+		t.Errorf("Link pin should be removed when KeepAttached is false, stat err = %v", err)
 	}
 }
 
@@ -282,7 +849,7 @@ func TestXDPLargeScale(t *testing.T) {
 
 	iface := "lo"
 
-	filter, err := xdp.NewXDPFilter(iface)
+	filter, err := xdp.NewXDPFilter([]string{iface}, xdp.ModeGeneric)
 	if err != nil {
 		t.Fatalf("Failed to create XDP filter: %v", err)
 	}
@@ -338,7 +905,7 @@ func TestXDPLargeScale(t *testing.T) {
 func TestXDPConcurrentOperations(t *testing.T) {
 	iface := "lo"
 
-	filter, err := xdp.NewXDPFilter(iface)
+	filter, err := xdp.NewXDPFilter([]string{iface}, xdp.ModeGeneric)
 	if err != nil {
 		t.Fatalf("Failed to create XDP filter: %v", err)
 	}
@@ -394,14 +961,80 @@ func TestXDPConcurrentOperations(t *testing.T) {
 // TestXDPInterfaceValidation tests interface name validation
 func TestXDPInterfaceValidation(t *testing.T) {
 	// Test with non-existent interface
-	_, err := xdp.NewXDPFilter("nonexistent999")
+	_, err := xdp.NewXDPFilter([]string{"nonexistent999"}, xdp.ModeGeneric)
 	if err == nil {
 		t.Error("Expected error for non-existent interface, got nil")
 	}
 
 	// Test with empty interface name
-	_, err = xdp.NewXDPFilter("")
+	_, err = xdp.NewXDPFilter([]string{""}, xdp.ModeGeneric)
 	if err == nil {
 		t.Error("Expected error for empty interface name, got nil")
 	}
 }
+
+// TestXDPAttachModes tests that the requested attach mode is honored and reported
+func TestXDPAttachModes(t *testing.T) {
+	iface := "lo"
+
+	// Generic mode must work everywhere
+	filter, err := xdp.NewXDPFilter([]string{iface}, xdp.ModeGeneric)
+	if err != nil {
+		t.Fatalf("Failed to create XDP filter in generic mode: %v", err)
+	}
+	if ifaces := filter.GetInterfaces(); len(ifaces) != 1 || ifaces[0].AttachMode != xdp.ModeGeneric {
+		t.Errorf("GetInterfaces() = %+v, want lo attached in %s mode", ifaces, xdp.ModeGeneric)
+	}
+	filter.Close()
+
+	// Auto mode falls back to generic when the driver lacks native XDP support
+	filter, err = xdp.NewXDPFilter([]string{iface}, xdp.ModeAuto)
+	if err != nil {
+		t.Fatalf("Failed to create XDP filter in auto mode: %v", err)
+	}
+	mode := filter.GetInterfaces()[0].AttachMode
+	if mode != xdp.ModeNative && mode != xdp.ModeGeneric {
+		t.Errorf("Auto mode resolved to %q, want native or generic", mode)
+	}
+	filter.Close()
+
+	// Unknown modes are rejected
+	if _, err := xdp.NewXDPFilter([]string{iface}, "turbo"); err == nil {
+		t.Error("Expected error for invalid XDP mode")
+	}
+}
+
+// TestXDPMultipleInterfaces tests attaching one program to several interfaces
+func TestXDPMultipleInterfaces(t *testing.T) {
+	// A missing interface must not prevent attaching to the others
+	filter, err := xdp.NewXDPFilter([]string{"lo", "nonexistent999"}, xdp.ModeGeneric)
+	if err != nil {
+		t.Fatalf("Failed to create XDP filter: %v", err)
+	}
+	defer filter.Close()
+
+	ifaces := filter.GetInterfaces()
+	if len(ifaces) != 2 {
+		t.Fatalf("GetInterfaces() returned %d entries, want 2", len(ifaces))
+	}
+	if !ifaces[0].Attached || ifaces[0].Name != "lo" {
+		t.Errorf("lo should be attached, got %+v", ifaces[0])
+	}
+	if ifaces[1].Attached || ifaces[1].Error == "" {
+		t.Errorf("nonexistent999 should report an attach error, got %+v", ifaces[1])
+	}
+
+	stats, err := filter.GetStats()
+	if err != nil {
+		t.Fatalf("GetStats failed: %v", err)
+	}
+	perIface, ok := stats["interfaces"].(map[string]interface{})
+	if !ok || len(perIface) != 2 {
+		t.Fatalf("stats[interfaces] = %v, want per-interface status for 2 interfaces", stats["interfaces"])
+	}
+
+	// Offload mode cannot span several interfaces
+	if _, err := xdp.NewXDPFilter([]string{"lo", "lo"}, xdp.ModeOffload); err == nil {
+		t.Error("Expected error for offload mode with multiple interfaces")
+	}
+}